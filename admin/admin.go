@@ -0,0 +1,179 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"toss/config"
+	"toss/metrics"
+	"toss/policy"
+	"toss/tunnel"
+)
+
+// Server is the HTTP/JSON admin api for inspecting and killing live tunnels.
+//
+//	GET    /tunnels       list the tunnels, see parseFilter for the query parameters
+//	GET    /tunnels/{id}  show one tunnel
+//	DELETE /tunnels/{id}  close one tunnel
+//	GET    /auto-bypass   list the learned clients and server names, filtered by client and sni
+//	DELETE /auto-bypass   forget the learned entries matching client and sni, all without them
+//	GET    /metrics       Prometheus metrics
+type Server struct {
+	logger  *slog.Logger
+	tunnels *tunnel.Registry
+	learned *policy.Learned
+	mux     *http.ServeMux
+}
+
+func NewServer(logger *slog.Logger, tunnels *tunnel.Registry, learned *policy.Learned) *Server {
+	s := &Server{
+		logger:  logger.With("context", "Admin"),
+		tunnels: tunnels,
+		learned: learned,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /tunnels", s.listTunnels)
+	s.mux.HandleFunc("GET /tunnels/{id}", s.getTunnel)
+	s.mux.HandleFunc("DELETE /tunnels/{id}", s.deleteTunnel)
+	s.mux.HandleFunc("GET /auto-bypass", s.listLearned)
+	s.mux.HandleFunc("DELETE /auto-bypass", s.deleteLearned)
+	s.mux.Handle("GET /metrics", metrics.Handler())
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Listen listens on a "host:port" or "unix:/path" address.
+// A stale unix socket left by a previous process is removed first.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, config.AdminUnixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (s *Server) listTunnels(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	views := []tunnelView{}
+	for _, tun := range s.tunnels.List() {
+		view := newTunnelView(tun)
+		if filter.matches(view) {
+			views = append(views, view)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"count":   len(views),
+		"tunnels": views,
+	})
+}
+
+func (s *Server) getTunnel(w http.ResponseWriter, r *http.Request) {
+	tun, ok := s.tunnels.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("tunnel not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTunnelView(tun))
+}
+
+func (s *Server) deleteTunnel(w http.ResponseWriter, r *http.Request) {
+	tun, ok := s.tunnels.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("tunnel not found"))
+		return
+	}
+
+	view := newTunnelView(tun)
+	if err := tun.Close(); err != nil {
+		s.logger.Debug("close tunnel", "id", view.ID, slog.Any("error", err))
+	}
+
+	s.logger.Info("tunnel killed", "id", view.ID, "src", view.Src, "dst", view.Dst, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type learnedView struct {
+	Client     string    `json:"client"`
+	ServerName string    `json:"serverName"`
+	Reason     string    `json:"reason"`
+	Expires    time.Time `json:"expires"`
+	ExpiresIn  string    `json:"expiresIn"`
+}
+
+func (s *Server) listLearned(w http.ResponseWriter, r *http.Request) {
+	client, serverName := r.URL.Query().Get("client"), r.URL.Query().Get("sni")
+
+	views := []learnedView{}
+	for _, entry := range s.learned.Entries() {
+		if client != "" && entry.Client != client || serverName != "" && entry.ServerName != serverName {
+			continue
+		}
+
+		views = append(views, learnedView{
+			Client:     entry.Client,
+			ServerName: entry.ServerName,
+			Reason:     entry.Reason,
+			Expires:    entry.Expires,
+			ExpiresIn:  time.Until(entry.Expires).Round(time.Second).String(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"count":   len(views),
+		"entries": views,
+	})
+}
+
+func (s *Server) deleteLearned(w http.ResponseWriter, r *http.Request) {
+	client, serverName := r.URL.Query().Get("client"), r.URL.Query().Get("sni")
+
+	removed := s.learned.Forget(client, serverName)
+
+	s.logger.Info("auto bypass entries forgotten", "client", client, "sni", serverName, "removed", removed, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
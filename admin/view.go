@@ -0,0 +1,180 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"time"
+	"toss/matcher"
+	"toss/tunnel"
+)
+
+type tunnelView struct {
+	ID          string    `json:"id"`
+	Src         string    `json:"src"`
+	Dst         string    `json:"dst"`
+	Protocol    string    `json:"protocol"`
+	Handlers    []string  `json:"handlers"`
+	ServerNames []string  `json:"serverNames"`
+	ALPN        []string  `json:"alpn"`
+	JA3         string    `json:"ja3,omitempty"`
+	JA4         string    `json:"ja4,omitempty"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Age         string    `json:"age"`
+
+	src, dst *net.TCPAddr
+	age      time.Duration
+}
+
+func newTunnelView(tun *tunnel.Tunnel) tunnelView {
+	info := tun.Info()
+	stats := tun.Stats()
+	age := time.Since(tun.CreatedAt())
+
+	src, _ := tun.Src.(*net.TCPAddr)
+	dst, _ := tun.Dst.(*net.TCPAddr)
+
+	return tunnelView{
+		ID:          tun.ID(),
+		Src:         tun.Src.String(),
+		Dst:         tun.Dst.String(),
+		Protocol:    info.Protocol,
+		Handlers:    orEmpty(info.Handlers),
+		ServerNames: orEmpty(info.ServerNames),
+		ALPN:        orEmpty(info.ALPN),
+		JA3:         info.JA3,
+		JA4:         info.JA4,
+		BytesIn:     stats.BytesIn,
+		BytesOut:    stats.BytesOut,
+		CreatedAt:   tun.CreatedAt(),
+		Age:         age.Round(time.Millisecond).String(),
+
+		src: src,
+		dst: dst,
+		age: age,
+	}
+}
+
+// orEmpty keeps nil slices from being encoded as null.
+func orEmpty(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// filter narrows down the tunnel list. Every parameter that is set must match.
+type filter struct {
+	src, dst    *matcher.Matcher
+	serverNames *matcher.Matcher
+	protocol    string
+	handler     string
+	minAge      time.Duration
+}
+
+// parseFilter reads the query parameters of GET /tunnels:
+//
+//	src, dst  ip or cidr pattern, dst may carry a :port
+//	sni       server name pattern, e.g. *.example.com
+//	protocol  detected protocol (http11, http2, tls, unknown)
+//	handler   handler in the chain, e.g. Http2Handler
+//	minAge    only tunnels older than the duration, e.g. 5m
+//
+// See matcher.Parse for the pattern syntax.
+func parseFilter(query url.Values) (*filter, error) {
+	f := &filter{
+		protocol: query.Get("protocol"),
+		handler:  query.Get("handler"),
+	}
+
+	var err error
+	if f.src, err = parsePattern(query, "src", true); err != nil {
+		return nil, err
+	}
+	if f.dst, err = parsePattern(query, "dst", true); err != nil {
+		return nil, err
+	}
+	if f.serverNames, err = parsePattern(query, "sni", false); err != nil {
+		return nil, err
+	}
+
+	if v := query.Get("minAge"); v != "" {
+		if f.minAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("minAge: invalid duration %q", v)
+		}
+	}
+
+	return f, nil
+}
+
+func parsePattern(query url.Values, key string, address bool) (*matcher.Matcher, error) {
+	raw := query.Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+
+	p, err := matcher.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if p.Kind.IsAddress() != address {
+		return nil, fmt.Errorf("%s: unexpected %s pattern %q", key, p.Kind, raw)
+	}
+
+	m, _ := matcher.New(nil)
+	m.Add(p)
+
+	return m, nil
+}
+
+func (f *filter) matches(view tunnelView) bool {
+	if f.protocol != "" && view.Protocol != f.protocol {
+		return false
+	}
+
+	if f.handler != "" && !slices.Contains(view.Handlers, f.handler) {
+		return false
+	}
+
+	if view.age < f.minAge {
+		return false
+	}
+
+	if f.src != nil {
+		if view.src == nil {
+			return false
+		}
+		if _, ok := f.src.MatchIP(view.src.IP, 0); !ok {
+			return false
+		}
+	}
+
+	if f.dst != nil {
+		if view.dst == nil {
+			return false
+		}
+		if _, ok := f.dst.MatchIP(view.dst.IP, view.dst.Port); !ok {
+			return false
+		}
+	}
+
+	if f.serverNames != nil {
+		port := 0
+		if view.dst != nil {
+			port = view.dst.Port
+		}
+
+		matched := slices.ContainsFunc(view.ServerNames, func(name string) bool {
+			_, ok := f.serverNames.MatchName(name, port)
+			return ok
+		})
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
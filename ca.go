@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"toss/cert"
+)
+
+// Files of a CA directory. root.key is only needed by init and rotate and can be kept offline,
+// the proxy runs with ca.cert=intermediate.pem and ca.key=intermediate.key.
+const (
+	caRootCert         = "root.pem"
+	caRootKey          = "root.key"
+	caIntermediateCert = "intermediate.pem"
+	caIntermediateKey  = "intermediate.key"
+)
+
+const caUsage = `usage: toss ca <command> [flags]
+
+commands:
+  init     create a root CA and an intermediate CA signing the leaves
+  rotate   replace the intermediate CA, or both CAs with -root
+  export   write the root CA for installation on clients
+`
+
+// runCA runs the "toss ca" subcommand and returns the exit code.
+func runCA(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, caUsage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "init":
+		err = caInit(args[1:], stderr)
+	case "rotate":
+		err = caRotate(args[1:], stderr)
+	case "export":
+		err = caExport(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], caUsage)
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "toss ca %s: %v\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+type caFlags struct {
+	dir  string
+	opts cert.AuthorityOptions
+}
+
+func newCAFlagSet(name string, stderr io.Writer, f *caFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("toss ca "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&f.dir, "dir", "./tls", "directory of the CA files")
+	fs.StringVar(&f.opts.Organization, "org", "Toss VPN", "organization of the CA subjects")
+	fs.DurationVar(&f.opts.RootValidity, "root-validity", 10*365*24*time.Hour, "lifetime of a new root CA")
+	fs.DurationVar(&f.opts.IntermediateValidity, "intermediate-validity", 365*24*time.Hour, "lifetime of a new intermediate CA")
+
+	return fs
+}
+
+func caInit(args []string, stderr io.Writer) error {
+	var f caFlags
+	fs := newCAFlagSet("init", stderr, &f)
+	force := fs.Bool("force", false, "overwrite existing CA files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !*force {
+		for _, name := range []string{caRootCert, caRootKey, caIntermediateCert, caIntermediateKey} {
+			if _, err := os.Stat(filepath.Join(f.dir, name)); err == nil {
+				return fmt.Errorf("%s already exists, use rotate or -force", filepath.Join(f.dir, name))
+			}
+		}
+	}
+
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+
+	root, rootKey, err := cert.NewRoot(f.opts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeCA(f.dir, caRootCert, caRootKey, rootKey, root); err != nil {
+		return err
+	}
+
+	if err := issueIntermediate(f, root, rootKey); err != nil {
+		return err
+	}
+
+	printNextSteps(stderr, f.dir, true)
+	return nil
+}
+
+func caRotate(args []string, stderr io.Writer) error {
+	var f caFlags
+	fs := newCAFlagSet("rotate", stderr, &f)
+	rotateRoot := fs.Bool("root", false, "also replace the root CA, clients have to install the new one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	suffix := "." + time.Now().UTC().Format("20060102T150405Z")
+	backup := func(names ...string) error {
+		for _, name := range names {
+			path := filepath.Join(f.dir, name)
+			if err := os.Rename(path, path+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		root    *x509.Certificate
+		rootKey crypto.Signer
+		err     error
+	)
+
+	// nothing is replaced until every new file is written
+	staged := &stagedCA{dir: f.dir}
+	defer staged.remove()
+
+	if *rotateRoot {
+		if root, rootKey, err = cert.NewRoot(f.opts); err != nil {
+			return err
+		}
+		if err := staged.write(caRootCert, caRootKey, rootKey, root); err != nil {
+			return err
+		}
+	} else {
+		roots, err := cert.LoadCertificates(filepath.Join(f.dir, caRootCert))
+		if err != nil {
+			return err
+		}
+		if rootKey, err = cert.LoadPrivateKey(filepath.Join(f.dir, caRootKey)); err != nil {
+			return fmt.Errorf("%w (bring the offline root key back to rotate the intermediate)", err)
+		}
+		root = roots[0]
+	}
+
+	intermediate, key, err := cert.NewIntermediate(root, rootKey, f.opts)
+	if err != nil {
+		return err
+	}
+
+	if err := staged.write(caIntermediateCert, caIntermediateKey, key, intermediate, root); err != nil {
+		return err
+	}
+
+	if err := staged.commit(backup); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "previous files are kept with the suffix %s\n", suffix)
+	printNextSteps(stderr, f.dir, *rotateRoot)
+	return nil
+}
+
+func caExport(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("toss ca export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", "./tls", "directory of the CA files")
+	certPath := fs.String("cert", "", "PEM file whose last certificate is exported (default <dir>/"+caRootCert+")")
+	format := fs.String("format", cert.FormatPEM, "output format: der, pem or mobileconfig")
+	out := fs.String("out", "-", "output file, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *certPath == "" {
+		*certPath = filepath.Join(*dir, caRootCert)
+	}
+
+	certs, err := cert.LoadCertificates(*certPath)
+	if err != nil {
+		return err
+	}
+
+	// a chain file ends with the root
+	data, err := cert.EncodeCertificate(certs[len(certs)-1], *format)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		_, err = stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(*out, data, 0o644)
+}
+
+// issueIntermediate writes a new intermediate CA, followed by its root in the certificate file.
+func issueIntermediate(f caFlags, root *x509.Certificate, rootKey crypto.Signer) error {
+	intermediate, key, err := cert.NewIntermediate(root, rootKey, f.opts)
+	if err != nil {
+		return err
+	}
+
+	return writeCA(f.dir, caIntermediateCert, caIntermediateKey, key, intermediate, root)
+}
+
+func writeCA(dir, certName, keyName string, key crypto.Signer, certs ...*x509.Certificate) error {
+	if err := cert.WritePrivateKey(filepath.Join(dir, keyName), key); err != nil {
+		return err
+	}
+
+	return cert.WriteCertificates(filepath.Join(dir, certName), certs...)
+}
+
+// stagedSuffix is appended to the names of the CA files written by stagedCA until they are committed.
+const stagedSuffix = ".new"
+
+// stagedCA writes CA files next to the ones they replace, so that a failed rotation leaves the
+// previous CA in place, and renames them all at the end.
+type stagedCA struct {
+	dir   string
+	names []string
+}
+
+func (s *stagedCA) write(certName, keyName string, key crypto.Signer, certs ...*x509.Certificate) error {
+	s.names = append(s.names, keyName, certName)
+	return writeCA(s.dir, certName+stagedSuffix, keyName+stagedSuffix, key, certs...)
+}
+
+// commit moves the files being replaced aside with backup and renames the staged files in place.
+func (s *stagedCA) commit(backup func(names ...string) error) error {
+	if err := backup(s.names...); err != nil {
+		return err
+	}
+
+	for _, name := range s.names {
+		path := filepath.Join(s.dir, name)
+		if err := os.Rename(path+stagedSuffix, path); err != nil {
+			return err
+		}
+	}
+
+	s.names = nil
+	return nil
+}
+
+// remove deletes the staged files that were not committed.
+func (s *stagedCA) remove() {
+	for _, name := range s.names {
+		_ = os.Remove(filepath.Join(s.dir, name+stagedSuffix))
+	}
+}
+
+func printNextSteps(w io.Writer, dir string, newRoot bool) {
+	fmt.Fprintf(w, "run the proxy with -ca-cert %s -ca-key %s, running proxies pick it up on reload (SIGHUP)\n",
+		filepath.Join(dir, caIntermediateCert), filepath.Join(dir, caIntermediateKey))
+	if newRoot {
+		fmt.Fprintf(w, "install %s on the clients (toss ca export -format der|pem|mobileconfig)\n", filepath.Join(dir, caRootCert))
+		fmt.Fprintf(w, "%s is only needed to rotate the intermediate, keep it offline\n", filepath.Join(dir, caRootKey))
+	}
+}
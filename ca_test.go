@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"toss/cert"
+)
+
+// runTestCA runs "toss ca" with args and fails the test when it does not exit with code.
+func runTestCA(t *testing.T, code int, args ...string) string {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	if got := runCA(args, &stdout, &stderr); got != code {
+		t.Fatalf("toss ca %s exited with %d, want %d: %s", strings.Join(args, " "), got, code, stderr.String())
+	}
+
+	return stdout.String()
+}
+
+// loadTestCA returns the root and the intermediate chain of dir, checking that the chain verifies.
+func loadTestCA(t *testing.T, dir string) (root *x509.Certificate, chain []*x509.Certificate) {
+	t.Helper()
+
+	roots, err := cert.LoadCertificates(filepath.Join(dir, caRootCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err = cert.LoadCertificates(filepath.Join(dir, caIntermediateCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || len(chain) != 2 || !chain[1].Equal(roots[0]) {
+		t.Fatalf("%d root and %d chain certificates, the chain must end with the root", len(roots), len(chain))
+	}
+	if err := chain[0].CheckSignatureFrom(roots[0]); err != nil {
+		t.Fatalf("intermediate not signed by the root: %v", err)
+	}
+
+	for _, file := range []struct {
+		cert *x509.Certificate
+		key  string
+	}{{roots[0], caRootKey}, {chain[0], caIntermediateKey}} {
+		key, err := cert.LoadPrivateKey(filepath.Join(dir, file.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(file.cert.PublicKey) {
+			t.Fatalf("%s does not match its certificate", file.key)
+		}
+	}
+
+	return roots[0], chain
+}
+
+// backups returns the names in dir with the rotate suffix of name.
+func backups(t *testing.T, dir, name string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, name+".*Z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return matches
+}
+
+func TestCAInit(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	runTestCA(t, 0, "init", "-dir", dir, "-org", "Toss Test")
+
+	root, chain := loadTestCA(t, dir)
+	if root.Subject.CommonName != "Toss Test Root CA" || chain[0].Subject.CommonName != "Toss Test Intermediate CA" {
+		t.Errorf("subjects %q and %q", root.Subject.CommonName, chain[0].Subject.CommonName)
+	}
+
+	// an existing CA is only replaced with -force
+	runTestCA(t, 1, "init", "-dir", dir)
+	if again, _ := loadTestCA(t, dir); !again.Equal(root) {
+		t.Error("init without -force replaced the root")
+	}
+
+	runTestCA(t, 0, "init", "-dir", dir, "-force")
+	if forced, _ := loadTestCA(t, dir); forced.Equal(root) {
+		t.Error("init -force kept the root")
+	}
+}
+
+func TestCARotate(t *testing.T) {
+	dir := t.TempDir()
+	runTestCA(t, 0, "init", "-dir", dir)
+	root, chain := loadTestCA(t, dir)
+
+	runTestCA(t, 0, "rotate", "-dir", dir)
+
+	rotatedRoot, rotated := loadTestCA(t, dir)
+	if !rotatedRoot.Equal(root) {
+		t.Error("rotate replaced the root")
+	}
+	if rotated[0].Equal(chain[0]) {
+		t.Error("rotate kept the intermediate")
+	}
+	for _, name := range []string{caIntermediateCert, caIntermediateKey} {
+		if len(backups(t, dir, name)) != 1 {
+			t.Errorf("no backup of %s", name)
+		}
+	}
+	if len(backups(t, dir, caRootCert)) != 0 {
+		t.Error("rotate moved the root aside")
+	}
+
+	runTestCA(t, 0, "rotate", "-dir", dir, "-root")
+
+	newRoot, _ := loadTestCA(t, dir)
+	if newRoot.Equal(root) {
+		t.Error("rotate -root kept the root")
+	}
+	for _, name := range []string{caRootCert, caRootKey} {
+		if len(backups(t, dir, name)) != 1 {
+			t.Errorf("no backup of %s", name)
+		}
+	}
+}
+
+func TestCARotateFailure(t *testing.T) {
+	t.Run("offline root key", func(t *testing.T) {
+		dir := t.TempDir()
+		runTestCA(t, 0, "init", "-dir", dir)
+		_, chain := loadTestCA(t, dir)
+
+		if err := os.Rename(filepath.Join(dir, caRootKey), filepath.Join(t.TempDir(), caRootKey)); err != nil {
+			t.Fatal(err)
+		}
+		runTestCA(t, 1, "rotate", "-dir", dir)
+
+		certs, err := cert.LoadCertificates(filepath.Join(dir, caIntermediateCert))
+		if err != nil || !certs[0].Equal(chain[0]) {
+			t.Errorf("intermediate replaced: %v", err)
+		}
+	})
+
+	t.Run("root written, intermediate not", func(t *testing.T) {
+		dir := t.TempDir()
+		runTestCA(t, 0, "init", "-dir", dir)
+		root, chain := loadTestCA(t, dir)
+
+		// the staged intermediate certificate can not be written
+		if err := os.Mkdir(filepath.Join(dir, caIntermediateCert+stagedSuffix), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		runTestCA(t, 1, "rotate", "-dir", dir, "-root")
+
+		kept, keptChain := loadTestCA(t, dir)
+		if !kept.Equal(root) || !keptChain[0].Equal(chain[0]) {
+			t.Error("a failed rotate -root replaced the CA")
+		}
+		for _, name := range []string{caRootCert, caRootKey, caIntermediateCert, caIntermediateKey} {
+			if len(backups(t, dir, name)) != 0 {
+				t.Errorf("%s moved aside", name)
+			}
+		}
+		for _, name := range []string{caRootCert, caRootKey, caIntermediateKey} {
+			if _, err := os.Stat(filepath.Join(dir, name+stagedSuffix)); err == nil {
+				t.Errorf("staged %s left behind", name)
+			}
+		}
+	})
+}
+
+func TestCAExport(t *testing.T) {
+	dir := t.TempDir()
+	runTestCA(t, 0, "init", "-dir", dir)
+	root, _ := loadTestCA(t, dir)
+
+	if der := runTestCA(t, 0, "export", "-dir", dir, "-format", "der"); der != string(root.Raw) {
+		t.Error("der export is not the root")
+	}
+
+	// the root ends the intermediate chain
+	out := filepath.Join(t.TempDir(), "root.pem")
+	runTestCA(t, 0, "export", "-cert", filepath.Join(dir, caIntermediateCert), "-out", out)
+	certs, err := cert.LoadCertificates(out)
+	if err != nil || len(certs) != 1 || !certs[0].Equal(root) {
+		t.Errorf("pem export of the chain: %d certificates, %v", len(certs), err)
+	}
+
+	if profile := runTestCA(t, 0, "export", "-dir", dir, "-format", "mobileconfig"); !strings.Contains(profile, "com.apple.security.root") {
+		t.Error("mobileconfig export without a root payload")
+	}
+
+	runTestCA(t, 1, "export", "-dir", dir, "-format", "p12")
+	runTestCA(t, 1, "export", "-dir", t.TempDir())
+}
+
+func TestCAUsage(t *testing.T) {
+	runTestCA(t, 2)
+	runTestCA(t, 2, "revoke")
+	runTestCA(t, 0, "init", "-h")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"toss/pcapng"
+	"toss/tunnel"
+)
+
+// startCapture writes the tunnel to a pcapng file when pcap.dir is set.
+// The returned function finishes the file and must be called once the tunnel is done.
+func startCapture(tun *tunnel.Tunnel, logger *slog.Logger, rc *runtimeConfig) func() {
+	dir := rc.conf.PCAP.Dir
+	if dir == "" {
+		return func() {}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		logger.Error("pcap: create dir", slog.Any("error", err))
+		return func() {}
+	}
+
+	name := fmt.Sprintf("%s-%s.pcapng", tun.CreatedAt().UTC().Format("20060102T150405Z"), tun.ID())
+	capture, err := pcapng.NewTunnelCapture(filepath.Join(dir, name), tun)
+	if err != nil {
+		logger.Error("pcap: create capture", slog.Any("error", err))
+		return func() {}
+	}
+
+	tun.SetTap(capture)
+	tun.AddKeyLogWriter(tunnel.SideDownstream, capture)
+	tun.AddKeyLogWriter(tunnel.SideUpstream, capture)
+
+	return func() {
+		if err := capture.Close(); err != nil {
+			logger.Error("pcap: write capture", "name", name, slog.Any("error", err))
+			return
+		}
+		logger.Debug("pcap: capture written", "name", name)
+	}
+}
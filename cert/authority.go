@@ -0,0 +1,286 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AuthorityOptions describes the CAs created by NewRoot and NewIntermediate.
+type AuthorityOptions struct {
+	// Organization is the subject organization, the common names are derived from it.
+	Organization string
+	// RootValidity and IntermediateValidity are the lifetimes of the CAs.
+	RootValidity         time.Duration
+	IntermediateValidity time.Duration
+}
+
+// NewRoot creates a self-signed root CA that may only sign intermediates.
+func NewRoot(opts AuthorityOptions) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate root key: %w", err)
+	}
+
+	template, err := caTemplate(opts.Organization+" Root CA", opts.Organization, opts.RootValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.MaxPathLen = 1
+
+	cert, err := createCA(template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create root: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+// NewIntermediate creates the online CA that signs the leaves, signed by root.
+// It is restricted to server and client authentication, so a leaked intermediate key
+// can not be used to sign code or mail.
+func NewIntermediate(root *x509.Certificate, rootKey crypto.Signer, opts AuthorityOptions) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate intermediate key: %w", err)
+	}
+
+	template, err := caTemplate(opts.Organization+" Intermediate CA", opts.Organization, opts.IntermediateValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.MaxPathLenZero = true
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if template.NotAfter.After(root.NotAfter) {
+		template.NotAfter = root.NotAfter
+	}
+
+	cert, err := createCA(template, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create intermediate: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+func caTemplate(commonName, organization string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("serial: %w", err)
+	}
+
+	notBefore := time.Now().Add(-5 * time.Minute)
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{organization},
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil
+}
+
+func createCA(template, parent *x509.Certificate, public crypto.PublicKey, parentKey crypto.Signer) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, public, parentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// LoadCertificates reads the certificates of a PEM file, in file order.
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate %d of %s: %w", len(certs)+1, path, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CERTIFICATE block in %s", path)
+	}
+
+	return certs, nil
+}
+
+// LoadPrivateKey reads the first private key of a PEM file: PKCS #8 ("PRIVATE KEY"),
+// PKCS #1 ("RSA PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY", as written by openssl ecparam -genkey).
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var key any
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			// e.g. the EC PARAMETERS block before the key
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s of %s: %w", block.Type, path, err)
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key of %s is not a crypto.Signer", path)
+		}
+
+		return signer, nil
+	}
+
+	return nil, fmt.Errorf("no private key block in %s", path)
+}
+
+// WriteCertificates writes the certificates to a PEM file, replacing it.
+func WriteCertificates(path string, certs ...*x509.Certificate) error {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// WritePrivateKey writes the key to a PKCS #8 PEM file readable by the owner only, replacing it.
+func WritePrivateKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// Export formats of EncodeCertificate.
+const (
+	FormatPEM          = "pem"
+	FormatDER          = "der"
+	FormatMobileConfig = "mobileconfig"
+)
+
+// EncodeCertificate encodes a CA certificate for installation on clients. mobileconfig is an
+// Apple configuration profile that installs it as a trusted root on iOS and macOS.
+func EncodeCertificate(cert *x509.Certificate, format string) ([]byte, error) {
+	switch format {
+	case FormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+	case FormatDER:
+		return cert.Raw, nil
+	case FormatMobileConfig:
+		return mobileConfig(cert), nil
+	}
+
+	return nil, fmt.Errorf("unknown format %q (known: der, pem, mobileconfig)", format)
+}
+
+// mobileConfig returns a configuration profile with a single com.apple.security.root payload.
+// The UUIDs are derived from the certificate, so installing the profile again replaces it.
+func mobileConfig(cert *x509.Certificate) []byte {
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = "Toss VPN CA"
+	}
+
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(name))
+
+	profileUUID, payloadUUID := certUUID(cert, "profile"), certUUID(cert, "payload")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>ca.cer</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>com.apple.security.root.%s</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>%s</string>
+	<key>PayloadIdentifier</key>
+	<string>toss.ca.%s</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(cert.Raw), escaped.String(), payloadUUID, payloadUUID,
+		escaped.String(), profileUUID, profileUUID)
+
+	return buf.Bytes()
+}
+
+// certUUID derives a UUID (version 8, RFC 9562) from the certificate and a label.
+func certUUID(cert *x509.Certificate, label string) string {
+	sum := sha256.Sum256(append([]byte(label+"\x00"), cert.Raw...))
+	sum[6] = sum[6]&0x0f | 0x80
+	sum[8] = sum[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// matchesKey reports whether key is the private key of cert.
+func matchesKey(cert *x509.Certificate, key crypto.Signer) bool {
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && public.Equal(cert.PublicKey)
+}
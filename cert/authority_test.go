@@ -0,0 +1,101 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPEM(t *testing.T, blocks ...*pem.Block) string {
+	t.Helper()
+
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// openssl ecparam -genkey writes the curve before the key
+	params := &pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}}
+
+	tests := []struct {
+		name   string
+		blocks []*pem.Block
+		want   crypto.Signer
+	}{
+		{name: "pkcs8", blocks: []*pem.Block{{Type: "PRIVATE KEY", Bytes: pkcs8}}, want: ecKey},
+		{name: "pkcs1", blocks: []*pem.Block{{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}}, want: rsaKey},
+		{name: "sec1", blocks: []*pem.Block{{Type: "EC PRIVATE KEY", Bytes: sec1}}, want: ecKey},
+		{name: "sec1 after ec parameters", blocks: []*pem.Block{params, {Type: "EC PRIVATE KEY", Bytes: sec1}}, want: ecKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := LoadPrivateKey(writeTestPEM(t, tt.blocks...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			equal, ok := key.(interface{ Equal(crypto.PrivateKey) bool })
+			if !ok || !equal.Equal(tt.want) {
+				t.Errorf("loaded %T, not the written key", key)
+			}
+		})
+	}
+}
+
+func TestLoadPrivateKeyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks []*pem.Block
+	}{
+		{name: "no key block", blocks: []*pem.Block{{Type: "CERTIFICATE", Bytes: []byte("certificate")}}},
+		{name: "corrupt pkcs1", blocks: []*pem.Block{{Type: "RSA PRIVATE KEY", Bytes: []byte("key")}}},
+		{name: "corrupt sec1", blocks: []*pem.Block{{Type: "EC PRIVATE KEY", Bytes: []byte("key")}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key, err := LoadPrivateKey(writeTestPEM(t, tt.blocks...)); err == nil {
+				t.Errorf("LoadPrivateKey = %T, want an error", key)
+			}
+		})
+	}
+
+	if _, err := LoadPrivateKey(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("LoadPrivateKey of a missing file succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package cert
+
+import (
+	"container/list"
+	"crypto/tls"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// leafCache keeps the most recently used leaves, keyed by cacheKey.
+type leafCache struct {
+	mu      sync.Mutex
+	size    int
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	cert *tls.Certificate
+}
+
+func newLeafCache(size int) *leafCache {
+	return &leafCache{
+		size:    size,
+		entries: list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
+func (c *leafCache) get(key string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.entries.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).cert, true
+}
+
+// add stores the leaf and returns how many least recently used leaves were evicted.
+func (c *leafCache) add(key string, cert *tls.Certificate) (evicted int) {
+	if c.size <= 0 {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.index[key]; ok {
+		elem.Value.(*cacheEntry).cert = cert
+		c.entries.MoveToFront(elem)
+		return 0
+	}
+
+	c.index[key] = c.entries.PushFront(&cacheEntry{key: key, cert: cert})
+
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*cacheEntry).key)
+		evicted++
+	}
+
+	return evicted
+}
+
+func (c *leafCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.entries.Len()
+}
+
+// cacheKey identifies a leaf by its subject and sorted SAN set.
+func cacheKey(subject string, dnsNames []string, ips []net.IP) string {
+	sans := slices.Clone(dnsNames)
+	for _, ip := range ips {
+		sans = append(sans, "ip:"+ip.String())
+	}
+	slices.Sort(sans)
+
+	return subject + "|" + strings.Join(sans, ",")
+}
@@ -0,0 +1,117 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// KeyType is the kind of key of the issued leaves.
+type KeyType uint8
+
+const (
+	// KeyECDSA is a P-256 key, cheap to generate and accepted by every modern client.
+	KeyECDSA = KeyType(iota)
+	KeyEd25519
+	KeyRSA
+
+	numKeyTypes
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyECDSA:
+		return "ecdsa"
+	case KeyEd25519:
+		return "ed25519"
+	case KeyRSA:
+		return "rsa"
+	}
+
+	return fmt.Sprintf("KeyType(%d)", uint8(t))
+}
+
+func ParseKeyType(s string) (KeyType, error) {
+	for t := range numKeyTypes {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown key type %q (known: ecdsa, ed25519, rsa)", s)
+}
+
+// fallbacks lists the key types tried in order when the preferred one is not supported by the client.
+// RSA comes last as every TLS client supports it.
+var fallbacks = map[KeyType][]KeyType{
+	KeyECDSA:   {KeyECDSA, KeyRSA},
+	KeyEd25519: {KeyEd25519, KeyECDSA, KeyRSA},
+	KeyRSA:     {KeyRSA},
+}
+
+// sharedKey is generated on first use and shared by every leaf of its type.
+type sharedKey struct {
+	once sync.Once
+	key  crypto.Signer
+	err  error
+}
+
+func (m *Manager) sharedLeafKey(keyType KeyType) (crypto.Signer, error) {
+	shared := &m.leafKeys[keyType]
+
+	shared.once.Do(func() {
+		if shared.key = m.store.loadKey(keyType); shared.key != nil {
+			return
+		}
+
+		defer func() {
+			if shared.err == nil {
+				m.store.saveKey(keyType, shared.key)
+			}
+		}()
+
+		switch keyType {
+		case KeyEd25519:
+			_, shared.key, shared.err = ed25519.GenerateKey(rand.Reader)
+		case KeyRSA:
+			shared.key, shared.err = rsa.GenerateKey(rand.Reader, m.opts.RSABits)
+		default:
+			shared.key, shared.err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+		if shared.err != nil {
+			shared.err = fmt.Errorf("generate %s leaf key: %w", keyType, shared.err)
+		}
+	})
+
+	return shared.key, shared.err
+}
+
+// selectKeyType returns the first key type, starting with the configured one, whose leaf the client
+// can verify with the signature schemes, cipher suites and curves of its ClientHello.
+func (m *Manager) selectKeyType(info *tls.ClientHelloInfo) (KeyType, error) {
+	candidates := fallbacks[m.opts.LeafKey]
+
+	// without a server name only the private key is looked at, so the check needs no leaf
+	probe := *info
+	probe.ServerName = ""
+
+	for _, keyType := range candidates {
+		key, err := m.sharedLeafKey(keyType)
+		if err != nil {
+			return 0, err
+		}
+
+		if probe.SupportsCertificate(&tls.Certificate{PrivateKey: key}) == nil {
+			return keyType, nil
+		}
+	}
+
+	// let the handshake report why the client can not use any of them
+	return candidates[len(candidates)-1], nil
+}
@@ -1,98 +1,265 @@
 package cert
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
-	"errors"
 	"fmt"
+	"log/slog"
 	"math/big"
+	"net"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
+	"toss/metrics"
+
+	"golang.org/x/sync/singleflight"
 )
 
 type Manager struct {
-	once     sync.Once
-	rootCert *x509.Certificate
-	rootKey  crypto.Signer
+	// caCert signs the leaves: the root CA, or an intermediate whose chain is in chain.
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	// chain are the CA certificates sent after each leaf, from caCert up to but without the root.
+	chain [][]byte
+	// root is the last certificate of the CA file, the one the clients install.
+	root *x509.Certificate
+	// files are the CA files as loaded, to tell when they were replaced.
+	files []fileStamp
+	opts  Options
 
 	LeafTTL time.Duration
+
+	// leafKeys are generated once per KeyType and shared by every leaf, so issuing a leaf only costs a signature.
+	leafKeys [numKeyTypes]sharedKey
+
+	cache *leafCache
+	store *store
+	// issuing makes concurrent handshakes for one leaf wait for a single issuance.
+	issuing singleflight.Group
+
+	untrustedMu   sync.Mutex
+	untrustedCert *x509.Certificate
+	untrustedKey  crypto.Signer
 }
 
-func NewCertManager(rootCertPath, rootKeyPath string) (*Manager, error) {
-	cert, key, err := load(rootCertPath, rootKeyPath)
-	if err != nil {
+type Options struct {
+	// LeafCacheSize is how many leaves are kept, 0 disables the cache.
+	LeafCacheSize int
+	// LeafKey is the preferred key type, clients that can not use it get the next one of its fallbacks.
+	LeafKey KeyType
+	// RSABits is the size of RSA leaf keys.
+	RSABits int
+	// StoreDir keeps the leaves and leaf keys across restarts, empty keeps them in memory only.
+	StoreDir string
+}
+
+// NewCertManager loads the CA that signs the leaves. caCertPath holds the CA certificate
+// followed by the certificates up to the root when it is an intermediate, see "toss ca init".
+func NewCertManager(logger *slog.Logger, caCertPath, caKeyPath string, opts Options) (*Manager, error) {
+	m := &Manager{
+		opts:    opts,
+		LeafTTL: 90 * 24 * time.Hour,
+		cache:   newLeafCache(opts.LeafCacheSize),
+	}
+
+	if err := m.load(caCertPath, caKeyPath); err != nil {
 		return nil, err
 	}
 
-	return &Manager{
-		rootCert: cert,
-		rootKey:  key,
-		LeafTTL:  90 * 24 * time.Hour,
-	}, nil
+	if opts.StoreDir != "" {
+		var err error
+		if m.store, err = openStore(logger, opts.StoreDir, caCertPath, m.caCert, m.caKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
 }
 
 func (m *Manager) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	name := info.ServerName
+	return m.GetCertificateFor(info, nil)
+}
 
-	cert, err := m.issueLeaf(name)
+// GetCertificateFor issues a leaf for the client that copies the names, subject, validity and
+// key usages of upstream, the verified leaf of the origin, so that it looks like the real one.
+// A nil upstream gives the same leaf as GetCertificate.
+func (m *Manager) GetCertificateFor(info *tls.ClientHelloInfo, upstream *x509.Certificate) (*tls.Certificate, error) {
+	keyType, err := m.selectKeyType(info)
 	if err != nil {
 		return nil, err
 	}
 
-	return cert, nil
+	template, err := m.leafTemplate(info)
+	if err != nil {
+		return nil, err
+	}
+
+	if upstream != nil {
+		m.mimic(template, upstream)
+	}
+
+	return m.cachedLeaf(template, keyType)
 }
 
-func load(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
-	certPEM, err := os.ReadFile(filepath.Clean(certPath))
-	if err != nil {
-		return nil, nil, fmt.Errorf("read root pem: %w", err)
+// CacheLen is the number of cached leaves.
+func (m *Manager) CacheLen() int {
+	return m.cache.len()
+}
+
+// cachedLeaf returns the cached leaf with the names of template, issuing it on a miss.
+// A leaf in the last tenth of its lifetime is still served while a new one is issued.
+func (m *Manager) cachedLeaf(template *x509.Certificate, keyType KeyType) (*tls.Certificate, error) {
+	key := keyType.String() + "|" + cacheKey(template.Subject.String(), template.DNSNames, template.IPAddresses)
+	now := time.Now()
+
+	if crt, ok := m.cache.get(key); ok && now.Before(crt.Leaf.NotAfter) {
+		if now.Before(crt.Leaf.NotAfter.Add(-m.LeafTTL / 10)) {
+			metrics.CertCacheLookups.WithLabelValues("hit").Inc()
+			return crt, nil
+		}
+
+		// a leaf capped by the validity of its origin is not renewed until the origin is
+		if template.NotAfter.After(crt.Leaf.NotAfter) {
+			metrics.CertCacheLookups.WithLabelValues("renew").Inc()
+			m.issuing.DoChan(key, func() (any, error) { return m.issueCached(key, template, keyType) })
+		} else {
+			metrics.CertCacheLookups.WithLabelValues("hit").Inc()
+		}
+		return crt, nil
 	}
 
-	certBlock, certPEM := pem.Decode(certPEM)
-	if certBlock == nil {
-		return nil, nil, errors.New("no CERTIFICATE certBlock in rootCA.pem")
+	metrics.CertCacheLookups.WithLabelValues("miss").Inc()
+	crt, err, _ := m.issuing.Do(key, func() (any, error) {
+		if crt := m.storedLeaf(key, keyType); crt != nil {
+			m.addCached(key, crt)
+			return crt, nil
+		}
+		return m.issueCached(key, template, keyType)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	return crt.(*tls.Certificate), nil
+}
+
+func (m *Manager) issueCached(key string, template *x509.Certificate, keyType KeyType) (*tls.Certificate, error) {
+	crt, err := m.createLeaf(template, keyType, m.caCert, m.caKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("parse root certificate: %w", err)
+		return nil, err
+	}
+
+	m.store.save(key, keyType, crt.Leaf)
+	m.addCached(key, crt)
+
+	return crt, nil
+}
+
+func (m *Manager) addCached(key string, crt *tls.Certificate) {
+	if evicted := m.cache.add(key, crt); evicted > 0 {
+		metrics.CertCacheEvictions.Add(float64(evicted))
+	}
+}
+
+// storedLeaf returns the leaf of the cache key kept by the store before a restart.
+// It is only used while the leaf key it was issued for is still the shared one.
+func (m *Manager) storedLeaf(key string, keyType KeyType) *tls.Certificate {
+	leaf := m.store.load(key)
+	if leaf == nil {
+		return nil
 	}
 
-	keyPEM, err := os.ReadFile(filepath.Clean(keyPath))
+	leafKey, err := m.sharedLeafKey(keyType)
 	if err != nil {
-		return nil, nil, fmt.Errorf("read root key: %w", err)
+		return nil
+	}
+
+	if !matchesKey(leaf, leafKey) {
+		return nil
 	}
 
-	keyBlock, keyPEM := pem.Decode(keyPEM)
-	if keyBlock == nil {
-		return nil, nil, errors.New("no private key certBlock in rootCA.key")
+	return &tls.Certificate{
+		Certificate: append([][]byte{leaf.Raw}, m.chain...),
+		PrivateKey:  leafKey,
+		Leaf:        leaf,
+	}
+}
+
+func (m *Manager) load(certPath, keyPath string) error {
+	for _, path := range []string{certPath, keyPath} {
+		stamp, err := stampFile(path)
+		if err != nil {
+			return fmt.Errorf("read ca: %w", err)
+		}
+		m.files = append(m.files, stamp)
+	}
+
+	certs, err := LoadCertificates(certPath)
+	if err != nil {
+		return fmt.Errorf("read ca certificate: %w", err)
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	key, err := LoadPrivateKey(keyPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("parse root key: %w", err)
+		return fmt.Errorf("read ca key: %w", err)
 	}
-	signer, ok := key.(crypto.Signer)
-	if !ok {
-		return nil, nil, errors.New("root key is not a crypto.Signer")
+
+	if !matchesKey(certs[0], key) {
+		return fmt.Errorf("ca key %s does not belong to the first certificate of %s", keyPath, certPath)
+	}
+
+	m.caCert, m.caKey = certs[0], key
+	m.root = certs[len(certs)-1]
+
+	for _, cert := range certs {
+		// clients already have the root, it is not sent
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			continue
+		}
+		m.chain = append(m.chain, cert.Raw)
+	}
+
+	return nil
+}
+
+// Root is the CA certificate to install on the clients.
+func (m *Manager) Root() *x509.Certificate {
+	return m.root
+}
+
+// Stale reports whether the CA files were replaced since they were loaded, e.g. by "toss ca rotate".
+func (m *Manager) Stale() bool {
+	for _, stamp := range m.files {
+		if now, err := stampFile(stamp.path); err != nil || now.size != stamp.size || !now.modTime.Equal(stamp.modTime) {
+			return true
+		}
 	}
 
-	return cert, signer, nil
+	return false
+}
+
+type fileStamp struct {
+	path    string
+	size    int64
+	modTime time.Time
 }
 
-func (m *Manager) issueLeaf(serverName string) (*tls.Certificate, error) {
-	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+func stampFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return nil, fmt.Errorf("generate leaf key: %w", err)
+		return fileStamp{}, err
 	}
 
+	return fileStamp{path: path, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// leafTemplate returns the template of a leaf for the requested name: the server name, or without
+// one the address the client connected to, which is the original destination under TPROXY.
+func (m *Manager) leafTemplate(info *tls.ClientHelloInfo) (*x509.Certificate, error) {
 	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
 		return nil, fmt.Errorf("serial: %w", err)
@@ -101,6 +268,13 @@ func (m *Manager) issueLeaf(serverName string) (*tls.Certificate, error) {
 	notBefore := time.Now().Add(-5 * time.Minute)
 	notAfter := notBefore.Add(m.LeafTTL)
 
+	serverName := info.ServerName
+	if serverName == "" && info.Conn != nil {
+		if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+			serverName = addr.IP.String()
+		}
+	}
+
 	template := &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
@@ -110,34 +284,53 @@ func (m *Manager) issueLeaf(serverName string) (*tls.Certificate, error) {
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
 
-	if serverName != "" {
+	if ip := net.ParseIP(serverName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if serverName != "" {
 		template.DNSNames = []string{serverName}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, template, m.rootCert, &leafKey.PublicKey, m.rootKey)
+	return template, nil
+}
+
+func (m *Manager) createLeaf(template *x509.Certificate, keyType KeyType, parent *x509.Certificate, parentKey crypto.Signer) (*tls.Certificate, error) {
+	start := time.Now()
+
+	leafKey, err := m.sharedLeafKey(keyType)
 	if err != nil {
-		return nil, fmt.Errorf("create leaf cert: %w", err)
+		return nil, err
+	}
+
+	if keyType == KeyRSA {
+		// the RSA key exchange of TLS 1.2 encrypts the premaster secret with the leaf key
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
 	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, leafKey.Public(), parentKey)
 	if err != nil {
-		return nil, fmt.Errorf("marshal leaf key: %w", err)
+		return nil, fmt.Errorf("create leaf cert: %w", err)
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	leaf, err := x509.ParseCertificate(derBytes)
 	if err != nil {
-		return nil, fmt.Errorf("x509 key pair: %w", err)
+		return nil, fmt.Errorf("parse leaf cert: %w", err)
 	}
 
-	if leaf, err := x509.ParseCertificate(derBytes); err == nil {
-		tlsCert.Leaf = leaf
+	metrics.CertIssueDuration.WithLabelValues(keyType.String()).Observe(time.Since(start).Seconds())
+
+	chain := [][]byte{derBytes}
+	if parent == m.caCert {
+		chain = append(chain, m.chain...)
 	}
-	return &tlsCert, nil
+
+	return &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  leafKey,
+		Leaf:        leaf,
+	}, nil
 }
@@ -0,0 +1,217 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"toss/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestManager(t *testing.T, opts Options) *Manager {
+	t.Helper()
+
+	caCert, caKey := newTestCA(t)
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if err := WriteCertificates(certPath, caCert); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePrivateKey(keyPath, caKey); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewCertManager(slog.New(slog.DiscardHandler), certPath, keyPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func helloFor(serverName string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        serverName,
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+	}
+}
+
+func TestManagerConcurrentIssue(t *testing.T) {
+	m := newTestManager(t, Options{LeafCacheSize: 10})
+	misses := testutil.ToFloat64(metrics.CertCacheLookups.WithLabelValues("miss"))
+
+	const clients = 32
+	crts := make([]*tls.Certificate, clients)
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for i := range clients {
+		wg.Go(func() {
+			<-start
+			crt, err := m.GetCertificateFor(helloFor("example.com"), nil)
+			if err != nil {
+				t.Error(err)
+			}
+			crts[i] = crt
+		})
+	}
+	close(start)
+	wg.Wait()
+
+	// the handshakes that missed the cache waited for one issuance, the others hit its result
+	for i, crt := range crts {
+		if crt == nil || crt != crts[0] {
+			t.Fatalf("handshake %d got another leaf", i)
+		}
+	}
+	if m.CacheLen() != 1 {
+		t.Errorf("%d cached leaves, want 1", m.CacheLen())
+	}
+	if n := testutil.ToFloat64(metrics.CertCacheLookups.WithLabelValues("miss")) - misses; n < 1 || n > clients {
+		t.Errorf("%v misses", n)
+	}
+
+	leaf := crts[0].Leaf
+	if leaf.Subject.CommonName != "example.com" || len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "example.com" {
+		t.Errorf("leaf for %q, names %v", leaf.Subject.CommonName, leaf.DNSNames)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(m.Root())
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+		t.Errorf("leaf does not verify: %v", err)
+	}
+}
+
+func TestManagerEviction(t *testing.T) {
+	m := newTestManager(t, Options{LeafCacheSize: 2})
+	evictions := testutil.ToFloat64(metrics.CertCacheEvictions)
+
+	issue := func(name string) *tls.Certificate {
+		t.Helper()
+
+		crt, err := m.GetCertificateFor(helloFor(name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt
+	}
+
+	a := issue("a.example.com")
+	b := issue("b.example.com")
+	if issue("a.example.com") != a {
+		t.Fatal("a.example.com was issued again while cached")
+	}
+
+	// b is the least recently used and makes room for c
+	c := issue("c.example.com")
+	if m.CacheLen() != 2 {
+		t.Errorf("%d cached leaves at capacity 2", m.CacheLen())
+	}
+	if n := testutil.ToFloat64(metrics.CertCacheEvictions) - evictions; n != 1 {
+		t.Errorf("%v evictions, want 1", n)
+	}
+
+	if issue("a.example.com") != a || issue("c.example.com") != c {
+		t.Error("a recently used leaf was evicted")
+	}
+	if again := issue("b.example.com"); again == b || again.Leaf.SerialNumber.Cmp(b.Leaf.SerialNumber) == 0 {
+		t.Error("the evicted leaf was served from the cache")
+	}
+}
+
+func TestManagerNoCache(t *testing.T) {
+	m := newTestManager(t, Options{})
+
+	first, err := m.GetCertificateFor(helloFor("example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.GetCertificateFor(helloFor("example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second || m.CacheLen() != 0 {
+		t.Errorf("leaf cached with a cache size of 0, %d cached", m.CacheLen())
+	}
+}
+
+func TestManagerRenew(t *testing.T) {
+	m := newTestManager(t, Options{LeafCacheSize: 10})
+	renewals := testutil.ToFloat64(metrics.CertCacheLookups.WithLabelValues("renew"))
+
+	// leaves start 5 minutes in the past, this one has 30s left, in the last tenth of its lifetime
+	m.LeafTTL = 5*time.Minute + 30*time.Second
+
+	first, err := m.GetCertificateFor(helloFor("example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaf is still served while the new one is issued in the background
+	stale, err := m.GetCertificateFor(helloFor("example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != first {
+		t.Error("the leaf being renewed was not served")
+	}
+	if n := testutil.ToFloat64(metrics.CertCacheLookups.WithLabelValues("renew")) - renewals; n != 1 {
+		t.Errorf("%v renewals, want 1", n)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		renewed, err := m.GetCertificateFor(helloFor("example.com"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renewed != first {
+			if renewed.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) == 0 || renewed.Leaf.NotAfter.Before(first.Leaf.NotAfter) || m.CacheLen() != 1 {
+				t.Errorf("renewed leaf expires %v, the stale one %v", renewed.Leaf.NotAfter, first.Leaf.NotAfter)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the leaf was not renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManagerStore(t *testing.T) {
+	storeDir := t.TempDir()
+	m := newTestManager(t, Options{LeafCacheSize: 10, StoreDir: storeDir})
+
+	first, err := m.GetCertificateFor(helloFor("example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted proxy serves the stored leaf with the stored key
+	restarted, err := NewCertManager(slog.New(slog.DiscardHandler), m.files[0].path, m.files[1].path, Options{LeafCacheSize: 10, StoreDir: storeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := restarted.GetCertificateFor(helloFor("example.com"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Leaf.Equal(first.Leaf) {
+		t.Errorf("leaf issued again after a restart, serial %v, want %v", again.Leaf.SerialNumber, first.Leaf.SerialNumber)
+	}
+}
@@ -0,0 +1,65 @@
+package cert
+
+import (
+	"crypto/x509"
+	"slices"
+	"time"
+)
+
+// mimic copies the subject, names, validity and key usages of the origin's leaf to template.
+// The requested name of template is kept when the origin's leaf is not valid for it, e.g. for
+// origins that are not verified.
+func (m *Manager) mimic(template *x509.Certificate, upstream *x509.Certificate) {
+	requestedDNS, requestedIPs := template.DNSNames, template.IPAddresses
+
+	template.Subject = upstream.Subject
+	template.DNSNames = slices.Clone(upstream.DNSNames)
+	template.IPAddresses = slices.Clone(upstream.IPAddresses)
+
+	for _, name := range requestedDNS {
+		if upstream.VerifyHostname(name) != nil {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	for _, ip := range requestedIPs {
+		if !slices.ContainsFunc(upstream.IPAddresses, ip.Equal) {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+
+	m.clampValidity(template, upstream)
+
+	// the key encipherment of an RSA origin is added by createLeaf for RSA leaves only
+	template.KeyUsage = upstream.KeyUsage&^(x509.KeyUsageKeyEncipherment|x509.KeyUsageCertSign|x509.KeyUsageCRLSign) |
+		x509.KeyUsageDigitalSignature
+
+	template.ExtKeyUsage = slices.Clone(upstream.ExtKeyUsage)
+	if !slices.Contains(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth) && !slices.Contains(template.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+}
+
+// clampValidity narrows the validity of template to the one of upstream and of the root CA.
+// An origin that is not valid now, which only passes unverified, keeps the window of template
+// so that the client does not fail where the proxy did not.
+func (m *Manager) clampValidity(template *x509.Certificate, upstream *x509.Certificate) {
+	now := time.Now()
+	if now.Before(upstream.NotBefore) || now.After(upstream.NotAfter) {
+		return
+	}
+
+	notBefore := latest(upstream.NotBefore, m.caCert.NotBefore)
+	notAfter := earliest(upstream.NotAfter, template.NotAfter, m.caCert.NotAfter)
+
+	if notBefore.Before(notAfter) {
+		template.NotBefore, template.NotAfter = notBefore, notAfter
+	}
+}
+
+func latest(times ...time.Time) time.Time {
+	return slices.MaxFunc(times, time.Time.Compare)
+}
+
+func earliest(times ...time.Time) time.Time {
+	return slices.MinFunc(times, time.Time.Compare)
+}
@@ -0,0 +1,146 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestOrigin returns the leaf of an origin, mimic only reads its fields so it is not signed.
+func newTestOrigin(notBefore, notAfter time.Time, dnsNames []string, ips ...net.IP) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "origin", Organization: []string{"Origin Inc"}},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+}
+
+func mimicTemplate(t *testing.T, m *Manager, serverName string, upstream *x509.Certificate) *x509.Certificate {
+	t.Helper()
+
+	template, err := m.leafTemplate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mimic(template, upstream)
+
+	return template
+}
+
+func TestMimicNames(t *testing.T) {
+	m := newTestManager(t, Options{})
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		serverName string
+		dnsNames   []string
+		ips        []net.IP
+		wantDNS    []string
+		wantIPs    []string
+	}{
+		{name: "covered", serverName: "www.example.com", dnsNames: []string{"example.com", "www.example.com"}, wantDNS: []string{"example.com", "www.example.com"}},
+		{name: "wildcard", serverName: "www.example.com", dnsNames: []string{"*.example.com"}, wantDNS: []string{"*.example.com"}},
+		// an unverified origin that is not valid for the requested name
+		{name: "other name", serverName: "other.test", dnsNames: []string{"example.com"}, wantDNS: []string{"example.com", "other.test"}},
+		{name: "covered ip", serverName: "192.0.2.1", dnsNames: []string{"example.com"}, ips: []net.IP{net.ParseIP("192.0.2.1")}, wantDNS: []string{"example.com"}, wantIPs: []string{"192.0.2.1"}},
+		{name: "other ip", serverName: "192.0.2.2", ips: []net.IP{net.ParseIP("192.0.2.1")}, wantIPs: []string{"192.0.2.1", "192.0.2.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// spare capacity would let an append write into the origin's names
+			upstream := newTestOrigin(now.Add(-time.Minute), now.Add(time.Minute), slices.Grow(slices.Clone(tt.dnsNames), 4), slices.Grow(slices.Clone(tt.ips), 4)...)
+			template := mimicTemplate(t, m, tt.serverName, upstream)
+
+			var ips []string
+			for _, ip := range template.IPAddresses {
+				ips = append(ips, ip.String())
+			}
+			if !slices.Equal(template.DNSNames, tt.wantDNS) || !slices.Equal(ips, tt.wantIPs) {
+				t.Errorf("names %q and %q, want %q and %q", template.DNSNames, ips, tt.wantDNS, tt.wantIPs)
+			}
+			if !slices.Equal(upstream.DNSNames, tt.dnsNames) || len(upstream.IPAddresses) != len(tt.ips) {
+				t.Errorf("origin names changed to %q and %q", upstream.DNSNames, upstream.IPAddresses)
+			}
+			if template.Subject.String() != upstream.Subject.String() {
+				t.Errorf("subject %q, want %q", template.Subject, upstream.Subject)
+			}
+		})
+	}
+}
+
+func TestMimicKeyUsage(t *testing.T) {
+	m := newTestManager(t, Options{})
+	now := time.Now()
+
+	template := mimicTemplate(t, m, "example.com", newTestOrigin(now.Add(-time.Minute), now.Add(time.Minute), []string{"example.com"}))
+
+	// a leaf never signs certificates, createLeaf adds the key encipherment of RSA leaves
+	if template.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("key usage %b, want the digital signature only", template.KeyUsage)
+	}
+	if want := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}; !slices.Equal(template.ExtKeyUsage, want) {
+		t.Errorf("extended key usage %v, want %v", template.ExtKeyUsage, want)
+	}
+}
+
+func TestMimicValidity(t *testing.T) {
+	m := newTestManager(t, Options{})
+	now := time.Now()
+	root := m.caCert
+
+	tests := []struct {
+		name      string
+		leafTTL   time.Duration
+		notBefore time.Time
+		notAfter  time.Time
+		// zero for the window of the template
+		wantNotBefore time.Time
+		wantNotAfter  time.Time
+	}{
+		{name: "origin", notBefore: now.Add(-time.Minute), notAfter: now.Add(10 * time.Minute),
+			wantNotBefore: now.Add(-time.Minute), wantNotAfter: now.Add(10 * time.Minute)},
+		{name: "leaf ttl", notBefore: now.Add(-24 * time.Hour), notAfter: now.Add(24 * time.Hour),
+			wantNotBefore: root.NotBefore},
+		{name: "root", leafTTL: 24 * time.Hour, notBefore: now.Add(-24 * time.Hour), notAfter: now.Add(24 * time.Hour),
+			wantNotBefore: root.NotBefore, wantNotAfter: root.NotAfter},
+		{name: "expired origin", notBefore: now.Add(-48 * time.Hour), notAfter: now.Add(-24 * time.Hour)},
+		{name: "origin not yet valid", notBefore: now.Add(time.Hour), notAfter: now.Add(24 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.LeafTTL = 30 * time.Minute
+			if tt.leafTTL != 0 {
+				m.LeafTTL = tt.leafTTL
+			}
+
+			template, err := m.leafTemplate(&tls.ClientHelloInfo{ServerName: "example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantNotBefore, wantNotAfter := template.NotBefore, template.NotAfter
+			if !tt.wantNotBefore.IsZero() {
+				wantNotBefore = tt.wantNotBefore
+			}
+			if !tt.wantNotAfter.IsZero() {
+				wantNotAfter = tt.wantNotAfter
+			}
+
+			m.mimic(template, newTestOrigin(tt.notBefore, tt.notAfter, []string{"example.com"}))
+
+			if !template.NotBefore.Equal(wantNotBefore) || !template.NotAfter.Equal(wantNotAfter) {
+				t.Errorf("valid from %v to %v, want %v to %v", template.NotBefore, template.NotAfter, wantNotBefore, wantNotAfter)
+			}
+		})
+	}
+}
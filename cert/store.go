@@ -0,0 +1,407 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"toss/metrics"
+)
+
+// gcInterval is how often saving a leaf also removes the expired ones.
+const gcInterval = time.Hour
+
+// storeDirLen is the length of the directory names, the hex of the first 8 bytes of the CA fingerprint.
+const storeDirLen = 16
+
+// storeOwnerFile names the file of a CA directory that holds the path of the CA certificate the
+// directory was created for.
+const storeOwnerFile = "ca-path"
+
+// store keeps the issued leaves and the leaf keys on disk, so that a restarted proxy serves the
+// leaves the clients have already seen. Every file is a PEM block sealed with AES-256-GCM under
+// a key derived from the CA key, in a directory per CA certificate:
+//
+//	<dir>/<ca>/ca-path             path of the CA certificate file
+//	<dir>/<ca>/index.json          leaves by file name, with their key type and expiry
+//	<dir>/<ca>/keys/<type>.pem     leaf keys (PKCS #8)
+//	<dir>/<ca>/leaves/<hash>.pem   leaves, named by the hash of their cache key
+//
+// Opening the store of a CA removes the directories created for an earlier CA at the same
+// certificate path, whose leaves no client trusts once "toss ca rotate" replaced it. The
+// directories of the other CAs are left alone, proxies with their own CA may share dir.
+//
+// A nil *store keeps nothing.
+type store struct {
+	logger *slog.Logger
+	dir    string
+	aead   cipher.AEAD
+
+	mu      sync.Mutex
+	entries map[string]*storeEntry
+	lastGC  time.Time
+}
+
+type storeEntry struct {
+	keyType  string
+	notAfter time.Time
+}
+
+// storeIndex is the content of index.json.
+type storeIndex struct {
+	Leaves map[string]storeIndexEntry `json:"leaves"`
+}
+
+type storeIndexEntry struct {
+	KeyType  string    `json:"keyType"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// openStore opens the store of the CA whose certificate was loaded from caPath.
+func openStore(logger *slog.Logger, dir, caPath string, caCert *x509.Certificate, caKey crypto.Signer) (*store, error) {
+	caDER, err := x509.MarshalPKCS8PrivateKey(caKey)
+	if err != nil {
+		return nil, fmt.Errorf("cert store: marshal ca key: %w", err)
+	}
+
+	secret, err := hkdf.Key(sha256.New, caDER, nil, "toss cert store", 32)
+	if err != nil {
+		return nil, fmt.Errorf("cert store: derive key: %w", err)
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("cert store: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cert store: %w", err)
+	}
+
+	fingerprint := sha256.Sum256(caCert.Raw)
+	s := &store{
+		logger:  logger.With("context", "CertStore"),
+		dir:     filepath.Join(dir, hex.EncodeToString(fingerprint[:storeDirLen/2])),
+		aead:    aead,
+		entries: make(map[string]*storeEntry),
+	}
+
+	for _, sub := range []string{"keys", "leaves"} {
+		if err := os.MkdirAll(filepath.Join(s.dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("cert store: %w", err)
+		}
+	}
+
+	if caPath, err = filepath.Abs(caPath); err != nil {
+		return nil, fmt.Errorf("cert store: %w", err)
+	}
+	if err := s.writeOwner(caPath); err != nil {
+		return nil, err
+	}
+
+	s.removeRotated(caPath)
+
+	if err := s.readIndex(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := s.gc()
+	s.logger.Info("cert store opened", "dir", s.dir, "leaves", len(s.entries), "removed", removed)
+
+	return s, nil
+}
+
+// loadKey returns the stored leaf key of keyType, nil when there is none or it can not be read.
+func (s *store) loadKey(keyType KeyType) crypto.Signer {
+	if s == nil {
+		return nil
+	}
+
+	der, err := s.open(filepath.Join("keys", keyType.String()+".pem"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("read leaf key, a new one is generated", "key", keyType.String(), slog.Any("error", err))
+		}
+		return nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		s.logger.Warn("parse leaf key, a new one is generated", "key", keyType.String(), slog.Any("error", err))
+		return nil
+	}
+
+	signer, _ := key.(crypto.Signer)
+	return signer
+}
+
+func (s *store) saveKey(keyType KeyType, key crypto.Signer) {
+	if s == nil {
+		return
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err == nil {
+		err = s.seal(filepath.Join("keys", keyType.String()+".pem"), der)
+	}
+	if err != nil {
+		s.logger.Warn("save leaf key", "key", keyType.String(), slog.Any("error", err))
+	}
+}
+
+// load returns the stored, unexpired leaf of the cache key.
+func (s *store) load(key string) *x509.Certificate {
+	if s == nil {
+		return nil
+	}
+
+	name := leafFileName(key)
+
+	s.mu.Lock()
+	entry, ok := s.entries[name]
+	s.mu.Unlock()
+
+	if !ok || !time.Now().Before(entry.notAfter) {
+		metrics.CertStoreLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+
+	der, err := s.open(filepath.Join("leaves", name))
+	if err == nil {
+		var leaf *x509.Certificate
+		if leaf, err = x509.ParseCertificate(der); err == nil {
+			metrics.CertStoreLookups.WithLabelValues("hit").Inc()
+			return leaf
+		}
+	}
+
+	s.logger.Warn("read stored leaf", "file", name, slog.Any("error", err))
+	metrics.CertStoreLookups.WithLabelValues("miss").Inc()
+	return nil
+}
+
+func (s *store) save(key string, keyType KeyType, leaf *x509.Certificate) {
+	if s == nil {
+		return
+	}
+
+	// held while writing the file, so that gc does not take it for a leftover
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := leafFileName(key)
+	if err := s.seal(filepath.Join("leaves", name), leaf.Raw); err != nil {
+		s.logger.Warn("save leaf", "file", name, slog.Any("error", err))
+		return
+	}
+
+	s.entries[name] = &storeEntry{keyType: keyType.String(), notAfter: leaf.NotAfter}
+
+	if time.Since(s.lastGC) >= gcInterval {
+		s.gc()
+	}
+
+	if err := s.writeIndex(); err != nil {
+		s.logger.Warn("write index", slog.Any("error", err))
+	}
+}
+
+// gc removes the expired leaves and the leaf files missing from the index, it returns how many
+// leaves were removed. s.mu must be held.
+func (s *store) gc() (removed int) {
+	s.lastGC = time.Now()
+
+	for name, entry := range s.entries {
+		if s.lastGC.Before(entry.notAfter) {
+			continue
+		}
+
+		delete(s.entries, name)
+		if err := os.Remove(filepath.Join(s.dir, "leaves", name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("remove expired leaf", "file", name, slog.Any("error", err))
+		}
+		removed++
+	}
+
+	files, err := os.ReadDir(filepath.Join(s.dir, "leaves"))
+	if err != nil {
+		s.logger.Warn("list leaves", slog.Any("error", err))
+	}
+	for _, file := range files {
+		if _, ok := s.entries[file.Name()]; !ok {
+			_ = os.Remove(filepath.Join(s.dir, "leaves", file.Name()))
+		}
+	}
+
+	if removed > 0 {
+		metrics.CertStoreRemovals.Add(float64(removed))
+		if err := s.writeIndex(); err != nil {
+			s.logger.Warn("write index", slog.Any("error", err))
+		}
+	}
+
+	return removed
+}
+
+// writeOwner records caPath in the ca-path file of s.dir, unless it is already there.
+func (s *store) writeOwner(caPath string) error {
+	path := filepath.Join(s.dir, storeOwnerFile)
+	if owner, err := os.ReadFile(path); err == nil && string(owner) == caPath {
+		return nil
+	}
+
+	if err := writeFileAtomic(path, []byte(caPath)); err != nil {
+		return fmt.Errorf("cert store: %w", err)
+	}
+
+	return nil
+}
+
+// removeRotated removes the directories next to s.dir that were created for an earlier CA
+// certificate at caPath. Directories of other paths, or without a ca-path file, belong to another
+// proxy or to something else and are left alone.
+func (s *store) removeRotated(caPath string) {
+	parent, current := filepath.Split(s.dir)
+
+	files, err := os.ReadDir(parent)
+	if err != nil {
+		s.logger.Warn("list ca directories", slog.Any("error", err))
+		return
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || file.Name() == current || !isStoreDirName(file.Name()) {
+			continue
+		}
+
+		owner, err := os.ReadFile(filepath.Join(parent, file.Name(), storeOwnerFile))
+		if err != nil || string(owner) != caPath {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(parent, file.Name())); err != nil {
+			s.logger.Warn("remove the leaves of a rotated ca", "dir", file.Name(), slog.Any("error", err))
+			continue
+		}
+		s.logger.Info("leaves of a rotated ca removed", "dir", file.Name())
+	}
+}
+
+func isStoreDirName(name string) bool {
+	if len(name) != storeDirLen {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+func (s *store) readIndex() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, "index.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cert store: %w", err)
+	}
+
+	var index storeIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		// the leaves are re-issued, the files are removed by gc
+		s.logger.Warn("ignore unreadable index", slog.Any("error", err))
+		return nil
+	}
+
+	for name, leaf := range index.Leaves {
+		s.entries[name] = &storeEntry{keyType: leaf.KeyType, notAfter: leaf.NotAfter}
+	}
+
+	return nil
+}
+
+// writeIndex replaces index.json with the entries. s.mu must be held.
+func (s *store) writeIndex() error {
+	index := storeIndex{Leaves: make(map[string]storeIndexEntry, len(s.entries))}
+	for name, entry := range s.entries {
+		index.Leaves[name] = storeIndexEntry{KeyType: entry.keyType, NotAfter: entry.notAfter}
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(s.dir, "index.json"), data)
+}
+
+// seal encrypts data into the file at name, the name is authenticated so that files can not be swapped.
+func (s *store) seal(name string, data []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type:  "TOSS SEALED DATA",
+		Bytes: s.aead.Seal(nonce, nonce, data, []byte(filepath.ToSlash(name))),
+	}
+
+	return writeFileAtomic(filepath.Join(s.dir, name), pem.EncodeToMemory(block))
+}
+
+func (s *store) open(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "TOSS SEALED DATA" || len(block.Bytes) < s.aead.NonceSize() {
+		return nil, errors.New("not a sealed pem block")
+	}
+
+	nonce, sealed := block.Bytes[:s.aead.NonceSize()], block.Bytes[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, sealed, []byte(filepath.ToSlash(name)))
+}
+
+func leafFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16]) + ".pem"
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
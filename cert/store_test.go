@@ -0,0 +1,269 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCA returns a CA certificate and key for a store.
+func newTestCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	caCert, caKey, err := NewRoot(AuthorityOptions{Organization: "Toss Test", RootValidity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return caCert, caKey
+}
+
+// newTestStore opens the store of a CA loaded from ca.pem, see newTestStoreOf.
+func newTestStore(t *testing.T, dir string, caCert *x509.Certificate, caKey crypto.Signer) *store {
+	t.Helper()
+
+	return newTestStoreOf(t, dir, "ca.pem", caCert, caKey)
+}
+
+// newTestStoreOf opens the store of a CA loaded from caPath.
+func newTestStoreOf(t *testing.T, dir, caPath string, caCert *x509.Certificate, caKey crypto.Signer) *store {
+	t.Helper()
+
+	s, err := openStore(slog.New(slog.DiscardHandler), dir, caPath, caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// newTestLeaf returns a self-signed leaf for name, only its names and expiry matter to the store.
+func newTestLeaf(t *testing.T, name string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf
+}
+
+func TestStoreSealOpen(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	s := newTestStore(t, t.TempDir(), caCert, caKey)
+
+	secret := []byte("leaf key")
+	if err := s.seal(filepath.Join("keys", "ecdsa.pem"), secret); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.open(filepath.Join("keys", "ecdsa.pem"))
+	if err != nil || string(data) != string(secret) {
+		t.Fatalf("open = %q, %v", data, err)
+	}
+
+	sealed, err := os.ReadFile(filepath.Join(s.dir, "keys", "ecdsa.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("swapped name", func(t *testing.T) {
+		// a sealed file moved to another name does not open, the name is authenticated
+		if err := os.WriteFile(filepath.Join(s.dir, "keys", "rsa.pem"), sealed, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := s.open(filepath.Join("keys", "rsa.pem")); err == nil {
+			t.Errorf("open of a swapped file = %q", data)
+		}
+	})
+
+	t.Run("other ca", func(t *testing.T) {
+		otherCert, otherKey := newTestCA(t)
+		other := newTestStore(t, t.TempDir(), otherCert, otherKey)
+		other.dir = s.dir
+
+		if data, err := other.open(filepath.Join("keys", "ecdsa.pem")); err == nil {
+			t.Errorf("open with the key of another ca = %q", data)
+		}
+	})
+
+	t.Run("not sealed", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(s.dir, "keys", "plain.pem"), []byte("plain"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.open(filepath.Join("keys", "plain.pem")); err == nil {
+			t.Error("open of a plain file succeeded")
+		}
+	})
+
+	if _, err := s.open(filepath.Join("keys", "missing.pem")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open of a missing file: %v", err)
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	dir := t.TempDir()
+	s := newTestStore(t, dir, caCert, caKey)
+
+	if key := s.loadKey(KeyECDSA); key != nil {
+		t.Fatal("loadKey of an empty store returned a key")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.saveKey(KeyECDSA, key)
+
+	loaded := newTestStore(t, dir, caCert, caKey).loadKey(KeyECDSA)
+	if loaded == nil || !key.Public().(*ecdsa.PublicKey).Equal(loaded.Public()) {
+		t.Error("loadKey after reopening did not return the saved key")
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	dir := t.TempDir()
+	s := newTestStore(t, dir, caCert, caKey)
+
+	valid := newTestLeaf(t, "valid.example.com", time.Now().Add(time.Hour))
+	expired := newTestLeaf(t, "expired.example.com", time.Now().Add(-time.Minute))
+	s.save("valid", KeyECDSA, valid)
+	s.save("expired", KeyECDSA, expired)
+
+	if leaf := s.load("valid"); leaf == nil || !leaf.Equal(valid) {
+		t.Fatal("load of a saved leaf failed")
+	}
+	if leaf := s.load("expired"); leaf != nil {
+		t.Error("load returned an expired leaf")
+	}
+
+	reopened := newTestStore(t, dir, caCert, caKey)
+	if len(reopened.entries) != 1 {
+		t.Fatalf("%d entries after reopening, want 1", len(reopened.entries))
+	}
+
+	entry := reopened.entries[leafFileName("valid")]
+	if entry == nil || entry.keyType != "ecdsa" || !entry.notAfter.Equal(valid.NotAfter) {
+		t.Errorf("entry %+v", entry)
+	}
+
+	if leaf := reopened.load("valid"); leaf == nil || !leaf.Equal(valid) {
+		t.Error("load after reopening failed")
+	}
+	if _, err := os.Stat(filepath.Join(reopened.dir, "leaves", leafFileName("expired"))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expired leaf file not removed: %v", err)
+	}
+}
+
+func TestStoreGC(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+	dir := t.TempDir()
+	s := newTestStore(t, dir, caCert, caKey)
+
+	s.save("valid", KeyECDSA, newTestLeaf(t, "valid.example.com", time.Now().Add(time.Hour)))
+
+	// a leaf written without its index entry, e.g. by a proxy killed in between
+	orphan := filepath.Join(s.dir, "leaves", leafFileName("orphan"))
+	if err := os.WriteFile(orphan, []byte("orphan"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	removed := s.gc()
+	s.mu.Unlock()
+
+	if removed != 0 {
+		t.Errorf("gc removed %d leaves, want 0, orphans are not counted", removed)
+	}
+	if _, err := os.Stat(orphan); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("orphan not removed: %v", err)
+	}
+	if s.load("valid") == nil {
+		t.Error("gc removed a valid leaf")
+	}
+}
+
+func TestStoreRemoveRotated(t *testing.T) {
+	dir := t.TempDir()
+
+	oldCert, oldKey := newTestCA(t)
+	old := newTestStore(t, dir, oldCert, oldKey)
+	old.save("valid", KeyECDSA, newTestLeaf(t, "valid.example.com", time.Now().Add(time.Hour)))
+
+	// what is not named like a ca directory is left alone
+	for _, name := range []string{"notes", "0123456789ABCDEF", "0123456789abcde"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "0123456789abcdef"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a proxy with its own ca sharing dir, and a ca directory without a ca-path file
+	otherCert, otherKey := newTestCA(t)
+	other := newTestStoreOf(t, dir, "other/ca.pem", otherCert, otherKey)
+	if err := os.Mkdir(filepath.Join(dir, "fedcba9876543210"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	newCert, newKey := newTestCA(t)
+	rotated := newTestStore(t, dir, newCert, newKey)
+
+	if _, err := os.Stat(old.dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("directory of the rotated ca not removed: %v", err)
+	}
+	if _, err := os.Stat(rotated.dir); err != nil {
+		t.Errorf("directory of the current ca: %v", err)
+	}
+	if _, err := os.Stat(other.dir); err != nil {
+		t.Errorf("directory of the other proxy's ca removed: %v", err)
+	}
+	for _, name := range []string{"notes", "0123456789ABCDEF", "0123456789abcde", "0123456789abcdef", "fedcba9876543210"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s removed: %v", name, err)
+		}
+	}
+}
+
+func TestStoreNil(t *testing.T) {
+	var s *store
+
+	s.save("valid", KeyECDSA, newTestLeaf(t, "valid.example.com", time.Now().Add(time.Hour)))
+	if s.load("valid") != nil || s.loadKey(KeyECDSA) != nil {
+		t.Error("nil store is not empty")
+	}
+	s.saveKey(KeyECDSA, nil)
+}
@@ -0,0 +1,120 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Untrusted is how a leaf for a rejected origin fails the verification of the client,
+// so that the client reports the same problem it would report talking to the origin.
+type Untrusted uint8
+
+const (
+	// UntrustedAuthority is signed by a throwaway CA that no client trusts.
+	UntrustedAuthority = Untrusted(iota)
+	// UntrustedExpired is signed by the root CA but expired.
+	UntrustedExpired
+	// UntrustedHostname is signed by the root CA for another name.
+	UntrustedHostname
+)
+
+// untrustedHostname is the name of leaves that must not match the requested server name.
+const untrustedHostname = "untrusted-upstream.invalid"
+
+// GetUntrustedCertificate issues a leaf for the client whose origin certificate was rejected.
+// The subject tells why, e.g. for clients that show the certificate details.
+func (m *Manager) GetUntrustedCertificate(info *tls.ClientHelloInfo, untrusted Untrusted, reason string) (*tls.Certificate, error) {
+	keyType, err := m.selectKeyType(info)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := m.leafTemplate(info)
+	if err != nil {
+		return nil, err
+	}
+
+	template.Subject.Organization = []string{"Toss VPN untrusted upstream"}
+	template.Subject.OrganizationalUnit = []string{truncate(reason, 64)}
+
+	parent, parentKey := m.caCert, m.caKey
+
+	switch untrusted {
+	case UntrustedExpired:
+		template.NotAfter = time.Now().Add(-time.Hour)
+		template.NotBefore = template.NotAfter.Add(-m.LeafTTL)
+	case UntrustedHostname:
+		template.Subject.CommonName = untrustedHostname
+		template.DNSNames = []string{untrustedHostname}
+		template.IPAddresses = nil
+	default:
+		parent, parentKey, err = m.untrustedCA()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m.createLeaf(template, keyType, parent, parentKey)
+}
+
+// untrustedCA returns the throwaway CA, created with the first untrusted leaf.
+func (m *Manager) untrustedCA() (*x509.Certificate, crypto.Signer, error) {
+	m.untrustedMu.Lock()
+	defer m.untrustedMu.Unlock()
+
+	if m.untrustedCert != nil {
+		return m.untrustedCert, m.untrustedKey, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate untrusted ca key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("serial: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "Toss VPN untrusted upstream CA",
+			Organization: []string{"Toss VPN"},
+		},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create untrusted ca: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse untrusted ca: %w", err)
+	}
+
+	m.untrustedCert, m.untrustedKey = cert, key
+	return cert, key, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n-3] + "..."
+}
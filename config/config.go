@@ -0,0 +1,434 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+	"toss/cert"
+	"toss/har"
+)
+
+const (
+	DetectorHttp11 = "http11"
+	DetectorHttp2  = "http2"
+	DetectorTls    = "tls"
+)
+
+var knownDetectors = []string{
+	DetectorHttp11,
+	DetectorHttp2,
+	DetectorTls,
+}
+
+type Config struct {
+	Listen          string        `yaml:"listen"`
+	Timeouts        Timeouts      `yaml:"timeouts"`
+	CA              CA            `yaml:"ca"`
+	Detectors       []string      `yaml:"detectors"`
+	Detection       Detection     `yaml:"detection"`
+	BodyPreviewSize uint64        `yaml:"bodyPreviewSize"`
+	Bypass          Bypass        `yaml:"bypass"`
+	Policy          Policy        `yaml:"policy"`
+	Reload          Reload        `yaml:"reload"`
+	Shutdown        Shutdown      `yaml:"shutdown"`
+	Admin           Admin         `yaml:"admin"`
+	Metrics         Metrics       `yaml:"metrics"`
+	HAR             HAR           `yaml:"har"`
+	PCAP            PCAP          `yaml:"pcap"`
+	KeyLog          KeyLog        `yaml:"keyLog"`
+	UpstreamTLS     UpstreamTLS   `yaml:"upstreamTLS"`
+	Onboarding      Onboarding    `yaml:"onboarding"`
+	AutoBypass      AutoBypass    `yaml:"autoBypass"`
+	ExplicitProxy   ExplicitProxy `yaml:"explicitProxy"`
+
+	// Path is the config file the values were read from, empty if none.
+	Path string `yaml:"-"`
+}
+
+type Timeouts struct {
+	// Dial is the timeout for connecting to the original destination.
+	Dial time.Duration `yaml:"dial"`
+	// FirstByte is how long a tunnel may stay silent before either side speaks.
+	FirstByte time.Duration `yaml:"firstByte"`
+}
+
+type Detection struct {
+	// Timeout is the total time budget for detecting the client-first protocol.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxBytes is how many bytes may be buffered before detection gives up.
+	MaxBytes int `yaml:"maxBytes"`
+}
+
+// MaxDetectionBytes is the size of the stream read buffer, more bytes can not be peeked.
+const MaxDetectionBytes = 4096
+
+type CA struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// LeafCacheSize is how many issued leaf certificates are kept, 0 issues one per handshake.
+	LeafCacheSize int `yaml:"leafCacheSize"`
+	// LeafKey is the preferred leaf key type: ecdsa (P-256), ed25519 or rsa.
+	// Clients that can not verify it get an ECDSA or RSA leaf.
+	LeafKey string `yaml:"leafKey"`
+	// RSABits is the size of RSA leaf keys.
+	RSABits int `yaml:"rsaBits"`
+	// StoreDir keeps the issued leaves and leaf keys, encrypted with the CA key, across restarts.
+	// Empty keeps them in memory only.
+	StoreDir string `yaml:"storeDir"`
+}
+
+// Bypass lists the destinations excluded from TLS MITM, see matcher.Parse for the pattern syntax.
+type Bypass struct {
+	// IPs holds ip and cidr patterns matched against the destination address.
+	IPs []string `yaml:"ips"`
+	// Domains holds exact, wildcard, suffix and regexp patterns matched against the SNI.
+	Domains []string `yaml:"domains"`
+}
+
+type Reload struct {
+	// WatchInterval is how often the config file is polled for changes. Zero disables watching.
+	WatchInterval time.Duration `yaml:"watchInterval"`
+}
+
+type Shutdown struct {
+	// DrainTimeout is how long in-flight exchanges may take to finish before tunnels are force-closed.
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+}
+
+type Admin struct {
+	// Listen is a loopback "host:port" or "unix:/path" for the admin api. Empty disables it.
+	Listen string `yaml:"listen"`
+}
+
+type Metrics struct {
+	// Listen is an extra "host:port" or "unix:/path" serving only /metrics, for scraping from another host.
+	// The admin api always serves /metrics too. Empty disables it.
+	Listen string `yaml:"listen"`
+	// JA4 and JA4S name the fingerprints counted by their own series, e.g. {chrome: [t13d1516h2_...]}.
+	// The others are counted as "other".
+	JA4  map[string][]string `yaml:"ja4"`
+	JA4S map[string][]string `yaml:"ja4s"`
+}
+
+// HAR configures recording of the intercepted http exchanges as HTTP Archive files.
+type HAR struct {
+	// Dir is where the files are written. Empty disables recording.
+	Dir string `yaml:"dir"`
+	// GroupBy starts a file per tunnel, client or window.
+	GroupBy string `yaml:"groupBy"`
+	// Window is the length of a window file, or how long a client may be idle before its file is closed.
+	Window time.Duration `yaml:"window"`
+	// BodySize is how many bytes of each request and response body are recorded, 0 records none.
+	BodySize int `yaml:"bodySize"`
+}
+
+// PCAP configures per tunnel pcapng captures including the TLS secrets of both legs.
+type PCAP struct {
+	// Dir is where the files are written. Empty disables capturing.
+	Dir string `yaml:"dir"`
+}
+
+// Onboarding configures the site serving the CA certificate to the clients.
+type Onboarding struct {
+	// Host is answered by the proxy itself over http and https. Empty disables the site.
+	// The name must resolve to an address routed through the proxy.
+	Host string `yaml:"host"`
+}
+
+// AutoBypass configures the bypass of clients refusing the forged certificates, e.g. apps pinning
+// the certificate of their server.
+type AutoBypass struct {
+	// TTL is how long the tunnels of a client to a server name are bypassed after the client
+	// refused its forged certificate. 0 disables learning.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// ExplicitProxy configures a listener for the clients set to use a proxy, e.g. a browser or HTTPS_PROXY on
+// a laptop. Unlike the TPROXY listener it needs neither root nor nftables.
+type ExplicitProxy struct {
+	// Listen is the "host:port" accepting CONNECT and absolute-URI http requests. Empty disables it.
+	Listen string `yaml:"listen"`
+	// AllowDestinations are ip/cidr patterns of destinations allowed although they are refused by
+	// default: loopback, unspecified and link-local addresses and the listeners of the proxy.
+	AllowDestinations []string `yaml:"allowDestinations"`
+}
+
+// KeyLog configures the NSS key log (SSLKEYLOGFILE) of both legs of the intercepted tunnels.
+// Only tunnels matching every condition that is set are logged.
+type KeyLog struct {
+	// File is the key log path. Empty disables it.
+	File string `yaml:"file"`
+	// MaxSize is the size in bytes after which the file is rotated, 0 never rotates.
+	MaxSize int64 `yaml:"maxSize"`
+	// MaxFiles is how many rotated files are kept.
+	MaxFiles int `yaml:"maxFiles"`
+
+	SNI     []string `yaml:"sni"`
+	Dst     []string `yaml:"dst"`
+	Src     []string `yaml:"src"`
+	Clients []string `yaml:"clients"`
+}
+
+// AdminUnixPrefix marks an admin listen address as a unix socket path.
+const AdminUnixPrefix = "unix:"
+
+func Default() *Config {
+	return &Config{
+		Listen: ":3129",
+		Timeouts: Timeouts{
+			Dial:      10 * time.Second,
+			FirstByte: 5 * time.Second,
+		},
+		CA: CA{
+			Cert:          "./tls/rootCA.pem",
+			Key:           "./tls/rootCA.key",
+			LeafCacheSize: 1024,
+			LeafKey:       "ecdsa",
+			RSABits:       2048,
+		},
+		Detectors: slices.Clone(knownDetectors),
+		Detection: Detection{
+			Timeout:  time.Second,
+			MaxBytes: MaxDetectionBytes,
+		},
+		BodyPreviewSize: 128,
+		Bypass: Bypass{
+			IPs:     []string{"1.1.1.1"},
+			Domains: []string{"www.example.com", "toss.im"},
+		},
+		Policy: Policy{
+			Default: "intercept",
+		},
+		Reload: Reload{
+			WatchInterval: 2 * time.Second,
+		},
+		Shutdown: Shutdown{
+			DrainTimeout: 30 * time.Second,
+		},
+		Admin: Admin{
+			Listen: "127.0.0.1:9090",
+		},
+		HAR: HAR{
+			GroupBy:  har.GroupByTunnel,
+			Window:   10 * time.Minute,
+			BodySize: 1 << 20,
+		},
+		KeyLog: KeyLog{
+			MaxSize:  100 << 20,
+			MaxFiles: 5,
+		},
+		Onboarding: Onboarding{
+			Host: "mitm.it",
+		},
+		AutoBypass: AutoBypass{
+			TTL: 24 * time.Hour,
+		},
+	}
+}
+
+// BuildCertOptions returns the leaf certificate options of the ca section.
+func (c *Config) BuildCertOptions() (cert.Options, error) {
+	opts := cert.Options{
+		LeafCacheSize: c.CA.LeafCacheSize,
+		RSABits:       c.CA.RSABits,
+		StoreDir:      c.CA.StoreDir,
+	}
+
+	if c.CA.LeafCacheSize < 0 {
+		return opts, &Error{Key: "ca.leafCacheSize", Err: fmt.Errorf("must not be negative, got %d", c.CA.LeafCacheSize)}
+	}
+
+	var err error
+	if opts.LeafKey, err = cert.ParseKeyType(c.CA.LeafKey); err != nil {
+		return opts, &Error{Key: "ca.leafKey", Err: err}
+	}
+
+	if !slices.Contains([]int{2048, 3072, 4096}, c.CA.RSABits) {
+		return opts, &Error{Key: "ca.rsaBits", Err: fmt.Errorf("must be 2048, 3072 or 4096, got %d", c.CA.RSABits)}
+	}
+
+	return opts, nil
+}
+
+// Error reports an invalid value together with the key it was read from.
+type Error struct {
+	Key    string
+	Source string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("config: %s: %v", e.Key, e.Err)
+	}
+
+	return fmt.Sprintf("config: %s (%s): %v", e.Key, e.Source, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (c *Config) Validate() error {
+	if c.Listen == "" && c.ExplicitProxy.Listen == "" {
+		return &Error{Key: "listen", Err: fmt.Errorf("must not be empty when explicitProxy.listen is empty")}
+	}
+
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return &Error{Key: "listen", Err: err}
+		}
+	}
+
+	if c.ExplicitProxy.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.ExplicitProxy.Listen); err != nil {
+			return &Error{Key: "explicitProxy.listen", Err: err}
+		}
+	}
+
+	if _, err := c.BuildProxyAllowedDestinations(); err != nil {
+		return err
+	}
+
+	if c.Timeouts.Dial <= 0 {
+		return &Error{Key: "timeouts.dial", Err: fmt.Errorf("must be positive, got %v", c.Timeouts.Dial)}
+	}
+
+	if c.Timeouts.FirstByte <= 0 {
+		return &Error{Key: "timeouts.firstByte", Err: fmt.Errorf("must be positive, got %v", c.Timeouts.FirstByte)}
+	}
+
+	if c.CA.Cert == "" {
+		return &Error{Key: "ca.cert", Err: fmt.Errorf("must not be empty")}
+	}
+
+	if c.CA.Key == "" {
+		return &Error{Key: "ca.key", Err: fmt.Errorf("must not be empty")}
+	}
+
+	if _, err := c.BuildCertOptions(); err != nil {
+		return err
+	}
+
+	if len(c.Detectors) == 0 {
+		return &Error{Key: "detectors", Err: fmt.Errorf("must not be empty")}
+	}
+
+	if c.Detection.Timeout <= 0 {
+		return &Error{Key: "detection.timeout", Err: fmt.Errorf("must be positive, got %v", c.Detection.Timeout)}
+	}
+
+	if c.Detection.MaxBytes <= 0 || c.Detection.MaxBytes > MaxDetectionBytes {
+		return &Error{Key: "detection.maxBytes", Err: fmt.Errorf("must be between 1 and %d, got %d", MaxDetectionBytes, c.Detection.MaxBytes)}
+	}
+
+	for i, name := range c.Detectors {
+		key := fmt.Sprintf("detectors[%d]", i)
+
+		if !slices.Contains(knownDetectors, name) {
+			return &Error{Key: key, Err: fmt.Errorf("unknown detector %q (known: %s)", name, strings.Join(knownDetectors, ", "))}
+		}
+
+		if slices.Index(c.Detectors, name) != i {
+			return &Error{Key: key, Err: fmt.Errorf("duplicate detector %q", name)}
+		}
+	}
+
+	if _, err := c.BuildPolicy(); err != nil {
+		return err
+	}
+
+	if c.Reload.WatchInterval < 0 {
+		return &Error{Key: "reload.watchInterval", Err: fmt.Errorf("must not be negative, got %v", c.Reload.WatchInterval)}
+	}
+
+	if c.Shutdown.DrainTimeout < 0 {
+		return &Error{Key: "shutdown.drainTimeout", Err: fmt.Errorf("must not be negative, got %v", c.Shutdown.DrainTimeout)}
+	}
+
+	if err := validateAdminListen(c.Admin.Listen); err != nil {
+		return &Error{Key: "admin.listen", Err: err}
+	}
+
+	if err := validateListen(c.Metrics.Listen); err != nil {
+		return &Error{Key: "metrics.listen", Err: err}
+	}
+
+	if c.HAR.Dir != "" {
+		groupBy := []string{har.GroupByTunnel, har.GroupByClient, har.GroupByWindow}
+		if !slices.Contains(groupBy, c.HAR.GroupBy) {
+			return &Error{Key: "har.groupBy", Err: fmt.Errorf("unknown group %q (known: %s)", c.HAR.GroupBy, strings.Join(groupBy, ", "))}
+		}
+
+		if c.HAR.Window <= 0 {
+			return &Error{Key: "har.window", Err: fmt.Errorf("must be positive, got %v", c.HAR.Window)}
+		}
+
+		if c.HAR.BodySize < 0 {
+			return &Error{Key: "har.bodySize", Err: fmt.Errorf("must not be negative, got %d", c.HAR.BodySize)}
+		}
+	}
+
+	if c.KeyLog.MaxSize < 0 {
+		return &Error{Key: "keyLog.maxSize", Err: fmt.Errorf("must not be negative, got %d", c.KeyLog.MaxSize)}
+	}
+
+	if c.KeyLog.MaxFiles < 0 {
+		return &Error{Key: "keyLog.maxFiles", Err: fmt.Errorf("must not be negative, got %d", c.KeyLog.MaxFiles)}
+	}
+
+	if _, err := c.BuildKeyLogFilter(); err != nil {
+		return err
+	}
+
+	if _, err := c.BuildUpstreamVerifier(); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(c.Onboarding.Host, ":/ ") {
+		return &Error{Key: "onboarding.host", Err: fmt.Errorf("must be a host name without port, got %q", c.Onboarding.Host)}
+	}
+
+	if c.AutoBypass.TTL < 0 {
+		return &Error{Key: "autoBypass.ttl", Err: fmt.Errorf("must not be negative, got %v", c.AutoBypass.TTL)}
+	}
+
+	return nil
+}
+
+// validateAdminListen only allows loopback and unix socket addresses, the admin api has no authentication.
+func validateAdminListen(addr string) error {
+	if err := validateListen(addr); err != nil {
+		return err
+	}
+
+	if addr == "" || strings.HasPrefix(addr, AdminUnixPrefix) {
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%q is not a loopback address, use 127.0.0.1, [::1], localhost or %s/path", host, AdminUnixPrefix)
+	}
+
+	return nil
+}
+
+// validateListen checks a "host:port" or "unix:/path" address, empty is allowed.
+func validateListen(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	if path, ok := strings.CutPrefix(addr, AdminUnixPrefix); ok {
+		if path == "" {
+			return fmt.Errorf("missing unix socket path")
+		}
+		return nil
+	}
+
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateDefault(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantKey string
+	}{
+		{name: "explicit proxy only", modify: func(c *Config) { c.Listen, c.ExplicitProxy.Listen = "", ":3128" }},
+		{name: "no listener", modify: func(c *Config) { c.Listen = "" }, wantKey: "listen"},
+		{name: "listen without port", modify: func(c *Config) { c.Listen = "localhost" }, wantKey: "listen"},
+		{name: "explicit proxy without port", modify: func(c *Config) { c.ExplicitProxy.Listen = "localhost" }, wantKey: "explicitProxy.listen"},
+		{name: "proxy destination by name", modify: func(c *Config) { c.ExplicitProxy.AllowDestinations = []string{"example.com"} }, wantKey: "explicitProxy.allowDestinations[0]"},
+		{name: "dial timeout", modify: func(c *Config) { c.Timeouts.Dial = 0 }, wantKey: "timeouts.dial"},
+		{name: "first byte timeout", modify: func(c *Config) { c.Timeouts.FirstByte = -time.Second }, wantKey: "timeouts.firstByte"},
+		{name: "ca cert", modify: func(c *Config) { c.CA.Cert = "" }, wantKey: "ca.cert"},
+		{name: "ca key", modify: func(c *Config) { c.CA.Key = "" }, wantKey: "ca.key"},
+		{name: "leaf cache size", modify: func(c *Config) { c.CA.LeafCacheSize = -1 }, wantKey: "ca.leafCacheSize"},
+		{name: "leaf key", modify: func(c *Config) { c.CA.LeafKey = "dsa" }, wantKey: "ca.leafKey"},
+		{name: "rsa bits", modify: func(c *Config) { c.CA.RSABits = 1024 }, wantKey: "ca.rsaBits"},
+		{name: "no detectors", modify: func(c *Config) { c.Detectors = nil }, wantKey: "detectors"},
+		{name: "unknown detector", modify: func(c *Config) { c.Detectors = []string{DetectorTls, "quic"} }, wantKey: "detectors[1]"},
+		{name: "duplicate detector", modify: func(c *Config) { c.Detectors = []string{DetectorTls, DetectorHttp2, DetectorTls} }, wantKey: "detectors[2]"},
+		{name: "detection timeout", modify: func(c *Config) { c.Detection.Timeout = 0 }, wantKey: "detection.timeout"},
+		{name: "detection max bytes", modify: func(c *Config) { c.Detection.MaxBytes = MaxDetectionBytes + 1 }, wantKey: "detection.maxBytes"},
+		{name: "policy default", modify: func(c *Config) { c.Policy.Default = "drop" }, wantKey: "policy.default"},
+		{name: "watch interval", modify: func(c *Config) { c.Reload.WatchInterval = -time.Second }, wantKey: "reload.watchInterval"},
+		{name: "watch disabled", modify: func(c *Config) { c.Reload.WatchInterval = 0 }},
+		{name: "drain timeout", modify: func(c *Config) { c.Shutdown.DrainTimeout = -time.Second }, wantKey: "shutdown.drainTimeout"},
+		{name: "admin on a public address", modify: func(c *Config) { c.Admin.Listen = "0.0.0.0:9090" }, wantKey: "admin.listen"},
+		{name: "admin on localhost", modify: func(c *Config) { c.Admin.Listen = "localhost:9090" }},
+		{name: "admin on a unix socket", modify: func(c *Config) { c.Admin.Listen = "unix:/run/toss.sock" }},
+		{name: "admin unix without path", modify: func(c *Config) { c.Admin.Listen = "unix:" }, wantKey: "admin.listen"},
+		{name: "metrics on a public address", modify: func(c *Config) { c.Metrics.Listen = "0.0.0.0:9100" }},
+		{name: "metrics without port", modify: func(c *Config) { c.Metrics.Listen = "0.0.0.0" }, wantKey: "metrics.listen"},
+		{name: "har group", modify: func(c *Config) { c.HAR.Dir, c.HAR.GroupBy = "/tmp/har", "host" }, wantKey: "har.groupBy"},
+		{name: "har group unused", modify: func(c *Config) { c.HAR.GroupBy = "host" }},
+		{name: "har window", modify: func(c *Config) { c.HAR.Dir, c.HAR.Window = "/tmp/har", 0 }, wantKey: "har.window"},
+		{name: "har body size", modify: func(c *Config) { c.HAR.Dir, c.HAR.BodySize = "/tmp/har", -1 }, wantKey: "har.bodySize"},
+		{name: "keylog max size", modify: func(c *Config) { c.KeyLog.MaxSize = -1 }, wantKey: "keyLog.maxSize"},
+		{name: "keylog max files", modify: func(c *Config) { c.KeyLog.MaxFiles = -1 }, wantKey: "keyLog.maxFiles"},
+		{name: "upstream failure mode", modify: func(c *Config) { c.UpstreamTLS.OnFailure = "ignore" }, wantKey: "upstreamTLS.onFailure"},
+		{name: "system roots ignored without bundle", modify: func(c *Config) { c.UpstreamTLS.IgnoreSystemRoots = true }, wantKey: "upstreamTLS.ignoreSystemRoots"},
+		{name: "onboarding host with port", modify: func(c *Config) { c.Onboarding.Host = "mitm.it:80" }, wantKey: "onboarding.host"},
+		{name: "onboarding disabled", modify: func(c *Config) { c.Onboarding.Host = "" }},
+		{name: "auto bypass ttl", modify: func(c *Config) { c.AutoBypass.TTL = -time.Hour }, wantKey: "autoBypass.ttl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+
+			err := c.Validate()
+			if tt.wantKey == "" {
+				if err != nil {
+					t.Errorf("Validate = %v", err)
+				}
+				return
+			}
+
+			var confErr *Error
+			if !errors.As(err, &confErr) || confErr.Key != tt.wantKey {
+				t.Errorf("Validate = %v, want key %s", err, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := &Error{Key: "timeouts.dial", Source: "flag -dial-timeout", Err: errors.New(`invalid duration "x"`)}
+	if want := `config: timeouts.dial (flag -dial-timeout): invalid duration "x"`; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+
+	err.Source = ""
+	if want := `config: timeouts.dial: invalid duration "x"`; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "TOSS_"
+
+// override describes a key that can be set from the environment and the command line.
+// The env name is derived from the flag name: "dial-timeout" -> "TOSS_DIAL_TIMEOUT".
+type override struct {
+	key   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var overrides = []override{
+	{
+		key: "listen", flag: "listen", usage: "listen address of the tproxy listener, empty to disable",
+		set: func(c *Config, v string) error { c.Listen = v; return nil },
+	},
+	{
+		key: "timeouts.dial", flag: "dial-timeout", usage: "timeout for dialing the original destination",
+		set: func(c *Config, v string) error { return setDuration(&c.Timeouts.Dial, v) },
+	},
+	{
+		key: "timeouts.firstByte", flag: "first-byte-timeout", usage: "how long to wait for either side to speak",
+		set: func(c *Config, v string) error { return setDuration(&c.Timeouts.FirstByte, v) },
+	},
+	{
+		key: "ca.cert", flag: "ca-cert", usage: "path of the CA certificate (PEM)",
+		set: func(c *Config, v string) error { c.CA.Cert = v; return nil },
+	},
+	{
+		key: "ca.key", flag: "ca-key", usage: "path of the CA private key (PEM)",
+		set: func(c *Config, v string) error { c.CA.Key = v; return nil },
+	},
+	{
+		key: "ca.storeDir", flag: "ca-store-dir", usage: "directory keeping the issued leaf certificates across restarts, empty to disable",
+		set: func(c *Config, v string) error { c.CA.StoreDir = v; return nil },
+	},
+	{
+		key: "detectors", flag: "detectors", usage: "comma separated detector order",
+		set: func(c *Config, v string) error { c.Detectors = splitList(v); return nil },
+	},
+	{
+		key: "detection.timeout", flag: "detect-timeout", usage: "time budget for protocol detection",
+		set: func(c *Config, v string) error { return setDuration(&c.Detection.Timeout, v) },
+	},
+	{
+		key: "detection.maxBytes", flag: "detect-max-bytes", usage: "bytes buffered before protocol detection gives up",
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid size %q", v)
+			}
+			c.Detection.MaxBytes = n
+			return nil
+		},
+	},
+	{
+		key: "bodyPreviewSize", flag: "body-preview-size", usage: "bytes of http bodies to log",
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid size %q", v)
+			}
+			c.BodyPreviewSize = n
+			return nil
+		},
+	},
+	{
+		key: "bypass.ips", flag: "bypass-ips", usage: "comma separated ip/cidr patterns excluded from MITM",
+		set: func(c *Config, v string) error { c.Bypass.IPs = splitList(v); return nil },
+	},
+	{
+		key: "bypass.domains", flag: "bypass-domains", usage: "comma separated server name patterns excluded from MITM",
+		set: func(c *Config, v string) error { c.Bypass.Domains = splitList(v); return nil },
+	},
+	{
+		key: "policy.default", flag: "policy-default", usage: "action when no policy rule matches (intercept, bypass, reject, close)",
+		set: func(c *Config, v string) error { c.Policy.Default = v; return nil },
+	},
+	{
+		key: "reload.watchInterval", flag: "watch-interval", usage: "config file polling interval, 0 to disable",
+		set: func(c *Config, v string) error { return setDuration(&c.Reload.WatchInterval, v) },
+	},
+	{
+		key: "shutdown.drainTimeout", flag: "drain-timeout", usage: "time given to in-flight exchanges on SIGTERM/SIGINT",
+		set: func(c *Config, v string) error { return setDuration(&c.Shutdown.DrainTimeout, v) },
+	},
+	{
+		key: "admin.listen", flag: "admin-listen", usage: "loopback address or unix:/path of the admin api, empty to disable",
+		set: func(c *Config, v string) error { c.Admin.Listen = v; return nil },
+	},
+	{
+		key: "metrics.listen", flag: "metrics-listen", usage: "extra address serving only /metrics, empty to disable",
+		set: func(c *Config, v string) error { c.Metrics.Listen = v; return nil },
+	},
+	{
+		key: "har.dir", flag: "har-dir", usage: "directory for HAR recordings, empty to disable",
+		set: func(c *Config, v string) error { c.HAR.Dir = v; return nil },
+	},
+	{
+		key: "har.groupBy", flag: "har-group-by", usage: "start a HAR file per tunnel, client or window",
+		set: func(c *Config, v string) error { c.HAR.GroupBy = v; return nil },
+	},
+	{
+		key: "pcap.dir", flag: "pcap-dir", usage: "directory for per tunnel pcapng captures, empty to disable",
+		set: func(c *Config, v string) error { c.PCAP.Dir = v; return nil },
+	},
+	{
+		key: "keyLog.file", flag: "keylog-file", usage: "NSS key log (SSLKEYLOGFILE) of the intercepted TLS sessions, empty to disable",
+		set: func(c *Config, v string) error { c.KeyLog.File = v; return nil },
+	},
+	{
+		key: "upstreamTLS.caFile", flag: "upstream-ca-file", usage: "PEM bundle trusted for origin certificates in addition to the system roots",
+		set: func(c *Config, v string) error { c.UpstreamTLS.CAFile = v; return nil },
+	},
+	{
+		key: "upstreamTLS.onFailure", flag: "upstream-on-failure", usage: "answer to clients of rejected origins: alert or untrusted-leaf",
+		set: func(c *Config, v string) error { c.UpstreamTLS.OnFailure = v; return nil },
+	},
+	{
+		key: "onboarding.host", flag: "onboarding-host", usage: "host name answered with the CA install page, empty to disable",
+		set: func(c *Config, v string) error { c.Onboarding.Host = v; return nil },
+	},
+	{
+		key: "autoBypass.ttl", flag: "auto-bypass-ttl", usage: "how long clients refusing a forged certificate are bypassed, 0 to disable",
+		set: func(c *Config, v string) error { return setDuration(&c.AutoBypass.TTL, v) },
+	},
+	{
+		key: "explicitProxy.listen", flag: "explicit-proxy-listen", usage: "listen address accepting CONNECT and absolute-URI http requests, empty to disable",
+		set: func(c *Config, v string) error { c.ExplicitProxy.Listen = v; return nil },
+	},
+	{
+		key: "explicitProxy.allowDestinations", flag: "explicit-proxy-allow", usage: "comma separated ip/cidr patterns the explicit proxy may connect to although they are on the proxy host",
+		set: func(c *Config, v string) error { c.ExplicitProxy.AllowDestinations = splitList(v); return nil },
+	},
+}
+
+// Load builds the configuration from, in increasing priority, the defaults,
+// the config file, TOSS_* environment variables and command-line flags. lookupEnv is
+// os.LookupEnv outside of tests, a variable set to the empty string clears the value.
+// It returns flag.ErrHelp when -h was requested.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	fs := flag.NewFlagSet("toss", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	path := fs.String("config", "", "path of the YAML config file (env "+envPrefix+"CONFIG)")
+	for _, o := range overrides {
+		fs.String(o.flag, "", fmt.Sprintf("%s (key %s, env %s)", o.usage, o.key, envName(o.flag)))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return nil, err
+	}
+
+	cfg := Default()
+
+	cfg.Path = *path
+	if cfg.Path == "" {
+		cfg.Path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+
+	if cfg.Path != "" {
+		if err := cfg.readFile(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range overrides {
+		name := envName(o.flag)
+		if v, ok := lookupEnv(name); ok {
+			if err := o.set(cfg, v); err != nil {
+				return nil, &Error{Key: o.key, Source: "env " + name, Err: err}
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range overrides {
+			if o.flag != f.Name || flagErr != nil {
+				continue
+			}
+			if err := o.set(cfg, f.Value.String()); err != nil {
+				flagErr = &Error{Key: o.key, Source: "flag -" + o.flag, Err: err}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("config: read %s: %w", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config: parse %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func setDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", v)
+	}
+
+	*dst = d
+	return nil
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
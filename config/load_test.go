@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// lookupIn returns a lookupEnv reading env instead of the process environment.
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeTestConfig(t, `
+listen: ":4000"
+timeouts:
+  dial: 3s
+  firstByte: 3s
+har:
+  dir: /var/lib/toss/har
+bypass:
+  domains: [file.example.com]
+`)
+
+	env := map[string]string{
+		"TOSS_DIAL_TIMEOUT":       "4s",
+		"TOSS_FIRST_BYTE_TIMEOUT": "4s",
+		// set but empty clears the value of the file
+		"TOSS_HAR_DIR":        "",
+		"TOSS_BYPASS_DOMAINS": "env.example.com, .env.example.com",
+	}
+
+	conf, err := Load([]string{"-config", path, "-dial-timeout", "5s"}, lookupIn(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Path != path {
+		t.Errorf("path %q, want %q", conf.Path, path)
+	}
+	if conf.Listen != ":4000" {
+		t.Errorf("listen %q, want the file value", conf.Listen)
+	}
+	if conf.Timeouts.Dial != 5*time.Second {
+		t.Errorf("timeouts.dial %v, want the flag value", conf.Timeouts.Dial)
+	}
+	if conf.Timeouts.FirstByte != 4*time.Second {
+		t.Errorf("timeouts.firstByte %v, want the env value", conf.Timeouts.FirstByte)
+	}
+	if conf.HAR.Dir != "" {
+		t.Errorf("har.dir %q, want it cleared by the empty env", conf.HAR.Dir)
+	}
+	if want := []string{"env.example.com", ".env.example.com"}; !slices.Equal(conf.Bypass.Domains, want) {
+		t.Errorf("bypass.domains %q, want %q", conf.Bypass.Domains, want)
+	}
+	if conf.Detection.Timeout != Default().Detection.Timeout {
+		t.Errorf("detection.timeout %v, want the default", conf.Detection.Timeout)
+	}
+}
+
+func TestLoadConfigPath(t *testing.T) {
+	envPath := writeTestConfig(t, "listen: \":4001\"\n")
+	flagPath := writeTestConfig(t, "listen: \":4002\"\n")
+	env := lookupIn(map[string]string{"TOSS_CONFIG": envPath})
+
+	conf, err := Load(nil, env)
+	if err != nil || conf.Listen != ":4001" {
+		t.Fatalf("TOSS_CONFIG: %v, listen %q", err, conf.Listen)
+	}
+
+	conf, err = Load([]string{"-config", flagPath}, env)
+	if err != nil || conf.Listen != ":4002" {
+		t.Fatalf("-config over TOSS_CONFIG: %v, listen %q", err, conf.Listen)
+	}
+
+	conf, err = Load(nil, lookupIn(map[string]string{"TOSS_CONFIG": ""}))
+	if err != nil || conf.Path != "" || conf.Listen != Default().Listen {
+		t.Fatalf("empty TOSS_CONFIG: %v, path %q", err, conf.Path)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		args       []string
+		env        map[string]string
+		wantKey    string
+		wantSource string
+	}{
+		{name: "env", env: map[string]string{"TOSS_DIAL_TIMEOUT": "x"}, wantKey: "timeouts.dial", wantSource: "env TOSS_DIAL_TIMEOUT"},
+		{name: "empty env of a duration", env: map[string]string{"TOSS_DIAL_TIMEOUT": ""}, wantKey: "timeouts.dial", wantSource: "env TOSS_DIAL_TIMEOUT"},
+		{name: "flag", args: []string{"-detect-max-bytes", "x"}, wantKey: "detection.maxBytes", wantSource: "flag -detect-max-bytes"},
+		{name: "flag over a valid env", args: []string{"-dial-timeout", "x"}, env: map[string]string{"TOSS_DIAL_TIMEOUT": "1s"}, wantKey: "timeouts.dial", wantSource: "flag -dial-timeout"},
+		{name: "invalid file value", file: "timeouts:\n  dial: -1s\n", wantKey: "timeouts.dial"},
+		{name: "invalid after the overrides", env: map[string]string{"TOSS_LISTEN": "", "TOSS_EXPLICIT_PROXY_LISTEN": ""}, wantKey: "listen"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeTestConfig(t, tt.file)}, args...)
+			}
+
+			_, err := Load(args, lookupIn(tt.env))
+
+			var confErr *Error
+			if !errors.As(err, &confErr) || confErr.Key != tt.wantKey || confErr.Source != tt.wantSource {
+				t.Errorf("Load = %v, want key %s from %q", err, tt.wantKey, tt.wantSource)
+			}
+		})
+	}
+
+	if _, err := Load([]string{"-config", writeTestConfig(t, "listn: \":4000\"\n")}, lookupIn(nil)); err == nil {
+		t.Error("unknown file key accepted")
+	}
+	if _, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, lookupIn(nil)); err == nil {
+		t.Error("missing config file accepted")
+	}
+	if _, err := Load([]string{"-unknown"}, lookupIn(nil)); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	if _, err := Load([]string{"-h"}, lookupIn(nil)); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Load -h = %v, want flag.ErrHelp", err)
+	}
+}
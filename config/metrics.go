@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"toss/metrics"
+)
+
+var ja4sPattern = regexp.MustCompile(`^[tqd][0-9a-z]{2}[0-9]{2}[0-9a-z]{2}_[0-9a-f]{4}_[0-9a-f]{12}$`)
+
+// BuildFingerprintNames returns the names of the JA4 and JA4S fingerprints used as metric labels.
+func (c *Config) BuildFingerprintNames() (ja4, ja4s metrics.FingerprintNames, err error) {
+	if ja4, err = buildFingerprintNames("metrics.ja4", c.Metrics.JA4, ja4Pattern, "t13d1516h2_8daaf6152771_e5627efa2ab1"); err != nil {
+		return nil, nil, err
+	}
+	if ja4s, err = buildFingerprintNames("metrics.ja4s", c.Metrics.JA4S, ja4sPattern, "t130200_1301_234ea6891581"); err != nil {
+		return nil, nil, err
+	}
+
+	return ja4, ja4s, nil
+}
+
+func buildFingerprintNames(key string, named map[string][]string, pattern *regexp.Regexp, example string) (metrics.FingerprintNames, error) {
+	names := make(metrics.FingerprintNames)
+
+	for _, name := range slices.Sorted(maps.Keys(named)) {
+		if name == "" || name == metrics.LabelOther {
+			return nil, &Error{Key: key, Err: fmt.Errorf("%q can not be used as a name", name)}
+		}
+
+		for i, fingerprint := range named[name] {
+			itemKey := fmt.Sprintf("%s.%s[%d]", key, name, i)
+			if !pattern.MatchString(fingerprint) {
+				return nil, &Error{Key: itemKey, Err: fmt.Errorf("%q is not a fingerprint, e.g. %s", fingerprint, example)}
+			}
+			if other, ok := names[fingerprint]; ok && other != name {
+				return nil, &Error{Key: itemKey, Err: fmt.Errorf("%q is already named %q", fingerprint, other)}
+			}
+			names[fingerprint] = name
+		}
+	}
+
+	return names, nil
+}
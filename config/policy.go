@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"toss/matcher"
+	"toss/policy"
+)
+
+// Policy is the declarative rule set deciding what happens to each detected tunnel.
+//
+// bypass.ips and bypass.domains are kept as shorthands and are evaluated
+// as TLS-only bypass rules before the rules listed here.
+type Policy struct {
+	// Default is the action when no rule matches.
+	Default string `yaml:"default"`
+
+	// Clients names groups of source ip/cidr patterns that rules refer to by name.
+	Clients map[string][]string `yaml:"clients"`
+
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+type PolicyRule struct {
+	Name      string   `yaml:"name"`
+	SNI       []string `yaml:"sni"`
+	Dst       []string `yaml:"dst"`
+	Src       []string `yaml:"src"`
+	Clients   []string `yaml:"clients"`
+	Protocols []string `yaml:"protocols"`
+	ALPN      []string `yaml:"alpn"`
+	// JA3 and JA4 are fingerprints of the TLS ClientHello, as logged by TlsDetector.
+	JA3 []string `yaml:"ja3"`
+	JA4 []string `yaml:"ja4"`
+
+	Action string `yaml:"action"`
+	// Reject is "rst" (default) or "tls-alert", only used with action reject.
+	Reject string `yaml:"reject"`
+}
+
+// BuildPolicy compiles the policy section together with the bypass shorthands.
+func (c *Config) BuildPolicy() (*policy.RuleSet, error) {
+	ruleSet := &policy.RuleSet{}
+
+	defaultAction, err := policy.ParseAction(c.Policy.Default)
+	if err != nil {
+		return nil, &Error{Key: "policy.default", Err: err}
+	}
+	ruleSet.Default = policy.Decision{Action: defaultAction}
+
+	clientNames := make([]string, 0, len(c.Policy.Clients))
+	for name := range c.Policy.Clients {
+		clientNames = append(clientNames, name)
+	}
+	slices.Sort(clientNames)
+
+	for _, name := range clientNames {
+		src, err := compileAddressPatterns(fmt.Sprintf("policy.clients.%s", name), c.Policy.Clients[name])
+		if err != nil {
+			return nil, err
+		}
+		ruleSet.Clients = append(ruleSet.Clients, policy.Client{Name: name, Src: src})
+	}
+
+	bypass := policy.Decision{Action: policy.ActionBypass}
+
+	if len(c.Bypass.IPs) > 0 {
+		dst, err := compileAddressPatterns("bypass.ips", c.Bypass.IPs)
+		if err != nil {
+			return nil, err
+		}
+		ruleSet.Rules = append(ruleSet.Rules, policy.Rule{
+			Name:      "bypass.ips",
+			Dst:       dst,
+			Protocols: []string{DetectorTls},
+			Decision:  bypass,
+		})
+	}
+
+	if len(c.Bypass.Domains) > 0 {
+		serverNames, err := compileNamePatterns("bypass.domains", c.Bypass.Domains)
+		if err != nil {
+			return nil, err
+		}
+		ruleSet.Rules = append(ruleSet.Rules, policy.Rule{
+			Name:        "bypass.domains",
+			ServerNames: serverNames,
+			Protocols:   []string{DetectorTls},
+			Decision:    bypass,
+		})
+	}
+
+	for i, r := range c.Policy.Rules {
+		key := fmt.Sprintf("policy.rules[%d]", i)
+
+		rule, err := r.compile(key, c.Policy.Clients)
+		if err != nil {
+			return nil, err
+		}
+
+		if rule.Name == "" {
+			rule.Name = key
+		}
+		ruleSet.Rules = append(ruleSet.Rules, rule)
+	}
+
+	return ruleSet, nil
+}
+
+// BuildKeyLogFilter compiles the conditions of the keyLog section, client names refer to policy.clients.
+func (c *Config) BuildKeyLogFilter() (*policy.Filter, error) {
+	ruleSet, err := c.BuildPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	rule := PolicyRule{
+		Name:    "keyLog",
+		SNI:     c.KeyLog.SNI,
+		Dst:     c.KeyLog.Dst,
+		Src:     c.KeyLog.Src,
+		Clients: c.KeyLog.Clients,
+		Action:  policy.ActionIntercept.String(),
+	}
+
+	compiled, err := rule.compile("keyLog", c.Policy.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy.Filter{Clients: ruleSet.Clients, Rule: compiled}, nil
+}
+
+func (r *PolicyRule) compile(key string, clients map[string][]string) (policy.Rule, error) {
+	rule := policy.Rule{
+		Name:      r.Name,
+		Clients:   r.Clients,
+		Protocols: r.Protocols,
+		ALPN:      r.ALPN,
+		JA3:       r.JA3,
+		JA4:       r.JA4,
+	}
+
+	var err error
+	if rule.ServerNames, err = compileNamePatterns(key+".sni", r.SNI); err != nil {
+		return rule, err
+	}
+	if rule.Dst, err = compileAddressPatterns(key+".dst", r.Dst); err != nil {
+		return rule, err
+	}
+	if rule.Src, err = compileAddressPatterns(key+".src", r.Src); err != nil {
+		return rule, err
+	}
+
+	for i, client := range r.Clients {
+		if _, ok := clients[client]; !ok {
+			return rule, &Error{Key: fmt.Sprintf("%s.clients[%d]", key, i), Err: fmt.Errorf("unknown client %q, define it in policy.clients", client)}
+		}
+	}
+
+	for i, ja3 := range r.JA3 {
+		if !ja3Pattern.MatchString(ja3) {
+			return rule, &Error{Key: fmt.Sprintf("%s.ja3[%d]", key, i), Err: fmt.Errorf("%q is not a JA3 hash, expected 32 lowercase hex digits", ja3)}
+		}
+	}
+	for i, ja4 := range r.JA4 {
+		if !ja4Pattern.MatchString(ja4) {
+			return rule, &Error{Key: fmt.Sprintf("%s.ja4[%d]", key, i), Err: fmt.Errorf("%q is not a JA4 fingerprint, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1", ja4)}
+		}
+	}
+
+	knownProtocols := append(slices.Clone(knownDetectors), policy.ProtocolUnknown)
+	for i, protocol := range r.Protocols {
+		if !slices.Contains(knownProtocols, protocol) {
+			return rule, &Error{Key: fmt.Sprintf("%s.protocols[%d]", key, i), Err: fmt.Errorf("unknown protocol %q (known: %v)", protocol, knownProtocols)}
+		}
+	}
+
+	if rule.Decision.Action, err = policy.ParseAction(r.Action); err != nil {
+		return rule, &Error{Key: key + ".action", Err: err}
+	}
+
+	if r.Reject != "" && rule.Decision.Action != policy.ActionReject {
+		return rule, &Error{Key: key + ".reject", Err: fmt.Errorf("only valid with action reject")}
+	}
+	if rule.Decision.Reject, err = policy.ParseRejectMode(r.Reject); err != nil {
+		return rule, &Error{Key: key + ".reject", Err: err}
+	}
+
+	return rule, nil
+}
+
+// BuildProxyAllowedDestinations returns the destinations the explicit proxy connects to although
+// they are on the proxy host, nil when none is allowed.
+func (c *Config) BuildProxyAllowedDestinations() (*matcher.Matcher, error) {
+	return compileAddressPatterns("explicitProxy.allowDestinations", c.ExplicitProxy.AllowDestinations)
+}
+
+var (
+	ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern = regexp.MustCompile(`^[tqd][0-9a-z]{2}[di][0-9]{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// compileAddressPatterns returns nil for an empty list so that the condition is left unset.
+func compileAddressPatterns(key string, patterns []string) (*matcher.Matcher, error) {
+	return compilePatterns(key, patterns, func(p matcher.Pattern) error {
+		if !p.Kind.IsAddress() {
+			return fmt.Errorf("%q is a %s pattern, expected ip or cidr", p.Raw, p.Kind)
+		}
+		return nil
+	})
+}
+
+func compileNamePatterns(key string, patterns []string) (*matcher.Matcher, error) {
+	return compilePatterns(key, patterns, func(p matcher.Pattern) error {
+		if p.Kind.IsAddress() {
+			return fmt.Errorf("%q is a %s pattern, expected a server name pattern", p.Raw, p.Kind)
+		}
+		return nil
+	})
+}
+
+func compilePatterns(key string, patterns []string, check func(matcher.Pattern) error) (*matcher.Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	m, _ := matcher.New(nil)
+	for i, raw := range patterns {
+		p, err := matcher.Parse(raw)
+		if err == nil {
+			err = check(p)
+		}
+		if err != nil {
+			return nil, &Error{Key: fmt.Sprintf("%s[%d]", key, i), Err: err}
+		}
+
+		m.Add(p)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"toss/matcher"
+	"toss/trust"
+)
+
+// UpstreamTLS configures how the certificates of the origins are verified.
+type UpstreamTLS struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string `yaml:"caFile"`
+	// IgnoreSystemRoots trusts the CAFile bundle only.
+	IgnoreSystemRoots bool `yaml:"ignoreSystemRoots"`
+
+	Pins []Pin `yaml:"pins"`
+
+	// InsecureSkipVerify lists server name, ip and cidr patterns of origins whose chain and
+	// host name are not verified, e.g. internal staging hosts.
+	InsecureSkipVerify []string `yaml:"insecureSkipVerify"`
+
+	// OnFailure is "alert" (default) or "untrusted-leaf".
+	OnFailure string `yaml:"onFailure"`
+}
+
+// Pin lists base64 SHA-256 hashes of the SubjectPublicKeyInfo of a certificate in the chain
+// of the matching origins, with an optional "sha256//" prefix as in curl --pinnedpubkey.
+// SNI lists server name patterns, and ip or cidr patterns matched against the destination of
+// the clients sending no SNI.
+type Pin struct {
+	SNI    []string `yaml:"sni"`
+	SHA256 []string `yaml:"sha256"`
+}
+
+// BuildUpstreamVerifier compiles the upstreamTLS section, reading the CA bundle.
+func (c *Config) BuildUpstreamVerifier() (*trust.Verifier, error) {
+	u := &c.UpstreamTLS
+	verifier := &trust.Verifier{}
+
+	var err error
+	if verifier.OnFailure, err = trust.ParseFailureMode(u.OnFailure); err != nil {
+		return nil, &Error{Key: "upstreamTLS.onFailure", Err: err}
+	}
+
+	if u.IgnoreSystemRoots && u.CAFile == "" {
+		return nil, &Error{Key: "upstreamTLS.ignoreSystemRoots", Err: fmt.Errorf("requires upstreamTLS.caFile")}
+	}
+
+	if u.CAFile != "" {
+		if verifier.Roots, err = loadRoots(u.CAFile, u.IgnoreSystemRoots); err != nil {
+			return nil, &Error{Key: "upstreamTLS.caFile", Err: err}
+		}
+	}
+
+	if verifier.Insecure, err = compilePatterns("upstreamTLS.insecureSkipVerify", u.InsecureSkipVerify, func(matcher.Pattern) error { return nil }); err != nil {
+		return nil, err
+	}
+
+	for i, pin := range u.Pins {
+		key := fmt.Sprintf("upstreamTLS.pins[%d]", i)
+
+		if len(pin.SNI) == 0 {
+			return nil, &Error{Key: key + ".sni", Err: fmt.Errorf("must not be empty")}
+		}
+		if len(pin.SHA256) == 0 {
+			return nil, &Error{Key: key + ".sha256", Err: fmt.Errorf("must not be empty")}
+		}
+
+		compiled := trust.Pin{}
+		if compiled.ServerNames, err = compilePatterns(key+".sni", pin.SNI, func(matcher.Pattern) error { return nil }); err != nil {
+			return nil, err
+		}
+
+		for j, raw := range pin.SHA256 {
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(raw, "sha256//"))
+			if err == nil && len(sum) != sha256.Size {
+				err = fmt.Errorf("%d bytes, expected %d", len(sum), sha256.Size)
+			}
+			if err != nil {
+				return nil, &Error{Key: fmt.Sprintf("%s.sha256[%d]", key, j), Err: fmt.Errorf("invalid hash %q: %w", raw, err)}
+			}
+			compiled.SHA256 = append(compiled.SHA256, sum)
+		}
+
+		verifier.Pins = append(verifier.Pins, compiled)
+	}
+
+	return verifier, nil
+}
+
+func loadRoots(path string, ignoreSystemRoots bool) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !ignoreSystemRoots {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("load system roots: %w", err)
+		}
+	}
+
+	if !roots.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+
+	return roots, nil
+}
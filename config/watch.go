@@ -0,0 +1,52 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stamp(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Watch polls the file at path every interval and calls onChange when its
+// modification time or size changes. It returns when ctx is done.
+//
+// Polling is used instead of inotify so that editors and config management
+// tools which replace the file by rename are picked up as well.
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := stamp(path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := stamp(path)
+		if err != nil {
+			// the file may be in the middle of being replaced
+			continue
+		}
+
+		if current != last {
+			last = current
+			onChange()
+		}
+	}
+}
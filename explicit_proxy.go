@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+	"toss/config"
+	"toss/matcher"
+	"toss/policy"
+)
+
+// maxProxyRequestSize bounds the request line and headers of a proxy request.
+const maxProxyRequestSize = 64 << 10
+
+// proxyRequest is the first request of a client of the explicit proxy.
+type proxyRequest struct {
+	method string
+	// addr is the original destination, "host:port".
+	addr string
+	// connect is set for CONNECT, the client is answered 200 before the tunnel starts.
+	connect bool
+	// replay are the bytes already read from the client that the tunnel must see: the absolute-URI
+	// request itself, or what the client sent after its CONNECT request without waiting for the answer.
+	replay []byte
+}
+
+var errNotProxyRequest = errors.New("not a CONNECT or absolute-URI http request")
+
+// readProxyRequest reads the CONNECT or absolute-URI http request a proxy client starts with.
+func readProxyRequest(conn net.Conn, timeout time.Duration) (*proxyRequest, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var read bytes.Buffer
+	reader := bufio.NewReader(io.TeeReader(io.LimitReader(conn, maxProxyRequestSize), &read))
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodConnect {
+		// CONNECT example.com:443 HTTP/1.1
+		if _, port, err := net.SplitHostPort(req.URL.Host); err != nil || port == "" {
+			return nil, fmt.Errorf("%w: CONNECT %q", errNotProxyRequest, req.RequestURI)
+		}
+
+		buffered, _ := reader.Peek(reader.Buffered())
+		return &proxyRequest{
+			method:  req.Method,
+			addr:    req.URL.Host,
+			connect: true,
+			replay:  bytes.Clone(buffered),
+		}, nil
+	}
+
+	// GET http://example.com/path HTTP/1.1, https is requested with CONNECT
+	if req.URL.Scheme != "http" || req.URL.Hostname() == "" {
+		return nil, fmt.Errorf("%w: %s %q", errNotProxyRequest, req.Method, req.RequestURI)
+	}
+
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	return &proxyRequest{
+		method: req.Method,
+		addr:   net.JoinHostPort(req.URL.Hostname(), port),
+		replay: read.Bytes(),
+	}, nil
+}
+
+// handleProxyConnection serves a client of the explicit proxy listener. The destination comes from
+// its first request, the tunnel then goes through the same pipeline as a TPROXY connection.
+func handleProxyConnection(ctx context.Context, downstreamConn net.Conn) {
+	defer downstreamConn.Close()
+
+	rc := current.Load()
+
+	srcAddr := downstreamConn.RemoteAddr()
+	logger := slog.Default().With("src", srcAddr.String(), "context", "ExplicitProxy")
+
+	req, err := readProxyRequest(downstreamConn, rc.conf.Timeouts.FirstByte)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			logger.Debug("client closed before its proxy request")
+			return
+		}
+
+		logger.Error("read proxy request", slog.Any("error", err))
+		writeProxyStatus(downstreamConn, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.With("dst", req.addr)
+	logger.Debug(fmt.Sprintf("proxy request: %s %s", req.method, req.addr))
+
+	dialer := &net.Dialer{
+		Timeout: rc.conf.Timeouts.Dial,
+		// checked for each resolved address right before connecting, a name resolving to the proxy
+		// host is refused as well as an ip literal
+		Control: func(network, address string, c syscall.RawConn) error {
+			return checkProxyDestination(address, rc.proxyAllowed)
+		},
+	}
+
+	upstreamConn, err := dialOrigin(dialer, req.addr, logger)
+	if errors.Is(err, errDestinationRefused) {
+		writeProxyStatus(downstreamConn, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeProxyStatus(downstreamConn, http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	if !req.connect && !servedByHttp11(rc, srcAddr, upstreamConn.RemoteAddr()) {
+		logger.Info("refuse absolute-URI request: tunnel would be bypassed, use CONNECT")
+		writeProxyStatus(downstreamConn, http.StatusForbidden)
+		return
+	}
+
+	if req.connect {
+		if _, err := io.WriteString(downstreamConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			logger.Error("answer CONNECT", slog.Any("error", err))
+			return
+		}
+	}
+
+	setNoDelay(downstreamConn)
+	setNoDelay(upstreamConn)
+
+	client := &replayConn{Conn: downstreamConn, replay: req.replay}
+	serveTunnel(ctx, rc, srcAddr, upstreamConn.RemoteAddr(), client, upstreamConn)
+}
+
+// servedByHttp11 reports whether Http11Handler will serve the tunnel of an absolute-URI request. Only
+// it closes the client connection after the response, a bypassed tunnel would carry the next requests
+// of the client to this origin whatever their host.
+func servedByHttp11(rc *runtimeConfig, src, dst net.Addr) bool {
+	if !slices.Contains(rc.conf.Detectors, config.DetectorHttp11) {
+		return false
+	}
+
+	srcAddr, _ := src.(*net.TCPAddr)
+	dstAddr, _ := dst.(*net.TCPAddr)
+	decision := rc.handlerOptions.Policy.Decide(&policy.Context{
+		Src:      srcAddr,
+		Dst:      dstAddr,
+		Protocol: config.DetectorHttp11,
+	})
+
+	return decision.Action != policy.ActionBypass
+}
+
+var errDestinationRefused = errors.New("destination refused")
+
+// checkProxyDestination refuses to connect a client of the explicit proxy to the proxy host itself:
+// loopback, unspecified and link-local addresses and the listeners of the proxy, unless allowed.
+// Such a client could otherwise reach the admin api or services only listening on loopback.
+func checkProxyDestination(address string, allowed *matcher.Matcher) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portString)
+	if ip == nil || err != nil {
+		// e.g. a link-local address with a zone
+		return fmt.Errorf("%w: %s is not an ip address", errDestinationRefused, address)
+	}
+
+	if _, ok := allowed.MatchIP(ip, port); ok {
+		return nil
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("%w: %s is on the proxy host", errDestinationRefused, address)
+	}
+
+	if isListenAddr(ip, port) {
+		return fmt.Errorf("%w: %s is a listener of the proxy", errDestinationRefused, address)
+	}
+
+	return nil
+}
+
+// isListenAddr reports whether ip and port reach one of listenAddrs. A listener on the
+// unspecified address is reached through any address of the host.
+func isListenAddr(ip net.IP, port int) bool {
+	for _, addr := range listenAddrs {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || tcpAddr.Port != port {
+			continue
+		}
+
+		if tcpAddr.IP != nil && !tcpAddr.IP.IsUnspecified() {
+			if tcpAddr.IP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		hostAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			// the address can not be told apart from the host
+			return true
+		}
+		for _, hostAddr := range hostAddrs {
+			if ipNet, ok := hostAddr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func writeProxyStatus(conn net.Conn, code int) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
+
+// replayConn reads replay before the bytes still to come from Conn.
+type replayConn struct {
+	net.Conn
+	replay []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+// SetLinger is forwarded so that RejectHandler can still reset the connection.
+func (c *replayConn) SetLinger(sec int) error {
+	if conn, ok := c.Conn.(interface{ SetLinger(sec int) error }); ok {
+		return conn.SetLinger(sec)
+	}
+
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"toss/config"
+	"toss/matcher"
+	"toss/policy"
+	"toss/tunnel/tunneltest"
+)
+
+// newTestExplicitProxy serves handleProxyConnection on loopback with the options and CA of proxy and
+// returns its address. Its tunnels may connect to 127.0.0.1, where the test origins listen.
+func newTestExplicitProxy(t *testing.T, proxy *tunneltest.Proxy, conf *config.Config) string {
+	t.Helper()
+
+	if conf == nil {
+		conf = config.Default()
+	}
+	if conf.ExplicitProxy.AllowDestinations == nil {
+		conf.ExplicitProxy.AllowDestinations = []string{"127.0.0.1"}
+	}
+
+	proxyAllowed, err := conf.BuildProxyAllowedDestinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serveTestExplicitProxy(t, &runtimeConfig{
+		conf:           conf,
+		handlerOptions: proxy.Options,
+		certManager:    proxy.CA.Manager,
+		proxyAllowed:   proxyAllowed,
+	})
+}
+
+// serveTestExplicitProxy makes rc the current snapshot, serves handleProxyConnection on loopback
+// and returns its address.
+func serveTestExplicitProxy(t *testing.T, rc *runtimeConfig) string {
+	t.Helper()
+
+	prev := current.Load()
+	current.Store(rc)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&acceptLoop{name: "explicit", listener: listener, handle: handleProxyConnection}).run(ctx)
+	}()
+
+	// registered first, so it runs after the clients of the test are closed
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		// a bypassed tunnel lasts until either side closes, e.g. the echo origins never do
+		tunnels.CloseAll()
+
+		finished := make(chan struct{})
+		go func() {
+			connections.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(10 * time.Second):
+			t.Error("explicit proxy connections still running after the test")
+		}
+
+		current.Store(prev)
+	})
+
+	return listener.Addr().String()
+}
+
+// proxyClient returns an http client using the explicit proxy at addr, trusting the CA of proxy.
+func proxyClient(t *testing.T, proxy *tunneltest.Proxy, addr string) *http.Client {
+	t.Helper()
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+		TLSClientConfig:   &tls.Config{RootCAs: proxy.CA.Pool, ServerName: "example.com"},
+		ForceAttemptHTTP2: true,
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// dialProxy writes raw to the explicit proxy at addr and returns the connection and its reader.
+func dialProxy(t *testing.T, addr, raw string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, bufio.NewReader(conn)
+}
+
+// proxyTunnel is the client side of a CONNECT tunnel through the explicit proxy.
+type proxyTunnel struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// connectTunnel opens a tunnel to dst through the explicit proxy at addr.
+func connectTunnel(t *testing.T, addr, dst string) *proxyTunnel {
+	t.Helper()
+
+	conn, reader := dialProxy(t, addr, "CONNECT "+dst+" HTTP/1.1\r\nHost: "+dst+"\r\n\r\n")
+	res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s answered %v, %v", dst, res, err)
+	}
+
+	return &proxyTunnel{conn: conn, reader: reader}
+}
+
+// proxyStatus returns the status the explicit proxy at addr answers to raw.
+func proxyStatus(t *testing.T, addr, raw string) int {
+	t.Helper()
+
+	_, reader := dialProxy(t, addr, raw)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestExplicitProxyConnect(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	originCA := tunneltest.NewCA(t, "Toss Test Origin")
+	proxy.Trust(originCA)
+
+	origin := tunneltest.NewTLSOrigin(t, originCA, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello over "+r.Proto)
+	}))
+
+	addr := newTestExplicitProxy(t, proxy, nil)
+
+	res, err := proxyClient(t, proxy, addr).Get("https://" + origin.Addr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil || string(body) != "hello over HTTP/2.0" {
+		t.Fatalf("body %q, %v", body, err)
+	}
+
+	// the client trusted the leaf forged by the proxy, the origin saw the request decrypted and encrypted again
+	if res.TLS == nil || res.TLS.PeerCertificates[len(res.TLS.PeerCertificates)-1].Issuer.Organization[0] != "Toss Test Proxy" {
+		t.Error("the response did not come over the tls of the proxy")
+	}
+	if requests := origin.Requests(); len(requests) != 1 || !requests[0].TLS {
+		t.Errorf("origin received %d requests", len(requests))
+	}
+}
+
+func TestExplicitProxyConnectReplay(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewEchoOrigin(t)
+	addr := newTestExplicitProxy(t, proxy, nil)
+
+	// the client does not wait for the answer to CONNECT before sending its first bytes
+	conn, reader := dialProxy(t, addr, "CONNECT "+origin.Addr.String()+" HTTP/1.1\r\nHost: "+origin.Addr.String()+"\r\n\r\nhello")
+
+	res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT answered %v, %v", res, err)
+	}
+
+	if _, err := io.WriteString(conn, " world"); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(reader, echoed); err != nil || string(echoed) != "hello world" {
+		t.Errorf("echoed %q, %v", echoed, err)
+	}
+	if received := origin.Received(); len(received) != 1 || string(received[0]) != "hello world" {
+		t.Errorf("origin received %q", received)
+	}
+}
+
+func TestExplicitProxyAbsoluteURI(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewHTTPOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+
+	addr := newTestExplicitProxy(t, proxy, nil)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+origin.Addr.String()+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Proxy-Connection", "keep-alive")
+
+	res, err := proxyClient(t, proxy, addr).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil || string(body) != "/path" {
+		t.Fatalf("body %q, %v", body, err)
+	}
+
+	// the tunnel stays connected to this origin, the client must not send its next request over it
+	if !res.Close {
+		t.Error("response to an absolute-URI request does not close the connection")
+	}
+
+	requests := origin.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("origin received %d requests", len(requests))
+	}
+	if requests[0].RequestURI != "/path" || requests[0].Header.Get("Proxy-Connection") != "" {
+		t.Errorf("origin received %q with headers %v", requests[0].RequestURI, requests[0].Header)
+	}
+}
+
+func TestExplicitProxyAbsoluteURINotForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(proxy *tunneltest.Proxy, conf *config.Config)
+	}{
+		{
+			name: "bypassed by policy",
+			modify: func(proxy *tunneltest.Proxy, conf *config.Config) {
+				proxy.Options.Policy = policy.Static{Action: policy.ActionBypass}
+			},
+		},
+		{
+			name: "http11 detector disabled",
+			modify: func(proxy *tunneltest.Proxy, conf *config.Config) {
+				conf.Detectors = slices.DeleteFunc(conf.Detectors, func(name string) bool { return name == config.DetectorHttp11 })
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := tunneltest.NewProxy(t)
+			origin := tunneltest.NewHTTPOrigin(t, http.NotFoundHandler())
+
+			conf := config.Default()
+			tt.modify(proxy, conf)
+			addr := newTestExplicitProxy(t, proxy, conf)
+
+			raw := "GET http://" + origin.Addr.String() + "/ HTTP/1.1\r\nHost: " + origin.Addr.String() + "\r\n\r\n"
+			if status := proxyStatus(t, addr, raw); status != http.StatusForbidden {
+				t.Errorf("status %d, want %d", status, http.StatusForbidden)
+			}
+			if requests := origin.Requests(); len(requests) != 0 {
+				t.Errorf("origin received %d requests", len(requests))
+			}
+		})
+	}
+}
+
+func TestExplicitProxyErrors(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewEchoOrigin(t)
+
+	// a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	conf := config.Default()
+	conf.ExplicitProxy.AllowDestinations = []string{"127.0.0.1:" + strings.Split(closedAddr, ":")[1]}
+	addr := newTestExplicitProxy(t, proxy, conf)
+
+	tests := []struct {
+		name string
+		raw  string
+		want int
+	}{
+		{name: "not http", raw: "hello\r\n\r\n", want: http.StatusBadRequest},
+		{name: "origin-form", raw: "GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n", want: http.StatusBadRequest},
+		{name: "https absolute-URI", raw: "GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", want: http.StatusBadRequest},
+		{name: "CONNECT without port", raw: "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", want: http.StatusBadRequest},
+		{name: "dial failure", raw: "CONNECT " + closedAddr + " HTTP/1.1\r\nHost: " + closedAddr + "\r\n\r\n", want: http.StatusBadGateway},
+		{name: "loopback not allowed", raw: "CONNECT " + origin.Addr.String() + " HTTP/1.1\r\nHost: " + origin.Addr.String() + "\r\n\r\n", want: http.StatusForbidden},
+		{name: "localhost", raw: "CONNECT localhost:" + strings.Split(origin.Addr.String(), ":")[1] + " HTTP/1.1\r\nHost: localhost\r\n\r\n", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := proxyStatus(t, addr, tt.raw); status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+	if received := origin.Received(); len(received) != 0 {
+		t.Errorf("refused origin received %q", received)
+	}
+}
+
+func TestCheckProxyDestination(t *testing.T) {
+	prev := listenAddrs
+	t.Cleanup(func() { listenAddrs = prev })
+
+	listenAddrs = []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 9090},
+		&net.UnixAddr{Name: "/run/toss/admin.sock", Net: "unix"},
+	}
+
+	allowed, err := matcher.New([]string{"127.0.0.1:8000", "10.1.2.3:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		allowed *matcher.Matcher
+		refused bool
+	}{
+		{address: "93.184.216.34:443"},
+		{address: "[2001:db8::1]:443"},
+		{address: "10.1.2.3:9091"},
+		{address: "127.0.0.1:80", refused: true},
+		{address: "127.0.0.2:80", refused: true},
+		{address: "[::1]:80", refused: true},
+		{address: "0.0.0.0:80", refused: true},
+		{address: "[::]:80", refused: true},
+		{address: "169.254.169.254:80", refused: true},
+		{address: "[fe80::1]:80", refused: true},
+		{address: "[fe80::1%eth0]:80", refused: true},
+		{address: "10.1.2.3:9090", refused: true},
+		{address: "127.0.0.1:8000", allowed: allowed},
+		{address: "10.1.2.3:9090", allowed: allowed},
+		{address: "127.0.0.1:8001", allowed: allowed, refused: true},
+	}
+
+	for _, tt := range tests {
+		err := checkProxyDestination(tt.address, tt.allowed)
+		if refused := err != nil; refused != tt.refused {
+			t.Errorf("checkProxyDestination(%s, %d allowed) = %v, want refused %v", tt.address, tt.allowed.Len(), err, tt.refused)
+		}
+	}
+}
+
+func TestIsListenAddrUnspecified(t *testing.T) {
+	hostAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	var hostIP net.IP
+	for _, addr := range hostAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			hostIP = ipNet.IP
+			break
+		}
+	}
+	if hostIP == nil {
+		t.Skip("no routable address on this host")
+	}
+
+	prev := listenAddrs
+	t.Cleanup(func() { listenAddrs = prev })
+	listenAddrs = []net.Addr{&net.TCPAddr{IP: net.IPv4zero, Port: 3129}}
+
+	// a listener on 0.0.0.0 is reached through every address of the host
+	if !isListenAddr(hostIP, 3129) {
+		t.Errorf("%s:3129 is not a listener on 0.0.0.0:3129", hostIP)
+	}
+	if isListenAddr(hostIP, 3130) || isListenAddr(net.ParseIP("93.184.216.34"), 3129) {
+		t.Error("another port or host is a listener")
+	}
+}
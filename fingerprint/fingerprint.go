@@ -0,0 +1,157 @@
+// Package fingerprint computes the JA3 and JA4 fingerprints of TLS ClientHellos and the JA4S
+// fingerprint of ServerHellos, which tell TLS stacks apart, e.g. our app builds from browsers and bots.
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"toss/tls/clienthello"
+)
+
+// JA3String is the fingerprint before hashing:
+// version,ciphers,extensions,groups,point formats with the values in decimal joined by "-".
+func JA3String(h *clienthello.ClientHello) string {
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(withoutGrease(h.CipherSuites)),
+		joinDecimal(withoutGrease(h.Extensions)),
+		joinDecimal(withoutGrease(h.SupportedGroups)),
+		joinDecimal(h.PointFormats),
+	}, ",")
+}
+
+// JA3 is the MD5 of JA3String in hex. Clients randomizing the extension order, e.g. Chrome, get
+// a new JA3 on each connection, JA4 sorts the extensions and stays the same.
+func JA3(h *clienthello.ClientHello) string {
+	sum := md5.Sum([]byte(JA3String(h)))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 is the FoxIO JA4 fingerprint of a ClientHello received over TCP, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1:
+//
+//	t13d1516h2    protocol, highest version, SNI (d) or not (i), cipher and extension counts, first ALPN
+//	8daaf6152771  sorted cipher suites, truncated SHA-256
+//	e5627efa2ab1  sorted extensions without SNI and ALPN, then the signature algorithms, truncated SHA-256
+func JA4(h *clienthello.ClientHello) string {
+	ciphers := withoutGrease(h.CipherSuites)
+	extensions := withoutGrease(h.Extensions)
+
+	sni := "i"
+	if slices.Contains(extensions, clienthello.ExtensionServerName) {
+		sni = "d"
+	}
+
+	alpn := ""
+	if len(h.ALPN) > 0 {
+		alpn = h.ALPN[0]
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionCode(h.MaxVersion()), sni, min(len(ciphers), 99), min(len(extensions), 99), alpnCode(alpn))
+
+	sortedCiphers := slices.Sorted(slices.Values(ciphers))
+
+	var sortedExtensions []uint16
+	for _, ext := range extensions {
+		if ext != clienthello.ExtensionServerName && ext != clienthello.ExtensionALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	slices.Sort(sortedExtensions)
+
+	c := joinHex(sortedExtensions)
+	if algorithms := withoutGrease(h.SignatureAlgorithms); len(algorithms) > 0 {
+		c += "_" + joinHex(algorithms)
+	}
+
+	return a + "_" + truncatedHash(joinHex(sortedCiphers), len(sortedCiphers) == 0) + "_" + truncatedHash(c, len(sortedExtensions) == 0)
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !clienthello.IsGrease(v) {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+// versionCode is the two characters of a protocol version in JA4.
+func versionCode(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+
+	return "00"
+}
+
+// alpnCode is the first and last character of an ALPN protocol, "00" for none. Protocols starting
+// or ending with other than an ASCII letter or digit use the first and last character of their hex.
+func alpnCode(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(alpn))
+		return h[:1] + h[len(h)-1:]
+	}
+
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// truncatedHash is the first 12 hex characters of the SHA-256 of s, all zeros when the list is empty.
+func truncatedHash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func joinDecimal[T uint8 | uint16](values []T) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+
+	return strings.Join(parts, ",")
+}
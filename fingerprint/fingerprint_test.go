@@ -0,0 +1,135 @@
+package fingerprint
+
+import (
+	"testing"
+	"toss/tls/clienthello"
+)
+
+// chromeHello is the ClientHello of the JA4 example of FoxIO, with the GREASE values and the
+// shuffled extension order of Chrome.
+func chromeHello() *clienthello.ClientHello {
+	return &clienthello.ClientHello{
+		Version: 0x0303,
+		CipherSuites: []uint16{
+			0x3a3a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014,
+			0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: []uint16{
+			0x8a8a, 0x001b, 0x0000, 0x0033, 0x0010, 0x4469, 0x0017, 0x002d, 0x000d, 0x0005, 0x0023, 0x0012,
+			0x002b, 0xff01, 0x000b, 0x000a, 0x0015, 0xdada,
+		},
+		ServerNames:         []string{"example.com"},
+		ALPN:                []string{"h2", "http/1.1"},
+		SupportedVersions:   []uint16{0x2a2a, 0x0304, 0x0303},
+		SupportedGroups:     []uint16{0x4a4a, 0x001d, 0x0017, 0x0018},
+		PointFormats:        []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+	}
+}
+
+func TestJA4(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello func(h *clienthello.ClientHello)
+		want  string
+	}{
+		{name: "foxio example", hello: func(*clienthello.ClientHello) {}, want: "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{
+			name: "no sni",
+			hello: func(h *clienthello.ClientHello) {
+				h.Extensions = without(h.Extensions, clienthello.ExtensionServerName)
+				h.ServerNames = nil
+			},
+			want: "t13i1515h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "no alpn",
+			hello: func(h *clienthello.ClientHello) {
+				h.Extensions = without(h.Extensions, clienthello.ExtensionALPN)
+				h.ALPN = nil
+			},
+			want: "t13d151500_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "alpn not alphanumeric",
+			hello: func(h *clienthello.ClientHello) {
+				h.ALPN = []string{"\xabh2"}
+			},
+			want: "t13d1516a2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "tls 1.2",
+			hello: func(h *clienthello.ClientHello) {
+				h.Extensions = without(h.Extensions, clienthello.ExtensionSupportedVersions)
+				h.SupportedVersions = nil
+			},
+			want: "t12d1515h2_8daaf6152771_8d4582d59f63",
+		},
+		{
+			name: "nothing",
+			hello: func(h *clienthello.ClientHello) {
+				*h = clienthello.ClientHello{Version: 0x0301}
+			},
+			want: "t10i000000_000000000000_000000000000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := chromeHello()
+			tt.hello(h)
+
+			if got := JA4(h); got != tt.want {
+				t.Errorf("JA4 = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJA4IgnoresExtensionOrder(t *testing.T) {
+	a, b := chromeHello(), chromeHello()
+	b.Extensions = []uint16{
+		0x0a0a, 0x0015, 0x000a, 0x000b, 0xff01, 0x002b, 0x0012, 0x0023, 0x0005, 0x000d, 0x002d, 0x0017,
+		0x4469, 0x0010, 0x0033, 0x0000, 0x001b,
+	}
+
+	if JA4(a) != JA4(b) {
+		t.Errorf("JA4 %s != %s for the same extensions in another order", JA4(a), JA4(b))
+	}
+	if JA3(a) == JA3(b) {
+		t.Errorf("JA3 %s is the same for extensions in another order", JA3(a))
+	}
+}
+
+func TestJA3(t *testing.T) {
+	// the example of the JA3 README, with GREASE values the fingerprint leaves out
+	h := &clienthello.ClientHello{
+		Version:         769,
+		CipherSuites:    []uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:      []uint16{0, 10, 11, 0x1a1a},
+		SupportedGroups: []uint16{0x2a2a, 23, 24, 25},
+		PointFormats:    []uint8{0},
+	}
+
+	if got, want := JA3String(h), "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"; got != want {
+		t.Errorf("JA3String = %s, want %s", got, want)
+	}
+	if got, want := JA3(h), "ada70206e40642a3e4461f35503241d5"; got != want {
+		t.Errorf("JA3 = %s, want %s", got, want)
+	}
+
+	if got, want := JA3String(&clienthello.ClientHello{Version: 0x0303}), "771,,,,"; got != want {
+		t.Errorf("JA3String of an empty ClientHello = %q, want %q", got, want)
+	}
+}
+
+func without(values []uint16, v uint16) []uint16 {
+	var out []uint16
+	for _, value := range values {
+		if value != v {
+			out = append(out, value)
+		}
+	}
+
+	return out
+}
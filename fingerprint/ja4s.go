@@ -0,0 +1,133 @@
+package fingerprint
+
+import (
+	"errors"
+	"fmt"
+	"toss/tls/clienthello"
+)
+
+// ServerHello holds the fields of a ServerHello the JA4S fingerprint is made of.
+type ServerHello struct {
+	// Version is the legacy version of the message, the one chosen by supported_versions is in SupportedVersion.
+	Version          uint16
+	CipherSuite      uint16
+	Extensions       []uint16
+	SupportedVersion uint16
+	ALPN             string
+}
+
+var errShortServerHello = errors.New("fingerprint: truncated ServerHello")
+
+// ParseServerHello reads the ServerHello at the start of the first TLS record sent by a server.
+func ParseServerHello(record []byte) (*ServerHello, error) {
+	// <1 byte> ContentType, 0x16 Handshake
+	// <2 byte> ProtocolVersion
+	// <2 byte> Record Payload Length
+	if len(record) < 5 {
+		return nil, errShortServerHello
+	}
+	if record[0] != 0x16 {
+		return nil, fmt.Errorf("fingerprint: content type %d is not a handshake", record[0])
+	}
+
+	payload := record[5:]
+	if n := int(record[3])<<8 | int(record[4]); len(payload) > n {
+		payload = payload[:n]
+	}
+
+	// <1 byte> Message Type, 2 ServerHello
+	// <3 byte> Handshake Length
+	if len(payload) < 4 {
+		return nil, errShortServerHello
+	}
+	if payload[0] != 2 {
+		return nil, fmt.Errorf("fingerprint: handshake type %d is not a ServerHello", payload[0])
+	}
+
+	n := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+	hello := payload[4:]
+	if len(hello) < n {
+		return nil, errShortServerHello
+	}
+	hello = hello[:n]
+
+	// < 2 byte> Message Version
+	// <32 byte> Random
+	// < 1 byte> Session ID Length
+	// < n byte> Session ID
+	// < 2 byte> Cipher Suite
+	// < 1 byte> Compression Method
+	// < 2 byte> Extensions Len, absent when there are none
+	if len(hello) < 35 {
+		return nil, errShortServerHello
+	}
+
+	h := &ServerHello{Version: uint16(hello[0])<<8 | uint16(hello[1])}
+
+	sessionIdLen := int(hello[34])
+	hello = hello[35:]
+	if len(hello) < sessionIdLen+3 {
+		return nil, errShortServerHello
+	}
+	hello = hello[sessionIdLen:]
+
+	h.CipherSuite = uint16(hello[0])<<8 | uint16(hello[1])
+	hello = hello[3:]
+
+	if len(hello) < 2 {
+		return h, nil
+	}
+
+	extensionsLen := int(hello[0])<<8 | int(hello[1])
+	extensions := hello[2:]
+	if len(extensions) < extensionsLen {
+		return nil, errShortServerHello
+	}
+	extensions = extensions[:extensionsLen]
+
+	for len(extensions) >= 4 {
+		extType := uint16(extensions[0])<<8 | uint16(extensions[1])
+		extLen := int(extensions[2])<<8 | int(extensions[3])
+		extensions = extensions[4:]
+		if len(extensions) < extLen {
+			return nil, errShortServerHello
+		}
+
+		ext := extensions[:extLen]
+		extensions = extensions[extLen:]
+		h.Extensions = append(h.Extensions, extType)
+
+		switch extType {
+		case clienthello.ExtensionSupportedVersions:
+			// <2 byte> Selected Version
+			if len(ext) >= 2 {
+				h.SupportedVersion = uint16(ext[0])<<8 | uint16(ext[1])
+			}
+		case clienthello.ExtensionALPN:
+			// <2 byte> ProtocolNameList Len
+			// <1 byte> ProtocolName Len
+			// <n byte> ProtocolName, the only one chosen by the server
+			if len(ext) >= 3 && len(ext) >= 3+int(ext[2]) {
+				h.ALPN = string(ext[3 : 3+int(ext[2])])
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// JA4S is the FoxIO JA4S fingerprint of a ServerHello received over TCP, e.g. t130200_1301_234ea6891581:
+//
+//	t130200       protocol, version, extension count, chosen ALPN
+//	1301          chosen cipher suite
+//	234ea6891581  extensions in the order sent, truncated SHA-256
+func JA4S(h *ServerHello) string {
+	version := h.Version
+	if h.SupportedVersion != 0 {
+		version = h.SupportedVersion
+	}
+
+	a := fmt.Sprintf("t%s%02d%s", versionCode(version), min(len(h.Extensions), 99), alpnCode(h.ALPN))
+
+	return fmt.Sprintf("%s_%04x_%s", a, h.CipherSuite, truncatedHash(joinHex(h.Extensions), len(h.Extensions) == 0))
+}
@@ -0,0 +1,149 @@
+package fingerprint
+
+import (
+	"errors"
+	"testing"
+	"toss/tls/clienthello"
+)
+
+type serverHelloExtension struct {
+	typ  uint16
+	data []byte
+}
+
+// serverHelloRecord builds the first record of a server holding a ServerHello.
+func serverHelloRecord(version, cipherSuite uint16, sessionId []byte, extensions ...serverHelloExtension) []byte {
+	hello := []byte{byte(version >> 8), byte(version)}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello, byte(len(sessionId)))
+	hello = append(hello, sessionId...)
+	hello = append(hello, byte(cipherSuite>>8), byte(cipherSuite), 0)
+
+	if extensions != nil {
+		var exts []byte
+		for _, ext := range extensions {
+			exts = append(exts, byte(ext.typ>>8), byte(ext.typ), byte(len(ext.data)>>8), byte(len(ext.data)))
+			exts = append(exts, ext.data...)
+		}
+		hello = append(hello, byte(len(exts)>>8), byte(len(exts)))
+		hello = append(hello, exts...)
+	}
+
+	handshake := append([]byte{2, byte(len(hello) >> 16), byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	return append([]byte{0x16, 0x03, 0x03, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+}
+
+var (
+	tls13Extensions = []serverHelloExtension{
+		{typ: clienthello.ExtensionKeyShare, data: append([]byte{0x00, 0x1d, 0x00, 0x20}, make([]byte, 32)...)},
+		{typ: clienthello.ExtensionSupportedVersions, data: []byte{0x03, 0x04}},
+	}
+	alpnH2 = serverHelloExtension{typ: clienthello.ExtensionALPN, data: []byte{0x00, 0x03, 0x02, 'h', '2'}}
+)
+
+func TestJA4S(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []byte
+		want   string
+	}{
+		{
+			// the JA4S example of FoxIO
+			name:   "tls 1.3",
+			record: serverHelloRecord(0x0303, 0x1301, make([]byte, 32), tls13Extensions...),
+			want:   "t130200_1301_234ea6891581",
+		},
+		{
+			name:   "tls 1.3 h2",
+			record: serverHelloRecord(0x0303, 0x1301, make([]byte, 32), append(tls13Extensions, alpnH2)...),
+			want:   "t1303h2_1301_9da7bb554a8c",
+		},
+		{
+			name:   "tls 1.2 without extensions",
+			record: serverHelloRecord(0x0303, 0xc02f, nil),
+			want:   "t120000_c02f_000000000000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseServerHello(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := JA4S(h); got != tt.want {
+				t.Errorf("JA4S = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	h, err := ParseServerHello(serverHelloRecord(0x0303, 0x1302, []byte{1, 2, 3}, append(tls13Extensions, alpnH2)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Version != 0x0303 || h.SupportedVersion != 0x0304 || h.CipherSuite != 0x1302 || h.ALPN != "h2" {
+		t.Errorf("ServerHello %+v", h)
+	}
+	if want := []uint16{0x0033, 0x002b, 0x0010}; len(h.Extensions) != 3 || h.Extensions[0] != want[0] || h.Extensions[1] != want[1] || h.Extensions[2] != want[2] {
+		t.Errorf("extensions %04x, want %04x", h.Extensions, want)
+	}
+
+	// the record may hold more handshake messages after the ServerHello
+	record := serverHelloRecord(0x0303, 0x1301, nil, tls13Extensions...)
+	record = append(record, 0x0b, 0x00, 0x00, 0x00)
+	record[3], record[4] = byte((len(record)-5)>>8), byte(len(record)-5)
+	if h, err := ParseServerHello(record); err != nil || JA4S(h) != "t130200_1301_234ea6891581" {
+		t.Errorf("ServerHello followed by another message: %v", err)
+	}
+}
+
+func TestParseServerHelloInvalid(t *testing.T) {
+	record := serverHelloRecord(0x0303, 0x1301, make([]byte, 32), append(tls13Extensions, alpnH2)...)
+
+	// every prefix of a ServerHello is truncated, the one ending right before the extensions length
+	// reads as a ServerHello without extensions
+	withoutExtensions := 5 + 4 + 2 + 32 + 1 + 32 + 3
+	for n := range len(record) {
+		h, err := ParseServerHello(record[:n])
+		if n == withoutExtensions && err == nil {
+			continue
+		}
+		if h != nil || err == nil {
+			t.Errorf("%d bytes: parsed %+v, %v", n, h, err)
+		}
+	}
+
+	// a truncated record of which the header still claims the full length
+	if _, err := ParseServerHello(append(record[:5:5], record[5:40]...)); !errors.Is(err, errShortServerHello) {
+		t.Errorf("record shorter than its length: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		record []byte
+	}{
+		{name: "not a handshake", record: []byte{0x17, 0x03, 0x03, 0x00, 0x04, 2, 0, 0, 0}},
+		{name: "not a ServerHello", record: []byte{0x16, 0x03, 0x03, 0x00, 0x04, 1, 0, 0, 0}},
+		{name: "record shorter than the message", record: func() []byte {
+			r := serverHelloRecord(0x0303, 0x1301, nil, tls13Extensions...)
+			r[3], r[4] = 0, 20
+			return r
+		}()},
+		{name: "extension longer than the extensions", record: func() []byte {
+			r := serverHelloRecord(0x0303, 0x1301, nil, tls13Extensions...)
+			r[len(r)-3] = 0xff
+			return r
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if h, err := ParseServerHello(tt.record); err == nil {
+				t.Errorf("parsed %+v", h)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"toss/tunnel"
+	"unicode/utf8"
+)
+
+// Exchange is what a handler observed for one request.
+type Exchange struct {
+	Tunnel *tunnel.Tunnel
+
+	Request *http.Request
+	// RequestBody holds the first bytes of the request body, RequestBodySize counts all of them.
+	RequestBody     []byte
+	RequestBodySize int64
+
+	// Response is nil when the origin did not answer, Err tells why.
+	Response         *http.Response
+	ResponseBody     []byte
+	ResponseBodySize int64
+	Err              error
+
+	// Start is when the request was read from the client, Sent when it was written to the origin,
+	// Headers when the response headers arrived and End when the response body was relayed.
+	Start   time.Time
+	Sent    time.Time
+	Headers time.Time
+	End     time.Time
+}
+
+// newEntry builds the entry of x, gzip bodies are decoded up to bodySize bytes.
+func newEntry(x *Exchange, bodySize int) *Entry {
+	info := x.Tunnel.Info()
+	req := x.Request
+
+	scheme := "http"
+	if info.TLS != nil {
+		scheme = "https"
+	}
+
+	entry := &Entry{
+		StartedDateTime: x.Start,
+		Time:            millis(x.End.Sub(x.Start)),
+		Request: Request{
+			Method:      req.Method,
+			URL:         fmt.Sprintf("%s://%s%s", scheme, req.Host, req.URL.RequestURI()),
+			HTTPVersion: req.Proto,
+			Cookies:     requestCookies(req),
+			Headers:     requestHeaders(req, scheme),
+			QueryString: queryString(req),
+			PostData:    postData(req, x.RequestBody, x.RequestBodySize),
+			HeadersSize: -1,
+			BodySize:    x.RequestBodySize,
+		},
+		Timings: Timings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			Send:    millis(x.Sent.Sub(x.Start)),
+			Wait:    millis(x.Headers.Sub(x.Sent)),
+			Receive: millis(x.End.Sub(x.Headers)),
+			SSL:     -1,
+		},
+		Connection:    x.Tunnel.ID(),
+		ClientAddress: x.Tunnel.Src.String(),
+		TLS:           tlsDetails(info),
+	}
+
+	if dst, ok := x.Tunnel.Dst.(*net.TCPAddr); ok {
+		entry.ServerIPAddress = dst.IP.String()
+	}
+
+	res := x.Response
+	if res == nil {
+		entry.Response = Response{
+			HTTPVersion: req.Proto,
+			Cookies:     []Cookie{},
+			Headers:     []NameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		if x.Err != nil {
+			entry.Response.Error = x.Err.Error()
+		}
+		entry.Timings.Wait = millis(x.End.Sub(x.Sent))
+		entry.Timings.Receive = 0
+
+		return entry
+	}
+
+	entry.Response = Response{
+		Status:      res.StatusCode,
+		StatusText:  http.StatusText(res.StatusCode),
+		HTTPVersion: res.Proto,
+		Cookies:     responseCookies(res),
+		Headers:     nameValues(res.Header),
+		Content:     content(res, x.ResponseBody, x.ResponseBodySize, bodySize),
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    x.ResponseBodySize,
+	}
+
+	return entry
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func requestHeaders(req *http.Request, scheme string) []NameValue {
+	var pseudo []NameValue
+	if req.ProtoMajor == 2 {
+		pseudo = []NameValue{
+			{Name: ":method", Value: req.Method},
+			{Name: ":authority", Value: req.Host},
+			{Name: ":scheme", Value: scheme},
+			{Name: ":path", Value: req.URL.RequestURI()},
+		}
+	} else {
+		pseudo = []NameValue{{Name: "Host", Value: req.Host}}
+	}
+
+	return append(pseudo, nameValues(req.Header)...)
+}
+
+func nameValues(header http.Header) []NameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	list := make([]NameValue, 0, len(header))
+	for _, name := range names {
+		for _, value := range header[name] {
+			list = append(list, NameValue{Name: name, Value: value})
+		}
+	}
+
+	return list
+}
+
+func queryString(req *http.Request) []NameValue {
+	list := []NameValue{}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			list = append(list, NameValue{Name: name, Value: value})
+		}
+	}
+
+	slices.SortStableFunc(list, func(a, b NameValue) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+func requestCookies(req *http.Request) []Cookie {
+	cookies := []Cookie{}
+	for _, c := range req.Cookies() {
+		cookies = append(cookies, Cookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
+
+func responseCookies(res *http.Response) []Cookie {
+	cookies := []Cookie{}
+	for _, c := range res.Cookies() {
+		cookies = append(cookies, Cookie{Name: c.Name, Value: c.Value})
+	}
+	return cookies
+}
+
+func postData(req *http.Request, body []byte, size int64) *PostData {
+	if size == 0 {
+		return nil
+	}
+
+	text, encoding := encodeBody(body)
+
+	return &PostData{
+		MimeType: req.Header.Get("Content-Type"),
+		Text:     text,
+		Encoding: encoding,
+		Comment:  truncatedComment(len(body), size),
+	}
+}
+
+func content(res *http.Response, body []byte, size int64, bodySize int) Content {
+	c := Content{
+		Size:     size,
+		MimeType: res.Header.Get("Content-Type"),
+	}
+	if c.MimeType == "" {
+		c.MimeType = "x-unknown"
+	}
+
+	truncated := int64(len(body)) < size
+
+	switch encoding := res.Header.Get("Content-Encoding"); {
+	case encoding == "":
+	case encoding == "gzip" && !truncated:
+		decoded, err := gunzip(body, bodySize)
+		switch {
+		case errors.Is(err, errDecodedTooLarge):
+			c.Comment = fmt.Sprintf("gzip encoded body, decoded body truncated: more than %d bytes", bodySize)
+		case err == nil:
+			c.Size = int64(len(decoded))
+			c.Compression = c.Size - size
+			body = decoded
+		}
+	default:
+		c.Comment = fmt.Sprintf("%s encoded body", encoding)
+	}
+
+	c.Text, c.Encoding = encodeBody(body)
+	if truncated {
+		c.Comment = strings.TrimPrefix(c.Comment+", "+truncatedComment(len(body), size), ", ")
+	}
+
+	return c
+}
+
+// encodeBody returns text bodies as they are and everything else base64 encoded.
+func encodeBody(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func truncatedComment(captured int, size int64) string {
+	if int64(captured) >= size {
+		return ""
+	}
+
+	return fmt.Sprintf("body truncated to %d of %d bytes", captured, size)
+}
+
+var errDecodedTooLarge = errors.New("decoded body too large")
+
+// gunzip decodes body, up to limit bytes so that a small body of a hostile origin can not
+// expand in memory.
+func gunzip(body []byte, limit int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > limit {
+		return nil, errDecodedTooLarge
+	}
+
+	return decoded, nil
+}
+
+func tlsDetails(tunnelInfo tunnel.Info) *TLS {
+	info := tunnelInfo.TLS
+	if info == nil {
+		return nil
+	}
+
+	return &TLS{
+		ServerName: info.ServerName,
+		ALPN:       info.ALPN,
+
+		ClientVersion:     tls.VersionName(info.Downstream.Version),
+		ClientCipherSuite: tls.CipherSuiteName(info.Downstream.CipherSuite),
+		ClientHandshake:   millis(info.Downstream.Handshake),
+
+		UpstreamVersion:     tls.VersionName(info.Upstream.Version),
+		UpstreamCipherSuite: tls.CipherSuiteName(info.Upstream.CipherSuite),
+		UpstreamHandshake:   millis(info.Upstream.Handshake),
+
+		JA3:  tunnelInfo.JA3,
+		JA4:  tunnelInfo.JA4,
+		JA4S: info.JA4S,
+	}
+}
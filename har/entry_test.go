@@ -0,0 +1,240 @@
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"toss/tunnel"
+)
+
+func newTestTunnel(src string) *tunnel.Tunnel {
+	srcAddr, _ := net.ResolveTCPAddr("tcp", src)
+	dstAddr := &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 443}
+
+	return tunnel.NewTunnel(context.Background(), srcAddr, dstAddr, nil, nil)
+}
+
+func newTestExchange(tun *tunnel.Tunnel) *Exchange {
+	start := time.Date(2025, 10, 3, 12, 0, 0, 0, time.UTC)
+
+	req := &http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: "/api", RawQuery: "b=2&a=1"},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		Host:       "example.com",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+			"Cookie":       {"session=abc"},
+		},
+	}
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		Header: http.Header{
+			"Content-Type": {"text/plain"},
+			"Set-Cookie":   {"token=xyz; Path=/"},
+		},
+	}
+
+	return &Exchange{
+		Tunnel:           tun,
+		Request:          req,
+		RequestBody:      []byte(`{"q":1}`),
+		RequestBodySize:  7,
+		Response:         res,
+		ResponseBody:     []byte("hello"),
+		ResponseBodySize: 5,
+		Start:            start,
+		Sent:             start.Add(time.Millisecond),
+		Headers:          start.Add(11 * time.Millisecond),
+		End:              start.Add(12500 * time.Microsecond),
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNewEntry(t *testing.T) {
+	tun := newTestTunnel("10.0.0.2:50000")
+	entry := newEntry(newTestExchange(tun), 1024)
+
+	req := entry.Request
+	if req.URL != "http://example.com/api?b=2&a=1" || req.Method != http.MethodPost || req.BodySize != 7 {
+		t.Errorf("request %s %s, body size %d", req.Method, req.URL, req.BodySize)
+	}
+	if len(req.Headers) == 0 || req.Headers[0] != (NameValue{Name: "Host", Value: "example.com"}) {
+		t.Errorf("request headers %v", req.Headers)
+	}
+	if len(req.QueryString) != 2 || req.QueryString[0].Name != "a" || req.QueryString[1].Name != "b" {
+		t.Errorf("query string %v", req.QueryString)
+	}
+	if len(req.Cookies) != 1 || req.Cookies[0] != (Cookie{Name: "session", Value: "abc"}) {
+		t.Errorf("request cookies %v", req.Cookies)
+	}
+	if req.PostData == nil || req.PostData.Text != `{"q":1}` || req.PostData.MimeType != "application/json" || req.PostData.Comment != "" {
+		t.Errorf("post data %+v", req.PostData)
+	}
+
+	res := entry.Response
+	if res.Status != http.StatusOK || res.StatusText != "OK" || res.Content.Text != "hello" || res.Content.Size != 5 {
+		t.Errorf("response %d %s, content %+v", res.Status, res.StatusText, res.Content)
+	}
+	if len(res.Cookies) != 1 || res.Cookies[0] != (Cookie{Name: "token", Value: "xyz"}) {
+		t.Errorf("response cookies %v", res.Cookies)
+	}
+
+	want := Timings{Blocked: -1, DNS: -1, Connect: -1, Send: 1, Wait: 10, Receive: 1.5, SSL: -1}
+	if entry.Timings != want || entry.Time != 12.5 {
+		t.Errorf("timings %+v, time %v", entry.Timings, entry.Time)
+	}
+
+	if entry.Connection != tun.ID() || entry.ClientAddress != "10.0.0.2:50000" || entry.ServerIPAddress != "93.184.216.34" {
+		t.Errorf("connection %q, client %q, server %q", entry.Connection, entry.ClientAddress, entry.ServerIPAddress)
+	}
+	if entry.TLS != nil {
+		t.Errorf("tls %+v for a plain tunnel", entry.TLS)
+	}
+}
+
+func TestNewEntryTLS(t *testing.T) {
+	tun := newTestTunnel("10.0.0.2:50000")
+	tun.UpdateInfo(func(info *tunnel.Info) {
+		info.JA4 = "t13d1516h2_8daaf6152771_e5627efa2ab1"
+		info.TLS = &tunnel.TLSInfo{
+			ServerName: "example.com",
+			ALPN:       "h2",
+			JA4S:       "t130200_1301_234ea6891581",
+			Downstream: tunnel.TLSLeg{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, Handshake: 2 * time.Millisecond},
+			Upstream:   tunnel.TLSLeg{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, Handshake: 30 * time.Millisecond},
+		}
+	})
+
+	x := newTestExchange(tun)
+	x.Request.Proto, x.Request.ProtoMajor = "HTTP/2.0", 2
+	entry := newEntry(x, 1024)
+
+	if !strings.HasPrefix(entry.Request.URL, "https://") {
+		t.Errorf("url %s", entry.Request.URL)
+	}
+	if len(entry.Request.Headers) < 4 || entry.Request.Headers[0].Name != ":method" || entry.Request.Headers[2] != (NameValue{Name: ":scheme", Value: "https"}) {
+		t.Errorf("h2 headers %v", entry.Request.Headers)
+	}
+
+	got := entry.TLS
+	if got == nil || got.ClientVersion != "TLS 1.3" || got.UpstreamVersion != "TLS 1.2" || got.ClientHandshake != 2 || got.UpstreamHandshake != 30 ||
+		got.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" || got.JA4S != "t130200_1301_234ea6891581" || got.ALPN != "h2" {
+		t.Errorf("tls %+v", got)
+	}
+}
+
+func TestNewEntryNoResponse(t *testing.T) {
+	x := newTestExchange(newTestTunnel("10.0.0.2:50000"))
+	x.Response = nil
+	x.Err = errors.New("connection reset by peer")
+
+	entry := newEntry(x, 1024)
+	if entry.Response.Status != 0 || entry.Response.Error != "connection reset by peer" || entry.Response.BodySize != -1 {
+		t.Errorf("response %+v", entry.Response)
+	}
+	if entry.Timings.Wait != 11.5 || entry.Timings.Receive != 0 {
+		t.Errorf("timings %+v", entry.Timings)
+	}
+}
+
+func TestContent(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 4096)
+	largeGzip := gzipped(t, large)
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name         string
+		encoding     string
+		body         []byte
+		size         int64
+		bodySize     int
+		wantText     string
+		wantEncoding string
+		wantSize     int64
+		wantComment  string
+	}{
+		{name: "text", body: []byte("hello"), size: 5, bodySize: 1024, wantText: "hello", wantSize: 5},
+		{name: "binary", body: binary, size: 4, bodySize: 1024, wantText: b64(binary), wantEncoding: "base64", wantSize: 4},
+		{name: "truncated", body: []byte("hel"), size: 5, bodySize: 3, wantText: "hel", wantSize: 5, wantComment: "body truncated to 3 of 5 bytes"},
+		{name: "not recorded", body: nil, size: 5, bodySize: 0, wantSize: 5, wantComment: "body truncated to 0 of 5 bytes"},
+		{name: "gzip", encoding: "gzip", body: gzipped(t, []byte("hello gzip")), bodySize: 1024, wantText: "hello gzip", wantSize: 10},
+		{
+			name: "gzip decoded larger than the body size", encoding: "gzip", body: largeGzip, bodySize: 1024,
+			wantText: b64(largeGzip), wantEncoding: "base64", wantSize: int64(len(largeGzip)),
+			wantComment: "gzip encoded body, decoded body truncated: more than 1024 bytes",
+		},
+		{name: "gzip decoded as large as the body size", encoding: "gzip", body: largeGzip, bodySize: 4096, wantText: string(large), wantSize: 4096},
+		{
+			name: "gzip truncated", encoding: "gzip", body: []byte("\x1f\x8b"), size: 100, bodySize: 2,
+			wantText: b64([]byte("\x1f\x8b")), wantEncoding: "base64", wantSize: 100, wantComment: "gzip encoded body, body truncated to 2 of 100 bytes",
+		},
+		{name: "brotli", encoding: "br", body: binary, size: 4, bodySize: 1024, wantText: b64(binary), wantEncoding: "base64", wantSize: 4, wantComment: "br encoded body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = int64(len(tt.body))
+			}
+
+			res := &http.Response{Header: http.Header{}}
+			if tt.encoding != "" {
+				res.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			c := content(res, tt.body, size, tt.bodySize)
+			if c.Text != tt.wantText || c.Encoding != tt.wantEncoding || c.Size != tt.wantSize || c.Comment != tt.wantComment {
+				t.Errorf("content text %.40q (%d bytes), encoding %q, size %d, comment %q", c.Text, len(c.Text), c.Encoding, c.Size, c.Comment)
+			}
+			if c.MimeType != "x-unknown" {
+				t.Errorf("mime type %q", c.MimeType)
+			}
+		})
+	}
+}
+
+func TestGunzipLimit(t *testing.T) {
+	// 1 MiB of zeroes is about 1 KiB of gzip
+	bomb := gzipped(t, make([]byte, 1<<20))
+
+	if _, err := gunzip(bomb, 64<<10); !errors.Is(err, errDecodedTooLarge) {
+		t.Errorf("gunzip over the limit: %v, want errDecodedTooLarge", err)
+	}
+
+	decoded, err := gunzip(bomb, 1<<20)
+	if err != nil || len(decoded) != 1<<20 {
+		t.Errorf("gunzip at the limit: %d bytes, %v", len(decoded), err)
+	}
+
+	if _, err := gunzip([]byte("not gzip"), 1024); err == nil {
+		t.Error("gunzip of garbage succeeded")
+	}
+}
@@ -0,0 +1,110 @@
+// Package har records intercepted HTTP exchanges as HTTP Archive 1.2 files,
+// see http://www.softwareishard.com/blog/har-12-spec/.
+package har
+
+import "time"
+
+// Entry is one request/response pair. Fields starting with an underscore are custom HAR fields.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is the total time of the exchange in milliseconds.
+	Time     float64  `json:"time"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+	Cache    struct{} `json:"cache"`
+	Timings  Timings  `json:"timings"`
+
+	ServerIPAddress string `json:"serverIPAddress,omitempty"`
+	// Connection is the tunnel id, shared by every exchange of a tunnel.
+	Connection string `json:"connection,omitempty"`
+
+	ClientAddress string `json:"_clientAddress,omitempty"`
+	TLS           *TLS   `json:"_tls,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+
+	// Error is set when the origin did not answer, Status is then 0.
+	Error string `json:"_error,omitempty"`
+}
+
+type Cookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// Encoding is "base64" for bodies that are not valid UTF-8.
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Content struct {
+	// Size is the length of the decoded body.
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// Timings are in milliseconds, -1 when not applicable.
+// The proxy keeps its connections open, so blocked, dns, connect and ssl are always -1,
+// the handshake times are in TLS instead.
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// TLS describes both legs of the intercepted TLS connection.
+type TLS struct {
+	ServerName string `json:"serverName,omitempty"`
+	ALPN       string `json:"alpn,omitempty"`
+
+	ClientVersion     string  `json:"clientVersion"`
+	ClientCipherSuite string  `json:"clientCipherSuite"`
+	ClientHandshake   float64 `json:"clientHandshake"`
+
+	UpstreamVersion     string  `json:"upstreamVersion"`
+	UpstreamCipherSuite string  `json:"upstreamCipherSuite"`
+	UpstreamHandshake   float64 `json:"upstreamHandshake"`
+
+	// fingerprints of the client ClientHello and of the origin ServerHello
+	JA3  string `json:"ja3,omitempty"`
+	JA4  string `json:"ja4,omitempty"`
+	JA4S string `json:"ja4s,omitempty"`
+}
@@ -0,0 +1,274 @@
+package har
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+	"toss/tunnel"
+)
+
+const (
+	GroupByTunnel = "tunnel"
+	GroupByClient = "client"
+	GroupByWindow = "window"
+)
+
+// janitorInterval is how often files of finished groups are closed.
+const janitorInterval = 5 * time.Second
+
+type Options struct {
+	// Dir is where the .har files are written.
+	Dir string
+	// GroupBy is one of the GroupBy* constants.
+	GroupBy string
+	// Window is the length of a file for GroupByWindow, and for GroupByClient
+	// how long a client may be idle before its file is closed.
+	Window time.Duration
+	// BodySize is how many bytes of each request and response body are recorded.
+	BodySize int
+}
+
+// Recorder appends entries to one HAR file per group. A file is a valid HAR document
+// once closed: at the end of its tunnel, window or client idle time, or on Close.
+//
+// A nil *Recorder records nothing.
+type Recorder struct {
+	logger *slog.Logger
+	opts   Options
+
+	mu     sync.Mutex
+	files  map[string]*file
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type file struct {
+	f       *os.File
+	entries int
+	// expires is when the file is closed by the janitor, zero for tunnel files.
+	expires time.Time
+}
+
+func NewRecorder(logger *slog.Logger, opts Options) (*Recorder, error) {
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		logger: logger.With("context", "HarRecorder"),
+		opts:   opts,
+		files:  make(map[string]*file),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go r.janitor()
+
+	return r, nil
+}
+
+// BodySize is the number of body bytes the handlers should capture for the recorder.
+func (r *Recorder) BodySize() int {
+	if r == nil {
+		return 0
+	}
+
+	return r.opts.BodySize
+}
+
+// Record appends the exchange to the file of its group.
+func (r *Recorder) Record(x *Exchange) {
+	if r == nil {
+		return
+	}
+
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("    ", "  ")
+	if err := encoder.Encode(newEntry(x, r.opts.BodySize)); err != nil {
+		r.logger.Error("marshal entry", slog.Any("error", err))
+		return
+	}
+
+	key, name, expires := r.group(x.Tunnel, time.Now())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	f, ok := r.files[key]
+	if !ok {
+		var err error
+		if f, err = r.create(name); err != nil {
+			r.logger.Error("create har file", "name", name, slog.Any("error", err))
+			return
+		}
+		r.files[key] = f
+	}
+
+	if r.opts.GroupBy == GroupByClient {
+		f.expires = expires
+	} else if f.expires.IsZero() {
+		f.expires = expires
+	}
+
+	separator := "\n    "
+	if f.entries > 0 {
+		separator = ",\n    "
+	}
+
+	if _, err := f.f.Write(append([]byte(separator), bytes.TrimSuffix(data.Bytes(), []byte("\n"))...)); err != nil {
+		r.logger.Error("write har entry", "name", f.f.Name(), slog.Any("error", err))
+		return
+	}
+	f.entries++
+}
+
+// CloseTunnel finishes the file of the tunnel when grouping by tunnel.
+func (r *Recorder) CloseTunnel(tun *tunnel.Tunnel) {
+	if r == nil || r.opts.GroupBy != GroupByTunnel {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closeFile(GroupByTunnel + "/" + tun.ID())
+}
+
+// Close finishes every open file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	for key := range r.files {
+		r.closeFile(key)
+	}
+	r.mu.Unlock()
+
+	close(r.stop)
+	<-r.done
+
+	return nil
+}
+
+// group returns the key and file name of the group an exchange recorded now belongs to, and when the group ends.
+// Exchanges are grouped by when they finished, so that a closed file is never reopened.
+func (r *Recorder) group(tun *tunnel.Tunnel, now time.Time) (key, name string, expires time.Time) {
+	switch r.opts.GroupBy {
+	case GroupByClient:
+		client := tun.Src.String()
+		if src, ok := tun.Src.(*net.TCPAddr); ok {
+			client = src.IP.String()
+		}
+		// a new file is started each time the client comes back after being idle
+		name = fmt.Sprintf("%s-client-%s.har", timestamp(now), strings.ReplaceAll(client, ":", "_"))
+		return GroupByClient + "/" + client, name, now.Add(r.opts.Window)
+
+	case GroupByWindow:
+		windowStart := now.Truncate(r.opts.Window)
+		name = fmt.Sprintf("%s-window.har", timestamp(windowStart))
+		return GroupByWindow + "/" + timestamp(windowStart), name, windowStart.Add(r.opts.Window)
+	}
+
+	name = fmt.Sprintf("%s-tunnel-%s.har", timestamp(tun.CreatedAt()), tun.ID())
+	return GroupByTunnel + "/" + tun.ID(), name, time.Time{}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func (r *Recorder) create(name string) (*file, error) {
+	f, err := os.OpenFile(filepath.Join(r.opts.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	creator, _ := json.Marshal(map[string]string{"name": "toss", "version": version()})
+	header := fmt.Sprintf(`{"log": {"version": "1.2", "creator": %s, "pages": [], "entries": [`, creator)
+
+	if _, err := f.WriteString(header); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &file{f: f}, nil
+}
+
+// closeFile terminates the entries array and closes the file, r.mu must be held.
+func (r *Recorder) closeFile(key string) {
+	f, ok := r.files[key]
+	if !ok {
+		return
+	}
+	delete(r.files, key)
+
+	_, err := f.f.WriteString("\n  ]}}\n")
+	if closeErr := f.f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		r.logger.Error("close har file", "name", f.f.Name(), slog.Any("error", err))
+		return
+	}
+	r.logger.Debug("har file written", "name", f.f.Name(), "entries", f.entries)
+}
+
+func (r *Recorder) janitor() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.closeExpired(now)
+		}
+	}
+}
+
+// closeExpired finishes the files of the windows and idle clients that ended before now.
+func (r *Recorder) closeExpired(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, f := range r.files {
+		if !f.expires.IsZero() && now.After(f.expires) {
+			r.closeFile(key)
+		}
+	}
+}
+
+func version() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,211 @@
+package har
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"toss/tunnel"
+)
+
+func newTestRecorder(t *testing.T, groupBy string, window time.Duration) *Recorder {
+	t.Helper()
+
+	r, err := NewRecorder(slog.New(slog.DiscardHandler), Options{
+		Dir:      t.TempDir(),
+		GroupBy:  groupBy,
+		Window:   window,
+		BodySize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+
+	return r
+}
+
+// readHars returns the entries of each closed file of r, by file name.
+func readHars(t *testing.T, r *Recorder) map[string][]Entry {
+	t.Helper()
+
+	names, err := filepath.Glob(filepath.Join(r.opts.Dir, "*.har"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hars := make(map[string][]Entry)
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var doc struct {
+			Log struct {
+				Version string  `json:"version"`
+				Entries []Entry `json:"entries"`
+			} `json:"log"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatalf("%s is not valid json: %v", filepath.Base(name), err)
+		}
+		if doc.Log.Version != "1.2" {
+			t.Errorf("%s version %q", filepath.Base(name), doc.Log.Version)
+		}
+
+		hars[filepath.Base(name)] = doc.Log.Entries
+	}
+
+	return hars
+}
+
+func TestRecorderGroupByTunnel(t *testing.T) {
+	r := newTestRecorder(t, GroupByTunnel, 0)
+	first, second := newTestTunnel("10.0.0.2:50000"), newTestTunnel("10.0.0.2:50001")
+
+	r.Record(newTestExchange(first))
+	r.Record(newTestExchange(second))
+	r.Record(newTestExchange(first))
+
+	r.CloseTunnel(first)
+	if n := len(r.files); n != 1 {
+		t.Errorf("%d files open after closing the first tunnel, want 1", n)
+	}
+	r.CloseTunnel(second)
+
+	hars := readHars(t, r)
+	if len(hars) != 2 {
+		t.Fatalf("%d files, want 2", len(hars))
+	}
+	for name, entries := range hars {
+		switch {
+		case strings.HasSuffix(name, "-tunnel-"+first.ID()+".har"):
+			if len(entries) != 2 || entries[0].Connection != first.ID() {
+				t.Errorf("first tunnel file has %d entries", len(entries))
+			}
+		case strings.HasSuffix(name, "-tunnel-"+second.ID()+".har"):
+			if len(entries) != 1 || entries[0].Connection != second.ID() {
+				t.Errorf("second tunnel file has %d entries", len(entries))
+			}
+		default:
+			t.Errorf("unexpected file %s", name)
+		}
+	}
+}
+
+func TestRecorderGroupByClient(t *testing.T) {
+	r := newTestRecorder(t, GroupByClient, time.Minute)
+
+	r.Record(newTestExchange(newTestTunnel("10.0.0.2:50000")))
+	r.Record(newTestExchange(newTestTunnel("10.0.0.2:50001")))
+	r.Record(newTestExchange(newTestTunnel("[fd00::3]:50000")))
+
+	// a client file is kept open while the client is active, even when its tunnel is done
+	r.CloseTunnel(newTestTunnel("10.0.0.2:50000"))
+	r.closeExpired(time.Now())
+	if n := len(r.files); n != 2 {
+		t.Fatalf("%d files open, want 2", n)
+	}
+
+	r.closeExpired(time.Now().Add(2 * time.Minute))
+	if n := len(r.files); n != 0 {
+		t.Fatalf("%d files open after the clients were idle, want 0", n)
+	}
+
+	hars := readHars(t, r)
+	if len(hars) != 2 {
+		t.Fatalf("%d files, want 2", len(hars))
+	}
+	for name, entries := range hars {
+		switch {
+		case strings.HasSuffix(name, "-client-10.0.0.2.har"):
+			if len(entries) != 2 {
+				t.Errorf("%s has %d entries, want 2", name, len(entries))
+			}
+		case strings.HasSuffix(name, "-client-fd00__3.har"):
+			if len(entries) != 1 {
+				t.Errorf("%s has %d entries, want 1", name, len(entries))
+			}
+		default:
+			t.Errorf("unexpected file %s", name)
+		}
+	}
+}
+
+func TestRecorderGroupByWindow(t *testing.T) {
+	r := newTestRecorder(t, GroupByWindow, time.Hour)
+
+	r.Record(newTestExchange(newTestTunnel("10.0.0.2:50000")))
+	r.Record(newTestExchange(newTestTunnel("10.0.0.3:50000")))
+
+	r.closeExpired(time.Now().Add(2 * time.Hour))
+	if n := len(r.files); n != 0 {
+		t.Fatalf("%d files open after the window ended, want 0", n)
+	}
+
+	hars := readHars(t, r)
+	if len(hars) != 1 {
+		t.Fatalf("%d files, want 1", len(hars))
+	}
+	for name, entries := range hars {
+		if !strings.HasSuffix(name, "-window.har") || len(entries) != 2 {
+			t.Errorf("%s has %d entries, want 2", name, len(entries))
+		}
+	}
+}
+
+func TestRecorderGroup(t *testing.T) {
+	now := time.Date(2025, 10, 3, 12, 34, 56, 0, time.UTC)
+	tun := newTestTunnel("10.0.0.2:50000")
+
+	tests := []struct {
+		groupBy     string
+		window      time.Duration
+		now         time.Time
+		wantKey     string
+		wantName    string
+		wantExpires time.Time
+	}{
+		{
+			groupBy: GroupByClient, window: 5 * time.Minute, now: now,
+			wantKey: "client/10.0.0.2", wantName: "20251003T123456Z-client-10.0.0.2.har", wantExpires: now.Add(5 * time.Minute),
+		},
+		{
+			groupBy: GroupByWindow, window: time.Hour, now: now,
+			wantKey: "window/20251003T120000Z", wantName: "20251003T120000Z-window.har", wantExpires: now.Truncate(time.Hour).Add(time.Hour),
+		},
+		{
+			groupBy: GroupByWindow, window: time.Hour, now: now.Add(30 * time.Minute),
+			wantKey: "window/20251003T130000Z", wantName: "20251003T130000Z-window.har", wantExpires: now.Truncate(time.Hour).Add(2 * time.Hour),
+		},
+		{
+			groupBy: GroupByTunnel, now: now,
+			wantKey: "tunnel/" + tun.ID(), wantName: timestamp(tun.CreatedAt()) + "-tunnel-" + tun.ID() + ".har",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.groupBy, func(t *testing.T) {
+			r := &Recorder{opts: Options{GroupBy: tt.groupBy, Window: tt.window}}
+
+			key, name, expires := r.group(tun, tt.now)
+			if key != tt.wantKey || name != tt.wantName || !expires.Equal(tt.wantExpires) {
+				t.Errorf("group = %q, %q, %v, want %q, %q, %v", key, name, expires, tt.wantKey, tt.wantName, tt.wantExpires)
+			}
+		})
+	}
+}
+
+func TestRecorderNil(t *testing.T) {
+	var r *Recorder
+
+	r.Record(newTestExchange(newTestTunnel("10.0.0.2:50000")))
+	r.CloseTunnel(&tunnel.Tunnel{})
+	if r.BodySize() != 0 || r.Close() != nil {
+		t.Error("nil Recorder is not a no-op")
+	}
+}
@@ -0,0 +1,176 @@
+// Package keylog writes the TLS secrets of intercepted tunnels to an NSS key log file,
+// the SSLKEYLOGFILE format read by Wireshark.
+package keylog
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"toss/tunnel"
+)
+
+type Options struct {
+	// Path is the key log file, rotated files get a ".1", ".2", ... suffix.
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated, 0 never rotates.
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept.
+	MaxFiles int
+}
+
+// File is a key log file shared by all tunnels.
+//
+// Before the first secret of each tunnel leg a comment line tells which tunnel and leg
+// the following secrets belong to, e.g.
+//
+//	# 2025-10-03T09:00:00Z tunnel=d1c2... leg=upstream src=10.0.0.2:51234 dst=93.184.215.14:443 sni=example.com
+//
+// A nil *File writes nothing.
+type File struct {
+	logger *slog.Logger
+	opts   Options
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// generation counts rotations, writers repeat their comment in a new file.
+	generation int
+}
+
+func NewFile(logger *slog.Logger, opts Options) (*File, error) {
+	kf := &File{
+		logger: logger.With("context", "KeyLog"),
+		opts:   opts,
+	}
+
+	if err := kf.open(); err != nil {
+		return nil, err
+	}
+
+	return kf, nil
+}
+
+// Writer returns the key log writer for one leg of a tunnel.
+func (kf *File) Writer(tun *tunnel.Tunnel, side tunnel.Side) io.Writer {
+	return &legWriter{file: kf, tun: tun, side: side, generation: -1}
+}
+
+func (kf *File) Close() error {
+	if kf == nil {
+		return nil
+	}
+
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	return kf.f.Close()
+}
+
+// open appends to the existing file, so that a restart keeps the secrets of earlier tunnels.
+func (kf *File) open() error {
+	f, err := os.OpenFile(kf.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	kf.f = f
+	kf.size = stat.Size()
+
+	return nil
+}
+
+// reserve rotates the file first when n more bytes would not fit. kf.mu must be held.
+func (kf *File) reserve(n int) error {
+	if kf.opts.MaxSize > 0 && kf.size > 0 && kf.size+int64(n) > kf.opts.MaxSize {
+		return kf.rotate()
+	}
+
+	return nil
+}
+
+func (kf *File) rotate() error {
+	if err := kf.f.Close(); err != nil {
+		kf.logger.Error("close key log", slog.Any("error", err))
+	}
+
+	path := kf.opts.Path
+	if kf.opts.MaxFiles <= 0 {
+		_ = os.Remove(path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", path, kf.opts.MaxFiles))
+		for i := kf.opts.MaxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			kf.logger.Error("rotate key log", slog.Any("error", err))
+		}
+	}
+
+	kf.generation++
+	kf.logger.Debug("key log rotated", "path", path)
+
+	return kf.open()
+}
+
+type legWriter struct {
+	file *File
+	tun  *tunnel.Tunnel
+	side tunnel.Side
+	// generation is the file generation the comment was last written to.
+	generation int
+}
+
+// Write takes the lines crypto/tls writes for one secret.
+func (w *legWriter) Write(lines []byte) (int, error) {
+	kf := w.file
+	if kf == nil {
+		return len(lines), nil
+	}
+
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	// the room for a comment is always reserved, a rotation means it is written again
+	err := kf.reserve(len(w.comment()) + len(lines))
+	if err == nil {
+		data := lines
+		if w.generation != kf.generation {
+			data = append([]byte(w.comment()), lines...)
+		}
+
+		var n int
+		n, err = kf.f.Write(data)
+		kf.size += int64(n)
+	}
+	if err != nil {
+		kf.logger.Error("write key log", "tunnel", w.tun.ID(), slog.Any("error", err))
+		// a failed key log must not fail the TLS handshake
+		return len(lines), nil
+	}
+	w.generation = kf.generation
+
+	return len(lines), nil
+}
+
+func (w *legWriter) comment() string {
+	info := w.tun.Info()
+
+	return fmt.Sprintf("# %s tunnel=%s leg=%s src=%s dst=%s sni=%s\n",
+		time.Now().UTC().Format(time.RFC3339),
+		w.tun.ID(),
+		w.side,
+		w.tun.Src,
+		w.tun.Dst,
+		strings.Join(info.ServerNames, ","),
+	)
+}
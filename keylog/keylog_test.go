@@ -0,0 +1,180 @@
+package keylog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"toss/tunnel"
+)
+
+func newTestTunnel(serverName string) *tunnel.Tunnel {
+	tun := tunnel.NewTunnel(context.Background(),
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+		nil, nil)
+	tun.UpdateInfo(func(info *tunnel.Info) { info.ServerNames = []string{serverName} })
+
+	return tun
+}
+
+func newTestFile(t *testing.T, opts Options) *File {
+	t.Helper()
+
+	if opts.Path == "" {
+		opts.Path = filepath.Join(t.TempDir(), "keys.log")
+	}
+
+	kf, err := NewFile(slog.New(slog.DiscardHandler), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = kf.Close() })
+
+	return kf
+}
+
+// secret returns a key log line told apart by n.
+func secret(n int) string {
+	return fmt.Sprintf("CLIENT_RANDOM %064x %096x\n", n, n)
+}
+
+func writeSecret(t *testing.T, w io.Writer, n int) {
+	t.Helper()
+
+	if written, err := io.WriteString(w, secret(n)); err != nil || written != len(secret(n)) {
+		t.Fatalf("write secret: %d, %v", written, err)
+	}
+}
+
+// readLines returns the lines of path, with the comments reduced to their leg.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for line := range strings.Lines(string(data)) {
+		if strings.HasPrefix(line, "#") {
+			for field := range strings.FieldsSeq(line) {
+				if leg, ok := strings.CutPrefix(field, "leg="); ok {
+					line = "# " + leg
+				}
+			}
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	return lines
+}
+
+func TestFileComments(t *testing.T) {
+	kf := newTestFile(t, Options{})
+	tun := newTestTunnel("example.com")
+
+	downstream := kf.Writer(tun, tunnel.SideDownstream)
+	upstream := kf.Writer(tun, tunnel.SideUpstream)
+
+	writeSecret(t, downstream, 1)
+	writeSecret(t, downstream, 2)
+	writeSecret(t, upstream, 3)
+	writeSecret(t, downstream, 4)
+
+	// each leg tells once which tunnel its secrets belong to
+	want := []string{
+		"# downstream", strings.TrimSpace(secret(1)), strings.TrimSpace(secret(2)),
+		"# upstream", strings.TrimSpace(secret(3)),
+		strings.TrimSpace(secret(4)),
+	}
+	if got := readLines(t, kf.opts.Path); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("key log\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	data, err := os.ReadFile(kf.opts.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment := strings.SplitN(string(data), "\n", 2)[0]
+	for _, field := range []string{"tunnel=" + tun.ID(), "src=10.0.0.2:50000", "dst=192.0.2.1:443", "sni=example.com"} {
+		if !strings.Contains(comment, " "+field) {
+			t.Errorf("comment %q without %s", comment, field)
+		}
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	// every write but the first of a file rotates it
+	kf := newTestFile(t, Options{MaxSize: 1, MaxFiles: 2})
+	tun := newTestTunnel("example.com")
+
+	downstream := kf.Writer(tun, tunnel.SideDownstream)
+	upstream := kf.Writer(tun, tunnel.SideUpstream)
+
+	writeSecret(t, downstream, 1)
+	writeSecret(t, upstream, 2)
+	writeSecret(t, downstream, 3)
+	writeSecret(t, downstream, 4)
+
+	// a leg repeats its comment in the new file, the oldest file is removed
+	for path, want := range map[string][]string{
+		kf.opts.Path:        {"# downstream", strings.TrimSpace(secret(4))},
+		kf.opts.Path + ".1": {"# downstream", strings.TrimSpace(secret(3))},
+		kf.opts.Path + ".2": {"# upstream", strings.TrimSpace(secret(2))},
+	} {
+		if got := readLines(t, path); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s\n%s\nwant\n%s", filepath.Base(path), strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+	if _, err := os.Stat(kf.opts.Path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more rotated files than MaxFiles: %v", err)
+	}
+}
+
+func TestFileRotationWithoutFiles(t *testing.T) {
+	kf := newTestFile(t, Options{MaxSize: 1})
+	w := kf.Writer(newTestTunnel("example.com"), tunnel.SideUpstream)
+
+	writeSecret(t, w, 1)
+	writeSecret(t, w, 2)
+
+	if got := readLines(t, kf.opts.Path); len(got) != 2 || got[0] != "# upstream" || got[1] != strings.TrimSpace(secret(2)) {
+		t.Errorf("key log %q", got)
+	}
+	if _, err := os.Stat(kf.opts.Path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("rotated file kept with MaxFiles 0: %v", err)
+	}
+}
+
+func TestFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	if err := os.WriteFile(path, []byte(secret(1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size of the existing file counts toward the rotation
+	kf := newTestFile(t, Options{Path: path, MaxSize: int64(len(secret(1))) + 1, MaxFiles: 1})
+	writeSecret(t, kf.Writer(newTestTunnel("example.com"), tunnel.SideDownstream), 2)
+
+	if got := readLines(t, path+".1"); len(got) != 1 || got[0] != strings.TrimSpace(secret(1)) {
+		t.Errorf("previous key log %q", got)
+	}
+	if got := readLines(t, path); len(got) != 2 || got[1] != strings.TrimSpace(secret(2)) {
+		t.Errorf("key log %q", got)
+	}
+}
+
+func TestFileNil(t *testing.T) {
+	var kf *File
+
+	writeSecret(t, kf.Writer(newTestTunnel("example.com"), tunnel.SideDownstream), 1)
+	if err := kf.Close(); err != nil {
+		t.Error(err)
+	}
+}
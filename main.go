@@ -3,54 +3,189 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
 	"syscall"
 	"time"
-	"toss/cert"
+	"toss/admin"
+	"toss/config"
+	"toss/har"
+	"toss/keylog"
+	"toss/metrics"
 	"toss/tunnel"
 	"toss/tunnel/detector"
 	"toss/tunnel/handler"
 )
 
-const (
-	listenAddr  = ":3129"
-	dialTimeout = 10 * time.Second
-)
+// recorder is created once, har changes require a restart.
+var recorder *har.Recorder
+
+// keyLogFile is created once, only its filter is reloaded.
+var keyLogFile *keylog.File
 
-var certManager *cert.Manager
+// listenAddrs are the addresses of the listeners, set before accepting. The explicit proxy does
+// not connect to them, a client could otherwise reach the admin api or loop through the proxy.
+var listenAddrs []net.Addr
 
 func main() {
-	var err error
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		os.Exit(runCA(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	initLogger()
 
-	certManager, err = cert.NewCertManager("./tls/rootCA.pem", "./tls/rootCA.key")
-	if err != nil {
-		slog.Error("init cert manager", slog.Any("error", err))
+	conf, err := loadConfig()
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		slog.Error("load config", slog.Any("error", err))
+		os.Exit(2)
+	}
+
+	if conf.HAR.Dir != "" {
+		recorder, err = har.NewRecorder(slog.Default(), har.Options{
+			Dir:      conf.HAR.Dir,
+			GroupBy:  conf.HAR.GroupBy,
+			Window:   conf.HAR.Window,
+			BodySize: conf.HAR.BodySize,
+		})
+		if err != nil {
+			slog.Error("init har recorder", slog.Any("error", err))
+			return
+		}
+	}
 
-	listener, err := initListener()
+	if conf.KeyLog.File != "" {
+		keyLogFile, err = keylog.NewFile(slog.Default(), keylog.Options{
+			Path:     conf.KeyLog.File,
+			MaxSize:  conf.KeyLog.MaxSize,
+			MaxFiles: conf.KeyLog.MaxFiles,
+		})
+		if err != nil {
+			slog.Error("init key log", slog.Any("error", err))
+			return
+		}
+		slog.Warn("tls secrets are written to the key log, anyone reading it can decrypt the selected tunnels", "path", conf.KeyLog.File)
+	}
+
+	rc, err := newRuntimeConfig(conf, nil)
 	if err != nil {
-		slog.Error("init listener", slog.Any("error", err))
+		slog.Error("init runtime config", slog.Any("error", err))
 		return
 	}
+	current.Store(rc)
+	metrics.ObserveCertCacheEntries(func() int { return current.Load().certManager.CacheLen() })
+	metrics.ObserveAutoBypassEntries(autoBypass.Len)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	defer listener.Close()
+	go watchReload(ctx, loadConfig)
+
+	var listeners []*acceptLoop
+
+	if conf.Listen != "" {
+		listener, err := initListener(conf.Listen)
+		if err != nil {
+			slog.Error("init listener", slog.Any("error", err))
+			return
+		}
 
-	slog.Info(fmt.Sprintf("listening on %s", listener.Addr()))
+		defer listener.Close()
+
+		slog.Info(fmt.Sprintf("listening on %s", listener.Addr()))
+		listenAddrs = append(listenAddrs, listener.Addr())
+		listeners = append(listeners, &acceptLoop{name: "tproxy", listener: listener, handle: handleConnection})
+	}
+
+	if conf.ExplicitProxy.Listen != "" {
+		listener, err := net.Listen("tcp", conf.ExplicitProxy.Listen)
+		if err != nil {
+			slog.Error("init explicit proxy listener", slog.Any("error", err))
+			return
+		}
+
+		defer listener.Close()
+
+		slog.Info(fmt.Sprintf("explicit proxy listening on %s", listener.Addr()))
+		listenAddrs = append(listenAddrs, listener.Addr())
+		listeners = append(listeners, &acceptLoop{name: "explicit", listener: listener, handle: handleProxyConnection})
+	}
+
+	if conf.Admin.Listen != "" {
+		adminServer, err := serveHTTP("admin api", conf.Admin.Listen, admin.NewServer(slog.Default(), tunnels, autoBypass))
+		if err != nil {
+			slog.Error("init admin api", slog.Any("error", err))
+			return
+		}
+
+		// kept up during the drain to watch the remaining tunnels
+		defer adminServer.Close()
+	}
+
+	if conf.Metrics.Listen != "" {
+		metricsServer, err := serveHTTP("metrics", conf.Metrics.Listen, metrics.Handler())
+		if err != nil {
+			slog.Error("init metrics", slog.Any("error", err))
+			return
+		}
+
+		defer metricsServer.Close()
+	}
+
+	var accepting sync.WaitGroup
+	for _, loop := range listeners {
+		accepting.Go(func() { loop.run(ctx) })
+	}
+	accepting.Wait()
+
+	// a second signal during the drain kills the process
+	stop()
+	shutdown()
+
+	_ = recorder.Close()
+	_ = keyLogFile.Close()
+}
+
+// acceptLoop hands the connections of a listener to handle until ctx is done.
+type acceptLoop struct {
+	// name is the listener label of the accepted connections metric.
+	name     string
+	listener net.Listener
+	handle   func(ctx context.Context, conn net.Conn)
+}
+
+func (l *acceptLoop) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		_ = l.listener.Close()
+	}()
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
 			slog.Error("accept", slog.Any("error", err))
 			continue
 		}
 
-		go handleConnection(conn)
+		metrics.TunnelsAccepted.WithLabelValues(l.name).Inc()
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			l.handle(drainCtx, conn)
+		}()
 	}
 }
 
@@ -63,7 +198,7 @@ func initLogger() {
 	slog.SetDefault(logger)
 }
 
-func initListener() (net.Listener, error) {
+func initListener(listenAddr string) (net.Listener, error) {
 	listenConfig := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			var err error
@@ -80,9 +215,35 @@ func initListener() (net.Listener, error) {
 	return listener, err
 }
 
-func handleConnection(downstreamConn net.Conn) {
+// serveHTTP serves handler on addr, a "host:port" or "unix:/path", until the returned server is closed.
+func serveHTTP(name, addr string, handler http.Handler) (*http.Server, error) {
+	listener, err := admin.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(name, slog.Any("error", err))
+		}
+	}()
+
+	slog.Info(fmt.Sprintf("%s listening on %s", name, listener.Addr()))
+	listenAddrs = append(listenAddrs, listener.Addr())
+
+	return server, nil
+}
+
+func handleConnection(ctx context.Context, downstreamConn net.Conn) {
 	defer downstreamConn.Close()
 
+	rc := current.Load()
+
 	srcAddr := downstreamConn.RemoteAddr()
 	dstAddr := downstreamConn.LocalAddr()
 
@@ -93,32 +254,44 @@ func handleConnection(downstreamConn net.Conn) {
 
 	logger.Debug(fmt.Sprintf("connection request: %v -> %v", srcAddr, dstAddr))
 
-	upstreamConn, err := net.DialTimeout("tcp", dstAddr.String(), dialTimeout)
+	upstreamConn, err := dialOrigin(&net.Dialer{Timeout: rc.conf.Timeouts.Dial}, dstAddr.String(), logger)
 	if err != nil {
-		logger.Error("failed to dial to dst", slog.Any("error", err))
 		return
 	}
 	defer upstreamConn.Close()
 
-	downstreamTCPConn, ok := downstreamConn.(*net.TCPConn)
-	if !ok {
-		logger.Error("downstream connection is not tcp")
-		return
-	}
+	setNoDelay(downstreamConn)
+	setNoDelay(upstreamConn)
 
-	upstreamTCPConn, ok := upstreamConn.(*net.TCPConn)
-	if !ok {
-		logger.Error("upstream connection is not tcp")
-		return
+	serveTunnel(ctx, rc, srcAddr, dstAddr, downstreamConn, upstreamConn)
+}
+
+// dialOrigin connects to the original destination, failures are logged and counted.
+func dialOrigin(dialer *net.Dialer, addr string, logger *slog.Logger) (net.Conn, error) {
+	upstreamConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		class := dialErrorClass(err)
+		metrics.DialFailures.WithLabelValues(class).Inc()
+		logger.Error("failed to dial to dst", "class", class, slog.Any("error", err))
+		return nil, err
 	}
 
-	_ = downstreamTCPConn.SetNoDelay(true)
-	_ = upstreamTCPConn.SetNoDelay(true)
+	return upstreamConn, nil
+}
 
-	tun := tunnel.NewTunnelFromConn(srcAddr, dstAddr, downstreamTCPConn, upstreamTCPConn)
+// serveTunnel runs the tunnel between the client and the origin until it is done.
+func serveTunnel(ctx context.Context, rc *runtimeConfig, srcAddr, dstAddr net.Addr, downstreamConn, upstreamConn net.Conn) {
+	tun := tunnel.NewTunnelFromConn(ctx, srcAddr, dstAddr, downstreamConn, upstreamConn)
 	defer tun.Close()
 
-	logger = slog.Default().With(
+	tunnels.Add(tun)
+	defer tunnels.Remove(tun)
+	defer recorder.CloseTunnel(tun)
+
+	metrics.TunnelsActive.Inc()
+	defer metrics.TunnelsActive.Dec()
+
+	logger := slog.Default().With(
 		slog.Group("tunnel",
 			"id", tun.ID(),
 			"src", srcAddr.String(),
@@ -127,57 +300,57 @@ func handleConnection(downstreamConn net.Conn) {
 	)
 	logger.Debug("tunnel created")
 
-	handleTunnel(tun, logger)
-}
-
-func handleTunnel(tun *tunnel.Tunnel, logger *slog.Logger) {
-	logger.Debug("tunnel handling start")
-
-	deadline := time.Now().Add(5 * time.Second)
-
-	// TODO: spin lock하지말고 goroutine으로 먼저 온쪽을 처리하도록 개선 필요
-	for deadline.After(time.Now()) {
-		logger.Debug("Try to detect client-side or server-side first protocol")
+	finishCapture := startCapture(tun, logger, rc)
+	defer finishCapture()
 
-		_ = tun.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-		_, _ = tun.Downstream.Reader.Peek(1)
-		_, _ = tun.Upstream.Reader.Peek(1)
-		_ = tun.SetReadDeadline(time.Time{})
-
-		if tun.Downstream.Reader.Buffered() > 0 {
-			logger.Debug("client-side first protocol detected")
-			handleClientFirstProtocol(tun, logger)
-			return
-		}
+	handler.Serve(tun, logger, newDetectors(logger, rc), rc.handlerOptions)
+}
 
-		if tun.Upstream.Reader.Buffered() > 0 {
-			logger.Debug("server-side first protocol detected")
-			handleServerFirstProtocol(tun, logger)
-			return
-		}
+// setNoDelay sends the small writes of the handlers right away on tcp connections.
+func setNoDelay(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(true)
 	}
-
-	logger.Error("failed to read packet")
 }
 
-func handleClientFirstProtocol(tun *tunnel.Tunnel, logger *slog.Logger) {
-	detectors := []tunnel.Detector{
-		detector.NewHttp11Detector(logger),
-		detector.NewHttp2Detector(logger),
-		detector.NewTlsDetector(logger, certManager),
+// dialErrorClass sorts dial errors into the classes of the dial failure metric.
+func dialErrorClass(err error) string {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errDestinationRefused):
+		return "forbidden"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
 	}
 
-	detectHandler := handler.NewDetectHandler(logger, detectors)
+	return "other"
+}
 
-	if err := detectHandler.Handle(tun); err != nil && err != io.EOF {
-		logger.Error("error occurred", "error", err, "stack", err.Error())
+func newDetectors(logger *slog.Logger, rc *runtimeConfig) []tunnel.Detector {
+	detectors := make([]tunnel.Detector, 0, len(rc.conf.Detectors))
+	for _, name := range rc.conf.Detectors {
+		detectors = append(detectors, newDetector(name, logger, rc))
 	}
-}
 
-func handleServerFirstProtocol(tun *tunnel.Tunnel, logger *slog.Logger) {
-	byPassHandler := handler.NewByPassHandler(logger)
+	return detectors
+}
 
-	if err := byPassHandler.Handle(tun); err != nil && err != io.EOF {
-		logger.Error("error occurred", slog.Any("error", err))
+func newDetector(name string, logger *slog.Logger, rc *runtimeConfig) tunnel.Detector {
+	switch name {
+	case config.DetectorHttp11:
+		return detector.NewHttp11Detector(logger, rc.handlerOptions)
+	case config.DetectorHttp2:
+		return detector.NewHttp2Detector(logger, rc.handlerOptions)
+	case config.DetectorTls:
+		return detector.NewTlsDetector(logger, rc.certManager, rc.handlerOptions)
 	}
+
+	panic(fmt.Sprintf("unknown detector %q", name))
 }
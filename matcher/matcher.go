@@ -0,0 +1,258 @@
+package matcher
+
+import (
+	"net"
+	"strings"
+)
+
+// Matcher matches server names and destination addresses against a list of patterns.
+//
+// Exact, wildcard and suffix patterns are indexed in a trie of reversed domain
+// labels and ip/cidr patterns in a binary trie per address family, so a lookup
+// costs one walk of the name or address regardless of the number of entries.
+// Regexp patterns are tried one by one after the indexed ones.
+type Matcher struct {
+	domains *domainNode
+	ipv4    *ipNode
+	ipv6    *ipNode
+	regexps []Pattern
+	size    int
+}
+
+func New(patterns []string) (*Matcher, error) {
+	m := &Matcher{
+		domains: &domainNode{},
+		ipv4:    &ipNode{},
+		ipv6:    &ipNode{},
+	}
+
+	for _, raw := range patterns {
+		p, err := Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Add(p)
+	}
+
+	return m, nil
+}
+
+func (m *Matcher) Add(p Pattern) {
+	m.size++
+
+	switch p.Kind {
+	case KindExact, KindWildcard, KindSuffix:
+		m.domains.insert(p)
+	case KindIP, KindCIDR:
+		if p.ipNet.IP.To4() != nil {
+			m.ipv4.insert(p)
+		} else {
+			m.ipv6.insert(p)
+		}
+	case KindRegexp:
+		m.regexps = append(m.regexps, p)
+	}
+}
+
+func (m *Matcher) Len() int {
+	if m == nil {
+		return 0
+	}
+
+	return m.size
+}
+
+// Match reports the first pattern matching any of the server names or the destination address.
+// dst may be nil when the destination is unknown.
+func (m *Matcher) Match(serverNames []string, dst *net.TCPAddr) (Pattern, bool) {
+	if m == nil {
+		return Pattern{}, false
+	}
+
+	port := 0
+	if dst != nil {
+		port = dst.Port
+		if p, ok := m.MatchIP(dst.IP, port); ok {
+			return p, true
+		}
+	}
+
+	for _, serverName := range serverNames {
+		if p, ok := m.MatchName(serverName, port); ok {
+			return p, true
+		}
+	}
+
+	return Pattern{}, false
+}
+
+// MatchName matches a server name. Names that are ip literals are matched against ip patterns.
+func (m *Matcher) MatchName(name string, port int) (Pattern, bool) {
+	if m == nil {
+		return Pattern{}, false
+	}
+
+	if ip := net.ParseIP(name); ip != nil {
+		return m.MatchIP(ip, port)
+	}
+
+	name = normalizeName(name)
+	if name == "" {
+		return Pattern{}, false
+	}
+
+	if p, ok := m.domains.lookup(name, port); ok {
+		return p, true
+	}
+
+	for _, p := range m.regexps {
+		if portMatches(p.Port, port) && p.regexp.MatchString(name) {
+			return p, true
+		}
+	}
+
+	return Pattern{}, false
+}
+
+func (m *Matcher) MatchIP(ip net.IP, port int) (Pattern, bool) {
+	if m == nil || ip == nil {
+		return Pattern{}, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return m.ipv4.lookup(ip4, port)
+	}
+
+	return m.ipv6.lookup(ip.To16(), port)
+}
+
+func portMatches(patternPort, port int) bool {
+	return patternPort == 0 || patternPort == port
+}
+
+func firstPortMatch(patterns []Pattern, port int) (Pattern, bool) {
+	for _, p := range patterns {
+		if portMatches(p.Port, port) {
+			return p, true
+		}
+	}
+
+	return Pattern{}, false
+}
+
+// domainNode is a trie node keyed by domain labels from the top level domain down,
+// "www.example.com" is stored under com -> example -> www.
+type domainNode struct {
+	children map[string]*domainNode
+
+	exact    []Pattern // the name ending at this node
+	wildcard []Pattern // names strictly below this node
+	suffix   []Pattern // this node and everything below it
+}
+
+func (n *domainNode) insert(p Pattern) {
+	labels := strings.Split(p.name, ".")
+
+	node := n
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*domainNode)
+		}
+
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	switch p.Kind {
+	case KindExact:
+		node.exact = append(node.exact, p)
+	case KindWildcard:
+		node.wildcard = append(node.wildcard, p)
+	case KindSuffix:
+		node.suffix = append(node.suffix, p)
+	}
+}
+
+func (n *domainNode) lookup(name string, port int) (Pattern, bool) {
+	node := n
+	rest := name
+
+	for rest != "" {
+		var label string
+		if dot := strings.LastIndexByte(rest, '.'); dot >= 0 {
+			label, rest = rest[dot+1:], rest[:dot]
+		} else {
+			label, rest = rest, ""
+		}
+
+		if p, ok := firstPortMatch(node.suffix, port); ok && node != n {
+			return p, true
+		}
+		if p, ok := firstPortMatch(node.wildcard, port); ok && node != n {
+			return p, true
+		}
+
+		child, ok := node.children[label]
+		if !ok {
+			return Pattern{}, false
+		}
+		node = child
+	}
+
+	if p, ok := firstPortMatch(node.exact, port); ok {
+		return p, true
+	}
+
+	return firstPortMatch(node.suffix, port)
+}
+
+// ipNode is a binary trie node, one level per address bit.
+type ipNode struct {
+	children [2]*ipNode
+	patterns []Pattern
+}
+
+func (n *ipNode) insert(p Pattern) {
+	ones, _ := p.ipNet.Mask.Size()
+	ip := p.ipNet.IP
+
+	node := n
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipNode{}
+		}
+		node = node.children[bit]
+	}
+
+	node.patterns = append(node.patterns, p)
+}
+
+// lookup returns the most specific pattern containing ip.
+func (n *ipNode) lookup(ip net.IP, port int) (Pattern, bool) {
+	var (
+		found Pattern
+		ok    bool
+	)
+
+	node := n
+	for i := 0; node != nil; i++ {
+		if p, matched := firstPortMatch(node.patterns, port); matched {
+			found, ok = p, true
+		}
+
+		if i == len(ip)*8 {
+			break
+		}
+
+		bit := ip[i/8] >> (7 - i%8) & 1
+		node = node.children[bit]
+	}
+
+	return found, ok
+}
@@ -0,0 +1,258 @@
+package matcher
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw      string
+		wantKind Kind
+		wantPort int
+		wantErr  bool
+	}{
+		{raw: "www.example.com", wantKind: KindExact},
+		{raw: "WWW.Example.COM.", wantKind: KindExact},
+		{raw: "*.example.com", wantKind: KindWildcard},
+		{raw: ".example.com", wantKind: KindSuffix},
+		{raw: "/^api[0-9]+\\.example\\.com$/", wantKind: KindRegexp},
+		{raw: "/^api\\./:8443", wantKind: KindRegexp, wantPort: 8443},
+		{raw: "1.1.1.1", wantKind: KindIP},
+		{raw: "2001:db8::1", wantKind: KindIP},
+		{raw: "10.0.0.0/8", wantKind: KindCIDR},
+		{raw: "2001:db8::/32", wantKind: KindCIDR},
+		{raw: "example.com:443", wantKind: KindExact, wantPort: 443},
+		{raw: "*.example.com:443", wantKind: KindWildcard, wantPort: 443},
+		{raw: "10.0.0.0/8:443", wantKind: KindCIDR, wantPort: 443},
+		{raw: "[2001:db8::1]:443", wantKind: KindIP, wantPort: 443},
+		{raw: "[2001:db8::]/32:443", wantKind: KindCIDR, wantPort: 443},
+		{raw: "", wantErr: true},
+		{raw: "/unterminated", wantErr: true},
+		{raw: "/[/", wantErr: true},
+		{raw: "example.com:0", wantErr: true},
+		{raw: "example.com:65536", wantErr: true},
+		{raw: "example.com:https", wantErr: true},
+		{raw: "10.0.0.0/33", wantErr: true},
+		{raw: "[2001:db8::1", wantErr: true},
+		{raw: "*.", wantErr: true},
+		{raw: "a..example.com", wantErr: true},
+		{raw: "a.*.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			p, err := Parse(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Parse(%q) = %v %v, want an error", tt.raw, p.Kind, p.Port)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.raw, err)
+			}
+			if p.Kind != tt.wantKind || p.Port != tt.wantPort || p.Raw != tt.raw {
+				t.Errorf("Parse(%q) = %v port %d, want %v port %d", tt.raw, p.Kind, p.Port, tt.wantKind, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	m, err := New([]string{
+		"www.example.com",
+		"*.wild.com",
+		".suffix.com",
+		"/^api[0-9]+\\.regexp\\.com$/",
+		"port.com:443",
+		"*.port.com:8443",
+		"bank.co.kr",
+		"*.bank.co.kr",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		port int
+		want string
+	}{
+		{name: "www.example.com", want: "www.example.com"},
+		{name: "WWW.EXAMPLE.COM.", want: "www.example.com"},
+		{name: "example.com"},
+		{name: "a.www.example.com"},
+
+		{name: "a.wild.com", want: "*.wild.com"},
+		{name: "a.b.wild.com", want: "*.wild.com"},
+		{name: "wild.com"},
+		{name: "notwild.com"},
+
+		{name: "suffix.com", want: ".suffix.com"},
+		{name: "a.b.suffix.com", want: ".suffix.com"},
+		{name: "notsuffix.com"},
+
+		{name: "api1.regexp.com", want: "/^api[0-9]+\\.regexp\\.com$/"},
+		{name: "API42.Regexp.com", want: "/^api[0-9]+\\.regexp\\.com$/"},
+		{name: "api.regexp.com"},
+
+		{name: "port.com", port: 443, want: "port.com:443"},
+		{name: "port.com", port: 80},
+		{name: "port.com"},
+		{name: "a.port.com", port: 8443, want: "*.port.com:8443"},
+		{name: "a.port.com", port: 443},
+
+		{name: "bank.co.kr", want: "bank.co.kr"},
+		{name: "www.bank.co.kr", want: "*.bank.co.kr"},
+		{name: "co.kr"},
+
+		{name: ""},
+		{name: "com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s:%d", tt.name, tt.port), func(t *testing.T) {
+			p, ok := m.MatchName(tt.name, tt.port)
+			if ok != (tt.want != "") || p.Raw != tt.want {
+				t.Errorf("MatchName(%q, %d) = %q %v, want %q", tt.name, tt.port, p.Raw, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchIP(t *testing.T) {
+	m, err := New([]string{
+		"10.0.0.0/8",
+		"10.1.0.0/16:443",
+		"192.168.1.1",
+		"2001:db8::/32",
+		"[2001:db8:1::]/48:443",
+		"::ffff:172.16.0.0/108",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		port int
+		want string
+	}{
+		{ip: "10.2.3.4", want: "10.0.0.0/8"},
+		{ip: "10.1.2.3", port: 443, want: "10.1.0.0/16:443"},
+		{ip: "10.1.2.3", port: 80, want: "10.0.0.0/8"},
+		{ip: "11.0.0.1"},
+		{ip: "192.168.1.1", want: "192.168.1.1"},
+		{ip: "192.168.1.2"},
+		{ip: "::ffff:10.0.0.1", want: "10.0.0.0/8"},
+		{ip: "172.16.5.5", want: "::ffff:172.16.0.0/108"},
+		{ip: "172.32.0.1"},
+
+		{ip: "2001:db8::1", want: "2001:db8::/32"},
+		{ip: "2001:db8:1::1", port: 443, want: "[2001:db8:1::]/48:443"},
+		{ip: "2001:db8:1::1", port: 80, want: "2001:db8::/32"},
+		{ip: "2001:db9::1"},
+		// an IPv6 prefix never matches an IPv4 address of the same bits
+		{ip: "32.1.13.184"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s:%d", tt.ip, tt.port), func(t *testing.T) {
+			p, ok := m.MatchIP(net.ParseIP(tt.ip), tt.port)
+			if ok != (tt.want != "") || p.Raw != tt.want {
+				t.Errorf("MatchIP(%s, %d) = %q %v, want %q", tt.ip, tt.port, p.Raw, ok, tt.want)
+			}
+
+			// ip literals given as server names are matched against the ip patterns
+			if p, _ := m.MatchName(tt.ip, tt.port); p.Raw != tt.want {
+				t.Errorf("MatchName(%s, %d) = %q, want %q", tt.ip, tt.port, p.Raw, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	m, err := New([]string{"10.0.0.0/8", ".example.com:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 443}
+
+	if p, ok := m.Match([]string{"other.com", "www.example.com"}, dst); !ok || p.Raw != ".example.com:443" {
+		t.Errorf("Match by a later server name = %q %v", p.Raw, ok)
+	}
+	if p, ok := m.Match([]string{"www.example.com"}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}); !ok || p.Raw != "10.0.0.0/8" {
+		t.Errorf("Match prefers the destination, got %q %v", p.Raw, ok)
+	}
+	// without a destination the port is unknown and port-qualified patterns do not match
+	if p, ok := m.Match([]string{"www.example.com"}, nil); ok {
+		t.Errorf("Match without destination = %q", p.Raw)
+	}
+
+	var nilMatcher *Matcher
+	if _, ok := nilMatcher.Match([]string{"www.example.com"}, dst); ok || nilMatcher.Len() != 0 {
+		t.Error("nil Matcher matched")
+	}
+	if m.Len() != 2 {
+		t.Errorf("Len = %d, want 2", m.Len())
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New([]string{"example.com", "/[/"}); err == nil {
+		t.Error("New accepted an invalid pattern")
+	}
+}
+
+// benchmarkPatterns returns n exact, wildcard, suffix and cidr patterns, the size of a large bypass list.
+func benchmarkPatterns(n int) []string {
+	patterns := make([]string, 0, n)
+	for i := 0; len(patterns) < n; i++ {
+		switch i % 4 {
+		case 0:
+			patterns = append(patterns, fmt.Sprintf("www.site%d.com", i))
+		case 1:
+			patterns = append(patterns, fmt.Sprintf("*.bank%d.co.kr", i))
+		case 2:
+			patterns = append(patterns, fmt.Sprintf(".health%d.org", i))
+		case 3:
+			patterns = append(patterns, fmt.Sprintf("10.%d.%d.0/24", i>>8&0xff, i&0xff))
+		}
+	}
+
+	return patterns
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, size := range []int{100, 50_000} {
+		m, err := New(benchmarkPatterns(size))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		names := []string{"www.unlisted.com"}
+		dst := &net.TCPAddr{IP: net.ParseIP("172.16.0.1"), Port: 443}
+
+		// a miss walks the whole index, the lookup cost must not grow with the list
+		b.Run(fmt.Sprintf("miss/%d", size), func(b *testing.B) {
+			for b.Loop() {
+				if _, ok := m.Match(names, dst); ok {
+					b.Fatal("unexpected match")
+				}
+			}
+		})
+
+		hit := []string{fmt.Sprintf("login.bank%d.co.kr", size-3)}
+		b.Run(fmt.Sprintf("hit/%d", size), func(b *testing.B) {
+			for b.Loop() {
+				if _, ok := m.Match(hit, dst); !ok {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
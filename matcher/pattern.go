@@ -0,0 +1,213 @@
+package matcher
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Kind uint8
+
+const (
+	KindExact    = Kind(iota) // www.example.com
+	KindWildcard              // *.example.com, any subdomain but not example.com itself
+	KindSuffix                // .example.com, example.com and any subdomain
+	KindRegexp                // /^api[0-9]+\.example\.com$/
+	KindIP                    // 1.1.1.1, 2001:db8::1
+	KindCIDR                  // 10.0.0.0/8, 2001:db8::/32
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindExact:
+		return "exact"
+	case KindWildcard:
+		return "wildcard"
+	case KindSuffix:
+		return "suffix"
+	case KindRegexp:
+		return "regexp"
+	case KindIP:
+		return "ip"
+	case KindCIDR:
+		return "cidr"
+	}
+
+	return fmt.Sprintf("Kind(%d)", uint8(k))
+}
+
+// IsAddress reports whether the pattern matches destination addresses rather than names.
+func (k Kind) IsAddress() bool {
+	return k == KindIP || k == KindCIDR
+}
+
+// Pattern is a single parsed entry of a match list.
+//
+// Every form accepts an optional ":port" qualifier, IPv6 addresses need brackets
+// when a port is given: "example.com:443", "10.0.0.0/8:443", "[2001:db8::]/32:443",
+// "/^api\./:8443".
+type Pattern struct {
+	Raw  string
+	Kind Kind
+
+	// Port restricts the match to a destination port. Zero matches any port.
+	Port int
+
+	// name is the lower-cased domain without the "*." or "." prefix.
+	name   string
+	regexp *regexp.Regexp
+	ipNet  *net.IPNet
+}
+
+func Parse(raw string) (Pattern, error) {
+	p := Pattern{Raw: raw}
+
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return p, fmt.Errorf("empty pattern")
+	}
+
+	if strings.HasPrefix(s, "/") {
+		end := strings.LastIndex(s, "/")
+		if end == 0 {
+			return p, fmt.Errorf("unterminated regexp %q", raw)
+		}
+
+		port, err := parsePortSuffix(s[end+1:])
+		if err != nil {
+			return p, fmt.Errorf("pattern %q: %w", raw, err)
+		}
+
+		re, err := regexp.Compile("(?i)" + s[1:end])
+		if err != nil {
+			return p, fmt.Errorf("pattern %q: %w", raw, err)
+		}
+
+		p.Kind, p.Port, p.regexp = KindRegexp, port, re
+		return p, nil
+	}
+
+	host, port, err := splitPort(s)
+	if err != nil {
+		return p, fmt.Errorf("pattern %q: %w", raw, err)
+	}
+	p.Port = port
+
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return p, fmt.Errorf("pattern %q: %w", raw, err)
+		}
+
+		p.Kind, p.ipNet = KindCIDR, normalizeIPNet(ipNet)
+		return p, nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		p.Kind, p.ipNet = KindIP, normalizeIPNet(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		return p, nil
+	}
+
+	name := normalizeName(host)
+	switch {
+	case strings.HasPrefix(name, "*."):
+		p.Kind, p.name = KindWildcard, name[2:]
+	case strings.HasPrefix(name, "."):
+		p.Kind, p.name = KindSuffix, name[1:]
+	default:
+		p.Kind, p.name = KindExact, name
+	}
+
+	if err := validateName(p.name); err != nil {
+		return p, fmt.Errorf("pattern %q: %w", raw, err)
+	}
+
+	return p, nil
+}
+
+// splitPort splits "host:port", "[v6]:port", "[v6]/len:port" and "v4/len:port".
+// A bare IPv6 address without brackets is returned as is.
+func splitPort(s string) (string, int, error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing ']'")
+		}
+
+		host, rest := s[1:end], s[end+1:]
+		if strings.HasPrefix(rest, "/") {
+			colon := strings.Index(rest, ":")
+			if colon < 0 {
+				return host + rest, 0, nil
+			}
+			host, rest = host+rest[:colon], rest[colon:]
+		}
+
+		port, err := parsePortSuffix(rest)
+		return host, port, err
+	}
+
+	if strings.Count(s, ":") > 1 {
+		return s, 0, nil
+	}
+
+	colon := strings.LastIndex(s, ":")
+	if colon < 0 {
+		return s, 0, nil
+	}
+
+	port, err := parsePortSuffix(s[colon:])
+	return s[:colon], port, err
+}
+
+func parsePortSuffix(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if !strings.HasPrefix(s, ":") {
+		return 0, fmt.Errorf("unexpected %q after pattern", s)
+	}
+
+	port, err := strconv.Atoi(s[1:])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s[1:])
+	}
+
+	return port, nil
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty domain")
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("empty label in domain %q", name)
+		}
+		if strings.ContainsAny(label, "*/ ") {
+			return fmt.Errorf("invalid label %q in domain %q", label, name)
+		}
+	}
+
+	return nil
+}
+
+func normalizeIPNet(ipNet *net.IPNet) *net.IPNet {
+	ones, bits := ipNet.Mask.Size()
+	if ip4 := ipNet.IP.To4(); ip4 != nil && (bits == 32 || ones >= 96) {
+		if bits == 128 {
+			ones -= 96
+		}
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones, 32)}
+	}
+
+	return ipNet
+}
@@ -0,0 +1,275 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "toss"
+
+// Registry holds the toss series together with the Go runtime and process collectors.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// listener is tproxy or explicit (the explicit proxy listener).
+	TunnelsAccepted = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnels_accepted_total",
+		Help:      "Connections accepted by the listeners.",
+	}, []string{"listener"})
+	TunnelsActive = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tunnels_active",
+		Help:      "Tunnels currently being handled.",
+	})
+
+	// DialFailures is labeled by class: timeout, refused, unreachable, reset, forbidden or other.
+	DialFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_failures_total",
+		Help:      "Failed dials to the original destination.",
+	}, []string{"class"})
+
+	// DetectResults counts the last result of every detector that ran, per tunnel.
+	DetectResults = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "detect_results_total",
+		Help:      "Detector results at the end of detection.",
+	}, []string{"detector", "result"})
+	// DetectFallbacks counts tunnels handed to ByPassHandler because no detector matched.
+	DetectFallbacks = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "detect_fallbacks_total",
+		Help:      "Detections that fell back to bypass, by reason.",
+	}, []string{"reason"})
+
+	// side is upstream (proxy to origin) or downstream (client to proxy).
+	TlsHandshakeDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tls_handshake_duration_seconds",
+		Help:      "Duration of successful TLS handshakes in TlsHandler.",
+	}, []string{"side"})
+	TlsHandshakeFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_handshake_failures_total",
+		Help:      "Failed TLS handshakes in TlsHandler.",
+	}, []string{"side", "class"})
+	// JA4 rather than JA3, which changes on each connection of clients randomizing the extension order.
+	// ja4 and ja4s are the names of the known fingerprints, see FingerprintNames.
+	TlsClientHellos = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_client_hellos_total",
+		Help:      "TLS ClientHellos detected by TlsDetector, by name of the JA4 fingerprint.",
+	}, []string{"ja4"})
+	TlsServerHellos = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_server_hellos_total",
+		Help:      "Origin ServerHellos received by TlsHandler, by name of the JA4S fingerprint.",
+	}, []string{"ja4s"})
+	// reason is one of the trust.Reason values, mode is alert or untrusted-leaf.
+	UpstreamCertRejections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_cert_rejections_total",
+		Help:      "Origin certificates rejected by the upstream verification.",
+	}, []string{"reason", "mode"})
+
+	// result is hit, miss or renew (a leaf close to expiry served while a new one is issued).
+	CertCacheLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cert_cache_lookups_total",
+		Help:      "Leaf certificate cache lookups.",
+	}, []string{"result"})
+	CertCacheEvictions = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cert_cache_evictions_total",
+		Help:      "Leaf certificates evicted from the full cache.",
+	})
+	// result is hit or miss, a lookup of the store follows a miss of the cache.
+	CertStoreLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cert_store_lookups_total",
+		Help:      "Leaf certificate lookups in the on-disk store.",
+	}, []string{"result"})
+	CertStoreRemovals = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cert_store_removals_total",
+		Help:      "Expired leaf certificates removed from the on-disk store.",
+	})
+	// key is the leaf key type: ecdsa, ed25519 or rsa.
+	CertIssueDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cert_issue_duration_seconds",
+		Help:      "Duration of leaf certificate issuance.",
+	}, []string{"key"})
+
+	// reason is bad_certificate, unknown_ca, certificate_unknown (alerts of the client) or closed.
+	AutoBypassLearned = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auto_bypass_learned_total",
+		Help:      "Clients and server names learned because the client refused the forged certificate.",
+	}, []string{"reason"})
+	AutoBypassed = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auto_bypassed_total",
+		Help:      "Tunnels bypassed because their client refused the forged certificate before.",
+	})
+
+	// protocol is http1.1 or h2, status is "error" when the origin did not answer.
+	// method and host are bounded, see ObserveHttpRequest.
+	HttpRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests read from clients.",
+	}, []string{"protocol", "method", "host"})
+	HttpResponses = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_responses_total",
+		Help:      "HTTP responses relayed to clients.",
+	}, []string{"protocol", "method", "status", "host"})
+	HttpDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time from forwarding a request until the origin's response headers arrived.",
+	}, []string{"protocol", "method", "status", "host"})
+
+	// scheme is http or https.
+	OnboardingRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "onboarding_requests_total",
+		Help:      "Requests answered by the onboarding site.",
+	}, []string{"scheme", "status"})
+
+	// direction is upstream (client to origin) or downstream (origin to client).
+	PipeBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pipe_bytes_total",
+		Help:      "Bytes relayed by ByPassHandler.",
+	}, []string{"direction"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// LabelOther is the label value of the series counting the values that are not known.
+const LabelOther = "other"
+
+// FingerprintNames maps the known JA4 or JA4S fingerprints to the label value of their series.
+// The fingerprints are chosen by the clients and origins, the unknown ones share the LabelOther
+// series so that they can not create series at will.
+type FingerprintNames map[string]string
+
+// Label is the name of fingerprint, LabelOther when it is not known.
+func (n FingerprintNames) Label(fingerprint string) string {
+	if name, ok := n[fingerprint]; ok {
+		return name
+	}
+
+	return LabelOther
+}
+
+// maxHttpHosts bounds the host label of the http series, the hosts seen after the first
+// maxHttpHosts ones are counted as LabelOther.
+const maxHttpHosts = 200
+
+var httpHosts = &labelSet{max: maxHttpHosts, values: make(map[string]struct{})}
+
+// ObserveHttpRequest records a request read from a client. The method and host are sent by the
+// client, the method is one of the standard ones or OTHER and the host one of the first
+// maxHttpHosts ones or LabelOther, so that a client can not create series at will.
+func ObserveHttpRequest(protocol, method, host string) {
+	HttpRequests.WithLabelValues(protocol, methodLabel(method), httpHosts.label(hostLabel(host))).Inc()
+}
+
+// ObserveHttpExchange records one request and its response. status is zero when the origin did not answer.
+func ObserveHttpExchange(protocol, method, host string, status int, elapsed time.Duration) {
+	statusLabel := "error"
+	if status != 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+
+	method, host = methodLabel(method), httpHosts.label(hostLabel(host))
+
+	HttpResponses.WithLabelValues(protocol, method, statusLabel, host).Inc()
+	HttpDuration.WithLabelValues(protocol, method, statusLabel, host).Observe(elapsed.Seconds())
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+
+	return "OTHER"
+}
+
+// hostLabel is host without port, in lower case.
+func hostLabel(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// labelSet keeps the first max values of a label, the next ones are LabelOther.
+type labelSet struct {
+	max int
+
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+func (s *labelSet) label(value string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.values[value]; ok {
+		return value
+	}
+	if len(s.values) >= s.max {
+		return LabelOther
+	}
+
+	s.values[value] = struct{}{}
+	return value
+}
+
+// ObserveCertCacheEntries exports the size of the leaf cache, entries is called on each scrape
+// so that it can follow the cert.Manager of the current config.
+func ObserveCertCacheEntries(entries func() int) {
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cert_cache_entries",
+		Help:      "Leaf certificates in the cache.",
+	}, func() float64 { return float64(entries()) })
+}
+
+// ObserveAutoBypassEntries exports the number of learned clients and server names.
+func ObserveAutoBypassEntries(entries func() int) {
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "auto_bypass_entries",
+		Help:      "Learned clients and server names whose tunnels are bypassed.",
+	}, func() float64 { return float64(entries()) })
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMethodLabel(t *testing.T) {
+	tests := map[string]string{
+		"GET":      "GET",
+		"PATCH":    "PATCH",
+		"CONNECT":  "CONNECT",
+		"get":      "OTHER",
+		"PROPFIND": "OTHER",
+		"X-RANDOM": "OTHER",
+	}
+
+	for method, want := range tests {
+		if got := methodLabel(method); got != want {
+			t.Errorf("methodLabel(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestHostLabel(t *testing.T) {
+	tests := map[string]string{
+		"example.com":      "example.com",
+		"Example.COM:8443": "example.com",
+		"example.com.":     "example.com",
+		"[2001:db8::1]:80": "2001:db8::1",
+		"10.0.0.1":         "10.0.0.1",
+	}
+
+	for host, want := range tests {
+		if got := hostLabel(host); got != want {
+			t.Errorf("hostLabel(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestLabelSet(t *testing.T) {
+	s := &labelSet{max: 3, values: make(map[string]struct{})}
+
+	for i := range 3 {
+		host := fmt.Sprintf("host%d.example.com", i)
+		if got := s.label(host); got != host {
+			t.Errorf("label(%q) = %q before the set is full", host, got)
+		}
+	}
+
+	if got := s.label("late.example.com"); got != LabelOther {
+		t.Errorf("label of a new value in a full set = %q, want %q", got, LabelOther)
+	}
+	if got := s.label("host1.example.com"); got != "host1.example.com" {
+		t.Errorf("label of a known value in a full set = %q", got)
+	}
+	if len(s.values) != 3 {
+		t.Errorf("%d values kept, want 3", len(s.values))
+	}
+}
@@ -0,0 +1,118 @@
+// Package onboarding serves the CA certificate to the clients of the proxy on a reserved host name
+// that the proxy answers itself instead of forwarding the requests to the origin.
+package onboarding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"toss/cert"
+)
+
+// TrustCheckPath is requested by the install page over https, where it only loads when the client
+// trusts the CA.
+const TrustCheckPath = "/trust-check"
+
+//go:embed index.html
+var indexHTML string
+
+var indexTemplate = template.Must(template.New("index").Parse(indexHTML))
+
+// Server is the onboarding site.
+//
+//	GET /                 install page, with a check whether the client trusts the CA
+//	GET /ca.pem           the CA in PEM
+//	GET /ca.cer           the CA in DER
+//	GET /ca.crt           the CA in DER as application/x-x509-ca-cert, which Android installs from the browser
+//	GET /ca.mobileconfig  configuration profile installing the CA on iOS and macOS
+//	GET /trust-check      204, the page requests it over https where it only loads when the CA is trusted
+//
+// A nil *Server matches no host.
+type Server struct {
+	host string
+	root *x509.Certificate
+	mux  *http.ServeMux
+}
+
+func NewServer(host string, root *x509.Certificate) *Server {
+	s := &Server{
+		host: strings.ToLower(host),
+		root: root,
+		mux:  http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /{$}", s.index)
+	s.mux.HandleFunc("GET /ca.pem", s.certificate(cert.FormatPEM, "application/x-pem-file", "ca.pem"))
+	s.mux.HandleFunc("GET /ca.cer", s.certificate(cert.FormatDER, "application/pkix-cert", "ca.cer"))
+	s.mux.HandleFunc("GET /ca.crt", s.certificate(cert.FormatDER, "application/x-x509-ca-cert", "ca.crt"))
+	s.mux.HandleFunc("GET /ca.mobileconfig", s.certificate(cert.FormatMobileConfig, "application/x-apple-aspen-config", "ca.mobileconfig"))
+	s.mux.HandleFunc("GET "+TrustCheckPath, s.trustCheck)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Matches reports whether host, with or without a port, is the onboarding host.
+func (s *Server) Matches(host string) bool {
+	if s == nil || host == "" {
+		return false
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.EqualFold(strings.TrimSuffix(host, "."), s.host)
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	fingerprint := sha256.Sum256(s.root.Raw)
+
+	var buf bytes.Buffer
+	err := indexTemplate.Execute(&buf, map[string]any{
+		"Host":        s.host,
+		"Subject":     s.root.Subject.String(),
+		"NotAfter":    s.root.NotAfter.UTC().Format(time.DateOnly),
+		"Fingerprint": fmt.Sprintf("% X", fingerprint[:]),
+		"Secure":      r.TLS != nil,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(buf.Bytes())
+}
+
+func (s *Server) certificate(format, contentType, filename string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := cert.EncodeCertificate(s.root, format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *Server) trustCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package onboarding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"toss/cert"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	root, _, err := cert.NewRoot(cert.AuthorityOptions{Organization: "Toss Test", RootValidity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewServer("Toss.Test", root)
+}
+
+func serve(s *Server, method, path string, secure bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://toss.test"+path, nil)
+	if secure {
+		req.TLS = &tls.ConnectionState{}
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestServerCertificates(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		path        string
+		contentType string
+		// check reports what is wrong with the body
+		check func(body []byte) string
+	}{
+		{path: "/ca.pem", contentType: "application/x-pem-file", check: func(body []byte) string {
+			block, rest := pem.Decode(body)
+			if block == nil || block.Type != "CERTIFICATE" || !bytes.Equal(block.Bytes, s.root.Raw) || len(rest) != 0 {
+				return "not the root in PEM"
+			}
+			return ""
+		}},
+		{path: "/ca.cer", contentType: "application/pkix-cert", check: func(body []byte) string {
+			if !bytes.Equal(body, s.root.Raw) {
+				return "not the root in DER"
+			}
+			return ""
+		}},
+		{path: "/ca.crt", contentType: "application/x-x509-ca-cert", check: func(body []byte) string {
+			if !bytes.Equal(body, s.root.Raw) {
+				return "not the root in DER"
+			}
+			return ""
+		}},
+		{path: "/ca.mobileconfig", contentType: "application/x-apple-aspen-config", check: func(body []byte) string {
+			if !bytes.Contains(body, []byte("com.apple.security.root")) || !bytes.Contains(body, []byte(base64.StdEncoding.EncodeToString(s.root.Raw))) {
+				return "no root payload"
+			}
+			return ""
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, tt.path, false)
+
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tt.contentType {
+				t.Fatalf("status %d, content type %q, want 200 and %q", rec.Code, rec.Header().Get("Content-Type"), tt.contentType)
+			}
+			if want := fmt.Sprintf("attachment; filename=%q", tt.path[1:]); rec.Header().Get("Content-Disposition") != want {
+				t.Errorf("content disposition %q, want %q", rec.Header().Get("Content-Disposition"), want)
+			}
+			if problem := tt.check(rec.Body.Bytes()); problem != "" {
+				t.Errorf("body %q: %s", rec.Body.Bytes(), problem)
+			}
+		})
+	}
+}
+
+func TestServerIndex(t *testing.T) {
+	s := newTestServer(t)
+	fingerprint := sha256.Sum256(s.root.Raw)
+
+	for _, secure := range []bool{false, true} {
+		rec := serve(s, http.MethodGet, "/", secure)
+		// the template pads the values of the script with spaces
+		body := strings.Join(strings.Fields(rec.Body.String()), " ")
+
+		if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+			t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		// the page checks the trust of the CA over https on the onboarding host
+		for _, want := range []string{
+			fmt.Sprintf("% X", fingerprint[:]),
+			`const host = "toss.test"`,
+			fmt.Sprintf("const secure = %v", secure),
+			TrustCheckPath,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("secure %v: index without %q", secure, want)
+			}
+		}
+	}
+}
+
+func TestServerTrustCheck(t *testing.T) {
+	s := newTestServer(t)
+
+	// the page loads it from another origin with no-cors
+	rec := serve(s, http.MethodGet, TrustCheckPath, true)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Body.Len() != 0 {
+		t.Errorf("status %d, allowed origin %q, body %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"), rec.Body.String())
+	}
+}
+
+func TestServerUnknown(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{method: http.MethodGet, path: "/ca.key", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/index.html", want: http.StatusNotFound},
+		{method: http.MethodPost, path: "/ca.pem", want: http.StatusMethodNotAllowed},
+	} {
+		if rec := serve(s, tt.method, tt.path, false); rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestServerMatches(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := map[string]bool{
+		"toss.test":       true,
+		"TOSS.test":       true,
+		"toss.test.":      true,
+		"toss.test:443":   true,
+		"toss.test:8080":  true,
+		"www.toss.test":   false,
+		"toss.test.other": false,
+		"":                false,
+	}
+	for host, want := range tests {
+		if got := s.Matches(host); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	var disabled *Server
+	if disabled.Matches("toss.test") {
+		t.Error("a nil server matches")
+	}
+}
@@ -0,0 +1,131 @@
+package pcapng
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"toss/tunnel"
+)
+
+// TunnelCapture writes both legs of a tunnel to a pcapng file: client to proxy on the
+// "downstream" interface and proxy to origin on the "upstream" interface. The TCP/IP
+// framing is synthesized from the tunnel addresses.
+//
+// It is a tunnel.Tap for the bytes on the wire, and an io.Writer for the NSS key log of
+// TlsHandler, whose secrets are written as decryption secrets blocks so that Wireshark
+// decrypts both legs without a separate key log file.
+type TunnelCapture struct {
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	w    *Writer
+	// err is the first write error, nothing is written after it.
+	err error
+
+	downstream, upstream     *tcpFlow
+	downstreamIf, upstreamIf uint32
+}
+
+func NewTunnelCapture(path string, tun *tunnel.Tunnel) (*TunnelCapture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TunnelCapture{
+		file: file,
+		buf:  bufio.NewWriter(file),
+
+		// the client believes it talks to Dst, the origin sees the proxy's own address
+		downstream: newTCPFlow(tcpAddr(tun.Src), tcpAddr(tun.Dst)),
+		upstream:   newTCPFlow(tcpAddr(tun.Upstream.Conn.LocalAddr()), tcpAddr(tun.Dst)),
+	}
+
+	c.w, err = NewWriter(c.buf, "toss tunnel "+tun.ID())
+	if err == nil {
+		c.downstreamIf, err = c.w.AddInterface("downstream", LinkTypeRaw)
+	}
+	if err == nil {
+		c.upstreamIf, err = c.w.AddInterface("upstream", LinkTypeRaw)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Observe implements tunnel.Tap.
+func (c *TunnelCapture) Observe(side tunnel.Side, read bool, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flow, interfaceID, fromClient := c.downstream, c.downstreamIf, read
+	if side == tunnel.SideUpstream {
+		flow, interfaceID, fromClient = c.upstream, c.upstreamIf, !read
+	}
+
+	if !flow.established {
+		c.writePackets(interfaceID, flow.handshake())
+	}
+	c.writePackets(interfaceID, flow.data(fromClient, b))
+}
+
+// Write takes NSS key log lines.
+func (c *TunnelCapture) Write(keyLog []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = c.w.WriteTLSKeyLog(keyLog)
+	}
+
+	// a failed capture must not fail the TLS handshake
+	return len(keyLog), nil
+}
+
+// Close ends the synthesized connections and closes the file.
+func (c *TunnelCapture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, leg := range []struct {
+		flow        *tcpFlow
+		interfaceID uint32
+	}{{c.downstream, c.downstreamIf}, {c.upstream, c.upstreamIf}} {
+		if leg.flow.established && !leg.flow.closed {
+			c.writePackets(leg.interfaceID, leg.flow.close())
+		}
+	}
+
+	err := c.err
+	if err == nil {
+		err = c.buf.Flush()
+	}
+	c.err = errors.Join(err, os.ErrClosed)
+
+	return errors.Join(err, c.file.Close())
+}
+
+func (c *TunnelCapture) writePackets(interfaceID uint32, packets [][]byte) {
+	now := time.Now()
+
+	for _, packet := range packets {
+		if c.err != nil {
+			return
+		}
+		c.err = c.w.WritePacket(interfaceID, now, packet)
+	}
+}
+
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
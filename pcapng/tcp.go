@@ -0,0 +1,177 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	ipProtocolTCP = 6
+
+	// maxSegmentSize keeps the synthesized packets under a common MTU.
+	maxSegmentSize = 1460
+)
+
+var be = binary.BigEndian
+
+// tcpFlow synthesizes the packets of one TCP connection between a client and a server.
+type tcpFlow struct {
+	client, server *net.TCPAddr
+
+	// clientSeq and serverSeq are the next sequence numbers of each side.
+	clientSeq uint32
+	serverSeq uint32
+	ipID      uint16
+
+	established bool
+	closed      bool
+}
+
+func newTCPFlow(client, server *net.TCPAddr) *tcpFlow {
+	return &tcpFlow{
+		client:    client,
+		server:    server,
+		clientSeq: 1_000_000,
+		serverSeq: 2_000_000,
+	}
+}
+
+// handshake returns the SYN, SYN-ACK and ACK opening the flow.
+func (f *tcpFlow) handshake() [][]byte {
+	f.established = true
+
+	syn := f.packet(true, tcpFlagSYN, nil)
+	f.clientSeq++
+	synAck := f.packet(false, tcpFlagSYN|tcpFlagACK, nil)
+	f.serverSeq++
+	ack := f.packet(true, tcpFlagACK, nil)
+
+	return [][]byte{syn, synAck, ack}
+}
+
+// data returns the segments carrying payload from the client, or from the server when fromClient is false.
+func (f *tcpFlow) data(fromClient bool, payload []byte) [][]byte {
+	var packets [][]byte
+
+	for len(payload) > 0 {
+		n := min(len(payload), maxSegmentSize)
+		packets = append(packets, f.packet(fromClient, tcpFlagPSH|tcpFlagACK, payload[:n]))
+
+		if fromClient {
+			f.clientSeq += uint32(n)
+		} else {
+			f.serverSeq += uint32(n)
+		}
+		payload = payload[n:]
+	}
+
+	return packets
+}
+
+// close returns the FIN exchange closing the flow.
+func (f *tcpFlow) close() [][]byte {
+	f.closed = true
+
+	fin := f.packet(true, tcpFlagFIN|tcpFlagACK, nil)
+	f.clientSeq++
+	finAck := f.packet(false, tcpFlagFIN|tcpFlagACK, nil)
+	f.serverSeq++
+	ack := f.packet(true, tcpFlagACK, nil)
+
+	return [][]byte{fin, finAck, ack}
+}
+
+func (f *tcpFlow) packet(fromClient bool, flags byte, payload []byte) []byte {
+	src, dst := f.client, f.server
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		src, dst = f.server, f.client
+		seq, ack = f.serverSeq, f.clientSeq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	segment := make([]byte, 20, 20+len(payload))
+	be.PutUint16(segment[0:], uint16(src.Port))
+	be.PutUint16(segment[2:], uint16(dst.Port))
+	be.PutUint32(segment[4:], seq)
+	be.PutUint32(segment[8:], ack)
+	segment[12] = 5 << 4 // data offset, no options
+	segment[13] = flags
+	be.PutUint16(segment[14:], 65535) // window
+	segment = append(segment, payload...)
+
+	f.ipID++
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil && dstIP != nil {
+		be.PutUint16(segment[16:], checksum(pseudoHeader(srcIP, dstIP, len(segment)), segment))
+		return append(ipv4Header(srcIP, dstIP, f.ipID, len(segment)), segment...)
+	}
+
+	srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	be.PutUint16(segment[16:], checksum(pseudoHeader(srcIP, dstIP, len(segment)), segment))
+	return append(ipv6Header(srcIP, dstIP, len(segment)), segment...)
+}
+
+func ipv4Header(src, dst net.IP, id uint16, payloadLen int) []byte {
+	header := make([]byte, 20)
+	header[0] = 4<<4 | 5 // version, header length in words
+	be.PutUint16(header[2:], uint16(20+payloadLen))
+	be.PutUint16(header[4:], id)
+	be.PutUint16(header[6:], 0x4000) // don't fragment
+	header[8] = 64                   // ttl
+	header[9] = ipProtocolTCP
+	copy(header[12:], src)
+	copy(header[16:], dst)
+	be.PutUint16(header[10:], checksum(nil, header))
+
+	return header
+}
+
+func ipv6Header(src, dst net.IP, payloadLen int) []byte {
+	header := make([]byte, 40)
+	header[0] = 6 << 4
+	be.PutUint16(header[4:], uint16(payloadLen))
+	header[6] = ipProtocolTCP
+	header[7] = 64 // hop limit
+	copy(header[8:], src)
+	copy(header[24:], dst)
+
+	return header
+}
+
+// pseudoHeader is the part of the IP header covered by the TCP checksum.
+func pseudoHeader(src, dst net.IP, tcpLen int) []byte {
+	header := append(append([]byte{}, src...), dst...)
+	if len(src) == net.IPv4len {
+		return append(header, 0, ipProtocolTCP, byte(tcpLen>>8), byte(tcpLen))
+	}
+
+	return append(header, byte(tcpLen>>24), byte(tcpLen>>16), byte(tcpLen>>8), byte(tcpLen), 0, 0, 0, ipProtocolTCP)
+}
+
+// checksum is the internet checksum of a followed by b, with a of even length.
+func checksum(a, b []byte) uint16 {
+	var sum uint32
+	for _, data := range [][]byte{a, b} {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(be.Uint16(data[i:]))
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,133 @@
+// Package pcapng writes captures in the pcapng format,
+// see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-03.html.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	blockTypeSectionHeader        = 0x0A0D0D0A
+	blockTypeInterfaceDescription = 0x00000001
+	blockTypeEnhancedPacket       = 0x00000006
+	blockTypeDecryptionSecrets    = 0x0000000A
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optionEndOfOpt   = 0
+	optionShbUserApp = 4
+	optionIfName     = 2
+	optionIfTsResol  = 9
+
+	// LinkTypeRaw carries IPv4 or IPv6 packets without a link layer header.
+	LinkTypeRaw = 101
+
+	// secretsTypeTLSKeyLog is "TLSK", the NSS key log format.
+	secretsTypeTLSKeyLog = 0x544c534b
+
+	// tsResolNanoseconds is the if_tsresol value for 10^-9 seconds.
+	tsResolNanoseconds = 9
+)
+
+var order = binary.LittleEndian
+
+// Writer writes the blocks of a single section. It is not safe for concurrent use.
+type Writer struct {
+	w          io.Writer
+	interfaces int
+}
+
+// NewWriter writes the section header block.
+func NewWriter(w io.Writer, application string) (*Writer, error) {
+	var body []byte
+	body = order.AppendUint32(body, byteOrderMagic)
+	body = order.AppendUint16(body, 1) // major version
+	body = order.AppendUint16(body, 0) // minor version
+	body = order.AppendUint64(body, ^uint64(0))
+	body = appendOption(body, optionShbUserApp, []byte(application))
+	body = appendOption(body, optionEndOfOpt, nil)
+
+	writer := &Writer{w: w}
+	if err := writer.writeBlock(blockTypeSectionHeader, body); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// AddInterface writes an interface description block with nanosecond timestamps
+// and returns the interface id to use with WritePacket.
+func (w *Writer) AddInterface(name string, linkType uint16) (uint32, error) {
+	var body []byte
+	body = order.AppendUint16(body, linkType)
+	body = order.AppendUint16(body, 0) // reserved
+	body = order.AppendUint32(body, 0) // no snap length limit
+	body = appendOption(body, optionIfName, []byte(name))
+	body = appendOption(body, optionIfTsResol, []byte{tsResolNanoseconds})
+	body = appendOption(body, optionEndOfOpt, nil)
+
+	if err := w.writeBlock(blockTypeInterfaceDescription, body); err != nil {
+		return 0, err
+	}
+
+	id := uint32(w.interfaces)
+	w.interfaces++
+
+	return id, nil
+}
+
+// WritePacket writes an enhanced packet block.
+func (w *Writer) WritePacket(interfaceID uint32, ts time.Time, packet []byte) error {
+	nanos := uint64(ts.UnixNano())
+
+	body := make([]byte, 0, 20+len(packet)+3)
+	body = order.AppendUint32(body, interfaceID)
+	body = order.AppendUint32(body, uint32(nanos>>32))
+	body = order.AppendUint32(body, uint32(nanos))
+	body = order.AppendUint32(body, uint32(len(packet)))
+	body = order.AppendUint32(body, uint32(len(packet)))
+	body = appendPadded(body, packet)
+
+	return w.writeBlock(blockTypeEnhancedPacket, body)
+}
+
+// WriteTLSKeyLog writes a decryption secrets block holding NSS key log lines.
+// Wireshark only uses secrets that appear before the packets they decrypt.
+func (w *Writer) WriteTLSKeyLog(keyLog []byte) error {
+	body := make([]byte, 0, 8+len(keyLog)+3)
+	body = order.AppendUint32(body, secretsTypeTLSKeyLog)
+	body = order.AppendUint32(body, uint32(len(keyLog)))
+	body = appendPadded(body, keyLog)
+
+	return w.writeBlock(blockTypeDecryptionSecrets, body)
+}
+
+func (w *Writer) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+
+	block := make([]byte, 0, length)
+	block = order.AppendUint32(block, blockType)
+	block = order.AppendUint32(block, length)
+	block = append(block, body...)
+	block = order.AppendUint32(block, length)
+
+	_, err := w.w.Write(block)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = order.AppendUint16(b, code)
+	b = order.AppendUint16(b, uint16(len(value)))
+
+	return appendPadded(b, value)
+}
+
+// appendPadded appends data padded to 32 bits.
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	padding := (4 - len(data)%4) % 4
+
+	return append(b, make([]byte, padding)...)
+}
@@ -0,0 +1,210 @@
+package pcapng
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"toss/tunnel"
+)
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// readBlocks splits a section into its blocks, checking the lengths around each body.
+func readBlocks(t *testing.T, data []byte) []block {
+	t.Helper()
+
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block of %d bytes", len(data))
+		}
+
+		length := order.Uint32(data[4:])
+		if length%4 != 0 || length < 12 || int(length) > len(data) {
+			t.Fatalf("block length %d of %d bytes left", length, len(data))
+		}
+		if trailing := order.Uint32(data[length-4:]); trailing != length {
+			t.Fatalf("block length %d, trailing length %d", length, trailing)
+		}
+
+		blocks = append(blocks, block{blockType: order.Uint32(data), body: data[8 : length-4]})
+		data = data[length:]
+	}
+
+	return blocks
+}
+
+// readOptions returns the values of the options by code, up to opt_endofopt.
+func readOptions(t *testing.T, b []byte) map[uint16][]byte {
+	t.Helper()
+
+	options := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		code, length := order.Uint16(b), int(order.Uint16(b[2:]))
+		if code == optionEndOfOpt {
+			return options
+		}
+
+		padded := length + (4-length%4)%4
+		if 4+padded > len(b) {
+			t.Fatalf("option %d of %d bytes overflows", code, length)
+		}
+		options[code] = b[4 : 4+length]
+		b = b[4+padded:]
+	}
+
+	t.Fatal("options without opt_endofopt")
+	return nil
+}
+
+func TestWriterBlocks(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, "toss test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"downstream", "upstream"} {
+		if id, err := w.AddInterface(name, LinkTypeRaw); err != nil || id != uint32(i) {
+			t.Fatalf("interface %s: id %d, %v", name, id, err)
+		}
+	}
+
+	ts := time.Unix(1_700_000_000, 123_456_789)
+	packet := []byte("12345")
+	if err := w.WritePacket(1, ts, packet); err != nil {
+		t.Fatal(err)
+	}
+	keyLog := []byte("CLIENT_RANDOM 0a 0b\n")
+	if err := w.WriteTLSKeyLog(keyLog); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 5 {
+		t.Fatalf("%d blocks, want 5", len(blocks))
+	}
+
+	shb := blocks[0]
+	if shb.blockType != blockTypeSectionHeader || order.Uint32(shb.body) != byteOrderMagic ||
+		order.Uint16(shb.body[4:]) != 1 || order.Uint16(shb.body[6:]) != 0 || order.Uint64(shb.body[8:]) != ^uint64(0) {
+		t.Errorf("section header %x", shb.body)
+	}
+	if app := readOptions(t, shb.body[16:])[optionShbUserApp]; string(app) != "toss test" {
+		t.Errorf("shb_userappl %q", app)
+	}
+
+	for i, name := range []string{"downstream", "upstream"} {
+		idb := blocks[1+i]
+		if idb.blockType != blockTypeInterfaceDescription || order.Uint16(idb.body) != LinkTypeRaw || order.Uint32(idb.body[4:]) != 0 {
+			t.Errorf("interface %s: %x", name, idb.body)
+		}
+		options := readOptions(t, idb.body[8:])
+		if string(options[optionIfName]) != name || !bytes.Equal(options[optionIfTsResol], []byte{tsResolNanoseconds}) {
+			t.Errorf("interface %s options %q", name, options)
+		}
+	}
+
+	epb := blocks[3]
+	nanos := uint64(ts.UnixNano())
+	if epb.blockType != blockTypeEnhancedPacket || order.Uint32(epb.body) != 1 ||
+		order.Uint32(epb.body[4:]) != uint32(nanos>>32) || order.Uint32(epb.body[8:]) != uint32(nanos) ||
+		order.Uint32(epb.body[12:]) != uint32(len(packet)) || order.Uint32(epb.body[16:]) != uint32(len(packet)) {
+		t.Errorf("enhanced packet header %x", epb.body[:20])
+	}
+	if data := epb.body[20:]; !bytes.Equal(data, append(packet, 0, 0, 0)) {
+		t.Errorf("packet data %q, want it padded with zeros to 32 bits", data)
+	}
+
+	dsb := blocks[4]
+	if dsb.blockType != blockTypeDecryptionSecrets || order.Uint32(dsb.body) != secretsTypeTLSKeyLog || order.Uint32(dsb.body[4:]) != uint32(len(keyLog)) {
+		t.Errorf("decryption secrets header %x", dsb.body[:8])
+	}
+	if data := dsb.body[8:]; len(data)%4 != 0 || !bytes.Equal(data[:len(keyLog)], keyLog) || !bytes.Equal(data[len(keyLog):], make([]byte, len(data)-len(keyLog))) {
+		t.Errorf("secrets %q", data)
+	}
+}
+
+func TestTunnelCapture(t *testing.T) {
+	client, downstream := net.Pipe()
+	upstream, origin := net.Pipe()
+	for _, conn := range []net.Conn{client, downstream, upstream, origin} {
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+
+	tun := tunnel.NewTunnelFromConn(context.Background(),
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+		downstream, upstream)
+
+	path := filepath.Join(t.TempDir(), "tunnel.pcapng")
+	capture, err := NewTunnelCapture(path, tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the secrets of the handshake come before the packets they decrypt
+	keyLog := []byte("CLIENT_RANDOM 0a 0b\n")
+	if n, err := capture.Write(keyLog); err != nil || n != len(keyLog) {
+		t.Fatalf("write key log: %d, %v", n, err)
+	}
+	capture.Observe(tunnel.SideDownstream, true, []byte("hello"))
+	capture.Observe(tunnel.SideDownstream, false, bytes.Repeat([]byte("w"), maxSegmentSize+1))
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readBlocks(t, data)
+
+	wantTypes := []uint32{blockTypeSectionHeader, blockTypeInterfaceDescription, blockTypeInterfaceDescription, blockTypeDecryptionSecrets}
+	// SYN, SYN-ACK, ACK, one client segment, two server segments and the FIN exchange
+	for range 3 + 1 + 2 + 3 {
+		wantTypes = append(wantTypes, blockTypeEnhancedPacket)
+	}
+	if len(blocks) != len(wantTypes) {
+		t.Fatalf("%d blocks, want %d", len(blocks), len(wantTypes))
+	}
+	for i, b := range blocks {
+		if b.blockType != wantTypes[i] {
+			t.Errorf("block %d of type %#x, want %#x", i, b.blockType, wantTypes[i])
+		}
+	}
+
+	client4, server4 := net.ParseIP("10.0.0.2").To4(), net.ParseIP("192.0.2.1").To4()
+	var payloads [][]byte
+	for _, b := range blocks[4:] {
+		if id := order.Uint32(b.body); id != 0 {
+			t.Errorf("packet on interface %d, want the downstream one", id)
+		}
+		packet := b.body[20 : 20+order.Uint32(b.body[12:])]
+
+		header, segment := packet[:20], packet[20:]
+		if checksum(nil, header) != 0 {
+			t.Errorf("invalid ipv4 header checksum")
+		}
+		src, dst := net.IP(header[12:16]), net.IP(header[16:20])
+		if !(src.Equal(client4) && dst.Equal(server4)) && !(src.Equal(server4) && dst.Equal(client4)) {
+			t.Errorf("packet from %s to %s", src, dst)
+		}
+		if checksum(pseudoHeader(src, dst, len(segment)), segment) != 0 {
+			t.Errorf("invalid tcp checksum")
+		}
+		if payload := segment[20:]; len(payload) > 0 {
+			payloads = append(payloads, payload)
+		}
+	}
+
+	if len(payloads) != 3 || string(payloads[0]) != "hello" || len(payloads[1]) != maxSegmentSize || len(payloads[2]) != 1 {
+		t.Errorf("%d segments with payload", len(payloads))
+	}
+}
@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// RuleAutoBypass is the rule name of the decisions made by AutoBypass.
+const RuleAutoBypass = "autoBypass"
+
+// AutoBypass bypasses the tunnels that Policy would intercept when their client refused the forged
+// certificate of the server name before, e.g. an app pinning the certificate of its api server.
+// Rejecting and closing decisions of Policy are kept.
+type AutoBypass struct {
+	Policy  Policy
+	Learned *Learned
+}
+
+func (a *AutoBypass) Decide(ctx *Context) Decision {
+	decision := a.Policy.Decide(ctx)
+	if decision.Action != ActionIntercept || ctx.Protocol != ProtocolTls {
+		return decision
+	}
+
+	if _, ok := a.Learned.Lookup(ctx); ok {
+		return Decision{Action: ActionBypass, Rule: RuleAutoBypass}
+	}
+
+	return decision
+}
+
+// Learned remembers for a while which clients refused the forged certificate of which server name.
+// Clients are told apart by source ip, tunnels without SNI by destination ip.
+// A nil *Learned remembers nothing.
+type Learned struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[learnedKey]LearnedEntry
+}
+
+type learnedKey struct {
+	client     string
+	serverName string
+}
+
+type LearnedEntry struct {
+	Client     string
+	ServerName string
+	// Reason tells how the client refused the certificate, e.g. "unknown_ca" or "closed".
+	Reason  string
+	Expires time.Time
+}
+
+// NewLearned keeps at most size entries, the ones expiring first make room for new ones.
+func NewLearned(size int) *Learned {
+	return &Learned{
+		size:    size,
+		entries: make(map[learnedKey]LearnedEntry),
+	}
+}
+
+// Learn remembers the client and server name of ctx for ttl. It reports whether they were not known yet.
+func (l *Learned) Learn(ctx *Context, reason string, ttl time.Duration) (LearnedEntry, bool) {
+	key, ok := keyOf(ctx)
+	if l == nil || !ok {
+		return LearnedEntry{}, false
+	}
+
+	now := time.Now()
+	entry := LearnedEntry{
+		Client:     key.client,
+		ServerName: key.serverName,
+		Reason:     reason,
+		Expires:    now.Add(ttl),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	prev, exists := l.entries[key]
+	if !exists && len(l.entries) >= l.size {
+		l.evict(now)
+	}
+	l.entries[key] = entry
+
+	return entry, !exists || !now.Before(prev.Expires)
+}
+
+// Lookup returns the unexpired entry of the client and server name of ctx.
+func (l *Learned) Lookup(ctx *Context) (LearnedEntry, bool) {
+	key, ok := keyOf(ctx)
+	if l == nil || !ok {
+		return LearnedEntry{}, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return LearnedEntry{}, false
+	}
+
+	if !time.Now().Before(entry.Expires) {
+		delete(l.entries, key)
+		return LearnedEntry{}, false
+	}
+
+	return entry, true
+}
+
+// Entries returns the unexpired entries, the one expiring first first.
+func (l *Learned) Entries() []LearnedEntry {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	entries := make([]LearnedEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		if now.Before(entry.Expires) {
+			entries = append(entries, entry)
+		}
+	}
+	l.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b LearnedEntry) int {
+		return a.Expires.Compare(b.Expires)
+	})
+
+	return entries
+}
+
+// Forget removes the entries of client, or of every client when client is empty, whose server name
+// is serverName, or any when serverName is empty. It returns how many entries were removed.
+func (l *Learned) Forget(client, serverName string) int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for key := range l.entries {
+		if (client == "" || key.client == client) && (serverName == "" || key.serverName == serverName) {
+			delete(l.entries, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// Len is the number of entries, including expired ones not removed yet.
+func (l *Learned) Len() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+// evict removes the expired entries and, if still full, the tenth of the entries expiring first,
+// so that a full store is not scanned again on the next insert. l.mu must be held.
+func (l *Learned) evict(now time.Time) {
+	for key, entry := range l.entries {
+		if !now.Before(entry.Expires) {
+			delete(l.entries, key)
+		}
+	}
+
+	if len(l.entries) < l.size {
+		return
+	}
+
+	type expiry struct {
+		key     learnedKey
+		expires time.Time
+	}
+
+	byExpiry := make([]expiry, 0, len(l.entries))
+	for key, entry := range l.entries {
+		byExpiry = append(byExpiry, expiry{key, entry.Expires})
+	}
+	slices.SortFunc(byExpiry, func(a, b expiry) int {
+		return a.expires.Compare(b.expires)
+	})
+
+	n := min(len(byExpiry), len(byExpiry)-l.size+max(l.size/10, 1))
+	for _, e := range byExpiry[:n] {
+		delete(l.entries, e.key)
+	}
+}
+
+func keyOf(ctx *Context) (learnedKey, bool) {
+	if ctx.Src == nil {
+		return learnedKey{}, false
+	}
+
+	key := learnedKey{client: ctx.Src.IP.String()}
+	switch {
+	case ctx.ClientHello.ServerName() != "":
+		key.serverName = ctx.ClientHello.ServerName()
+	case ctx.Dst != nil:
+		key.serverName = ctx.Dst.IP.String()
+	default:
+		return learnedKey{}, false
+	}
+
+	return key, true
+}
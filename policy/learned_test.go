@@ -0,0 +1,229 @@
+package policy
+
+import (
+	"net"
+	"testing"
+	"time"
+	"toss/tls/clienthello"
+)
+
+func learnedContext(client, serverName, dst string) *Context {
+	ctx := &Context{Protocol: ProtocolTls}
+	if client != "" {
+		ctx.Src = &net.TCPAddr{IP: net.ParseIP(client), Port: 50000}
+	}
+	if dst != "" {
+		ctx.Dst = &net.TCPAddr{IP: net.ParseIP(dst), Port: 443}
+	}
+	if serverName != "" {
+		ctx.ClientHello = &clienthello.ClientHello{ServerNames: []string{serverName}}
+	}
+
+	return ctx
+}
+
+func TestKeyOf(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  *Context
+		want learnedKey
+		ok   bool
+	}{
+		{name: "sni", ctx: learnedContext("10.0.0.2", "example.com", "93.184.216.34"), want: learnedKey{"10.0.0.2", "example.com"}, ok: true},
+		{name: "no sni falls back to dst ip", ctx: learnedContext("10.0.0.2", "", "93.184.216.34"), want: learnedKey{"10.0.0.2", "93.184.216.34"}, ok: true},
+		{name: "ipv6", ctx: learnedContext("fd00::2", "", "2001:db8::1"), want: learnedKey{"fd00::2", "2001:db8::1"}, ok: true},
+		{name: "no src", ctx: learnedContext("", "example.com", "93.184.216.34")},
+		{name: "no sni nor dst", ctx: learnedContext("10.0.0.2", "", "")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := keyOf(tt.ctx)
+			if ok != tt.ok || key != tt.want {
+				t.Errorf("keyOf = %+v, %v, want %+v, %v", key, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLearnedLearnLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		// ttls are the ttls of the successive Learn calls for the same client and server name
+		ttls        []time.Duration
+		wantLearned []bool
+		wantFound   bool
+	}{
+		{name: "new", ttls: []time.Duration{time.Hour}, wantLearned: []bool{true}, wantFound: true},
+		{name: "expired", ttls: []time.Duration{0}, wantLearned: []bool{true}, wantFound: false},
+		{name: "known", ttls: []time.Duration{time.Hour, time.Hour}, wantLearned: []bool{true, false}, wantFound: true},
+		{name: "learned again after expiry", ttls: []time.Duration{0, time.Hour}, wantLearned: []bool{true, true}, wantFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLearned(10)
+			ctx := learnedContext("10.0.0.2", "example.com", "93.184.216.34")
+
+			for i, ttl := range tt.ttls {
+				if _, learned := l.Learn(ctx, "unknown_ca", ttl); learned != tt.wantLearned[i] {
+					t.Errorf("Learn #%d learned %v, want %v", i, learned, tt.wantLearned[i])
+				}
+			}
+
+			entry, found := l.Lookup(ctx)
+			if found != tt.wantFound {
+				t.Fatalf("Lookup found %v, want %v", found, tt.wantFound)
+			}
+			if found && (entry.Client != "10.0.0.2" || entry.ServerName != "example.com" || entry.Reason != "unknown_ca") {
+				t.Errorf("Lookup = %+v", entry)
+			}
+
+			// another client or server name is not affected
+			if _, found := l.Lookup(learnedContext("10.0.0.3", "example.com", "93.184.216.34")); found {
+				t.Error("Lookup found the entry for another client")
+			}
+			if _, found := l.Lookup(learnedContext("10.0.0.2", "example.org", "93.184.216.34")); found {
+				t.Error("Lookup found the entry for another server name")
+			}
+		})
+	}
+}
+
+func TestLearnedEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		expired int
+		valid   int
+		wantLen int
+	}{
+		{name: "expired first", size: 10, expired: 3, valid: 7, wantLen: 8},
+		{name: "expiring first", size: 10, valid: 10, wantLen: 10},
+		{name: "size 1", size: 1, valid: 1, wantLen: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLearned(tt.size)
+
+			for i := range tt.expired {
+				l.Learn(learnedContext("10.0.0.2", "expired"+string(rune('a'+i)), ""), "closed", 0)
+			}
+			for i := range tt.valid {
+				l.Learn(learnedContext("10.0.0.2", "valid"+string(rune('a'+i)), ""), "closed", time.Duration(i+1)*time.Hour)
+			}
+
+			newcomer := learnedContext("10.0.0.2", "newcomer.example.com", "")
+			l.Learn(newcomer, "closed", 100*time.Hour)
+
+			if l.Len() > tt.size {
+				t.Errorf("Len = %d over size %d", l.Len(), tt.size)
+			}
+			if l.Len() != tt.wantLen {
+				t.Errorf("Len = %d, want %d", l.Len(), tt.wantLen)
+			}
+			if _, found := l.Lookup(newcomer); !found {
+				t.Error("the new entry was evicted")
+			}
+			if tt.expired == 0 && tt.valid > 1 {
+				if _, found := l.Lookup(learnedContext("10.0.0.2", "valida", "")); found {
+					t.Error("the entry expiring first was kept")
+				}
+				last := "valid" + string(rune('a'+tt.valid-1))
+				if _, found := l.Lookup(learnedContext("10.0.0.2", last, "")); !found {
+					t.Error("the entry expiring last was evicted")
+				}
+			}
+		})
+	}
+}
+
+func TestLearnedForget(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     string
+		serverName string
+		want       int
+	}{
+		{name: "client", client: "10.0.0.2", want: 2},
+		{name: "server name", serverName: "example.com", want: 2},
+		{name: "client and server name", client: "10.0.0.2", serverName: "example.com", want: 1},
+		{name: "all", want: 3},
+		{name: "unknown client", client: "10.0.0.9", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLearned(10)
+			l.Learn(learnedContext("10.0.0.2", "example.com", ""), "unknown_ca", time.Hour)
+			l.Learn(learnedContext("10.0.0.2", "example.org", ""), "unknown_ca", 2*time.Hour)
+			l.Learn(learnedContext("10.0.0.3", "example.com", ""), "bad_certificate", 3*time.Hour)
+
+			if n := l.Forget(tt.client, tt.serverName); n != tt.want {
+				t.Errorf("Forget = %d, want %d", n, tt.want)
+			}
+			if n := len(l.Entries()); n != 3-tt.want {
+				t.Errorf("%d entries left, want %d", n, 3-tt.want)
+			}
+		})
+	}
+}
+
+func TestLearnedEntries(t *testing.T) {
+	l := NewLearned(10)
+	l.Learn(learnedContext("10.0.0.2", "later.example.com", ""), "closed", 2*time.Hour)
+	l.Learn(learnedContext("10.0.0.2", "expired.example.com", ""), "closed", 0)
+	l.Learn(learnedContext("10.0.0.2", "sooner.example.com", ""), "closed", time.Hour)
+
+	entries := l.Entries()
+	if len(entries) != 2 || entries[0].ServerName != "sooner.example.com" || entries[1].ServerName != "later.example.com" {
+		t.Errorf("Entries = %+v", entries)
+	}
+}
+
+func TestLearnedNil(t *testing.T) {
+	var l *Learned
+	ctx := learnedContext("10.0.0.2", "example.com", "")
+
+	if _, learned := l.Learn(ctx, "closed", time.Hour); learned {
+		t.Error("nil Learned learned")
+	}
+	if _, found := l.Lookup(ctx); found {
+		t.Error("nil Learned found an entry")
+	}
+	if l.Len() != 0 || l.Entries() != nil || l.Forget("", "") != 0 {
+		t.Error("nil Learned is not empty")
+	}
+}
+
+func TestAutoBypassDecide(t *testing.T) {
+	learned := NewLearned(10)
+	learned.Learn(learnedContext("10.0.0.2", "pinned.example.com", ""), "bad_certificate", time.Hour)
+
+	pinned := learnedContext("10.0.0.2", "pinned.example.com", "")
+	http := learnedContext("10.0.0.2", "pinned.example.com", "")
+	http.Protocol = "http11"
+
+	tests := []struct {
+		name   string
+		policy Decision
+		ctx    *Context
+		want   Decision
+	}{
+		{name: "learned", policy: Decision{Action: ActionIntercept}, ctx: pinned, want: Decision{Action: ActionBypass, Rule: RuleAutoBypass}},
+		{name: "not learned", policy: Decision{Action: ActionIntercept}, ctx: learnedContext("10.0.0.3", "pinned.example.com", ""), want: Decision{Action: ActionIntercept}},
+		{name: "not tls", policy: Decision{Action: ActionIntercept}, ctx: http, want: Decision{Action: ActionIntercept}},
+		{name: "reject kept", policy: Decision{Action: ActionReject, Rule: "deny"}, ctx: pinned, want: Decision{Action: ActionReject, Rule: "deny"}},
+		{name: "close kept", policy: Decision{Action: ActionClose, Rule: "drop"}, ctx: pinned, want: Decision{Action: ActionClose, Rule: "drop"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &AutoBypass{Policy: Static(tt.policy), Learned: learned}
+			if got := a.Decide(tt.ctx); got != tt.want {
+				t.Errorf("Decide = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"toss/tls/clienthello"
+)
+
+type Action uint8
+
+const (
+	// ActionIntercept hands the tunnel to the handler of the matched detector.
+	ActionIntercept = Action(iota)
+	// ActionBypass pipes the tunnel through untouched.
+	ActionBypass
+	// ActionReject refuses the client with a TCP RST or a TLS alert.
+	ActionReject
+	// ActionClose closes both sides without a response.
+	ActionClose
+)
+
+var actionNames = map[Action]string{
+	ActionIntercept: "intercept",
+	ActionBypass:    "bypass",
+	ActionReject:    "reject",
+	ActionClose:     "close",
+}
+
+func (a Action) String() string {
+	if name, ok := actionNames[a]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Action(%d)", uint8(a))
+}
+
+func ParseAction(s string) (Action, error) {
+	for action, name := range actionNames {
+		if name == s {
+			return action, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown action %q (known: intercept, bypass, reject, close)", s)
+}
+
+type RejectMode uint8
+
+const (
+	RejectRST = RejectMode(iota)
+	RejectTlsAlert
+)
+
+func (m RejectMode) String() string {
+	switch m {
+	case RejectRST:
+		return "rst"
+	case RejectTlsAlert:
+		return "tls-alert"
+	}
+
+	return fmt.Sprintf("RejectMode(%d)", uint8(m))
+}
+
+func ParseRejectMode(s string) (RejectMode, error) {
+	switch s {
+	case "", "rst":
+		return RejectRST, nil
+	case "tls-alert":
+		return RejectTlsAlert, nil
+	}
+
+	return 0, fmt.Errorf("unknown reject mode %q (known: rst, tls-alert)", s)
+}
+
+// Context is everything known about a tunnel when the policy is consulted.
+type Context struct {
+	TunnelID string
+
+	Src *net.TCPAddr
+	Dst *net.TCPAddr
+
+	// Protocol is the name of the matched detector, ProtocolUnknown when none matched.
+	Protocol string
+
+	// ClientHello is the decoded TLS ClientHello, nil for other protocols.
+	ClientHello *clienthello.ClientHello
+	// JA3 and JA4 are the fingerprints of ClientHello, empty for other protocols.
+	JA3 string
+	JA4 string
+
+	// Client is the name of the client group the source belongs to.
+	// Policies resolve it from Src when left empty.
+	Client string
+}
+
+// ServerNames are the SNI names of the ClientHello.
+func (ctx *Context) ServerNames() []string {
+	if ctx.ClientHello == nil {
+		return nil
+	}
+
+	return ctx.ClientHello.ServerNames
+}
+
+// ALPN are the protocols offered in the ClientHello.
+func (ctx *Context) ALPN() []string {
+	if ctx.ClientHello == nil {
+		return nil
+	}
+
+	return ctx.ClientHello.ALPN
+}
+
+const (
+	ProtocolUnknown = "unknown"
+	ProtocolTls     = "tls"
+)
+
+type Decision struct {
+	Action Action
+	Reject RejectMode
+
+	// Rule is the name of the rule that produced the decision, empty for the default.
+	Rule string
+}
+
+type Policy interface {
+	Decide(ctx *Context) Decision
+}
+
+// Static always returns the same decision.
+type Static Decision
+
+func (s Static) Decide(*Context) Decision {
+	return Decision(s)
+}
@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"net"
+	"slices"
+	"toss/matcher"
+)
+
+// Client names a group of source addresses, e.g. the WireGuard peers of the QA devices.
+type Client struct {
+	Name string
+	Src  *matcher.Matcher
+}
+
+// Rule matches when every condition that is set matches. Unset conditions match anything.
+type Rule struct {
+	Name string
+
+	// ServerNames matches any of the SNI names, a tunnel without SNI never matches.
+	ServerNames *matcher.Matcher
+	Dst         *matcher.Matcher
+	Src         *matcher.Matcher
+	Clients     []string
+	Protocols   []string
+	// ALPN matches when the client offers any of the protocols.
+	ALPN []string
+	// JA3 and JA4 match any of the fingerprints of the TLS ClientHello.
+	JA3 []string
+	JA4 []string
+
+	Decision Decision
+}
+
+// RuleSet is a declarative Policy: the first matching rule decides, otherwise Default.
+type RuleSet struct {
+	Clients []Client
+	Rules   []Rule
+	Default Decision
+}
+
+func (s *RuleSet) Decide(ctx *Context) Decision {
+	client := ctx.Client
+	if client == "" {
+		client = s.Identify(ctx.Src)
+	}
+
+	for _, rule := range s.Rules {
+		if rule.matches(ctx, client) {
+			decision := rule.Decision
+			decision.Rule = rule.Name
+			return decision
+		}
+	}
+
+	return s.Default
+}
+
+// Identify returns the name of the first client group containing src.
+func (s *RuleSet) Identify(src *net.TCPAddr) string {
+	return identify(s.Clients, src)
+}
+
+// Filter selects tunnels with the conditions of a single rule, for features that apply
+// to some tunnels only, e.g. the TLS key log. The decision of the rule is not used.
+type Filter struct {
+	Clients []Client
+	Rule    Rule
+}
+
+func (f *Filter) Match(ctx *Context) bool {
+	client := ctx.Client
+	if client == "" {
+		client = identify(f.Clients, ctx.Src)
+	}
+
+	return f.Rule.matches(ctx, client)
+}
+
+func identify(clients []Client, src *net.TCPAddr) string {
+	if src == nil {
+		return ""
+	}
+
+	for _, client := range clients {
+		if _, ok := client.Src.MatchIP(src.IP, 0); ok {
+			return client.Name
+		}
+	}
+
+	return ""
+}
+
+func (r *Rule) matches(ctx *Context, client string) bool {
+	if len(r.Protocols) > 0 && !slices.Contains(r.Protocols, ctx.Protocol) {
+		return false
+	}
+
+	if len(r.Clients) > 0 && !slices.Contains(r.Clients, client) {
+		return false
+	}
+
+	if len(r.JA3) > 0 && !slices.Contains(r.JA3, ctx.JA3) {
+		return false
+	}
+
+	if len(r.JA4) > 0 && !slices.Contains(r.JA4, ctx.JA4) {
+		return false
+	}
+
+	if len(r.ALPN) > 0 && !slices.ContainsFunc(ctx.ALPN(), func(proto string) bool { return slices.Contains(r.ALPN, proto) }) {
+		return false
+	}
+
+	if r.Src != nil {
+		if ctx.Src == nil {
+			return false
+		}
+		if _, ok := r.Src.MatchIP(ctx.Src.IP, 0); !ok {
+			return false
+		}
+	}
+
+	dstPort := 0
+	if ctx.Dst != nil {
+		dstPort = ctx.Dst.Port
+	}
+
+	if r.Dst != nil {
+		if ctx.Dst == nil {
+			return false
+		}
+		if _, ok := r.Dst.MatchIP(ctx.Dst.IP, dstPort); !ok {
+			return false
+		}
+	}
+
+	if r.ServerNames != nil {
+		matched := false
+		for _, name := range ctx.ServerNames() {
+			if _, ok := r.ServerNames.MatchName(name, dstPort); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"toss/cert"
+	"toss/config"
+	"toss/matcher"
+	"toss/onboarding"
+	"toss/policy"
+	"toss/tunnel/handler"
+)
+
+// runtimeConfig is an immutable snapshot of the settings a tunnel runs with.
+// Each tunnel loads it once when accepted, so a reload only affects new tunnels.
+type runtimeConfig struct {
+	conf           *config.Config
+	handlerOptions *handler.Options
+	certManager    *cert.Manager
+	// proxyAllowed are the destinations on the proxy host the explicit proxy connects to.
+	proxyAllowed *matcher.Matcher
+}
+
+// autoBypassSize bounds the learned clients and server names.
+const autoBypassSize = 10000
+
+var (
+	current  atomic.Pointer[runtimeConfig]
+	reloadMu sync.Mutex
+
+	// autoBypass is shared by the snapshots, so a reload does not forget the learned clients.
+	autoBypass = policy.NewLearned(autoBypassSize)
+)
+
+func newRuntimeConfig(conf *config.Config, prev *runtimeConfig) (*runtimeConfig, error) {
+	var certManager *cert.Manager
+	// the files are read again when they were replaced, e.g. by "toss ca rotate"
+	if prev != nil && prev.conf.CA == conf.CA && !prev.certManager.Stale() {
+		certManager = prev.certManager
+	} else {
+		certOptions, err := conf.BuildCertOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		certManager, err = cert.NewCertManager(slog.Default(), conf.CA.Cert, conf.CA.Key, certOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	handlerOptions, err := newHandlerOptions(conf, certManager)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyAllowed, err := conf.BuildProxyAllowedDestinations()
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtimeConfig{
+		conf:           conf,
+		handlerOptions: handlerOptions,
+		certManager:    certManager,
+		proxyAllowed:   proxyAllowed,
+	}, nil
+}
+
+func newHandlerOptions(conf *config.Config, certManager *cert.Manager) (*handler.Options, error) {
+	ruleSet, err := conf.BuildPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	keyLogFilter, err := conf.BuildKeyLogFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamVerifier, err := conf.BuildUpstreamVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	ja4Names, ja4sNames, err := conf.BuildFingerprintNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var onboardingServer *onboarding.Server
+	if conf.Onboarding.Host != "" {
+		onboardingServer = onboarding.NewServer(conf.Onboarding.Host, certManager.Root())
+	}
+
+	var (
+		pol            policy.Policy = ruleSet
+		learnedClients *policy.Learned
+	)
+	if conf.AutoBypass.TTL > 0 {
+		pol = &policy.AutoBypass{Policy: ruleSet, Learned: autoBypass}
+		learnedClients = autoBypass
+	}
+
+	return &handler.Options{
+		FirstByteTimeout: conf.Timeouts.FirstByte,
+		DetectTimeout:    conf.Detection.Timeout,
+		DetectMaxBytes:   conf.Detection.MaxBytes,
+		BodyPreviewSize:  conf.BodyPreviewSize,
+		Policy:           pol,
+		Recorder:         recorder,
+		KeyLog:           keyLogFile,
+		KeyLogFilter:     keyLogFilter,
+		UpstreamVerifier: upstreamVerifier,
+		Onboarding:       onboardingServer,
+		AutoBypass:       learnedClients,
+		AutoBypassTTL:    conf.AutoBypass.TTL,
+		JA4Names:         ja4Names,
+		JA4SNames:        ja4sNames,
+	}, nil
+}
+
+// loadConfig reads the config with the flags and environment of the process.
+func loadConfig() (*config.Config, error) {
+	return config.Load(os.Args[1:], os.LookupEnv)
+}
+
+// reloadConfig re-reads the config with load and swaps the snapshot used by new tunnels.
+// On error the previous snapshot is kept.
+func reloadConfig(reason string, load func() (*config.Config, error)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	logger := slog.Default().With("reason", reason)
+	prev := current.Load()
+
+	conf, err := load()
+	if err != nil {
+		logger.Error("reload config: keep previous config", slog.Any("error", err))
+		return
+	}
+
+	if conf.Listen != prev.conf.Listen {
+		logger.Warn("reload config: listen address change requires restart", "listen", prev.conf.Listen, "requested", conf.Listen)
+	}
+
+	if conf.ExplicitProxy.Listen != prev.conf.ExplicitProxy.Listen {
+		logger.Warn("reload config: explicit proxy listen address change requires restart", "listen", prev.conf.ExplicitProxy.Listen, "requested", conf.ExplicitProxy.Listen)
+	}
+
+	if conf.Admin.Listen != prev.conf.Admin.Listen {
+		logger.Warn("reload config: admin listen address change requires restart", "listen", prev.conf.Admin.Listen, "requested", conf.Admin.Listen)
+	}
+
+	if conf.Metrics.Listen != prev.conf.Metrics.Listen {
+		logger.Warn("reload config: metrics listen address change requires restart", "listen", prev.conf.Metrics.Listen, "requested", conf.Metrics.Listen)
+	}
+
+	if conf.HAR != prev.conf.HAR {
+		logger.Warn("reload config: har change requires restart")
+	}
+
+	if conf.KeyLog.File != prev.conf.KeyLog.File || conf.KeyLog.MaxSize != prev.conf.KeyLog.MaxSize || conf.KeyLog.MaxFiles != prev.conf.KeyLog.MaxFiles {
+		logger.Warn("reload config: key log file change requires restart, the filter is reloaded")
+	}
+
+	rc, err := newRuntimeConfig(conf, prev)
+	if err != nil {
+		logger.Error("reload config: keep previous config", slog.Any("error", err))
+		return
+	}
+
+	current.Store(rc)
+	logger.Info("config reloaded", "path", conf.Path)
+}
+
+// watchReload reloads the config with load on SIGHUP and, when a config file is used, on file
+// changes. The file is watched with the reload.watchInterval of the current snapshot, a reload
+// changing it restarts the watch.
+func watchReload(ctx context.Context, load func() (*config.Config, error)) {
+	fileChanged := make(chan struct{}, 1)
+	watch := &fileWatch{ctx: ctx, onChange: func() {
+		select {
+		case fileChanged <- struct{}{}:
+		default:
+		}
+	}}
+	defer watch.stop()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		watch.update(current.Load().conf)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			reloadConfig("SIGHUP", load)
+		case <-fileChanged:
+			reloadConfig("file changed", load)
+		}
+	}
+}
+
+// fileWatch runs config.Watch with the path and interval of the last config passed to update.
+type fileWatch struct {
+	ctx      context.Context
+	onChange func()
+
+	path     string
+	interval time.Duration
+	cancel   context.CancelFunc
+}
+
+// update restarts the watch when conf changed its path or interval, a zero interval stops it.
+func (w *fileWatch) update(conf *config.Config) {
+	if w.cancel != nil && conf.Path == w.path && conf.Reload.WatchInterval == w.interval {
+		return
+	}
+
+	w.stop()
+	w.path, w.interval = conf.Path, conf.Reload.WatchInterval
+	if w.path == "" || w.interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.cancel = cancel
+	go config.Watch(ctx, w.path, w.interval, w.onChange)
+}
+
+func (w *fileWatch) stop() {
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"toss/config"
+	"toss/tunnel/tunneltest"
+)
+
+// newTestReloadConfig returns a config serving the explicit proxy with the CA created in dir by
+// "toss ca init" and the onboarding site on onboardingHost.
+func newTestReloadConfig(dir, onboardingHost string) *config.Config {
+	conf := config.Default()
+	conf.CA.Cert = filepath.Join(dir, caIntermediateCert)
+	conf.CA.Key = filepath.Join(dir, caIntermediateKey)
+	conf.Onboarding.Host = onboardingHost
+	conf.ExplicitProxy.AllowDestinations = []string{"127.0.0.1"}
+
+	return conf
+}
+
+// getThroughTunnel sends a GET of path for host through tun and returns the body.
+func getThroughTunnel(t *testing.T, tun *proxyTunnel, host, path string) string {
+	t.Helper()
+
+	if _, err := io.WriteString(tun.conn, "GET "+path+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(tun.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s%s: %d, %v", host, path, res.StatusCode, err)
+	}
+
+	return string(body)
+}
+
+func TestReloadKeepsLiveTunnels(t *testing.T) {
+	dir := t.TempDir()
+	runTestCA(t, 0, "init", "-dir", dir)
+	root, _ := loadTestCA(t, dir)
+	rootPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}))
+
+	origin := tunneltest.NewHTTPOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "origin")
+	}))
+
+	first, err := newRuntimeConfig(newTestReloadConfig(dir, "mitm.it"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTestExplicitProxy(t, first)
+
+	live := connectTunnel(t, addr, origin.Addr.String())
+	if body := getThroughTunnel(t, live, "mitm.it", "/ca.pem"); body != rootPEM {
+		t.Fatalf("onboarding answered %q", body)
+	}
+
+	// a failed reload keeps the snapshot
+	reloadConfig("test", func() (*config.Config, error) { return nil, errors.New("invalid") })
+	if current.Load() != first {
+		t.Fatal("failed reload replaced the snapshot")
+	}
+
+	reloadConfig("test", func() (*config.Config, error) { return newTestReloadConfig(dir, "setup.example.com"), nil })
+	reloaded := current.Load()
+	if reloaded == first || reloaded.conf.Onboarding.Host != "setup.example.com" {
+		t.Fatal("reload did not replace the snapshot")
+	}
+	if reloaded.certManager != first.certManager {
+		t.Error("reload without a ca change loaded the ca again")
+	}
+
+	// the tunnel accepted before the reload keeps answering for the previous onboarding host
+	if body := getThroughTunnel(t, live, "mitm.it", "/ca.pem"); body != rootPEM {
+		t.Errorf("live tunnel after the reload answered %q", body)
+	}
+	if requests := origin.Requests(); len(requests) != 0 {
+		t.Errorf("origin received %d requests for the previous onboarding host", len(requests))
+	}
+
+	// a new tunnel runs with the reloaded snapshot
+	next := connectTunnel(t, addr, origin.Addr.String())
+	if body := getThroughTunnel(t, next, "mitm.it", "/ca.pem"); body != "origin" {
+		t.Errorf("new tunnel answered %q, want the origin", body)
+	}
+	if body := getThroughTunnel(t, next, "setup.example.com", "/ca.pem"); body != rootPEM {
+		t.Errorf("new tunnel answered %q for the reloaded onboarding host", body)
+	}
+}
+
+func TestFileWatchUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("listen: \":3129\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := &fileWatch{ctx: ctx, onChange: func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}}
+	defer watch.stop()
+
+	conf := config.Default()
+	conf.Path = path
+	conf.Reload.WatchInterval = time.Hour
+	watch.update(conf)
+
+	appendConfig := func() {
+		t.Helper()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendConfig()
+	select {
+	case <-changed:
+		t.Fatal("change noticed before the hourly poll")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a reload shortening the interval restarts the watch
+	reloaded := *conf
+	reloaded.Reload.WatchInterval = 10 * time.Millisecond
+	watch.update(&reloaded)
+
+	// the restarted watch stamps the file when its goroutine starts, changes made before are not seen
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		appendConfig()
+
+		select {
+		case <-changed:
+		case <-time.After(50 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("change not noticed after the interval was shortened")
+			}
+			continue
+		}
+		break
+	}
+
+	disabled := reloaded
+	disabled.Reload.WatchInterval = 0
+	watch.update(&disabled)
+	if watch.cancel != nil {
+		t.Error("watch still running with a zero interval")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+	"toss/tunnel"
+)
+
+// forceCloseGrace bounds the wait for connection goroutines after their tunnels were force-closed.
+const forceCloseGrace = 5 * time.Second
+
+var (
+	tunnels     = tunnel.NewRegistry()
+	connections sync.WaitGroup
+
+	// drainCtx is the context of every tunnel, canceled when shutdown starts.
+	drainCtx, startDrain = context.WithCancel(context.Background())
+)
+
+// shutdown asks the live tunnels to finish their in-flight exchanges and
+// force-closes whatever is left when the drain timeout expires.
+func shutdown() {
+	drainConnections(tunnels, &connections, startDrain, current.Load().conf.Shutdown.DrainTimeout, forceCloseGrace)
+}
+
+// drainConnections calls startDrain and waits up to drainTimeout for the connections. The tunnels
+// left in registry are then force-closed and the connections given up to grace to return. It
+// returns how many tunnels were force-closed.
+func drainConnections(registry *tunnel.Registry, connections *sync.WaitGroup, startDrain func(), drainTimeout, grace time.Duration) (forced int) {
+	active := registry.Len()
+	start := time.Now()
+
+	slog.Info("shutting down: draining tunnels", "active", active, "drainTimeout", drainTimeout.String())
+	startDrain()
+
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		forced = registry.CloseAll()
+
+		select {
+		case <-done:
+		case <-time.After(grace):
+			slog.Warn("connections still running after force close")
+		}
+	}
+
+	slog.Info("shutdown complete",
+		"active", active,
+		"drained", max(active-forced, 0),
+		"forced", forced,
+		"elapsed", time.Since(start).String(),
+	)
+
+	return forced
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"toss/tunnel"
+)
+
+// startTestConnection registers a tunnel in registry and runs its connection like handleConnection
+// does. The connection reads the client until the tunnel or the client is closed, then waits for release.
+func startTestConnection(t *testing.T, registry *tunnel.Registry, connections *sync.WaitGroup, release <-chan struct{}) (client net.Conn) {
+	t.Helper()
+
+	client, downstream := net.Pipe()
+	upstream, origin := net.Pipe()
+	for _, conn := range []net.Conn{client, downstream, upstream, origin} {
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+
+	tun := tunnel.NewTunnelFromConn(context.Background(), client.LocalAddr(), origin.LocalAddr(), downstream, upstream)
+	registry.Add(tun)
+
+	connections.Add(1)
+	go func() {
+		defer connections.Done()
+		defer registry.Remove(tun)
+
+		_, _ = io.Copy(io.Discard, tun.Downstream.Reader)
+		<-release
+	}()
+
+	return client
+}
+
+func TestDrainConnections(t *testing.T) {
+	released := make(chan struct{})
+	close(released)
+
+	t.Run("drained", func(t *testing.T) {
+		var (
+			registry    = tunnel.NewRegistry()
+			connections sync.WaitGroup
+		)
+		client := startTestConnection(t, registry, &connections, released)
+
+		// the tunnel finishes its exchange once asked to
+		forced := drainConnections(registry, &connections, func() { _ = client.Close() }, 10*time.Second, 10*time.Second)
+		if forced != 0 || registry.Len() != 0 {
+			t.Errorf("%d tunnels forced, %d left", forced, registry.Len())
+		}
+	})
+
+	t.Run("forced after the drain timeout", func(t *testing.T) {
+		var (
+			registry    = tunnel.NewRegistry()
+			connections sync.WaitGroup
+		)
+		startTestConnection(t, registry, &connections, released)
+		startTestConnection(t, registry, &connections, released)
+
+		start := time.Now()
+		forced := drainConnections(registry, &connections, func() {}, 50*time.Millisecond, 10*time.Second)
+		if forced != 2 || registry.Len() != 0 {
+			t.Errorf("%d tunnels forced, %d left", forced, registry.Len())
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+			t.Errorf("drained in %v", elapsed)
+		}
+	})
+
+	t.Run("stuck after the force close", func(t *testing.T) {
+		var (
+			registry    = tunnel.NewRegistry()
+			connections sync.WaitGroup
+			release     = make(chan struct{})
+		)
+		startTestConnection(t, registry, &connections, release)
+
+		start := time.Now()
+		forced := drainConnections(registry, &connections, func() {}, 50*time.Millisecond, 50*time.Millisecond)
+		if forced != 1 {
+			t.Errorf("%d tunnels forced, want 1", forced)
+		}
+		// the grace bounds the wait for a connection that does not return
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+			t.Errorf("drained in %v", elapsed)
+		}
+
+		close(release)
+		connections.Wait()
+	})
+}
@@ -0,0 +1,331 @@
+// Package clienthello parses the TLS ClientHello a client sends first, across as many handshake
+// records as it was split into, and decodes the extensions the proxy looks at.
+package clienthello
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	recordHeaderLen = 5
+	// maxRecordLen is the largest record payload crypto/tls accepts, 2^14 plus the expansion allowance.
+	maxRecordLen = 1<<14 + 2048
+	// MaxLen bounds the ClientHello message, real ones are a few KB even with post-quantum key shares.
+	MaxLen = 1 << 16
+
+	contentTypeHandshake     = 0x16
+	handshakeTypeClientHello = 1
+	handshakeHeaderLen       = 4
+	maxSessionIdLen          = 32
+)
+
+var (
+	// ErrIncomplete is returned when the data ends before the ClientHello does, more data may complete it.
+	ErrIncomplete = errors.New("clienthello: incomplete")
+	// ErrNotTLS is returned when the data does not start with a TLS handshake record.
+	ErrNotTLS = errors.New("clienthello: not a TLS handshake record")
+)
+
+// MalformedError tells which part of a ClientHello could not be decoded.
+type MalformedError struct {
+	Field string
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("clienthello: malformed %s", e.Field)
+}
+
+func malformed(field string) error {
+	return &MalformedError{Field: field}
+}
+
+// ClientHello is a decoded ClientHello. The lists keep the order and the GREASE values the
+// client sent, see IsGrease.
+type ClientHello struct {
+	// Version is the legacy version of the message, 0x0303 for TLS 1.2 and 1.3.
+	Version uint16
+	// RecordVersion is the version of the first record, 0x0301 for most clients.
+	RecordVersion uint16
+	// Records is the number of records the message was split into.
+	Records int
+
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []uint16
+	CompressionMethods []uint8
+
+	// Extensions are the extension types in the order they were sent.
+	Extensions []uint16
+
+	ServerNames         []string
+	ALPN                []string
+	SupportedVersions   []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	KeyShares           []KeyShare
+	PSKModes            []uint8
+	PSK                 *PreSharedKey
+	ECH                 *ECH
+
+	// Raw is the handshake message, without the record headers.
+	Raw []byte
+}
+
+// KeyShare is an entry of the key_share extension.
+type KeyShare struct {
+	Group uint16
+	Data  []byte
+}
+
+// PreSharedKey is the pre_shared_key extension of a resumption.
+type PreSharedKey struct {
+	Identities []PSKIdentity
+	Binders    [][]byte
+}
+
+type PSKIdentity struct {
+	Identity            []byte
+	ObfuscatedTicketAge uint32
+}
+
+// ECH is the encrypted_client_hello extension. The outer ClientHello carries the encrypted inner one
+// in Payload, the inner ClientHello only marks itself. Clients without an ECH config send a GREASE
+// outer extension with random content.
+type ECH struct {
+	// Inner is set for the inner ClientHello, the other fields are only set for the outer one.
+	Inner    bool
+	KDF      uint16
+	AEAD     uint16
+	ConfigID uint8
+	Enc      []byte
+	Payload  []byte
+}
+
+// Parse decodes the ClientHello at the start of data, the bytes received from the client.
+// It returns ErrIncomplete when data is a valid prefix of a ClientHello, ErrNotTLS when data is not
+// a handshake record and a *MalformedError when the message cannot be decoded.
+func Parse(data []byte) (*ClientHello, error) {
+	msg, recordVersion, records, err := reassemble(data)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := parseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	hello.RecordVersion = recordVersion
+	hello.Records = records
+	return hello, nil
+}
+
+// reassemble concatenates the payloads of the handshake records until they hold the whole
+// ClientHello message, which is returned with its handshake header.
+//
+//	<1 byte> ContentType, 0x16 Handshake
+//	<2 byte> ProtocolVersion, 3.0 (SSL 3.0) ~ 3.4
+//	<2 byte> Record Payload Length
+//	<n byte> Record Payload, a fragment of the handshake messages
+func reassemble(data []byte) (msg []byte, recordVersion uint16, records int, err error) {
+	var (
+		buf    []byte
+		msgLen = -1
+	)
+
+	for {
+		if len(data) < recordHeaderLen {
+			if err := checkRecordHeader(data); err != nil {
+				return nil, 0, 0, err
+			}
+			return nil, 0, 0, ErrIncomplete
+		}
+
+		if err := checkRecordHeader(data[:recordHeaderLen]); err != nil {
+			return nil, 0, 0, err
+		}
+
+		payloadLen := int(data[3])<<8 | int(data[4])
+		if payloadLen == 0 || payloadLen > maxRecordLen {
+			return nil, 0, 0, malformed("record length")
+		}
+
+		if records == 0 {
+			recordVersion = uint16(data[1])<<8 | uint16(data[2])
+		}
+		records++
+
+		// the last record may be buffered partially, take what is there to check the header early
+		payload := data[recordHeaderLen:min(len(data), recordHeaderLen+payloadLen)]
+		buf = append(buf, payload...)
+		data = data[len(payload)+recordHeaderLen:]
+
+		//	<1 byte> Message Type, 1 ClientHello
+		//	<3 byte> Handshake Length
+		if msgLen < 0 && len(buf) >= 1 && buf[0] != handshakeTypeClientHello {
+			return nil, 0, 0, malformed("handshake type")
+		}
+		if msgLen < 0 && len(buf) >= handshakeHeaderLen {
+			msgLen = handshakeHeaderLen + (int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3]))
+			if msgLen > MaxLen {
+				return nil, 0, 0, malformed("handshake length")
+			}
+		}
+
+		if msgLen >= 0 && len(buf) >= msgLen {
+			return buf[:msgLen], recordVersion, records, nil
+		}
+
+		if len(payload) < payloadLen {
+			return nil, 0, 0, ErrIncomplete
+		}
+	}
+}
+
+// checkRecordHeader checks the part of a record header that is there.
+func checkRecordHeader(header []byte) error {
+	if len(header) >= 1 && header[0] != contentTypeHandshake {
+		return ErrNotTLS
+	}
+
+	if len(header) >= 3 && (header[1] != 3 || header[2] > 4) {
+		return ErrNotTLS
+	}
+
+	return nil
+}
+
+// parseMessage decodes a ClientHello handshake message.
+//
+//	< 2 byte> Message Version
+//	<32 byte> Random
+//	< 1 byte> Session ID Length, 0 ~ 32
+//	< n byte> Session ID
+//	< 2 byte> Cipher Suites Length
+//	< n byte> Cipher Suites
+//	< 1 byte> Compression Methods Length
+//	< n byte> Compression Methods
+//	< 2 byte> Extensions Length, absent in old clients without extensions
+//	<repeat>  Extension
+//	  <2 byte> Extension Type
+//	  <2 byte> Extension Length
+//	  <n byte> Extension Data
+func parseMessage(msg []byte) (*ClientHello, error) {
+	hello := &ClientHello{Raw: msg}
+	r := reader(msg[handshakeHeaderLen:])
+
+	var ok bool
+	if hello.Version, ok = r.uint16(); !ok {
+		return nil, malformed("version")
+	}
+
+	if hello.Random, ok = r.bytes(32); !ok {
+		return nil, malformed("random")
+	}
+
+	sessionId, ok := r.vector8()
+	if !ok || len(sessionId) > maxSessionIdLen {
+		return nil, malformed("session id")
+	}
+	hello.SessionID = sessionId
+
+	cipherSuites, ok := r.vector16()
+	if !ok || cipherSuites.empty() {
+		return nil, malformed("cipher suites")
+	}
+	if hello.CipherSuites, ok = cipherSuites.uint16s(); !ok {
+		return nil, malformed("cipher suites")
+	}
+
+	compressionMethods, ok := r.vector8()
+	if !ok || compressionMethods.empty() {
+		return nil, malformed("compression methods")
+	}
+	hello.CompressionMethods = compressionMethods
+
+	if r.empty() {
+		return hello, nil
+	}
+
+	extensions, ok := r.vector16()
+	if !ok || !r.empty() {
+		return nil, malformed("extensions")
+	}
+
+	for !extensions.empty() {
+		extType, ok := extensions.uint16()
+		if !ok {
+			return nil, malformed("extensions")
+		}
+
+		data, ok := extensions.vector16()
+		if !ok {
+			return nil, malformed("extensions")
+		}
+
+		hello.Extensions = append(hello.Extensions, extType)
+		if err := hello.parseExtension(extType, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+// HasExtension reports whether the client sent the extension.
+func (h *ClientHello) HasExtension(extType uint16) bool {
+	for _, ext := range h.Extensions {
+		if ext == extType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MaxVersion is the highest version the client offers, from supported_versions when it is sent.
+func (h *ClientHello) MaxVersion() uint16 {
+	version := uint16(0)
+	for _, v := range h.SupportedVersions {
+		if !IsGrease(v) && v > version {
+			version = v
+		}
+	}
+
+	if version == 0 {
+		return h.Version
+	}
+
+	return version
+}
+
+// ServerName is the first server name, empty when the client sent none or h is nil.
+func (h *ClientHello) ServerName() string {
+	if h == nil || len(h.ServerNames) == 0 {
+		return ""
+	}
+
+	return h.ServerNames[0]
+}
+
+// Grease reports whether the client sent GREASE values (RFC 8701) in its cipher suites, extensions,
+// groups or versions, as Chrome based clients do.
+func (h *ClientHello) Grease() bool {
+	for _, list := range [][]uint16{h.CipherSuites, h.Extensions, h.SupportedGroups, h.SupportedVersions} {
+		for _, v := range list {
+			if IsGrease(v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsGrease reports whether v is one of the GREASE values clients send to keep servers tolerant of
+// unknown ones, 0x0a0a, 0x1a1a, ... 0xfafa.
+func IsGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
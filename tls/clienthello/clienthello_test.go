@@ -0,0 +1,387 @@
+package clienthello
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+type extension struct {
+	typ  uint16
+	data []byte
+}
+
+func u16(values ...uint16) []byte {
+	b := make([]byte, 0, 2*len(values))
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+
+	return b
+}
+
+func vector8(data []byte) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+func vector16(data []byte) []byte {
+	return append(u16(uint16(len(data))), data...)
+}
+
+// helloMessage builds a ClientHello handshake message with its handshake header.
+func helloMessage(sessionID []byte, cipherSuites []uint16, extensions ...extension) []byte {
+	body := u16(tls.VersionTLS12)
+	body = append(body, bytes.Repeat([]byte{0xaa}, 32)...)
+	body = append(body, vector8(sessionID)...)
+	body = append(body, vector16(u16(cipherSuites...))...)
+	body = append(body, vector8([]byte{0})...)
+
+	if extensions != nil {
+		var exts []byte
+		for _, ext := range extensions {
+			exts = append(exts, u16(ext.typ)...)
+			exts = append(exts, vector16(ext.data)...)
+		}
+		body = append(body, vector16(exts)...)
+	}
+
+	return append([]byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// records splits msg into handshake records with the given payload sizes, the last record takes the rest.
+func records(msg []byte, sizes ...int) []byte {
+	var data []byte
+	for i := 0; len(msg) > 0; i++ {
+		n := len(msg)
+		if i < len(sizes) {
+			n = min(sizes[i], len(msg))
+		}
+
+		data = append(data, contentTypeHandshake, 3, 1, byte(n>>8), byte(n))
+		data = append(data, msg[:n]...)
+		msg = msg[n:]
+	}
+
+	return data
+}
+
+// testHello is a hello with the extensions the proxy decodes and GREASE values the way Chrome sends them.
+func testHello() []byte {
+	return helloMessage(bytes.Repeat([]byte{1}, 32), []uint16{0x0a0a, tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		extension{typ: 0x1a1a},
+		extension{typ: ExtensionServerName, data: vector16(append([]byte{nameTypeHostName}, vector16([]byte("example.com"))...))},
+		extension{typ: ExtensionALPN, data: vector16(append(vector8([]byte("h2")), vector8([]byte("http/1.1"))...))},
+		extension{typ: ExtensionSupportedGroups, data: vector16(u16(0x2a2a, uint16(tls.X25519), uint16(tls.CurveP256)))},
+		extension{typ: ExtensionECPointFormats, data: vector8([]byte{0})},
+		extension{typ: ExtensionSignatureAlgorithms, data: vector16(u16(uint16(tls.ECDSAWithP256AndSHA256), uint16(tls.PSSWithSHA256)))},
+		extension{typ: ExtensionSupportedVersions, data: vector8(u16(0x3a3a, tls.VersionTLS13, tls.VersionTLS12))},
+		extension{typ: ExtensionKeyShare, data: vector16(append(append(u16(0x2a2a), vector16([]byte{0})...), append(u16(uint16(tls.X25519)), vector16(bytes.Repeat([]byte{2}, 32))...)...))},
+		extension{typ: ExtensionPSKKeyExchangeModes, data: vector8([]byte{1})},
+		extension{typ: ExtensionEncryptedClientHello, data: append([]byte{echClientHelloTypeOuter}, append(u16(1, 1), append([]byte{7}, append(vector16([]byte{3, 3}), vector16([]byte{4, 4, 4})...)...)...)...)},
+		extension{typ: ExtensionPreSharedKey, data: append(vector16(append(vector16([]byte("ticket")), 0, 0, 0, 9)), vector16(vector8(bytes.Repeat([]byte{5}, 32)))...)},
+	)
+}
+
+func TestParse(t *testing.T) {
+	msg := testHello()
+
+	hello, err := Parse(records(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello.Version != tls.VersionTLS12 || hello.RecordVersion != tls.VersionTLS10 || hello.Records != 1 || !bytes.Equal(hello.Raw, msg) {
+		t.Errorf("version %#x, record version %#x, %d records", hello.Version, hello.RecordVersion, hello.Records)
+	}
+	if len(hello.SessionID) != 32 || len(hello.Random) != 32 || !slices.Equal(hello.CompressionMethods, []uint8{0}) {
+		t.Errorf("session id %x, random %x, compression %v", hello.SessionID, hello.Random, hello.CompressionMethods)
+	}
+	if hello.ServerName() != "example.com" || !slices.Equal(hello.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("server names %v, alpn %v", hello.ServerNames, hello.ALPN)
+	}
+
+	wantExtensions := []uint16{0x1a1a, ExtensionServerName, ExtensionALPN, ExtensionSupportedGroups, ExtensionECPointFormats, ExtensionSignatureAlgorithms,
+		ExtensionSupportedVersions, ExtensionKeyShare, ExtensionPSKKeyExchangeModes, ExtensionEncryptedClientHello, ExtensionPreSharedKey}
+	if !slices.Equal(hello.Extensions, wantExtensions) {
+		t.Errorf("extensions %#x", hello.Extensions)
+	}
+	if !slices.Equal(hello.SupportedGroups, []uint16{0x2a2a, uint16(tls.X25519), uint16(tls.CurveP256)}) || !slices.Equal(hello.PointFormats, []uint8{0}) {
+		t.Errorf("groups %#x, point formats %v", hello.SupportedGroups, hello.PointFormats)
+	}
+	if !slices.Equal(hello.SignatureAlgorithms, []uint16{uint16(tls.ECDSAWithP256AndSHA256), uint16(tls.PSSWithSHA256)}) {
+		t.Errorf("signature algorithms %#x", hello.SignatureAlgorithms)
+	}
+	if !slices.Equal(hello.SupportedVersions, []uint16{0x3a3a, tls.VersionTLS13, tls.VersionTLS12}) || hello.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("supported versions %#x, max %#x", hello.SupportedVersions, hello.MaxVersion())
+	}
+	if len(hello.KeyShares) != 2 || hello.KeyShares[1].Group != uint16(tls.X25519) || len(hello.KeyShares[1].Data) != 32 {
+		t.Errorf("key shares %+v", hello.KeyShares)
+	}
+	if !slices.Equal(hello.PSKModes, []uint8{1}) {
+		t.Errorf("psk modes %v", hello.PSKModes)
+	}
+	if ech := hello.ECH; ech == nil || ech.Inner || ech.KDF != 1 || ech.AEAD != 1 || ech.ConfigID != 7 || len(ech.Enc) != 2 || len(ech.Payload) != 3 {
+		t.Errorf("ech %+v", hello.ECH)
+	}
+	if psk := hello.PSK; psk == nil || len(psk.Identities) != 1 || string(psk.Identities[0].Identity) != "ticket" ||
+		psk.Identities[0].ObfuscatedTicketAge != 9 || len(psk.Binders) != 1 || len(psk.Binders[0]) != 32 {
+		t.Errorf("psk %+v", hello.PSK)
+	}
+	if !hello.Grease() {
+		t.Error("GREASE not detected")
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	msg := testHello()
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantRecords int
+		// wantLen is where the message ends in data
+		wantLen int
+	}{
+		{name: "one record", data: records(msg), wantRecords: 1, wantLen: len(records(msg))},
+		{name: "split in the handshake header", data: records(msg, 1, 2), wantRecords: 3, wantLen: len(records(msg, 1, 2))},
+		{name: "split in the extensions", data: records(msg, 100), wantRecords: 2, wantLen: len(records(msg, 100))},
+		{
+			name: "one byte records", data: records(msg, slices.Repeat([]int{1}, len(msg))...),
+			wantRecords: len(msg), wantLen: len(msg) * (recordHeaderLen + 1),
+		},
+		// what follows the message, the next handshake message or application data, is left alone
+		{name: "trailing record", data: append(records(msg), 0x17, 3, 3, 0, 1, 0), wantRecords: 1, wantLen: len(records(msg))},
+		{name: "trailing bytes in the last record", data: records(append(slices.Clone(msg), 0, 0, 0), 100), wantRecords: 2, wantLen: len(records(msg, 100))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := Parse(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.Records != tt.wantRecords || !bytes.Equal(hello.Raw, msg) || hello.ServerName() != "example.com" {
+				t.Errorf("%d records, server name %q, raw equal %v", hello.Records, hello.ServerName(), bytes.Equal(hello.Raw, msg))
+			}
+
+			// every prefix of a valid hello may be completed by more data
+			for i := range tt.wantLen {
+				if _, err := Parse(tt.data[:i]); !errors.Is(err, ErrIncomplete) {
+					t.Fatalf("Parse of %d of %d bytes: %v, want ErrIncomplete", i, len(tt.data), err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	msg := testHello()
+	fragmented := records(msg, 50)
+
+	// a record that claims more than what was received, and than the message needs
+	claimsMore := records(msg)[:recordHeaderLen+len(msg)/2]
+	claimsMore[3], claimsMore[4] = 0x40, 0x00
+
+	tooLong := records(msg)
+	tooLong[3], tooLong[4] = (maxRecordLen+1)>>8, (maxRecordLen+1)&0xff
+
+	hugeHandshake := slices.Clone(msg)
+	hugeHandshake[1] = 0x01
+
+	// the extensions vector claims one byte more than the message holds
+	extensionsTooLong := helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: 0x1234})
+	extensionsTooLong[handshakeHeaderLen+2+32+1+4+2+1]++
+
+	serverHello := slices.Clone(msg)
+	serverHello[0] = 2
+
+	longSessionID := helloMessage(bytes.Repeat([]byte{1}, 33), []uint16{tls.TLS_AES_128_GCM_SHA256})
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{name: "empty", data: nil, want: ErrIncomplete},
+		{name: "record length beyond the data", data: claimsMore, want: ErrIncomplete},
+		{name: "http", data: []byte("GET / HTTP/1.1\r\n"), want: ErrNotTLS},
+		{name: "ssl 2 version", data: []byte{contentTypeHandshake, 2, 0}, want: ErrNotTLS},
+		{name: "unknown version", data: []byte{contentTypeHandshake, 3, 5}, want: ErrNotTLS},
+		{name: "alert record", data: []byte{0x15, 3, 3, 0, 2, 2, 40}, want: ErrNotTLS},
+		{name: "application data mid message", data: append(slices.Clone(fragmented[:55]), append([]byte{0x17}, fragmented[56:]...)...), want: ErrNotTLS},
+		{name: "alert mid message", data: append(slices.Clone(fragmented[:55]), 0x15, 3, 3, 0, 2, 2, 40), want: ErrNotTLS},
+		{name: "empty record", data: []byte{contentTypeHandshake, 3, 1, 0, 0}, want: &MalformedError{Field: "record length"}},
+		{name: "record length over the limit", data: tooLong, want: &MalformedError{Field: "record length"}},
+		{name: "handshake length over the limit", data: records(hugeHandshake), want: &MalformedError{Field: "handshake length"}},
+		{name: "server hello", data: records(serverHello), want: &MalformedError{Field: "handshake type"}},
+		{name: "session id too long", data: records(longSessionID), want: &MalformedError{Field: "session id"}},
+		{name: "no cipher suites", data: records(helloMessage(nil, nil)), want: &MalformedError{Field: "cipher suites"}},
+		{name: "extensions longer than the message", data: records(extensionsTooLong), want: &MalformedError{Field: "extensions"}},
+		{
+			name: "truncated server name",
+			data: records(helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: ExtensionServerName, data: vector16([]byte{0, 0, 9, 'a'})})),
+			want: &MalformedError{Field: "server_name"},
+		},
+		{
+			name: "empty alpn protocol",
+			data: records(helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: ExtensionALPN, data: vector16(vector8(nil))})),
+			want: &MalformedError{Field: "alpn"},
+		},
+		{
+			name: "odd supported versions",
+			data: records(helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: ExtensionSupportedVersions, data: vector8([]byte{3, 4, 3})})),
+			want: &MalformedError{Field: "supported_versions"},
+		},
+		{
+			name: "unknown ech type",
+			data: records(helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: ExtensionEncryptedClientHello, data: []byte{2}})),
+			want: &MalformedError{Field: "encrypted_client_hello"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := Parse(tt.data)
+			if hello != nil {
+				t.Errorf("Parse returned a hello with %v", err)
+			}
+
+			var malformedErr *MalformedError
+			if want, ok := tt.want.(*MalformedError); ok {
+				if !errors.As(err, &malformedErr) || *malformedErr != *want {
+					t.Errorf("Parse: %v, want %v", err, tt.want)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Parse: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMinimal(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		// the old detector rejected hellos without a session id
+		{name: "empty session id", msg: helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: ExtensionServerName, data: vector16(append([]byte{0}, vector16([]byte("example.com"))...))})},
+		{name: "no extensions", msg: helloMessage(nil, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA})},
+		{name: "empty extensions", msg: helloMessage(nil, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}, []extension{}...)},
+		{name: "inner ech", msg: helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256}, extension{typ: ExtensionEncryptedClientHello, data: []byte{echClientHelloTypeInner}})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := Parse(records(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.Grease() || hello.MaxVersion() != tls.VersionTLS12 || len(hello.SessionID) != 0 {
+				t.Errorf("grease %v, max version %#x, session id %x", hello.Grease(), hello.MaxVersion(), hello.SessionID)
+			}
+		})
+	}
+}
+
+// cryptoTLSHello returns the records of the ClientHello crypto/tls sends.
+func cryptoTLSHello(t testing.TB) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+	}()
+
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, buf[:n]...)
+
+		if _, err := Parse(data); !errors.Is(err, ErrIncomplete) {
+			return data
+		}
+	}
+}
+
+func TestParseCryptoTLS(t *testing.T) {
+	msg := cryptoTLSHello(t)[recordHeaderLen:]
+
+	for _, split := range []int{len(msg), 1, 3, 200} {
+		data := records(msg, split)
+
+		hello, err := Parse(data)
+		if err != nil {
+			t.Fatalf("split %d: %v", split, err)
+		}
+		if hello.ServerName() != "example.com" || !slices.Equal(hello.ALPN, []string{"h2", "http/1.1"}) || hello.MaxVersion() != tls.VersionTLS13 ||
+			len(hello.KeyShares) == 0 || !slices.Contains(hello.SupportedVersions, tls.VersionTLS12) {
+			t.Errorf("split %d: server name %q, alpn %v, max version %#x, key shares %d", split, hello.ServerName(), hello.ALPN, hello.MaxVersion(), len(hello.KeyShares))
+		}
+	}
+}
+
+func TestIsGrease(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0x2a2a, 0x3a3a, 0x4a4a, 0x5a5a, 0x6a6a, 0x7a7a, 0x8a8a, 0x9a9a, 0xaaaa, 0xbaba, 0xcaca, 0xdada, 0xeaea, 0xfafa} {
+		if !IsGrease(v) {
+			t.Errorf("IsGrease(%#04x) = false", v)
+		}
+	}
+
+	for _, v := range []uint16{0x0000, 0x0303, 0x0a1a, 0x1a0a, 0x0b0b, 0xaaab, 0x1301, 0xfe0d} {
+		if IsGrease(v) {
+			t.Errorf("IsGrease(%#04x) = true", v)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	msg := testHello()
+	f.Add(records(msg))
+	f.Add(records(msg, 1, 2, 100))
+	f.Add(records(helloMessage(nil, []uint16{tls.TLS_AES_128_GCM_SHA256})))
+	f.Add(cryptoTLSHello(f))
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hello, err := Parse(data)
+		if err != nil {
+			if hello != nil {
+				t.Fatalf("Parse returned a hello with %v", err)
+			}
+
+			var malformedErr *MalformedError
+			if !errors.Is(err, ErrIncomplete) && !errors.Is(err, ErrNotTLS) && !errors.As(err, &malformedErr) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+
+		if len(hello.Raw) > MaxLen || hello.Records < 1 || hello.Raw[0] != handshakeTypeClientHello {
+			t.Fatalf("raw %d bytes in %d records", len(hello.Raw), hello.Records)
+		}
+
+		// the message alone in one record, or split in small ones, decodes the same
+		for _, again := range [][]byte{records(hello.Raw), records(hello.Raw, 7)} {
+			other, err := Parse(again)
+			if err != nil || !bytes.Equal(other.Raw, hello.Raw) || !slices.Equal(other.Extensions, hello.Extensions) || other.ServerName() != hello.ServerName() {
+				t.Fatalf("reparse: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package clienthello
+
+// Extension types decoded by Parse, the others are only listed in ClientHello.Extensions.
+const (
+	ExtensionServerName           = 0x0000
+	ExtensionSupportedGroups      = 0x000a
+	ExtensionECPointFormats       = 0x000b
+	ExtensionSignatureAlgorithms  = 0x000d
+	ExtensionALPN                 = 0x0010
+	ExtensionPreSharedKey         = 0x0029
+	ExtensionSupportedVersions    = 0x002b
+	ExtensionPSKKeyExchangeModes  = 0x002d
+	ExtensionKeyShare             = 0x0033
+	ExtensionEncryptedClientHello = 0xfe0d
+)
+
+const (
+	nameTypeHostName = 0
+
+	echClientHelloTypeOuter = 0
+	echClientHelloTypeInner = 1
+)
+
+func (h *ClientHello) parseExtension(extType uint16, data reader) error {
+	var ok bool
+
+	switch extType {
+	case ExtensionServerName:
+		// <2 byte> ServerNameList Length
+		// <repeat> ServerName
+		//   <1 byte> NameType, 0 HostName
+		//   <2 byte> HostName Length
+		//   <n byte> HostName
+		list, ok := data.vector16()
+		if !ok || !data.empty() {
+			return malformed("server_name")
+		}
+
+		for !list.empty() {
+			nameType, ok := list.uint8()
+			if !ok {
+				return malformed("server_name")
+			}
+
+			name, ok := list.vector16()
+			if !ok {
+				return malformed("server_name")
+			}
+
+			if nameType == nameTypeHostName && len(name) > 0 {
+				h.ServerNames = append(h.ServerNames, string(name))
+			}
+		}
+	case ExtensionALPN:
+		// <2 byte> ProtocolNameList Length
+		// <repeat> ProtocolName
+		//   <1 byte> ProtocolName Length, at least 1
+		//   <n byte> ProtocolName
+		list, ok := data.vector16()
+		if !ok || !data.empty() {
+			return malformed("alpn")
+		}
+
+		for !list.empty() {
+			proto, ok := list.vector8()
+			if !ok || proto.empty() {
+				return malformed("alpn")
+			}
+
+			h.ALPN = append(h.ALPN, string(proto))
+		}
+	case ExtensionSupportedGroups, ExtensionSignatureAlgorithms:
+		// <2 byte> List Length
+		// <n byte> List of 2 byte values
+		list, ok := data.vector16()
+		if !ok || !data.empty() {
+			return malformed(extensionName(extType))
+		}
+
+		values, ok := list.uint16s()
+		if !ok {
+			return malformed(extensionName(extType))
+		}
+
+		if extType == ExtensionSupportedGroups {
+			h.SupportedGroups = values
+		} else {
+			h.SignatureAlgorithms = values
+		}
+	case ExtensionECPointFormats:
+		// <1 byte> List Length
+		// <n byte> List of 1 byte values
+		if h.PointFormats, ok = data.vector8(); !ok || !data.empty() {
+			return malformed("ec_point_formats")
+		}
+	case ExtensionSupportedVersions:
+		// <1 byte> List Length
+		// <n byte> List of 2 byte values
+		list, ok := data.vector8()
+		if !ok || !data.empty() {
+			return malformed("supported_versions")
+		}
+
+		if h.SupportedVersions, ok = list.uint16s(); !ok {
+			return malformed("supported_versions")
+		}
+	case ExtensionKeyShare:
+		// <2 byte> KeyShareList Length
+		// <repeat> KeyShareEntry
+		//   <2 byte> NamedGroup
+		//   <2 byte> KeyExchange Length
+		//   <n byte> KeyExchange
+		list, ok := data.vector16()
+		if !ok || !data.empty() {
+			return malformed("key_share")
+		}
+
+		for !list.empty() {
+			group, ok := list.uint16()
+			if !ok {
+				return malformed("key_share")
+			}
+
+			keyExchange, ok := list.vector16()
+			if !ok {
+				return malformed("key_share")
+			}
+
+			h.KeyShares = append(h.KeyShares, KeyShare{Group: group, Data: keyExchange})
+		}
+	case ExtensionPSKKeyExchangeModes:
+		// <1 byte> List Length
+		// <n byte> List of 1 byte modes
+		if h.PSKModes, ok = data.vector8(); !ok || !data.empty() {
+			return malformed("psk_key_exchange_modes")
+		}
+	case ExtensionPreSharedKey:
+		// <2 byte> Identities Length
+		// <repeat> PskIdentity
+		//   <2 byte> Identity Length
+		//   <n byte> Identity
+		//   <4 byte> Obfuscated Ticket Age
+		// <2 byte> Binders Length
+		// <repeat> PskBinderEntry
+		//   <1 byte> Binder Length
+		//   <n byte> Binder
+		psk := &PreSharedKey{}
+
+		identities, ok := data.vector16()
+		if !ok {
+			return malformed("pre_shared_key")
+		}
+
+		for !identities.empty() {
+			identity, ok := identities.vector16()
+			if !ok {
+				return malformed("pre_shared_key")
+			}
+
+			age, ok := identities.uint32()
+			if !ok {
+				return malformed("pre_shared_key")
+			}
+
+			psk.Identities = append(psk.Identities, PSKIdentity{Identity: identity, ObfuscatedTicketAge: age})
+		}
+
+		binders, ok := data.vector16()
+		if !ok || !data.empty() {
+			return malformed("pre_shared_key")
+		}
+
+		for !binders.empty() {
+			binder, ok := binders.vector8()
+			if !ok {
+				return malformed("pre_shared_key")
+			}
+
+			psk.Binders = append(psk.Binders, binder)
+		}
+
+		h.PSK = psk
+	case ExtensionEncryptedClientHello:
+		// <1 byte> ECHClientHelloType, 0 outer, 1 inner
+		// <when outer>
+		//   <2 byte> KDF ID
+		//   <2 byte> AEAD ID
+		//   <1 byte> Config ID
+		//   <2 byte> Enc Length
+		//   <n byte> Enc
+		//   <2 byte> Payload Length
+		//   <n byte> Payload
+		echType, ok := data.uint8()
+		if !ok {
+			return malformed("encrypted_client_hello")
+		}
+
+		switch echType {
+		case echClientHelloTypeInner:
+			if !data.empty() {
+				return malformed("encrypted_client_hello")
+			}
+			h.ECH = &ECH{Inner: true}
+		case echClientHelloTypeOuter:
+			ech := &ECH{}
+
+			kdf, ok1 := data.uint16()
+			aead, ok2 := data.uint16()
+			configId, ok3 := data.uint8()
+			enc, ok4 := data.vector16()
+			payload, ok5 := data.vector16()
+			if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !data.empty() {
+				return malformed("encrypted_client_hello")
+			}
+
+			ech.KDF, ech.AEAD, ech.ConfigID, ech.Enc, ech.Payload = kdf, aead, configId, enc, payload
+			h.ECH = ech
+		default:
+			return malformed("encrypted_client_hello")
+		}
+	}
+
+	return nil
+}
+
+func extensionName(extType uint16) string {
+	switch extType {
+	case ExtensionSupportedGroups:
+		return "supported_groups"
+	case ExtensionSignatureAlgorithms:
+		return "signature_algorithms"
+	}
+
+	return "extension"
+}
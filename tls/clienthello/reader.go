@@ -0,0 +1,83 @@
+package clienthello
+
+// reader consumes big endian integers and length prefixed vectors, every read checks the bounds
+// and reports false instead of panicking on short input.
+type reader []byte
+
+func (r *reader) empty() bool {
+	return len(*r) == 0
+}
+
+func (r *reader) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(*r) < n {
+		return nil, false
+	}
+
+	b := (*r)[:n:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	b, ok := r.bytes(1)
+	if !ok {
+		return 0, false
+	}
+
+	return b[0], true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+
+	return uint16(b[0])<<8 | uint16(b[1]), true
+}
+
+func (r *reader) uint32() (uint32, bool) {
+	b, ok := r.bytes(4)
+	if !ok {
+		return 0, false
+	}
+
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), true
+}
+
+// vector8 reads a vector with a 1 byte length prefix.
+func (r *reader) vector8() (reader, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+
+	b, ok := r.bytes(int(n))
+	return b, ok
+}
+
+// vector16 reads a vector with a 2 byte length prefix.
+func (r *reader) vector16() (reader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+
+	b, ok := r.bytes(int(n))
+	return b, ok
+}
+
+// uint16s reads the rest as a list of 2 byte values, it fails on an odd length.
+func (r *reader) uint16s() ([]uint16, bool) {
+	if len(*r)%2 != 0 {
+		return nil, false
+	}
+
+	values := make([]uint16, 0, len(*r)/2)
+	for !r.empty() {
+		v, _ := r.uint16()
+		values = append(values, v)
+	}
+
+	return values, true
+}
@@ -0,0 +1,225 @@
+// Package trust verifies the certificates of the origins TlsHandler connects to.
+package trust
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"toss/matcher"
+)
+
+// Reason tells why an upstream certificate was rejected, it is used as a metric label.
+type Reason string
+
+const (
+	ReasonUnknownAuthority = Reason("unknown_authority")
+	ReasonExpired          = Reason("expired")
+	ReasonHostname         = Reason("hostname")
+	ReasonPin              = Reason("pin")
+	ReasonOther            = Reason("other")
+)
+
+// FailureMode is what the client gets when the upstream certificate is rejected.
+type FailureMode uint8
+
+const (
+	// FailAlert ends the client handshake with a TLS alert matching the reason.
+	FailAlert = FailureMode(iota)
+	// FailUntrustedLeaf completes the client handshake with a leaf that fails the
+	// client's verification the same way, and answers with an error page.
+	FailUntrustedLeaf
+)
+
+func (m FailureMode) String() string {
+	switch m {
+	case FailAlert:
+		return "alert"
+	case FailUntrustedLeaf:
+		return "untrusted-leaf"
+	}
+
+	return fmt.Sprintf("FailureMode(%d)", uint8(m))
+}
+
+func ParseFailureMode(s string) (FailureMode, error) {
+	switch s {
+	case "", "alert":
+		return FailAlert, nil
+	case "untrusted-leaf":
+		return FailUntrustedLeaf, nil
+	}
+
+	return 0, fmt.Errorf("unknown failure mode %q (known: alert, untrusted-leaf)", s)
+}
+
+// Error is returned for a rejected upstream certificate.
+type Error struct {
+	Reason Reason
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("upstream certificate rejected (%s): %v", e.Reason, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Pin requires one certificate of the chain of the matching origins to have one of the
+// SHA-256 hashes of its SubjectPublicKeyInfo, as in HPKP and curl --pinnedpubkey.
+type Pin struct {
+	// ServerNames matches the server name of the origins, or their destination when the client
+	// sent no SNI.
+	ServerNames *matcher.Matcher
+	SHA256      [][]byte
+}
+
+// Verifier checks the certificate chain, host name and pins of an origin.
+// A nil *Verifier verifies against the system roots and fails with an alert.
+type Verifier struct {
+	// Roots are the trusted CAs, nil for the system roots.
+	Roots *x509.CertPool
+	Pins  []Pin
+	// Insecure matches the server names and destinations whose chain and host name are not verified.
+	// Pins still apply to them.
+	Insecure *matcher.Matcher
+
+	OnFailure FailureMode
+}
+
+// Skips reports whether the chain of the origin is not verified.
+func (v *Verifier) Skips(serverName string, dst *net.TCPAddr) bool {
+	if v == nil {
+		return false
+	}
+
+	_, ok := v.Insecure.Match(serverNames(serverName), dst)
+	return ok
+}
+
+func (v *Verifier) FailureMode() FailureMode {
+	if v == nil {
+		return FailAlert
+	}
+
+	return v.OnFailure
+}
+
+// Verify checks the certificates presented by the origin at dst for serverName.
+// Without a server name the certificate must be valid for the destination ip.
+func (v *Verifier) Verify(serverName string, dst *net.TCPAddr, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return &Error{Reason: ReasonOther, Err: errors.New("no certificate")}
+	}
+
+	chains := [][]*x509.Certificate{certs}
+
+	if !v.Skips(serverName, dst) {
+		opts := x509.VerifyOptions{
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+			CurrentTime:   time.Now(),
+		}
+		if v != nil {
+			opts.Roots = v.Roots
+		}
+		if opts.DNSName == "" && dst != nil {
+			opts.DNSName = dst.IP.String()
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		var err error
+		if chains, err = certs[0].Verify(opts); err != nil {
+			return &Error{Reason: reasonOf(err), Err: err}
+		}
+	}
+
+	if v != nil {
+		for _, pin := range v.Pins {
+			if pin.appliesTo(serverName, dst) && !pin.matches(chains) {
+				return &Error{Reason: ReasonPin, Err: fmt.Errorf("no certificate of the chain matches the pins of %s", origin(serverName, dst))}
+			}
+		}
+	}
+
+	return nil
+}
+
+// appliesTo matches the server name, or the destination when there is none, so that a client
+// leaving out SNI does not skip the pins of the origin.
+func (p *Pin) appliesTo(serverName string, dst *net.TCPAddr) bool {
+	port := 0
+	if dst != nil {
+		port = dst.Port
+	}
+
+	if serverName != "" {
+		_, ok := p.ServerNames.MatchName(serverName, port)
+		return ok
+	}
+
+	if dst == nil {
+		return false
+	}
+
+	_, ok := p.ServerNames.MatchIP(dst.IP, port)
+	return ok
+}
+
+func (p *Pin) matches(chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pinned := range p.SHA256 {
+				if bytes.Equal(sum[:], pinned) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func reasonOf(err error) Reason {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return ReasonUnknownAuthority
+	case errors.As(err, &hostname):
+		return ReasonHostname
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return ReasonExpired
+	}
+
+	return ReasonOther
+}
+
+// origin names the origin in errors, by its destination when the client sent no SNI.
+func origin(serverName string, dst *net.TCPAddr) string {
+	if serverName == "" && dst != nil {
+		return dst.String()
+	}
+
+	return serverName
+}
+
+func serverNames(serverName string) []string {
+	if serverName == "" {
+		return nil
+	}
+
+	return []string{serverName}
+}
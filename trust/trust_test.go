@@ -0,0 +1,167 @@
+package trust
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+	"toss/matcher"
+)
+
+// newTestCertificate returns a certificate signed by parent, or self-signed when parent is nil.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return crt, key
+}
+
+// newTestChain returns a root and a leaf for example.com and 192.0.2.1 valid until notAfter.
+func newTestChain(t *testing.T, notAfter time.Time) (root, leaf *x509.Certificate) {
+	t.Helper()
+
+	root, rootKey := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Toss Test Origin Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	leaf, _ = newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("192.0.2.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, root, rootKey)
+
+	return root, leaf
+}
+
+func pinOf(crt *x509.Certificate) []byte {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+func mustMatcher(t *testing.T, patterns ...string) *matcher.Matcher {
+	t.Helper()
+
+	m, err := matcher.New(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestVerify(t *testing.T) {
+	root, leaf := newTestChain(t, time.Now().Add(time.Hour))
+	otherRoot, _ := newTestChain(t, time.Now().Add(time.Hour))
+	_, expired := newTestChain(t, time.Now().Add(-time.Minute))
+
+	bundle := x509.NewCertPool()
+	bundle.AddCert(root)
+	otherBundle := x509.NewCertPool()
+	otherBundle.AddCert(otherRoot)
+
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	chain := []*x509.Certificate{leaf}
+
+	tests := []struct {
+		name       string
+		verifier   *Verifier
+		serverName string
+		certs      []*x509.Certificate
+		want       Reason
+	}{
+		{name: "custom bundle", verifier: &Verifier{Roots: bundle}, serverName: "example.com"},
+		{name: "no sni, valid for the ip", verifier: &Verifier{Roots: bundle}},
+		{name: "unknown authority", verifier: &Verifier{Roots: otherBundle}, serverName: "example.com", want: ReasonUnknownAuthority},
+		{name: "hostname", verifier: &Verifier{Roots: bundle}, serverName: "other.example.com", want: ReasonHostname},
+		{name: "expired", verifier: &Verifier{Roots: x509.NewCertPool()}, serverName: "example.com", certs: []*x509.Certificate{expired}, want: ReasonExpired},
+
+		{name: "pin match", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "example.com"), SHA256: [][]byte{pinOf(root)}}}}, serverName: "example.com"},
+		{name: "pin mismatch", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, ".example.com"), SHA256: [][]byte{pinOf(otherRoot)}}}}, serverName: "example.com", want: ReasonPin},
+		{name: "pin of another origin", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "other.example.com"), SHA256: [][]byte{pinOf(otherRoot)}}}}, serverName: "example.com"},
+		{name: "pin of another port", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "example.com:8443"), SHA256: [][]byte{pinOf(otherRoot)}}}}, serverName: "example.com"},
+		{name: "pin of the port", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "example.com:443"), SHA256: [][]byte{pinOf(otherRoot)}}}}, serverName: "example.com", want: ReasonPin},
+
+		{name: "no sni, pin by ip", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "192.0.2.0/24"), SHA256: [][]byte{pinOf(otherRoot)}}}}, want: ReasonPin},
+		{name: "no sni, pin by ip and port", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "192.0.2.1:443"), SHA256: [][]byte{pinOf(root)}}}}},
+		{name: "no sni, pin of another port", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "192.0.2.1:8443"), SHA256: [][]byte{pinOf(otherRoot)}}}}},
+		{name: "no sni, pin by name", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "example.com"), SHA256: [][]byte{pinOf(otherRoot)}}}}},
+		{name: "sni, pin by ip", verifier: &Verifier{Roots: bundle, Pins: []Pin{{ServerNames: mustMatcher(t, "192.0.2.1"), SHA256: [][]byte{pinOf(otherRoot)}}}}, serverName: "example.com"},
+
+		{name: "allowlisted", verifier: &Verifier{Roots: otherBundle, Insecure: mustMatcher(t, "example.com")}, serverName: "example.com"},
+		{name: "allowlisted by ip without sni", verifier: &Verifier{Roots: otherBundle, Insecure: mustMatcher(t, "192.0.2.0/24")}},
+		{name: "allowlisted expired", verifier: &Verifier{Insecure: mustMatcher(t, "example.com")}, serverName: "example.com", certs: []*x509.Certificate{expired}},
+		{name: "not allowlisted", verifier: &Verifier{Roots: otherBundle, Insecure: mustMatcher(t, "other.example.com")}, serverName: "example.com", want: ReasonUnknownAuthority},
+		{name: "allowlisted pin match", verifier: &Verifier{Roots: otherBundle, Insecure: mustMatcher(t, "example.com"), Pins: []Pin{{ServerNames: mustMatcher(t, "example.com"), SHA256: [][]byte{pinOf(leaf)}}}}, serverName: "example.com"},
+		{name: "allowlisted pin mismatch", verifier: &Verifier{Roots: otherBundle, Insecure: mustMatcher(t, "example.com"), Pins: []Pin{{ServerNames: mustMatcher(t, "example.com"), SHA256: [][]byte{pinOf(root)}}}}, serverName: "example.com", want: ReasonPin},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs := tt.certs
+			if certs == nil {
+				certs = chain
+			}
+
+			err := tt.verifier.Verify(tt.serverName, dst, certs)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Verify = %v", err)
+				}
+				return
+			}
+
+			var rejected *Error
+			if !errors.As(err, &rejected) || rejected.Reason != tt.want {
+				t.Errorf("Verify = %v, want reason %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyNoCertificate(t *testing.T) {
+	insecure := mustMatcher(t, "example.com")
+
+	// TlsHandler mimics the first certificate, an empty chain must fail even when it is not verified
+	for _, v := range []*Verifier{nil, {}, {Insecure: insecure}} {
+		var rejected *Error
+		err := v.Verify("example.com", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, nil)
+		if !errors.As(err, &rejected) || rejected.Reason != ReasonOther {
+			t.Errorf("Verify of an empty chain with %+v = %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+type counters struct {
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+// copyChunkSize bounds the bytes spliced at once by CopyCounted, the counts grow after each chunk.
+const copyChunkSize = 64 << 10
+
+// countingConn counts the bytes read from and written to conn.
+//
+// ReadFrom and WriteTo copy through CopyCounted, so that *net.TCPConn still splices the copies of
+// ByPassHandler while their bytes are counted chunk by chunk.
+type countingConn struct {
+	net.Conn
+	counters *counters
+}
+
+func newCountingConn(conn net.Conn, counters *counters) *countingConn {
+	return &countingConn{
+		Conn:     conn,
+		counters: counters,
+	}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counters.read.Add(int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counters.written.Add(int64(n))
+
+	return n, err
+}
+
+// ReadFrom copies r into conn, io.Copy uses it when c is the destination.
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	return CopyCounted(c, r, nil)
+}
+
+// WriteTo copies conn into w, io.Copy uses it when c is the source.
+func (c *countingConn) WriteTo(w io.Writer) (int64, error) {
+	return CopyCounted(w, c, nil)
+}
+
+// CopyCounted copies src into dst until EOF like io.Copy, in chunks of at most copyChunkSize bytes.
+// The counts of the tunnel connections among dst and src, and counted when it is not nil, are added
+// after each chunk, so that a long copy is counted as it goes. The tunnel connections are unwrapped
+// for the copy itself, two *net.TCPConn are then spliced.
+func CopyCounted(dst io.Writer, src io.Reader, counted func(n int64)) (int64, error) {
+	var dstCounters, srcCounters *counters
+	if c, ok := dst.(*countingConn); ok {
+		dst, dstCounters = c.Conn, c.counters
+	}
+	if c, ok := src.(*countingConn); ok {
+		src, srcCounters = c.Conn, c.counters
+	}
+
+	var total int64
+	for {
+		// io.CopyN hands an *io.LimitedReader to the ReaderFrom of dst, which *net.TCPConn splices
+		n, err := io.CopyN(dst, src, copyChunkSize)
+		total += n
+
+		if dstCounters != nil {
+			dstCounters.written.Add(n)
+		}
+		if srcCounters != nil {
+			srcCounters.read.Add(n)
+		}
+		if counted != nil {
+			counted(n)
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// SetLinger is forwarded so that RejectHandler can still reset the connection.
+func (c *countingConn) SetLinger(sec int) error {
+	return setLinger(c.Conn, sec)
+}
+
+// Tap observes the bytes read from and written to the client and origin connections of a tunnel.
+// Observe is called from the goroutine doing the read or write and must not keep b.
+type Tap interface {
+	Observe(side Side, read bool, b []byte)
+}
+
+type tapConn struct {
+	net.Conn
+	side Side
+	tap  Tap
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tap.Observe(c.side, true, b[:n])
+	}
+
+	return n, err
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.tap.Observe(c.side, false, b[:n])
+	}
+
+	return n, err
+}
+
+func (c *tapConn) SetLinger(sec int) error {
+	return setLinger(c.Conn, sec)
+}
+
+func setLinger(conn net.Conn, sec int) error {
+	if conn, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+		return conn.SetLinger(sec)
+	}
+
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range []net.Conn{client, server} {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestCountingConnCopy(t *testing.T) {
+	// client -> counted -> origin, the way ByPassHandler relays a bypassed tunnel
+	client, downstream := tcpPair(t)
+	upstream, origin := tcpPair(t)
+
+	var c counters
+	counted := newCountingConn(downstream, &c)
+
+	// the copies must reach the ReaderFrom/WriterTo of *net.TCPConn to be spliced
+	var _ io.ReaderFrom = counted
+	var _ io.WriterTo = counted
+
+	request := bytes.Repeat([]byte("q"), 100_000)
+	response := bytes.Repeat([]byte("r"), 50_000)
+
+	go func() {
+		_, _ = client.Write(request)
+		_ = client.CloseWrite()
+	}()
+	go func() {
+		_, _ = origin.Write(response)
+		_ = origin.CloseWrite()
+	}()
+
+	n, err := io.Copy(upstream, counted)
+	if err != nil || n != int64(len(request)) {
+		t.Fatalf("copy to the origin: %d bytes, %v", n, err)
+	}
+	_ = upstream.CloseWrite()
+
+	n, err = io.Copy(counted, upstream)
+	if err != nil || n != int64(len(response)) {
+		t.Fatalf("copy to the client: %d bytes, %v", n, err)
+	}
+
+	if read, written := c.read.Load(), c.written.Load(); read != int64(len(request)) || written != int64(len(response)) {
+		t.Errorf("counted %d bytes read and %d written, want %d and %d", read, written, len(request), len(response))
+	}
+
+	if received, err := io.ReadAll(origin); err != nil || !bytes.Equal(received, request) {
+		t.Errorf("origin received %d bytes, %v", len(received), err)
+	}
+}
+
+func TestCopyCountedChunks(t *testing.T) {
+	client, downstream := tcpPair(t)
+	upstream, origin := tcpPair(t)
+
+	var c counters
+	counted := newCountingConn(downstream, &c)
+
+	var copied atomic.Int64
+	done := make(chan error, 1)
+	go func() {
+		_, err := CopyCounted(upstream, counted, func(n int64) { copied.Add(n) })
+		done <- err
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, origin)
+	}()
+
+	// the client keeps the connection open, the chunks already copied are counted anyway
+	const chunks = 3
+	if _, err := client.Write(bytes.Repeat([]byte("q"), chunks*copyChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for c.read.Load() != chunks*copyChunkSize || copied.Load() != chunks*copyChunkSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("counted %d bytes read and %d copied during the copy, want %d", c.read.Load(), copied.Load(), chunks*copyChunkSize)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("copy ended before the client closed: %v", err)
+	default:
+	}
+
+	if _, err := client.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.CloseWrite()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(chunks*copyChunkSize + len("tail")); c.read.Load() != want || copied.Load() != want {
+		t.Errorf("counted %d bytes read and %d copied, want %d", c.read.Load(), copied.Load(), want)
+	}
+}
@@ -1,6 +1,13 @@
 package tunnel
 
+import (
+	"log/slog"
+	"time"
+)
+
 type Detector interface {
+	// Name identifies the detected protocol, e.g. in policy rules.
+	Name() string
 	Detect(tun *Tunnel) (DetectResult, Handler)
 }
 
@@ -11,3 +18,58 @@ const (
 	DetectResultPossible = DetectResult(1 << 0)
 	DetectResultMatched  = DetectResult(1 << 1)
 )
+
+func (r DetectResult) String() string {
+	switch {
+	case r&DetectResultMatched != 0:
+		return "matched"
+	case r&DetectResultPossible != 0:
+		return "possible"
+	}
+
+	return "never"
+}
+
+const (
+	FallbackNoMatch    = "no-match"
+	FallbackByteBudget = "byte-budget"
+	FallbackTimeout    = "timeout"
+	FallbackReadError  = "read-error"
+	FallbackDraining   = "draining"
+)
+
+// DetectOutcome summarizes one detection run for logs and metrics.
+type DetectOutcome struct {
+	// Detector is the name of the matched detector, empty when detection fell back.
+	Detector string
+	// Result is the combined result of the detectors in the last round.
+	Result DetectResult
+	// Results is the last result of each detector that ran, by detector name.
+	Results map[string]DetectResult
+	// Bytes is the number of downstream bytes buffered when detection ended.
+	Bytes int
+	// Rounds is how many times the detectors were run.
+	Rounds  int
+	Elapsed time.Duration
+	// Fallback is the reason no detector matched, one of the Fallback* constants.
+	Fallback string
+	Err      error
+}
+
+func (o DetectOutcome) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("detector", o.Detector),
+		slog.Int("bytes", o.Bytes),
+		slog.Int("rounds", o.Rounds),
+		slog.Duration("elapsed", o.Elapsed),
+	}
+
+	if o.Fallback != "" {
+		attrs = append(attrs, slog.String("fallback", o.Fallback))
+	}
+	if o.Err != nil {
+		attrs = append(attrs, slog.Any("error", o.Err))
+	}
+
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,185 @@
+package detector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"toss/tunnel"
+	"toss/tunnel/handler"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden.json from the detectors")
+
+// golden is the expected detection of one capture in testdata/corpus.
+type golden struct {
+	File string `json:"file"`
+	// Source tells where the capture comes from, it is written by hand.
+	Source string `json:"source"`
+
+	Results     map[string]string `json:"results"`
+	Handler     string            `json:"handler,omitempty"`
+	ServerNames []string          `json:"serverNames,omitempty"`
+	ALPN        []string          `json:"alpn,omitempty"`
+	JA4         string            `json:"ja4,omitempty"`
+}
+
+// bytesConn serves data to the bufio.Reader of a Stream, nothing is written to it.
+type bytesConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bytesConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// newTestTunnel returns a tunnel with data buffered in Downstream, as if the client had sent it.
+func newTestTunnel(tb testing.TB, data []byte) *tunnel.Tunnel {
+	downstream := tunnel.NewStream(bytesConn{r: bytes.NewReader(data)})
+	if len(data) > 0 {
+		if _, err := downstream.Reader.Peek(len(data)); err != nil {
+			tb.Fatalf("buffer %d bytes: %v", len(data), err)
+		}
+	}
+
+	return tunnel.NewTunnel(context.Background(), nil, nil, downstream, nil)
+}
+
+func newDetectors() []tunnel.Detector {
+	logger := slog.New(slog.DiscardHandler)
+	opts := &handler.Options{}
+
+	return []tunnel.Detector{
+		NewTlsDetector(logger, nil, opts),
+		NewHttp11Detector(logger, opts),
+		NewHttp2Detector(logger, opts),
+	}
+}
+
+// detect runs every detector on data and returns what they found.
+func detect(tb testing.TB, data []byte) golden {
+	tun := newTestTunnel(tb, data)
+	g := golden{Results: map[string]string{}}
+
+	for _, d := range newDetectors() {
+		result, h := d.Detect(tun)
+		g.Results[d.Name()] = result.String()
+
+		if (result == tunnel.DetectResultMatched) != (h != nil) {
+			tb.Fatalf("%s: result %s with handler %T", d.Name(), result, h)
+		}
+
+		if h != nil {
+			if g.Handler != "" {
+				tb.Fatalf("%s: matched after %s", d.Name(), g.Handler)
+			}
+
+			name := fmt.Sprintf("%T", h)
+			g.Handler = name[strings.LastIndex(name, ".")+1:]
+		}
+	}
+
+	info := tun.Info()
+	g.ServerNames, g.ALPN, g.JA4 = info.ServerNames, info.ALPN, info.JA4
+
+	return g
+}
+
+func TestGolden(t *testing.T) {
+	path := filepath.Join("testdata", "golden.json")
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []golden
+	if err := json.Unmarshal(raw, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		sources := map[string]string{}
+		for _, g := range want {
+			sources[g.File] = g.Source
+		}
+
+		var got []golden
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g := detect(t, data)
+			g.File = filepath.Base(file)
+			g.Source = sources[g.File]
+			if g.Source == "" {
+				t.Errorf("%s: add its source to %s", g.File, path)
+			}
+
+			got = append(got, g)
+		}
+
+		out, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(out, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	if len(want) != len(files) {
+		t.Errorf("%d captures in testdata/corpus, %d in %s, run go test -update", len(files), len(want), path)
+	}
+
+	for _, w := range want {
+		t.Run(strings.TrimSuffix(w.File, ".bin"), func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "corpus", w.File))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := detect(t, data)
+			got.File, got.Source = w.File, w.Source
+
+			wantJSON, _ := json.Marshal(w)
+			gotJSON, _ := json.Marshal(got)
+			if !bytes.Equal(wantJSON, gotJSON) {
+				t.Errorf("got  %s\nwant %s", gotJSON, wantJSON)
+			}
+
+			if w.Handler == "" {
+				return
+			}
+
+			// the client may send the capture a few bytes at a time, a detector that matches it
+			// in full must not give up on any part of it
+			for n := range len(data) {
+				results := detect(t, data[:n]).Results
+				for name, result := range w.Results {
+					if result == "matched" && results[name] == "never" {
+						t.Fatalf("%s: never after %d of %d bytes", name, n, len(data))
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package detector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"toss/config"
+	"toss/tunnel"
+)
+
+// addCorpus seeds f with the captures of testdata/corpus, go test -fuzz adds what it finds
+// to testdata/fuzz/<target>.
+func addCorpus(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*.bin"))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(data)
+	}
+}
+
+// fuzzDetector checks that the detector named name neither panics nor returns a handler
+// without matching on any client bytes that fit the detection buffer.
+func fuzzDetector(f *testing.F, name string) {
+	addCorpus(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > config.MaxDetectionBytes {
+			data = data[:config.MaxDetectionBytes]
+		}
+
+		var d tunnel.Detector
+		for _, detector := range newDetectors() {
+			if detector.Name() == name {
+				d = detector
+			}
+		}
+
+		tun := newTestTunnel(t, data)
+		result, h := d.Detect(tun)
+
+		switch result {
+		case tunnel.DetectResultMatched:
+			if h == nil {
+				t.Fatal("matched without a handler")
+			}
+		case tunnel.DetectResultPossible, tunnel.DetectResultNever:
+			if h != nil {
+				t.Fatalf("%s with handler %T", result, h)
+			}
+		default:
+			t.Fatalf("unknown result %d", result)
+		}
+
+		if len(tun.Downstream.Peeked()) != len(data) {
+			t.Fatalf("detection consumed the client bytes, %d of %d left", len(tun.Downstream.Peeked()), len(data))
+		}
+	})
+}
+
+func FuzzTlsDetector(f *testing.F) {
+	fuzzDetector(f, "tls")
+}
+
+func FuzzHttp11Detector(f *testing.F) {
+	fuzzDetector(f, "http11")
+}
+
+func FuzzHttp2Detector(f *testing.F) {
+	fuzzDetector(f, "http2")
+}
+
+// FuzzDetectors checks that no client bytes are matched by two detectors.
+func FuzzDetectors(f *testing.F) {
+	addCorpus(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > config.MaxDetectionBytes {
+			data = data[:config.MaxDetectionBytes]
+		}
+
+		detect(t, data)
+	})
+}
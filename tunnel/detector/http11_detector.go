@@ -9,11 +9,13 @@ import (
 
 type Http11Detector struct {
 	logger *slog.Logger
+	opts   *handler.Options
 }
 
-func NewHttp11Detector(logger *slog.Logger) *Http11Detector {
+func NewHttp11Detector(logger *slog.Logger, opts *handler.Options) *Http11Detector {
 	return &Http11Detector{
 		logger: logger,
+		opts:   opts,
 	}
 }
 
@@ -29,21 +31,35 @@ var httpMethods = [][]byte{
 	[]byte("TRACE "),
 }
 
+func (d Http11Detector) Name() string {
+	return "http11"
+}
+
 func (d Http11Detector) Detect(tun *tunnel.Tunnel) (tunnel.DetectResult, tunnel.Handler) {
 	logger := d.logger.With("context", "Http11Detector")
 
-	peek, err := tun.Downstream.Reader.Peek(7)
-	if err != nil {
-		logger.Debug("http1.1 protocol: possible: failed to peek (buffer maybe not ready)")
-		return tunnel.DetectResultPossible, nil
-	}
+	peek := tun.Downstream.Peeked()
+	result := tunnel.DetectResultNever
 
 	for _, method := range httpMethods {
-		if bytes.Equal(method, peek[:len(method)]) {
+		if len(peek) < len(method) {
+			if bytes.HasPrefix(method, peek) {
+				result = tunnel.DetectResultPossible
+			}
+			continue
+		}
+
+		if bytes.HasPrefix(peek, method) {
 			logger.Debug("http1.1 protocol: matched", "method", string(method))
-			return tunnel.DetectResultMatched, handler.NewHttp11Handler(d.logger)
+			return tunnel.DetectResultMatched, handler.NewHttp11Handler(d.logger, d.opts)
 		}
 	}
+
+	if result == tunnel.DetectResultPossible {
+		logger.Debug("http1.1 protocol: possible: method prefix (buffer maybe not ready)", "peek", string(peek))
+		return result, nil
+	}
+
 	logger.Debug("http1.1 protocol: never", "peek", string(peek))
 	return tunnel.DetectResultNever, nil
 }
@@ -9,30 +9,41 @@ import (
 
 type Http2Detector struct {
 	logger *slog.Logger
+	opts   *handler.Options
 }
 
-func NewHttp2Detector(logger *slog.Logger) *Http2Detector {
+func NewHttp2Detector(logger *slog.Logger, opts *handler.Options) *Http2Detector {
 	return &Http2Detector{
 		logger: logger,
+		opts:   opts,
 	}
 }
 
 var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
 
+func (d *Http2Detector) Name() string {
+	return "http2"
+}
+
 func (d *Http2Detector) Detect(tun *tunnel.Tunnel) (tunnel.DetectResult, tunnel.Handler) {
-	logger := d.logger.With("context", "Http11Detector")
+	logger := d.logger.With("context", "Http2Detector")
 
-	peek, err := tun.Downstream.Reader.Peek(len(http2Preface))
-	if err != nil {
-		logger.Debug("http2 protocol: possible: failed to peek (peek maybe not ready)")
+	peek := tun.Downstream.Peeked()
+	if len(peek) < len(http2Preface) {
+		if bytes.HasPrefix(http2Preface, peek) {
+			logger.Debug("http2 protocol: possible: preface prefix (buffer maybe not ready)")
+			return tunnel.DetectResultPossible, nil
+		}
+
+		logger.Debug("http2 protocol: never", "peek", string(peek))
 		return tunnel.DetectResultNever, nil
 	}
 
-	if !bytes.Equal(peek, http2Preface) {
+	if !bytes.HasPrefix(peek, http2Preface) {
 		logger.Debug("http2 protocol: never", "peek", string(peek))
 		return tunnel.DetectResultNever, nil
 	}
 
 	logger.Debug("http2 protocol: matched")
-	return tunnel.DetectResultMatched, handler.NewHttp2Handler(d.logger)
+	return tunnel.DetectResultMatched, handler.NewHttp2Handler(d.logger, d.opts)
 }
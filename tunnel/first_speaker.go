@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type Side uint8
+
+const (
+	SideNone = Side(iota)
+	SideDownstream
+	SideUpstream
+)
+
+func (s Side) String() string {
+	switch s {
+	case SideDownstream:
+		return "downstream"
+	case SideUpstream:
+		return "upstream"
+	}
+
+	return "none"
+}
+
+// aLongTimeAgo is a deadline in the past used to interrupt a blocked read immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+type peekResult struct {
+	side Side
+	err  error
+}
+
+// FirstSpeaker waits until either side of the tunnel sends its first byte and reports which side it was.
+// The byte stays buffered in the side's Reader.
+//
+// Both sides are read concurrently, so server-first protocols (MySQL, SMTP, SSH banners)
+// are classified as soon as the banner arrives. Read deadlines are only touched to
+// interrupt the side that lost the race, or both sides when ctx is done.
+func (tun *Tunnel) FirstSpeaker(ctx context.Context) (Side, error) {
+	results := make(chan peekResult, 2)
+
+	peek := func(side Side, stream *Stream) {
+		_, err := stream.Reader.Peek(1)
+		results <- peekResult{side: side, err: err}
+	}
+
+	go peek(SideDownstream, tun.Downstream)
+	go peek(SideUpstream, tun.Upstream)
+
+	var first peekResult
+	select {
+	case first = <-results:
+	case <-ctx.Done():
+		first = peekResult{side: SideNone, err: ctx.Err()}
+	}
+
+	// unblock the pending reads and wait for them, so that nobody else touches the Readers afterward
+	var losers []*Stream
+	switch first.side {
+	case SideDownstream:
+		losers = []*Stream{tun.Upstream}
+	case SideUpstream:
+		losers = []*Stream{tun.Downstream}
+	default:
+		losers = []*Stream{tun.Downstream, tun.Upstream}
+	}
+
+	for _, stream := range losers {
+		_ = stream.Conn.SetReadDeadline(aLongTimeAgo)
+	}
+	for range losers {
+		<-results
+	}
+
+	var resetErrs []error
+	for _, stream := range losers {
+		resetErrs = append(resetErrs, stream.Conn.SetReadDeadline(time.Time{}))
+	}
+
+	if first.err != nil {
+		return first.side, first.err
+	}
+
+	return first.side, errors.Join(resetErrs...)
+}
@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// newTestTunnel returns a tunnel between two loopback connections and the client and origin ends.
+func newTestTunnel(t *testing.T) (tun *Tunnel, client, origin io.ReadWriter) {
+	t.Helper()
+
+	clientConn, downstream := tcpPair(t)
+	upstream, originConn := tcpPair(t)
+
+	tun = NewTunnelFromConn(context.Background(), clientConn.LocalAddr(), originConn.LocalAddr(), downstream, upstream)
+	return tun, clientConn, originConn
+}
+
+// readStream reads n bytes from the Reader of stream.
+func readStream(t *testing.T, stream *Stream, n int) string {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(stream.Reader, b); err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+
+	return string(b)
+}
+
+func writeString(t *testing.T, w io.Writer, s string) {
+	t.Helper()
+
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirstSpeakerClientFirst(t *testing.T) {
+	tun, client, origin := newTestTunnel(t)
+	writeString(t, client, "GET / HTTP/1.1\r\n")
+
+	side, err := tun.FirstSpeaker(context.Background())
+	if err != nil || side != SideDownstream {
+		t.Fatalf("FirstSpeaker = %s, %v, want downstream", side, err)
+	}
+	if tun.Downstream.Reader.Buffered() == 0 {
+		t.Error("the first byte is not buffered")
+	}
+
+	// the interrupted read of the origin does not leave a deadline or an error behind
+	writeString(t, origin, "HTTP/1.1 200 OK\r\n")
+	if got := readStream(t, tun.Upstream, len("HTTP/1.1 200 OK\r\n")); got != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf("upstream read %q", got)
+	}
+	if got := readStream(t, tun.Downstream, len("GET / HTTP/1.1\r\n")); got != "GET / HTTP/1.1\r\n" {
+		t.Errorf("downstream read %q", got)
+	}
+}
+
+func TestFirstSpeakerServerFirst(t *testing.T) {
+	tun, client, origin := newTestTunnel(t)
+	writeString(t, origin, "SSH-2.0-OpenSSH_9.6\r\n")
+
+	side, err := tun.FirstSpeaker(context.Background())
+	if err != nil || side != SideUpstream {
+		t.Fatalf("FirstSpeaker = %s, %v, want upstream", side, err)
+	}
+
+	if got := readStream(t, tun.Upstream, len("SSH-2.0-OpenSSH_9.6\r\n")); got != "SSH-2.0-OpenSSH_9.6\r\n" {
+		t.Errorf("upstream read %q", got)
+	}
+
+	writeString(t, client, "SSH-2.0-client\r\n")
+	if got := readStream(t, tun.Downstream, len("SSH-2.0-client\r\n")); got != "SSH-2.0-client\r\n" {
+		t.Errorf("downstream read %q", got)
+	}
+}
+
+func TestFirstSpeakerTimeout(t *testing.T) {
+	tun, client, origin := newTestTunnel(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	side, err := tun.FirstSpeaker(ctx)
+	if side != SideNone || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("FirstSpeaker = %s, %v, want none and the deadline", side, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("FirstSpeaker returned %v after the timeout", elapsed)
+	}
+
+	// both reads were interrupted, the deadlines are cleared again
+	writeString(t, client, "late request")
+	writeString(t, origin, "late banner")
+	if got := readStream(t, tun.Downstream, len("late request")); got != "late request" {
+		t.Errorf("downstream read %q", got)
+	}
+	if got := readStream(t, tun.Upstream, len("late banner")); got != "late banner" {
+		t.Errorf("upstream read %q", got)
+	}
+}
+
+func TestFirstSpeakerLoserKeepsBufferedBytes(t *testing.T) {
+	tun, client, origin := newTestTunnel(t)
+
+	// both sides have spoken, the side whose peek loses the race has its bytes buffered anyway
+	writeString(t, client, "client hello")
+	writeString(t, origin, "server banner")
+	time.Sleep(50 * time.Millisecond)
+
+	side, err := tun.FirstSpeaker(context.Background())
+	if err != nil || side == SideNone {
+		t.Fatalf("FirstSpeaker = %s, %v", side, err)
+	}
+
+	if got := readStream(t, tun.Downstream, len("client hello")); got != "client hello" {
+		t.Errorf("downstream read %q", got)
+	}
+	if got := readStream(t, tun.Upstream, len("server banner")); got != "server banner" {
+		t.Errorf("upstream read %q", got)
+	}
+}
@@ -2,10 +2,11 @@ package handler
 
 import (
 	"context"
-	"io"
 	"log/slog"
+	"toss/metrics"
 	"toss/tunnel"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -28,8 +29,11 @@ func (h *ByPassHandler) Handle(tun *tunnel.Tunnel) error {
 	g, ctx := errgroup.WithContext(ctx)
 
 	logger.Debug("bypass start")
-	g.Go(func() error { return pipe(tun.Downstream, tun.Upstream) })
-	g.Go(func() error { return pipe(tun.Upstream, tun.Downstream) })
+	upstreamBytes := metrics.PipeBytes.WithLabelValues("upstream")
+	downstreamBytes := metrics.PipeBytes.WithLabelValues("downstream")
+
+	g.Go(func() error { return pipe(tun.Downstream, tun.Upstream, upstreamBytes) })
+	g.Go(func() error { return pipe(tun.Upstream, tun.Downstream, downstreamBytes) })
 
 	err := g.Wait()
 	logger.Debug("bypass end")
@@ -37,7 +41,9 @@ func (h *ByPassHandler) Handle(tun *tunnel.Tunnel) error {
 	return err
 }
 
-func pipe(from, to *tunnel.Stream) error {
+// pipe copies from into to and adds the bytes to piped. The connections are handed to
+// tunnel.CopyCounted as they are, so that TCP connections are spliced, and each chunk is counted.
+func pipe(from, to *tunnel.Stream, piped prometheus.Counter) error {
 	if n := from.Reader.Buffered(); n > 0 {
 		peeked, err := from.Reader.Peek(n)
 		if err != nil {
@@ -52,6 +58,7 @@ func pipe(from, to *tunnel.Stream) error {
 			}
 
 			written += w
+			piped.Add(float64(w))
 		}
 
 		if _, err := from.Reader.Discard(n); err != nil {
@@ -60,6 +67,7 @@ func pipe(from, to *tunnel.Stream) error {
 
 	}
 
-	_, err := io.Copy(to.Conn, from.Conn)
+	_, err := tunnel.CopyCounted(to.Conn, from.Conn, func(n int64) { piped.Add(float64(n)) })
+
 	return err
 }
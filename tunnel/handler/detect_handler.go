@@ -1,9 +1,13 @@
 package handler
 
 import (
-	"io"
+	"context"
+	"errors"
 	"log/slog"
+	"net"
 	"time"
+	"toss/metrics"
+	"toss/policy"
 	"toss/tunnel"
 )
 
@@ -15,62 +19,134 @@ type ProtocolSpecification struct {
 type DetectHandler struct {
 	logger    *slog.Logger
 	detectors []tunnel.Detector
+	opts      *Options
 }
 
-func NewDetectHandler(logger *slog.Logger, detectors []tunnel.Detector) *DetectHandler {
+func NewDetectHandler(logger *slog.Logger, detectors []tunnel.Detector, opts *Options) *DetectHandler {
 	return &DetectHandler{
 		logger:    logger,
 		detectors: detectors,
+		opts:      opts,
 	}
 }
 
 func (h DetectHandler) Handle(tun *tunnel.Tunnel) error {
-	var streamHandler tunnel.Handler = nil
+	// detection also stops when the server starts draining, the tunnel is then bypassed
+	ctx, cancel := context.WithTimeout(tun.Context(), h.opts.DetectTimeout)
+	defer cancel()
 
-	if err := tun.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil && err != io.EOF {
-		h.logger.Error("error set read deadline", "error", err)
-		return err
+	outcome, streamHandler := h.Detect(ctx, tun)
+
+	for name, result := range outcome.Results {
+		metrics.DetectResults.WithLabelValues(name, result.String()).Inc()
+	}
+
+	if streamHandler == nil {
+		h.logger.Debug("no handler: fallback to bypass", slog.Any("detect", outcome))
+		metrics.DetectFallbacks.WithLabelValues(outcome.Fallback).Inc()
+		tun.UpdateInfo(func(info *tunnel.Info) { info.Protocol = policy.ProtocolUnknown })
+		streamHandler = NewByPassHandler(h.logger)
+	} else {
+		h.logger.Debug("protocol detected", slog.Any("detect", outcome))
+	}
+
+	info := tun.Info()
+	decision := h.opts.Policy.Decide(policyContext(tun, info))
+
+	logger := h.logger.With(
+		slog.Group("policy",
+			"action", decision.Action.String(),
+			"rule", decision.Rule,
+		),
+	)
+	logger.Debug("policy decided", "protocol", info.Protocol, "tlsServerNameList", info.ServerNames, "alpn", info.ALPN)
+
+	switch decision.Action {
+	case policy.ActionBypass:
+		if decision.Rule == policy.RuleAutoBypass {
+			metrics.AutoBypassed.Inc()
+		}
+		if decision.Rule != "" {
+			logger.Info("bypassed by policy", "tlsServerNameList", info.ServerNames)
+		}
+		streamHandler = NewByPassHandler(logger)
+	case policy.ActionReject:
+		logger.Info("rejected by policy", "tlsServerNameList", info.ServerNames)
+		tlsAlert := decision.Reject == policy.RejectTlsAlert && info.Protocol == policy.ProtocolTls
+		streamHandler = NewRejectHandler(logger, tlsAlert)
+	case policy.ActionClose:
+		logger.Info("closed by policy", "tlsServerNameList", info.ServerNames)
+		return nil
 	}
 
-	// TODO: context.Timeout 기반으로 변경 필요
-	for i := 0; i < 5; i++ {
-		h.logger.Debug("try to detect protocol")
+	return Handle(tun, streamHandler)
+}
+
+// Detect runs the detectors on the buffered downstream bytes, and again each time more bytes arrive,
+// until one matches, all of them rule the stream out, the byte budget is used up or ctx is done.
+func (h DetectHandler) Detect(ctx context.Context, tun *tunnel.Tunnel) (outcome tunnel.DetectOutcome, streamHandler tunnel.Handler) {
+	start := time.Now()
+	defer func() {
+		outcome.Bytes = tun.Downstream.Reader.Buffered()
+		outcome.Elapsed = time.Since(start)
+	}()
+
+	maxBytes := min(h.opts.DetectMaxBytes, tun.Downstream.Reader.Size())
+	outcome.Results = make(map[string]tunnel.DetectResult, len(h.detectors))
 
-		resultFlag := tunnel.DetectResultNever
+	for {
+		outcome.Rounds++
+		outcome.Result = tunnel.DetectResultNever
 
 		for _, detector := range h.detectors {
 			result, handler := detector.Detect(tun)
-			resultFlag |= result
+			outcome.Result |= result
+			outcome.Results[detector.Name()] = result
 
 			if result == tunnel.DetectResultMatched {
-				streamHandler = handler
-				break
+				outcome.Detector = detector.Name()
+				tun.UpdateInfo(func(info *tunnel.Info) { info.Protocol = detector.Name() })
+				return outcome, handler
 			}
 		}
 
-		if streamHandler != nil {
-			break
+		if outcome.Result == tunnel.DetectResultNever {
+			outcome.Fallback = tunnel.FallbackNoMatch
+			return outcome, nil
 		}
 
-		if resultFlag == tunnel.DetectResultNever {
-			break
+		buffered := tun.Downstream.Reader.Buffered()
+		if buffered >= maxBytes {
+			outcome.Fallback = tunnel.FallbackByteBudget
+			return outcome, nil
 		}
-		//
-		//if tun.Downstream.Reader.Buffered()+tun.Upstream.Reader.Buffered() > 128 {
-		//	h.logger.Debug("failed to detect protocol", "downstream.buffered", tun.Downstream.Reader.Buffered(), "upstream.buffered", tun.Upstream.Reader.Buffered())
-		//	break
-		//}
-	}
 
-	if err := tun.SetReadDeadline(time.Time{}); err != nil && err != io.EOF {
-		h.logger.Error("error unset read deadline", "error", err)
-		return err
+		if err := tun.Downstream.PeekMore(ctx, buffered); err != nil {
+			switch {
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				outcome.Fallback = tunnel.FallbackTimeout
+			case ctx.Err() != nil:
+				outcome.Fallback = tunnel.FallbackDraining
+			default:
+				outcome.Fallback = tunnel.FallbackReadError
+				outcome.Err = err
+			}
+			return outcome, nil
+		}
 	}
+}
 
-	if streamHandler == nil {
-		h.logger.Debug("no handler: fallback to bypass")
-		streamHandler = NewByPassHandler(h.logger)
-	}
+func policyContext(tun *tunnel.Tunnel, info tunnel.Info) *policy.Context {
+	src, _ := tun.Src.(*net.TCPAddr)
+	dst, _ := tun.Dst.(*net.TCPAddr)
 
-	return streamHandler.Handle(tun)
+	return &policy.Context{
+		TunnelID:    tun.ID(),
+		Src:         src,
+		Dst:         dst,
+		Protocol:    info.Protocol,
+		ClientHello: info.ClientHello,
+		JA3:         info.JA3,
+		JA4:         info.JA4,
+	}
 }
@@ -0,0 +1,84 @@
+package handler_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+	"toss/tunnel"
+	"toss/tunnel/detector"
+	"toss/tunnel/handler"
+)
+
+func TestDetectFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     string
+		maxBytes int
+		timeout  time.Duration
+		// closeClient closes the client after sending, drain cancels the context instead
+		closeClient  bool
+		drain        bool
+		wantDetector string
+		wantFallback string
+	}{
+		{name: "matched", sent: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", maxBytes: 4096, timeout: 10 * time.Second, wantDetector: "http2"},
+		{name: "no match", sent: "SSH-2.0-client\r\n", maxBytes: 4096, timeout: 10 * time.Second, wantFallback: tunnel.FallbackNoMatch},
+		// a prefix of the h2 preface stays possible, the budget ends detection before the timeout
+		{name: "byte budget", sent: "PRI * HTTP/2", maxBytes: 8, timeout: 10 * time.Second, wantFallback: tunnel.FallbackByteBudget},
+		{name: "timeout", sent: "PRI * HT", maxBytes: 4096, timeout: 50 * time.Millisecond, wantFallback: tunnel.FallbackTimeout},
+		{name: "draining", sent: "PRI * HT", maxBytes: 4096, timeout: 10 * time.Second, drain: true, wantFallback: tunnel.FallbackDraining},
+		{name: "read error", sent: "PRI * HT", maxBytes: 4096, timeout: 10 * time.Second, closeClient: true, wantFallback: tunnel.FallbackReadError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, downstream := net.Pipe()
+			upstream, origin := net.Pipe()
+			for _, conn := range []net.Conn{client, downstream, upstream, origin} {
+				t.Cleanup(func() { _ = conn.Close() })
+			}
+
+			tun := tunnel.NewTunnelFromConn(context.Background(), client.LocalAddr(), origin.LocalAddr(), downstream, upstream)
+
+			logger := slog.New(slog.DiscardHandler)
+			opts := &handler.Options{DetectMaxBytes: tt.maxBytes, DetectTimeout: tt.timeout}
+			detectors := []tunnel.Detector{detector.NewHttp11Detector(logger, opts), detector.NewHttp2Detector(logger, opts)}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			go func() {
+				_, _ = io.WriteString(client, tt.sent)
+				switch {
+				case tt.closeClient:
+					_ = client.Close()
+				case tt.drain:
+					time.Sleep(50 * time.Millisecond)
+					cancel()
+				}
+			}()
+
+			start := time.Now()
+			outcome, streamHandler := handler.NewDetectHandler(logger, detectors, opts).Detect(ctx, tun)
+
+			if outcome.Detector != tt.wantDetector || outcome.Fallback != tt.wantFallback {
+				t.Fatalf("detected %q, fallback %q, want %q and %q", outcome.Detector, outcome.Fallback, tt.wantDetector, tt.wantFallback)
+			}
+			if (streamHandler != nil) != (tt.wantDetector != "") {
+				t.Errorf("handler %T", streamHandler)
+			}
+			if tt.wantFallback != tunnel.FallbackReadError && outcome.Err != nil {
+				t.Errorf("error %v", outcome.Err)
+			}
+			if outcome.Bytes != len(tt.sent) {
+				t.Errorf("%d bytes buffered, want %d", outcome.Bytes, len(tt.sent))
+			}
+			if tt.wantFallback != tunnel.FallbackTimeout && time.Since(start) >= tt.timeout {
+				t.Errorf("detection waited for the timeout")
+			}
+		})
+	}
+}
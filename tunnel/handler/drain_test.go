@@ -0,0 +1,175 @@
+package handler_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+	"toss/tunnel/tunneltest"
+
+	"golang.org/x/net/http2"
+)
+
+// slowOrigin serves /slow once release is closed, started is closed when the request arrived.
+func slowOrigin(t *testing.T) (origin *tunneltest.Origin, started, release chan struct{}) {
+	t.Helper()
+
+	started, release = make(chan struct{}), make(chan struct{})
+	origin = tunneltest.NewHTTPOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	}))
+
+	return origin, started, release
+}
+
+func waitClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestDrainHttp11InFlight(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin, started, release := slowOrigin(t)
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	if _, err := io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, started, "the request to reach the origin")
+
+	proxy.Drain()
+	close(release)
+
+	// the exchange in flight finishes, the client is told not to reuse the connection
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil || string(body) != "hello /slow" || !res.Close {
+		t.Fatalf("client received %q, close %v, %v", body, res.Close, err)
+	}
+
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("read after the drained response: %v, want EOF", err)
+	}
+	waitClosed(t, conn.Done(), "the tunnel to end")
+}
+
+func TestDrainHttp11Idle(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewHTTPOrigin(t, http.HandlerFunc(helloHandler))
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	if _, err := io.WriteString(conn, "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	if res.Close {
+		t.Fatal("connection closed before the drain")
+	}
+
+	// the connection waiting for its next request is closed right away
+	proxy.Drain()
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("read after the drain: %v, want EOF", err)
+	}
+	waitClosed(t, conn.Done(), "the tunnel to end")
+}
+
+func TestDrainHttp2GoAway(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin, started, release := slowOrigin(t)
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// h2 with prior knowledge over the tunnel
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cc.Close() })
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/slow", nil)
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		slow <- result{body: string(body), err: err}
+	}()
+	waitClosed(t, started, "the request to reach the origin")
+
+	proxy.Drain()
+
+	// the client receives GOAWAY while its stream is still in flight
+	for deadline := time.Now().Add(10 * time.Second); !cc.State().Closing; {
+		if time.Now().After(deadline) {
+			t.Fatal("no GOAWAY after the drain started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/after", nil)
+	if res, err := cc.RoundTrip(req); err == nil {
+		_ = res.Body.Close()
+		t.Error("new stream accepted after GOAWAY")
+	}
+
+	close(release)
+	select {
+	case r := <-slow:
+		if r.err != nil || r.body != "hello /slow" {
+			t.Errorf("stream in flight received %q, %v", r.body, r.err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream in flight did not finish")
+	}
+
+	waitClosed(t, conn.Done(), "the tunnel to end")
+	for _, r := range origin.Requests() {
+		if r.RequestURI == "/after" {
+			t.Error("origin received the request sent after GOAWAY")
+		}
+	}
+}
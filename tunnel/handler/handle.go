@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"toss/tunnel"
+)
+
+// Handle records h in the handler chain of tun and runs it.
+func Handle(tun *tunnel.Tunnel, h tunnel.Handler) error {
+	tun.AddHandler(handlerName(h))
+
+	return h.Handle(tun)
+}
+
+// handlerName returns the type name of h, e.g. "TlsHandler".
+func handlerName(h tunnel.Handler) string {
+	name := fmt.Sprintf("%T", h)
+
+	return name[strings.LastIndex(name, ".")+1:]
+}
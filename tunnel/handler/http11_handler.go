@@ -1,20 +1,29 @@
 package handler
 
 import (
-	"bytes"
+	"context"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+	"toss/har"
+	"toss/metrics"
 	"toss/tunnel"
 )
 
+// metricsProtocolHttp11 is the protocol label of the http metrics.
+const metricsProtocolHttp11 = "http1.1"
+
 type Http11Handler struct {
 	logger *slog.Logger
+	opts   *Options
 }
 
-func NewHttp11Handler(logger *slog.Logger) *Http11Handler {
+func NewHttp11Handler(logger *slog.Logger, opts *Options) *Http11Handler {
 	return &Http11Handler{
 		logger: logger,
+		opts:   opts,
 	}
 }
 
@@ -24,14 +33,49 @@ func (h *Http11Handler) Handle(tun *tunnel.Tunnel) error {
 	logger := h.logger.With("context", "Http11Handler")
 	logger.Debug("handle http1.1 protocol")
 
+	gate := &idleGate{stream: tun.Downstream}
+	stop := context.AfterFunc(tun.Context(), gate.drain)
+	defer stop()
+
 	for {
+		draining, err := gate.waitRequest()
+		if draining {
+			logger.Debug("http1.1 drained while idle")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
 		req, err := http.ReadRequest(tun.Downstream.Reader)
 		if err != nil {
 			return err
 		}
 
-		var reqBodyPreview *bytes.Buffer
-		req.Body, reqBodyPreview = tunnel.NewTeeReadCloser(req.Body, 128)
+		if h.opts.Onboarding.Matches(req.Host) {
+			draining = tun.Context().Err() != nil
+			if err := serveOnboarding(h.opts.Onboarding, req, tun.Downstream.Writer, draining, logger); err != nil {
+				return err
+			}
+			if draining || req.Close {
+				return nil
+			}
+			continue
+		}
+
+		// an absolute-URI request comes from a client of the explicit proxy, whose next request may be
+		// to another host while the tunnel stays connected to the destination of this one
+		forwarded := req.URL.IsAbs()
+		if forwarded {
+			req.Header.Del("Proxy-Connection")
+			req.Header.Del("Proxy-Authorization")
+		}
+
+		metrics.ObserveHttpRequest(metricsProtocolHttp11, req.Method, req.Host)
+		start := time.Now()
+
+		reqBody, reqBodyCapture := tunnel.NewTeeReadCloser(req.Body, h.opts.captureSize())
+		req.Body = reqBody
 
 		if err = req.Write(tun.Upstream.Writer); err != nil {
 			return err
@@ -39,24 +83,48 @@ func (h *Http11Handler) Handle(tun *tunnel.Tunnel) error {
 		if err = tun.Upstream.Writer.Flush(); err != nil {
 			return err
 		}
+		sent := time.Now()
 
 		slogReq := slog.Group("req",
 			slog.Any("method", req.Method),
 			slog.Any("host", req.Host),
 			slog.Any("url", req.URL.String()),
 			slog.Any("headers", req.Header),
-			slog.Any("body", reqBodyPreview.String()),
+			slog.Any("body", h.opts.bodyPreview(reqBodyCapture)),
 		)
 
 		logger.Info("http1.1 request", slogReq)
 
+		exchange := &har.Exchange{
+			Tunnel:          tun,
+			Request:         req,
+			RequestBody:     reqBodyCapture.Bytes(),
+			RequestBodySize: reqBody.Len(),
+			Start:           start,
+			Sent:            sent,
+		}
+
 		res, err := http.ReadResponse(tun.Upstream.Reader, req)
 		if err != nil {
+			metrics.ObserveHttpExchange(metricsProtocolHttp11, req.Method, req.Host, 0, time.Since(start))
+
+			exchange.Err = err
+			exchange.End = time.Now()
+			h.opts.Recorder.Record(exchange)
 			return err
 		}
+		exchange.Headers = time.Now()
+		metrics.ObserveHttpExchange(metricsProtocolHttp11, req.Method, req.Host, res.StatusCode, time.Since(start))
+
+		resBody, resBodyCapture := tunnel.NewTeeReadCloser(res.Body, h.opts.captureSize())
+		res.Body = resBody
 
-		var resBodyPreview *bytes.Buffer
-		res.Body, resBodyPreview = tunnel.NewTeeReadCloser(res.Body, 128)
+		// tell the client not to reuse the connection while the server is draining,
+		// nor for another request through the explicit proxy unless the protocol switches
+		draining = tun.Context().Err() != nil
+		if draining || forwarded && res.StatusCode != http.StatusSwitchingProtocols {
+			res.Close = true
+		}
 
 		if err = res.Write(tun.Downstream.Writer); err != nil {
 			return err
@@ -70,11 +138,17 @@ func (h *Http11Handler) Handle(tun *tunnel.Tunnel) error {
 			slog.Any("status", res.StatusCode),
 			slog.Any("status_code", res.StatusCode),
 			slog.Any("headers", res.Header),
-			slog.Any("body", resBodyPreview.String()),
+			slog.Any("body", h.opts.bodyPreview(resBodyCapture)),
 		)
 
 		logger.Info("http1.1 response", slogReq, slogRes)
 
+		exchange.Response = res
+		exchange.ResponseBody = resBodyCapture.Bytes()
+		exchange.ResponseBodySize = resBody.Len()
+		exchange.End = time.Now()
+		h.opts.Recorder.Record(exchange)
+
 		connectionHeader := strings.ToLower(res.Header.Get("Connection"))
 		upgradeHeader := strings.ToLower(res.Header.Get("Upgrade"))
 
@@ -83,11 +157,66 @@ func (h *Http11Handler) Handle(tun *tunnel.Tunnel) error {
 			handler = NewByPassHandler(h.logger)
 			break
 		}
+
+		if draining {
+			logger.Debug("http1.1 drained after response")
+			return nil
+		}
+
+		if forwarded {
+			logger.Debug("http1.1 forwarded request done, close for the next destination")
+			return nil
+		}
 	}
 
 	if handler != nil {
-		return handler.Handle(tun)
+		return Handle(tun, handler)
 	}
 
 	return nil
 }
+
+// idleGate interrupts the downstream read when the tunnel starts draining
+// while the connection is idle between two requests.
+type idleGate struct {
+	mu       sync.Mutex
+	stream   *tunnel.Stream
+	idle     bool
+	draining bool
+}
+
+func (g *idleGate) drain() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.draining = true
+	if g.idle {
+		_ = g.stream.InterruptRead()
+	}
+}
+
+// waitRequest blocks until the first byte of the next request arrives.
+// It reports draining when the wait was cut short because the tunnel is draining.
+func (g *idleGate) waitRequest() (draining bool, err error) {
+	g.mu.Lock()
+	if g.draining {
+		g.mu.Unlock()
+		return true, nil
+	}
+	g.idle = true
+	g.mu.Unlock()
+
+	_, err = g.stream.Reader.Peek(1)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.idle = false
+	if !g.draining {
+		return false, err
+	}
+
+	// the read may have been interrupted after the request already started, serve it
+	_ = g.stream.Conn.SetReadDeadline(time.Time{})
+	return err != nil, nil
+}
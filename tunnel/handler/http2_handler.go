@@ -1,24 +1,33 @@
 package handler
 
 import (
-	"bytes"
+	"context"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"sync/atomic"
+	"time"
+	"toss/har"
+	"toss/metrics"
 	"toss/tunnel"
 
-	"golang.org/x/net/context"
 	"golang.org/x/net/http2"
 )
 
+// metricsProtocolH2 is the protocol label of the http metrics.
+const metricsProtocolH2 = "h2"
+
 type Http2Handler struct {
 	logger *slog.Logger
+	opts   *Options
 }
 
-func NewHttp2Handler(logger *slog.Logger) *Http2Handler {
+func NewHttp2Handler(logger *slog.Logger, opts *Options) *Http2Handler {
 	return &Http2Handler{
 		logger: logger,
+		opts:   opts,
 	}
 }
 
@@ -38,6 +47,8 @@ func (h *Http2Handler) Handle(tun *tunnel.Tunnel) error {
 	}
 
 	h2Handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
 		outReq := req.Clone(req.Context())
 		outReq.URL = &url.URL{
 			Scheme:   "https",
@@ -47,24 +58,59 @@ func (h *Http2Handler) Handle(tun *tunnel.Tunnel) error {
 		}
 		outReq.RequestURI = ""
 
-		var reqBodyPreview *bytes.Buffer
-		outReq.Body, reqBodyPreview = tunnel.NewTeeReadCloser(outReq.Body, 128)
+		// WroteRequest is called by the transport once the request body is written
+		var sentAt atomic.Int64
+		outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) { sentAt.Store(time.Now().UnixNano()) },
+		}))
+
+		reqBody, reqBodyCapture := tunnel.NewTeeReadCloser(outReq.Body, h.opts.captureSize())
+		outReq.Body = reqBody
+
+		metrics.ObserveHttpRequest(metricsProtocolH2, req.Method, req.Host)
+
+		exchange := &har.Exchange{
+			Tunnel:  tun,
+			Request: req,
+			Start:   start,
+		}
+		defer func() {
+			exchange.RequestBody = reqBodyCapture.Bytes()
+			exchange.RequestBodySize = reqBody.Len()
+			exchange.End = time.Now()
+
+			// the origin may answer before the request body is complete
+			exchange.Sent = exchange.Headers
+			if at := sentAt.Load(); at != 0 && (exchange.Headers.IsZero() || at < exchange.Headers.UnixNano()) {
+				exchange.Sent = time.Unix(0, at)
+			}
+			if exchange.Sent.IsZero() {
+				exchange.Sent = exchange.End
+			}
+
+			h.opts.Recorder.Record(exchange)
+		}()
 
 		res, err := upstreamH2Conn.RoundTrip(outReq)
 		if err != nil {
+			metrics.ObserveHttpExchange(metricsProtocolH2, req.Method, req.Host, 0, time.Since(start))
+			exchange.Err = err
+
 			http.Error(w, "upstream roundtrip error: "+err.Error(), http.StatusBadGateway)
 			logger.Error("upstream roundtrip error", "error", err)
 			cancel()
 			return
 		}
 		defer res.Body.Close()
+		exchange.Headers = time.Now()
+		metrics.ObserveHttpExchange(metricsProtocolH2, req.Method, req.Host, res.StatusCode, time.Since(start))
 
 		slogReq := slog.Group("req",
 			slog.Any("method", req.Method),
 			slog.Any("host", req.Host),
 			slog.Any("url", req.URL.String()),
 			slog.Any("headers", req.Header),
-			slog.Any("body", reqBodyPreview.String()),
+			slog.Any("body", h.opts.bodyPreview(reqBodyCapture)),
 		)
 		logger.Info("h2 request", slogReq)
 
@@ -76,8 +122,14 @@ func (h *Http2Handler) Handle(tun *tunnel.Tunnel) error {
 
 		w.WriteHeader(res.StatusCode)
 
-		var resBodyPreview *bytes.Buffer
-		res.Body, resBodyPreview = tunnel.NewTeeReadCloser(res.Body, 128)
+		resBody, resBodyCapture := tunnel.NewTeeReadCloser(res.Body, h.opts.captureSize())
+		res.Body = resBody
+
+		exchange.Response = res
+		defer func() {
+			exchange.ResponseBody = resBodyCapture.Bytes()
+			exchange.ResponseBodySize = resBody.Len()
+		}()
 
 		if _, err := io.Copy(w, res.Body); err != nil {
 			_ = err
@@ -88,15 +140,29 @@ func (h *Http2Handler) Handle(tun *tunnel.Tunnel) error {
 			slog.Any("status", res.Status),
 			slog.Any("status_code", res.StatusCode),
 			slog.Any("headers", res.Header),
-			slog.Any("body", resBodyPreview.String()),
+			slog.Any("body", h.opts.bodyPreview(resBodyCapture)),
 		)
 
 		logger.Info("h2 response", slogReq, slogRes)
 	})
 
+	// ConfigureServer hooks the h2 server into baseServer.Shutdown, which sends GOAWAY
+	// and lets the streams in flight finish before ServeConn returns.
+	baseServer := &http.Server{}
+	if err := http2.ConfigureServer(baseServer, downstreamH2Server); err != nil {
+		return err
+	}
+
+	stopDrain := context.AfterFunc(tun.Context(), func() {
+		logger.Debug("h2 draining: sending GOAWAY")
+		_ = baseServer.Shutdown(context.Background())
+	})
+	defer stopDrain()
+
 	downstreamH2ServerOpts := &http2.ServeConnOpts{
-		Handler: h2Handler,
-		Context: ctx,
+		Handler:    h2Handler,
+		Context:    ctx,
+		BaseConfig: baseServer,
 	}
 	downstreamH2Server.ServeConn(tun.Downstream, downstreamH2ServerOpts)
 
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"toss/metrics"
+	"toss/onboarding"
+)
+
+// onboardingIdleTimeout closes an https onboarding connection without requests.
+const onboardingIdleTimeout = 30 * time.Second
+
+// serveOnboarding answers req with the onboarding site instead of forwarding it to the origin.
+func serveOnboarding(site *onboarding.Server, req *http.Request, w *bufio.Writer, closeConn bool, logger *slog.Logger) error {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	local := &localResponse{header: make(http.Header)}
+	site.ServeHTTP(local, req)
+	_ = req.Body.Close()
+
+	logger.Info("onboarding request", "scheme", scheme, "method", req.Method, "url", req.URL.String(), "status", local.status())
+	metrics.OnboardingRequests.WithLabelValues(scheme, strconv.Itoa(local.status())).Inc()
+
+	res := &http.Response{
+		StatusCode:    local.status(),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        local.header,
+		Body:          io.NopCloser(&local.body),
+		ContentLength: int64(local.body.Len()),
+		Close:         closeConn || req.Close,
+		Request:       req,
+	}
+
+	if err := res.Write(w); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// serveOnboardingConn serves the onboarding site on a client connection whose handshake was made
+// for the onboarding host, no origin is involved. It returns when the client is done or the tunnel drains.
+// trusted is called when the client passes the trust check, which it can only load over https once the
+// CA is installed.
+func serveOnboardingConn(ctx context.Context, site *onboarding.Server, conn *tls.Conn, trusted func(), logger *slog.Logger) error {
+	state := conn.ConnectionState()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(onboardingIdleTimeout))
+
+		req, err := http.ReadRequest(reader)
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		req.TLS = &state
+		if err := serveOnboarding(site, req, writer, ctx.Err() != nil, logger); err != nil {
+			return err
+		}
+		if req.Method == http.MethodGet && req.URL.Path == onboarding.TrustCheckPath {
+			trusted()
+		}
+		if req.Close {
+			return nil
+		}
+	}
+}
+
+// localResponse is the http.ResponseWriter of a request answered by the proxy itself.
+type localResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *localResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *localResponse) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *localResponse) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
+
+func (r *localResponse) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+
+	return r.statusCode
+}
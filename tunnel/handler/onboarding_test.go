@@ -0,0 +1,57 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"toss/onboarding"
+	"toss/policy"
+	"toss/tunnel/tunneltest"
+)
+
+func TestOnboardingTrustCheck(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewHTTPOrigin(t, http.HandlerFunc(helloHandler))
+
+	learned := policy.NewLearned(16)
+	proxy.Options.Onboarding = onboarding.NewServer("toss.test", proxy.CA.Root)
+	proxy.Options.AutoBypass = learned
+	proxy.Options.AutoBypassTTL = time.Hour
+
+	// a server name the client refused before the CA was installed
+	refused := &policy.Context{
+		Src: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000},
+		Dst: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+	}
+	if _, ok := learned.Learn(refused, "unknown_ca", time.Hour); !ok {
+		t.Fatal("refusal not learned")
+	}
+
+	client := proxy.HTTPClient(origin.Addr)
+
+	// plain http tells nothing about the trust of the client
+	res, body := get(t, client, "http://toss.test/ca.pem")
+	if block, _ := pem.Decode([]byte(body)); res.StatusCode != http.StatusOK || block == nil || !bytes.Equal(block.Bytes, proxy.CA.Root.Raw) {
+		t.Fatalf("ca.pem: status %d, body %q", res.StatusCode, body)
+	}
+	res, _ = get(t, client, "http://toss.test"+onboarding.TrustCheckPath)
+	if res.StatusCode != http.StatusNoContent || learned.Len() != 1 {
+		t.Fatalf("trust check over http: status %d, %d learned", res.StatusCode, learned.Len())
+	}
+
+	// the trust check only loads over https when the client accepted the leaf of the CA
+	res, _ = get(t, client, "https://toss.test"+onboarding.TrustCheckPath)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("trust check over https: status %d", res.StatusCode)
+	}
+	if _, ok := learned.Lookup(refused); ok || learned.Len() != 0 {
+		t.Errorf("%d refusals kept after the trust check", learned.Len())
+	}
+
+	if requests := origin.Requests(); len(requests) != 0 {
+		t.Errorf("origin received %d onboarding requests", len(requests))
+	}
+}
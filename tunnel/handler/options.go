@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"bytes"
+	"time"
+	"toss/har"
+	"toss/keylog"
+	"toss/metrics"
+	"toss/onboarding"
+	"toss/policy"
+	"toss/trust"
+)
+
+// Options is the configuration snapshot shared by the detectors and handlers of a tunnel.
+type Options struct {
+	// FirstByteTimeout is how long Serve waits for either side to speak.
+	FirstByteTimeout time.Duration
+
+	// DetectTimeout and DetectMaxBytes bound how long and how many downstream bytes
+	// DetectHandler waits before falling back to bypass.
+	DetectTimeout  time.Duration
+	DetectMaxBytes int
+
+	// BodyPreviewSize is the number of http body bytes written to the logs.
+	BodyPreviewSize uint64
+
+	// Policy decides whether a detected tunnel is intercepted, bypassed, rejected or closed.
+	Policy policy.Policy
+
+	// Recorder writes the intercepted http exchanges to HAR files, nil when disabled.
+	Recorder *har.Recorder
+
+	// KeyLog receives the TLS secrets of the tunnels selected by KeyLogFilter, nil when disabled.
+	KeyLog       *keylog.File
+	KeyLogFilter *policy.Filter
+
+	// UpstreamVerifier checks the origin certificates, nil verifies against the system roots.
+	UpstreamVerifier *trust.Verifier
+
+	// AutoBypass remembers the clients that refused the forged certificate of a server name for
+	// AutoBypassTTL, Policy bypasses their next tunnels to it. nil when disabled.
+	AutoBypass    *policy.Learned
+	AutoBypassTTL time.Duration
+
+	// JA4Names and JA4SNames are the metric labels of the known fingerprints.
+	JA4Names  metrics.FingerprintNames
+	JA4SNames metrics.FingerprintNames
+
+	// Onboarding answers the requests to the onboarding host instead of the origin, nil when disabled.
+	Onboarding *onboarding.Server
+}
+
+// captureSize is how many body bytes are kept for the logs and the HAR recorder.
+func (o *Options) captureSize() uint64 {
+	return max(o.BodyPreviewSize, uint64(o.Recorder.BodySize()))
+}
+
+// bodyPreview returns the part of a captured body that is written to the logs.
+func (o *Options) bodyPreview(captured *bytes.Buffer) string {
+	b := captured.Bytes()
+	return string(b[:min(uint64(len(b)), o.BodyPreviewSize)])
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"toss/tunnel"
+)
+
+const (
+	tlsContentTypeAlert = 0x15
+
+	tlsAlertLevelFatal             = 2
+	tlsAlertDescHandshakeFailure   = 40
+	tlsAlertDescBadCertificate     = 42
+	tlsAlertDescCertExpired        = 45
+	tlsAlertDescCertificateUnknown = 46
+	tlsAlertDescUnknownCA          = 48
+)
+
+// writeTlsAlert writes a fatal alert record, for clients whose handshake is not driven by crypto/tls.
+func writeTlsAlert(conn net.Conn, desc byte) error {
+	// TLS Record: Alert(0x15), TLS 1.0 record version, length 2, fatal desc
+	_, err := conn.Write([]byte{tlsContentTypeAlert, 3, 1, 0, 2, tlsAlertLevelFatal, desc})
+	return err
+}
+
+// RejectHandler refuses the client, either with a fatal TLS alert or with a TCP RST.
+type RejectHandler struct {
+	logger   *slog.Logger
+	tlsAlert bool
+}
+
+func NewRejectHandler(logger *slog.Logger, tlsAlert bool) *RejectHandler {
+	return &RejectHandler{
+		logger:   logger,
+		tlsAlert: tlsAlert,
+	}
+}
+
+func (h *RejectHandler) Handle(tun *tunnel.Tunnel) error {
+	logger := h.logger.With("context", "RejectHandler")
+
+	if h.tlsAlert {
+		logger.Debug("reject with tls alert")
+
+		err := writeTlsAlert(tun.Downstream.Conn, tlsAlertDescHandshakeFailure)
+		return errors.Join(err, tun.Close())
+	}
+
+	logger.Debug("reject with tcp rst")
+
+	// closing a socket with a zero linger time sends RST instead of FIN
+	if conn, ok := tun.Downstream.Conn.(interface{ SetLinger(sec int) error }); ok {
+		if err := conn.SetLinger(0); err != nil {
+			logger.Warn("failed to set linger", slog.Any("error", err))
+		}
+	}
+
+	return tun.Close()
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"toss/tunnel"
+)
+
+// Serve runs tun until it is done. It waits for either side to send data, then runs DetectHandler
+// with detectors when the client spoke first and ByPassHandler when the server did.
+// tun may be built from any net.Conn, e.g. a TPROXY socket or an in-memory pipe.
+func Serve(tun *tunnel.Tunnel, logger *slog.Logger, detectors []tunnel.Detector, opts *Options) {
+	logger.Debug("tunnel handling start")
+
+	ctx, cancel := context.WithTimeout(tun.Context(), opts.FirstByteTimeout)
+	defer cancel()
+
+	side, err := tun.FirstSpeaker(ctx)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			logger.Debug("draining: close tunnel before either side sent data")
+			return
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Error("neither side sent data", "timeout", opts.FirstByteTimeout.String())
+			return
+		}
+
+		logger.Error("failed to read packet", "side", side.String(), slog.Any("error", err))
+		return
+	}
+
+	switch side {
+	case tunnel.SideDownstream:
+		logger.Debug("client-side first protocol detected")
+		serveClientFirstProtocol(tun, logger, detectors, opts)
+	case tunnel.SideUpstream:
+		logger.Debug("server-side first protocol detected")
+		serveServerFirstProtocol(tun, logger)
+	}
+}
+
+func serveClientFirstProtocol(tun *tunnel.Tunnel, logger *slog.Logger, detectors []tunnel.Detector, opts *Options) {
+	detectHandler := NewDetectHandler(logger, detectors, opts)
+
+	if err := detectHandler.Handle(tun); err != nil && err != io.EOF {
+		logger.Error("error occurred", "error", err, "stack", err.Error())
+	}
+}
+
+func serveServerFirstProtocol(tun *tunnel.Tunnel, logger *slog.Logger) {
+	byPassHandler := NewByPassHandler(logger)
+
+	if err := Handle(tun, byPassHandler); err != nil && err != io.EOF {
+		logger.Error("error occurred", slog.Any("error", err))
+	}
+}
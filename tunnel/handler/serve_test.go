@@ -0,0 +1,279 @@
+package handler_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"toss/metrics"
+	"toss/policy"
+	"toss/tunnel"
+	"toss/tunnel/tunneltest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func helloHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Origin", "yes")
+	_, _ = io.WriteString(w, "hello "+r.URL.Path)
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Client", "yes")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, string(body)
+}
+
+// onlyTunnel returns the tunnel of a test that opened one and checks how it was handled.
+func onlyTunnel(t *testing.T, proxy *tunneltest.Proxy, protocol string, handlers ...string) tunnel.Info {
+	t.Helper()
+
+	tunnels := proxy.Tunnels()
+	if len(tunnels) != 1 {
+		t.Fatalf("%d tunnels, want 1", len(tunnels))
+	}
+
+	info := tunnels[0].Info()
+	if info.Protocol != protocol {
+		t.Errorf("protocol %q, want %q", info.Protocol, protocol)
+	}
+	if !slices.Equal(info.Handlers, handlers) {
+		t.Errorf("handlers %v, want %v", info.Handlers, handlers)
+	}
+
+	return info
+}
+
+func checkOriginRequest(t *testing.T, origin *tunneltest.Origin, proto, host, uri string) {
+	t.Helper()
+
+	requests := origin.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("origin received %d requests, want 1", len(requests))
+	}
+
+	r := requests[0]
+	if r.Proto != proto || r.Host != host || r.RequestURI != uri || r.Header.Get("X-Client") != "yes" {
+		t.Errorf("origin received %s %s %s%s, X-Client %q", r.Proto, r.Method, r.Host, r.RequestURI, r.Header.Get("X-Client"))
+	}
+}
+
+func TestServeHttp11(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewHTTPOrigin(t, http.HandlerFunc(helloHandler))
+
+	res, body := get(t, proxy.HTTPClient(origin.Addr), "http://example.com/a?b=1")
+	if body != "hello /a" || res.Header.Get("X-Origin") != "yes" {
+		t.Errorf("client received %q, X-Origin %q", body, res.Header.Get("X-Origin"))
+	}
+
+	checkOriginRequest(t, origin, "HTTP/1.1", "example.com", "/a?b=1")
+	onlyTunnel(t, proxy, "http11", "Http11Handler")
+}
+
+func TestServeHttp2PriorKnowledge(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewHTTPOrigin(t, http.HandlerFunc(helloHandler))
+
+	client := proxy.HTTPClient(origin.Addr)
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client.Transport.(*http.Transport).Protocols = protocols
+
+	res, body := get(t, client, "http://example.com/h2c")
+	if body != "hello /h2c" || res.ProtoMajor != 2 {
+		t.Errorf("client received %q over %s", body, res.Proto)
+	}
+
+	checkOriginRequest(t, origin, "HTTP/2.0", "example.com", "/h2c")
+	onlyTunnel(t, proxy, "http2", "Http2Handler")
+}
+
+func TestServeTls(t *testing.T) {
+	tests := []struct {
+		name       string
+		nextProtos []string
+		proto      string
+		handler    string
+	}{
+		{name: "h2", nextProtos: []string{"h2", "http/1.1"}, proto: "HTTP/2.0", handler: "Http2Handler"},
+		{name: "http/1.1", nextProtos: []string{"http/1.1"}, proto: "HTTP/1.1", handler: "Http11Handler"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originCA := tunneltest.NewCA(t, "Toss Test Origin")
+			origin := tunneltest.NewTLSOrigin(t, originCA, http.HandlerFunc(helloHandler))
+
+			proxy := tunneltest.NewProxy(t)
+			proxy.Trust(originCA)
+
+			client := proxy.HTTPClient(origin.Addr)
+			transport := client.Transport.(*http.Transport)
+			transport.TLSClientConfig.NextProtos = tt.nextProtos
+			transport.ForceAttemptHTTP2 = slices.Contains(tt.nextProtos, "h2")
+
+			res, body := get(t, client, "https://example.com/secure")
+			if body != "hello /secure" || res.Proto != tt.proto {
+				t.Errorf("client received %q over %s", body, res.Proto)
+			}
+
+			// the client only trusts the proxy CA, so the leaf it verified was forged
+			if issuer := res.TLS.PeerCertificates[0].Issuer.Organization; !slices.Equal(issuer, []string{"Toss Test Proxy"}) {
+				t.Errorf("client leaf issued by %v", issuer)
+			}
+
+			checkOriginRequest(t, origin, tt.proto, "example.com", "/secure")
+			if !origin.Requests()[0].TLS {
+				t.Error("origin received the request without tls")
+			}
+
+			info := onlyTunnel(t, proxy, "tls", "TlsHandler", tt.handler)
+			if !slices.Equal(info.ServerNames, []string{"example.com"}) || info.JA4 == "" {
+				t.Errorf("server names %v, ja4 %q", info.ServerNames, info.JA4)
+			}
+			if info.TLS == nil || info.TLS.ServerName != "example.com" || info.TLS.JA4S == "" {
+				t.Errorf("tls info %+v", info.TLS)
+			}
+		})
+	}
+}
+
+func TestServeTlsBypassedByPolicy(t *testing.T) {
+	originCA := tunneltest.NewCA(t, "Toss Test Origin")
+	origin := tunneltest.NewTLSOrigin(t, originCA, http.HandlerFunc(helloHandler))
+
+	proxy := tunneltest.NewProxy(t)
+	proxy.Options.Policy = policy.Static{Action: policy.ActionBypass}
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client talks to the origin itself, it must get the leaf of the origin CA
+	tlsConn := tls.Client(conn, originCA.ClientConfig("example.com", "http/1.1"))
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake through the bypassed tunnel: %v", err)
+	}
+	_ = tlsConn.Close()
+
+	onlyTunnel(t, proxy, "tls", "ByPassHandler")
+}
+
+func TestServeUnknownProtocol(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewEchoOrigin(t)
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const message = "hello, not http\n"
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echo, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || echo != message {
+		t.Fatalf("client received %q, %v", echo, err)
+	}
+
+	if received := origin.Received(); len(received) != 1 || string(received[0]) != message {
+		t.Errorf("origin received %q", received)
+	}
+
+	onlyTunnel(t, proxy, policy.ProtocolUnknown, "ByPassHandler")
+}
+
+func TestServeServerFirst(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewBannerOrigin(t, []byte("SSH-2.0-OpenSSH_9.2\r\n"))
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	banner, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(banner, "SSH-2.0-") {
+		t.Fatalf("client received %q, %v", banner, err)
+	}
+
+	// the proxy must not wait for the client before passing on the banner, nor hold its answer
+	if _, err := io.WriteString(conn, "SSH-2.0-Client\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if echo, err := reader.ReadString('\n'); err != nil || echo != "SSH-2.0-Client\r\n" {
+		t.Fatalf("client received %q, %v", echo, err)
+	}
+
+	if received := origin.Received(); len(received) != 1 || string(received[0]) != "SSH-2.0-Client\r\n" {
+		t.Errorf("origin received %q", received)
+	}
+
+	onlyTunnel(t, proxy, "", "ByPassHandler")
+}
+
+func TestServeBypassCountedDuringCopy(t *testing.T) {
+	proxy := tunneltest.NewProxy(t)
+	origin := tunneltest.NewEchoOrigin(t)
+	piped := testutil.ToFloat64(metrics.PipeBytes.WithLabelValues("upstream"))
+
+	conn, err := proxy.Dial(origin.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	// more than a splice chunk, the connection stays open
+	message := strings.Repeat("not http\n", 30_000)
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Fatal(err)
+	}
+
+	// all but the 64KiB chunk still being spliced are counted
+	want := len(message) - 64<<10
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := testutil.ToFloat64(metrics.PipeBytes.WithLabelValues("upstream")) - piped
+		stats := conn.Tunnel.Stats()
+		if n >= float64(want) && stats.BytesIn >= int64(want) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("piped %v bytes and counted %d bytes in while the tunnel is open, want at least %d", n, stats.BytesIn, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
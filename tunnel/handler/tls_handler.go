@@ -1,22 +1,37 @@
 package handler
 
 import (
+	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 	"toss/cert"
+	"toss/fingerprint"
+	"toss/metrics"
+	"toss/trust"
 	"toss/tunnel"
 )
 
 type TlsHandler struct {
 	logger      *slog.Logger
 	certManager *cert.Manager
+	opts        *Options
 }
 
-func NewTlsHandler(logger *slog.Logger, certManager *cert.Manager) *TlsHandler {
+func NewTlsHandler(logger *slog.Logger, certManager *cert.Manager, opts *Options) *TlsHandler {
 	return &TlsHandler{
 		logger:      logger,
 		certManager: certManager,
+		opts:        opts,
 	}
 }
 
@@ -27,70 +42,404 @@ func (h *TlsHandler) Handle(tun *tunnel.Tunnel) error {
 	var (
 		upstreamTlsConn    *tls.Conn
 		upstreamNegotiated string
+		upstreamElapsed    time.Duration
+		upstreamErr        error
+		ja4s               string
+		// rejected is set when the client is given an untrusted leaf instead of the origin
+		rejected *trust.Error
+		// onboarding is set when the client connects to the onboarding host, which has no origin
+		onboarding bool
+		// forgedAt is set when the client is given the forged leaf of the origin
+		forgedAt time.Time
 	)
 
+	verifier := h.opts.UpstreamVerifier
+	dst, _ := tun.Dst.(*net.TCPAddr)
+
+	if h.opts.KeyLog != nil && h.opts.KeyLogFilter.Match(policyContext(tun, tun.Info())) {
+		logger.Debug("write tls secrets to key log")
+		tun.AddKeyLogWriter(tunnel.SideDownstream, h.opts.KeyLog.Writer(tun, tunnel.SideDownstream))
+		tun.AddKeyLogWriter(tunnel.SideUpstream, h.opts.KeyLog.Writer(tun, tunnel.SideUpstream))
+	}
+
 	downstreamConfig := &tls.Config{
 		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			if h.opts.Onboarding.Matches(info.ServerName) {
+				onboarding = true
+				return h.onboardingConfig(tun, info)
+			}
 
 			upstreamConfig := &tls.Config{
-				NextProtos: info.SupportedProtos,
+				NextProtos:   info.SupportedProtos,
+				KeyLogWriter: tun.KeyLogWriter(tunnel.SideUpstream),
+				// the certificates are checked by the verifier in VerifyConnection instead
+				InsecureSkipVerify: true,
+				VerifyConnection: func(state tls.ConnectionState) error {
+					return verifier.Verify(info.ServerName, dst, state.PeerCertificates)
+				},
 			}
 
 			if info.ServerName != "" {
 				upstreamConfig.ServerName = info.ServerName
 			}
 
+			if verifier.Skips(info.ServerName, dst) {
+				logger.Debug("upstream certificate is not verified", "sni", info.ServerName)
+			}
+
 			logger.Debug("upstream tls handshake start")
-			conn := tls.Client(tun.Upstream, upstreamConfig)
+			start := time.Now()
+			recorder := &firstRecordConn{Conn: tun.Upstream}
+			conn := tls.Client(recorder, upstreamConfig)
 			if err := conn.Handshake(); err != nil {
+				upstreamErr = err
+				metrics.TlsHandshakeFailures.WithLabelValues("upstream", tlsErrorClass(err)).Inc()
+
+				if errors.As(err, &rejected) {
+					return h.rejectUpstream(tun, info, rejected, logger)
+				}
 				return nil, err
 			}
+			upstreamElapsed = time.Since(start)
+			metrics.TlsHandshakeDuration.WithLabelValues("upstream").Observe(upstreamElapsed.Seconds())
+
+			if serverHello, err := fingerprint.ParseServerHello(recorder.record); err == nil {
+				ja4s = fingerprint.JA4S(serverHello)
+				metrics.TlsServerHellos.WithLabelValues(h.opts.JA4SNames.Label(ja4s)).Inc()
+			}
 
 			negotiated := conn.ConnectionState().NegotiatedProtocol
-			logger.Debug("upstream tls handshake done", "negotiated", negotiated)
+			logger.Debug("upstream tls handshake done", "negotiated", negotiated, "ja4s", ja4s)
 
 			upstreamTlsConn = conn
 			upstreamNegotiated = negotiated
 
-			crt, err := h.certManager.GetCertificate(info)
+			// the leaf is mimicked from the origin certificate, verifier.Verify fails the handshake
+			// in VerifyConnection when there is none, even for the origins it does not verify
+			crt, err := h.certManager.GetCertificateFor(info, conn.ConnectionState().PeerCertificates[0])
 			if err != nil {
 				return nil, err
 			}
 
+			// this config replaces downstreamConfig for the rest of the handshake
 			cfg := &tls.Config{
 				Certificates: []tls.Certificate{*crt},
+				KeyLogWriter: tun.KeyLogWriter(tunnel.SideDownstream),
 			}
 			if negotiated != "" {
 				cfg.NextProtos = []string{negotiated}
 			}
 
+			forgedAt = time.Now()
 			return cfg, nil
 		},
 	}
 
 	logger.Debug("downstream tls handshake start")
+	start := time.Now()
 	downstreamTlsConn := tls.Server(tun.Downstream, downstreamConfig)
 	if err := downstreamTlsConn.Handshake(); err != nil {
+		// an upstream failure is already counted on its own side
+		if upstreamErr == nil {
+			metrics.TlsHandshakeFailures.WithLabelValues("downstream", tlsErrorClass(err)).Inc()
+		}
+		if !forgedAt.IsZero() {
+			h.learnRefusal(tun, err, time.Since(forgedAt), logger)
+		}
 		return err
 	}
 
-	downstreamNegotiated := downstreamTlsConn.ConnectionState().NegotiatedProtocol
+	if onboarding {
+		trusted := func() { h.forgetRefusals(tun, logger) }
+		return serveOnboardingConn(tun.Context(), h.opts.Onboarding, downstreamTlsConn, trusted, logger)
+	}
+
+	if upstreamTlsConn == nil {
+		return serveUpstreamRejection(downstreamTlsConn, rejected)
+	}
+
+	// the upstream handshake runs inside the downstream one, only count the time spent with the client
+	downstreamElapsed := time.Since(start) - upstreamElapsed
+	metrics.TlsHandshakeDuration.WithLabelValues("downstream").Observe(downstreamElapsed.Seconds())
+
+	downstreamState := downstreamTlsConn.ConnectionState()
+	upstreamState := upstreamTlsConn.ConnectionState()
+
+	downstreamNegotiated := downstreamState.NegotiatedProtocol
 	logger.Debug("downstream tls handshake done", "negotiated", downstreamNegotiated)
 
+	tun.UpdateInfo(func(info *tunnel.Info) {
+		info.TLS = &tunnel.TLSInfo{
+			ServerName: downstreamState.ServerName,
+			ALPN:       downstreamNegotiated,
+			JA4S:       ja4s,
+			Downstream: tunnel.TLSLeg{
+				Version:     downstreamState.Version,
+				CipherSuite: downstreamState.CipherSuite,
+				Handshake:   downstreamElapsed,
+			},
+			Upstream: tunnel.TLSLeg{
+				Version:     upstreamState.Version,
+				CipherSuite: upstreamState.CipherSuite,
+				Handshake:   upstreamElapsed,
+			},
+		}
+	})
+
 	if downstreamNegotiated != upstreamNegotiated {
 		return fmt.Errorf("ALPN mismatch: downstream=%s upstream=%s", downstreamNegotiated, upstreamNegotiated)
 	}
 
+	nextLogger := h.logger.With("ja4s", ja4s)
+
 	var streamHandler tunnel.Handler
 	switch downstreamNegotiated {
 	case "h2":
-		streamHandler = NewHttp2Handler(h.logger)
+		streamHandler = NewHttp2Handler(nextLogger, h.opts)
 	case "http/1.1":
-		streamHandler = NewHttp11Handler(h.logger)
+		streamHandler = NewHttp11Handler(nextLogger, h.opts)
 	default:
-		streamHandler = NewByPassHandler(h.logger)
+		streamHandler = NewByPassHandler(nextLogger)
+	}
+
+	tlsTun := tun.Wrap(downstreamTlsConn, upstreamTlsConn)
+	return Handle(tlsTun, streamHandler)
+}
+
+// onboardingConfig completes the client handshake for the onboarding host with a leaf of the CA,
+// without an upstream handshake.
+func (h *TlsHandler) onboardingConfig(tun *tunnel.Tunnel, info *tls.ClientHelloInfo) (*tls.Config, error) {
+	crt, err := h.certManager.GetCertificate(info)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{*crt},
+		KeyLogWriter: tun.KeyLogWriter(tunnel.SideDownstream),
+	}
+	// the site is served over http/1.1
+	if slices.Contains(info.SupportedProtos, "http/1.1") {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+
+	return cfg, nil
+}
+
+// rejectUpstream tells the client that the origin certificate was rejected, either with an alert
+// or with an untrusted leaf so that the client shows its own certificate warning.
+func (h *TlsHandler) rejectUpstream(tun *tunnel.Tunnel, info *tls.ClientHelloInfo, rejected *trust.Error, logger *slog.Logger) (*tls.Config, error) {
+	mode := h.opts.UpstreamVerifier.FailureMode()
+
+	logger.Warn("upstream certificate rejected",
+		"sni", info.ServerName,
+		"reason", rejected.Reason,
+		"mode", mode,
+		slog.Any("error", rejected.Err),
+	)
+	metrics.UpstreamCertRejections.WithLabelValues(string(rejected.Reason), mode.String()).Inc()
+
+	if mode == trust.FailAlert {
+		desc := byte(tlsAlertDescBadCertificate)
+		switch rejected.Reason {
+		case trust.ReasonUnknownAuthority:
+			desc = tlsAlertDescUnknownCA
+		case trust.ReasonExpired:
+			desc = tlsAlertDescCertExpired
+		}
+
+		// crypto/tls only sends internal_error when GetConfigForClient fails, the client reads this alert first
+		return nil, errors.Join(rejected, writeTlsAlert(tun.Downstream.Conn, desc))
+	}
+
+	untrusted := cert.UntrustedAuthority
+	switch rejected.Reason {
+	case trust.ReasonExpired:
+		untrusted = cert.UntrustedExpired
+	case trust.ReasonHostname:
+		untrusted = cert.UntrustedHostname
+	}
+
+	crt, err := h.certManager.GetUntrustedCertificate(info, untrusted, string(rejected.Reason)+": "+rejected.Err.Error())
+	if err != nil {
+		return nil, errors.Join(rejected, err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{*crt},
+		KeyLogWriter: tun.KeyLogWriter(tunnel.SideDownstream),
+	}
+	// the error page is served over http/1.1
+	if slices.Contains(info.SupportedProtos, "http/1.1") {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+
+	return cfg, nil
+}
+
+// serveUpstreamRejection answers the first request of a client that accepted the untrusted leaf.
+func serveUpstreamRejection(conn *tls.Conn, rejected *trust.Error) error {
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return errors.Join(rejected, err, conn.Close())
+	}
+
+	body := rejected.Error() + "\n"
+	res := &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+
+	return errors.Join(rejected, res.Write(conn), conn.Close())
+}
+
+// refusalCloseWindow is how soon after the forged leaf was sent a client must close the connection
+// for the close to be taken as a refusal. Pinning clients close as soon as they checked the leaf,
+// later closes are more likely a client giving up or a flaky link.
+const refusalCloseWindow = time.Second
+
+// learnRefusal remembers the client and server name when the client refused the forged leaf,
+// so that the policy bypasses its next tunnels instead of failing them the same way.
+// sinceLeaf is the time between sending the leaf and the failure of the handshake.
+func (h *TlsHandler) learnRefusal(tun *tunnel.Tunnel, err error, sinceLeaf time.Duration, logger *slog.Logger) {
+	reason := refusalReason(err, sinceLeaf)
+	if reason == "" {
+		return
+	}
+
+	entry, learned := h.opts.AutoBypass.Learn(policyContext(tun, tun.Info()), reason, h.opts.AutoBypassTTL)
+	if !learned {
+		return
+	}
+
+	metrics.AutoBypassLearned.WithLabelValues(reason).Inc()
+	logger.Warn("client refused the forged certificate, its next tunnels to the server are bypassed",
+		"client", entry.Client,
+		"sni", entry.ServerName,
+		"reason", reason,
+		"until", entry.Expires,
+	)
+}
+
+// forgetRefusals forgets the server names the client refused, it trusts the CA now. Before the CA
+// was installed, every site it visited refused the forged leaf with unknown_ca.
+func (h *TlsHandler) forgetRefusals(tun *tunnel.Tunnel, logger *slog.Logger) {
+	src, ok := tun.Src.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	client := src.IP.String()
+	if n := h.opts.AutoBypass.Forget(client, ""); n > 0 {
+		logger.Info("client trusts the CA, its learned server names are forgotten", "client", client, "forgotten", n)
+	}
+}
+
+// refusalReason tells whether a failed client handshake looks like the client refusing the leaf,
+// as apps pinning the certificate of their server do: an alert about the certificate, or closing
+// the connection within refusalCloseWindow of the leaf. The handshake failed, so the client never
+// sent a valid Finished. It returns "" for other failures.
+func refusalReason(err error, sinceLeaf time.Duration) string {
+	if code, ok := receivedAlert(err); ok {
+		switch code {
+		case tlsAlertDescBadCertificate:
+			return "bad_certificate"
+		case tlsAlertDescUnknownCA:
+			return "unknown_ca"
+		case tlsAlertDescCertificateUnknown:
+			// sent by Java and OkHttp based clients
+			return "certificate_unknown"
+		}
+		return ""
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		if sinceLeaf <= refusalCloseWindow {
+			return "closed"
+		}
+	}
+
+	return ""
+}
+
+// receivedAlert returns the code of the alert the peer ended the handshake with. crypto/tls reports
+// it as a "remote error" *net.OpError, holding an unexported alert type that is a uint8 like
+// tls.AlertError. The tls.AlertError wrapped by QUIC handshake errors is the alert sent to the peer.
+func receivedAlert(err error) (byte, bool) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return 0, false
+	}
+
+	var alertErr tls.AlertError
+	if errors.As(opErr.Err, &alertErr) {
+		return byte(alertErr), true
+	}
+
+	if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+		return byte(v.Uint()), true
+	}
+
+	return 0, false
+}
+
+// tlsErrorClass sorts handshake errors into a few classes for metrics:
+// certificate, alert (received from the peer), record (not TLS), eof, timeout or other.
+func tlsErrorClass(err error) string {
+	var (
+		certErr   *tls.CertificateVerificationError
+		rejected  *trust.Error
+		recordErr tls.RecordHeaderError
+		netErr    net.Error
+	)
+	_, alert := receivedAlert(err)
+
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &rejected):
+		return "certificate"
+	case alert:
+		return "alert"
+	case errors.As(err, &recordErr):
+		return "record"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+
+	return "other"
+}
+
+// firstRecordConn keeps a copy of the first TLS record read from Conn, the ServerHello of an
+// origin, which crypto/tls does not expose.
+type firstRecordConn struct {
+	net.Conn
+	record []byte
+	done   bool
+}
+
+func (c *firstRecordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.done || n == 0 {
+		return n, err
+	}
+
+	c.record = append(c.record, b[:n]...)
+	if len(c.record) >= 5 {
+		recordLen := 5 + (int(c.record[3])<<8 | int(c.record[4]))
+		if len(c.record) >= recordLen {
+			c.record = c.record[:recordLen]
+			c.done = true
+		}
 	}
 
-	tlsTun := tunnel.NewTunnelFromConn(tun.Src, tun.Dst, downstreamTlsConn, upstreamTlsConn)
-	return streamHandler.Handle(tlsTun)
+	return n, err
 }
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"toss/cert"
+)
+
+// clientRefusal returns the error of a server handshake whose client does not trust the leaf.
+func clientRefusal(t *testing.T) error {
+	t.Helper()
+
+	root, key, err := cert.NewRoot(cert.AuthorityOptions{Organization: "Toss Test Forged", RootValidity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// over loopback, the client alert does not wait for the server to read
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+		_ = tls.Client(clientConn, &tls.Config{ServerName: "example.com", RootCAs: x509.NewCertPool()}).Handshake()
+	}()
+
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	_ = serverConn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{root.Raw}, PrivateKey: key}},
+	})
+	return server.Handshake()
+}
+
+// remoteAlert returns the error of a handshake the peer ended with the alert code.
+func remoteAlert(code uint8) error {
+	return &net.OpError{Op: "remote error", Err: tls.AlertError(code)}
+}
+
+func TestRefusalReason(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	tests := []struct {
+		name      string
+		err       error
+		sinceLeaf time.Duration
+		want      string
+	}{
+		{name: "bad certificate", err: remoteAlert(42), want: "bad_certificate"},
+		{name: "unknown ca", err: remoteAlert(48), want: "unknown_ca"},
+		{name: "certificate unknown", err: remoteAlert(46), want: "certificate_unknown"},
+		{name: "wrapped alert", err: fmt.Errorf("handshake: %w", remoteAlert(42)), want: "bad_certificate"},
+		{name: "alert sent over quic", err: fmt.Errorf("%w%.0w", errors.New("tls: handshake failed"), tls.AlertError(48)), want: ""},
+		{name: "alert long after the leaf", err: remoteAlert(42), sinceLeaf: time.Minute, want: "bad_certificate"},
+		{name: "other alert", err: remoteAlert(40), want: ""},
+		{name: "alert text only", err: errors.New("remote error: tls: bad certificate"), want: ""},
+		{name: "alert sent", err: &net.OpError{Op: "local error", Err: tls.AlertError(42)}, want: ""},
+		{name: "eof", err: io.EOF, want: "closed"},
+		{name: "unexpected eof", err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), want: "closed"},
+		{name: "reset", err: reset, want: "closed"},
+		{name: "eof at the end of the window", err: io.EOF, sinceLeaf: refusalCloseWindow, want: "closed"},
+		{name: "eof after the window", err: io.EOF, sinceLeaf: refusalCloseWindow + time.Millisecond, want: ""},
+		{name: "reset after the window", err: reset, sinceLeaf: 10 * time.Second, want: ""},
+		{name: "timeout", err: os.ErrDeadlineExceeded, want: ""},
+		{name: "not tls", err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refusalReason(tt.err, tt.sinceLeaf); got != tt.want {
+				t.Errorf("refusalReason(%v, %v) = %q, want %q", tt.err, tt.sinceLeaf, got, tt.want)
+			}
+		})
+	}
+
+	// crypto/tls reports the received alert with its unexported type
+	t.Run("crypto/tls client", func(t *testing.T) {
+		err := clientRefusal(t)
+		if got := refusalReason(err, 0); got != "bad_certificate" {
+			t.Errorf("refusalReason(%v) = %q, want bad_certificate", err, got)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"slices"
+	"sync"
+)
+
+// Registry keeps track of the live tunnels.
+type Registry struct {
+	mu      sync.Mutex
+	tunnels map[string]*Tunnel
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tunnels: make(map[string]*Tunnel),
+	}
+}
+
+func (r *Registry) Add(tun *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tunnels[tun.ID()] = tun
+}
+
+func (r *Registry) Remove(tun *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tunnels, tun.ID())
+}
+
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.tunnels)
+}
+
+func (r *Registry) Get(id string) (*Tunnel, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tun, ok := r.tunnels[id]
+	return tun, ok
+}
+
+// List returns the live tunnels, oldest first.
+func (r *Registry) List() []*Tunnel {
+	r.mu.Lock()
+	tunnels := make([]*Tunnel, 0, len(r.tunnels))
+	for _, tun := range r.tunnels {
+		tunnels = append(tunnels, tun)
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(tunnels, func(a, b *Tunnel) int {
+		return a.CreatedAt().Compare(b.CreatedAt())
+	})
+
+	return tunnels
+}
+
+// CloseAll closes every registered tunnel and returns how many were closed.
+func (r *Registry) CloseAll() int {
+	tunnels := r.List()
+
+	for _, tun := range tunnels {
+		_ = tun.Close()
+	}
+
+	return len(tunnels)
+}
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"bufio"
+	"context"
 	"net"
 	"time"
 )
@@ -21,6 +22,40 @@ func NewStream(conn net.Conn) *Stream {
 	}
 }
 
+// Peeked returns the bytes buffered in Reader without reading from the connection.
+func (s Stream) Peeked() []byte {
+	peeked, _ := s.Reader.Peek(s.Reader.Buffered())
+	return peeked
+}
+
+// PeekMore blocks until more than n bytes are buffered in Reader, the read fails or ctx is done.
+func (s Stream) PeekMore(ctx context.Context, n int) error {
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.Conn.SetReadDeadline(aLongTimeAgo)
+		close(interrupted)
+	})
+
+	_, err := s.Reader.Peek(n + 1)
+
+	if !stop() {
+		<-interrupted
+		_ = s.Conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// InterruptRead makes a blocked or later Read on the connection fail immediately with a timeout.
+// Clear it with SetReadDeadline(time.Time{}).
+func (s Stream) InterruptRead() error {
+	return s.Conn.SetReadDeadline(aLongTimeAgo)
+}
+
 // region net.Conn
 func (s Stream) Read(b []byte) (n int, err error) {
 	return s.Reader.Read(b)
@@ -3,11 +3,13 @@ package tunnel
 import (
 	"bytes"
 	"io"
+	"sync/atomic"
 )
 
 type TeeReadCloser struct {
 	readCloser io.ReadCloser
 	writer     io.Writer
+	read       atomic.Int64
 }
 
 func NewTeeReadCloser(readCloser io.ReadCloser, max uint64) (*TeeReadCloser, *bytes.Buffer) {
@@ -24,6 +26,7 @@ func NewTeeReadCloser(readCloser io.ReadCloser, max uint64) (*TeeReadCloser, *by
 
 func (trc *TeeReadCloser) Read(buffer []byte) (int, error) {
 	n, err := trc.readCloser.Read(buffer)
+	trc.read.Add(int64(n))
 
 	if n > 0 {
 		_, _ = trc.writer.Write(buffer[:n])
@@ -32,6 +35,11 @@ func (trc *TeeReadCloser) Read(buffer []byte) (int, error) {
 	return n, err
 }
 
+// Len is the number of bytes read so far, including those not kept in the buffer.
+func (trc *TeeReadCloser) Len() int64 {
+	return trc.read.Load()
+}
+
 func (trc *TeeReadCloser) Close() error {
 	return trc.readCloser.Close()
 }
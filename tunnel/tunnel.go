@@ -1,9 +1,14 @@
 package tunnel
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net"
+	"slices"
+	"sync"
 	"time"
+	"toss/tls/clienthello"
 
 	"github.com/google/uuid"
 )
@@ -15,10 +20,74 @@ type Tunnel struct {
 	Downstream *Stream
 	Upstream   *Stream
 
-	id string
+	id  string
+	ctx context.Context
+
+	// state is shared with the tunnels wrapping this one.
+	state *state
+}
+
+// Info is what detection and the handlers learned about the tunnel.
+type Info struct {
+	// Protocol is the name of the detector that matched.
+	Protocol string
+
+	// ServerNames and ALPN are taken from the TLS ClientHello.
+	ServerNames []string
+	ALPN        []string
+	// JA3 and JA4 are the fingerprints of the TLS ClientHello.
+	JA3 string
+	JA4 string
+	// ClientHello is the decoded TLS ClientHello, nil for other protocols.
+	ClientHello *clienthello.ClientHello
+
+	// Handlers is the chain of handlers the tunnel went through, e.g. [TlsHandler Http2Handler].
+	Handlers []string
+
+	// TLS is set by TlsHandler once both handshakes are done.
+	TLS *TLSInfo
+}
+
+// TLSInfo describes an intercepted TLS connection.
+type TLSInfo struct {
+	ServerName string
+	// ALPN is the negotiated protocol, the same on both legs.
+	ALPN string
+	// JA4S is the fingerprint of the origin ServerHello, empty when it could not be read.
+	JA4S string
+
+	Downstream TLSLeg
+	Upstream   TLSLeg
+}
+
+type TLSLeg struct {
+	Version     uint16
+	CipherSuite uint16
+	Handshake   time.Duration
+}
+
+// Stats counts the bytes exchanged with the client.
+type Stats struct {
+	// BytesIn is read from the client, BytesOut is written to the client.
+	BytesIn  int64
+	BytesOut int64
+}
+
+type state struct {
+	createdAt time.Time
+	counters  counters
+
+	// keyLogWriters are indexed by Side, they are only used by the goroutine handling the tunnel.
+	keyLogWriters [SideUpstream + 1][]io.Writer
+
+	mu   sync.Mutex
+	info Info
 }
 
-func NewTunnel(src, dst net.Addr, downstream, upstream *Stream) *Tunnel {
+// NewTunnel creates a tunnel between downstream and upstream.
+// ctx is done when the server starts draining, handlers should then finish
+// the exchange in flight and return.
+func NewTunnel(ctx context.Context, src, dst net.Addr, downstream, upstream *Stream) *Tunnel {
 	return &Tunnel{
 		Src: src,
 		Dst: dst,
@@ -26,18 +95,35 @@ func NewTunnel(src, dst net.Addr, downstream, upstream *Stream) *Tunnel {
 		Downstream: downstream,
 		Upstream:   upstream,
 
-		id: uuid.NewString(),
+		id:  uuid.NewString(),
+		ctx: ctx,
+
+		state: &state{createdAt: time.Now()},
 	}
 }
-func NewTunnelFromConn(src, dst net.Addr, downstream, upstream net.Conn) *Tunnel {
+
+// NewTunnelFromConn creates a tunnel over the client and origin connections.
+// The bytes exchanged with the client are counted in Stats.
+func NewTunnelFromConn(ctx context.Context, src, dst net.Addr, downstream, upstream net.Conn) *Tunnel {
+	tun := NewTunnel(ctx, src, dst, nil, NewStream(upstream))
+	tun.Downstream = NewStream(newCountingConn(downstream, &tun.state.counters))
+
+	return tun
+}
+
+// Wrap returns a tunnel over new connections layered on top of tun, e.g. the decrypted side of TLS.
+// It shares the id, context, info and stats of tun.
+func (tun *Tunnel) Wrap(downstream, upstream net.Conn) *Tunnel {
 	return &Tunnel{
-		Src: src,
-		Dst: dst,
-		
+		Src: tun.Src,
+		Dst: tun.Dst,
+
 		Downstream: NewStream(downstream),
 		Upstream:   NewStream(upstream),
 
-		id: uuid.NewString(),
+		id:    tun.id,
+		ctx:   tun.ctx,
+		state: tun.state,
 	}
 }
 
@@ -45,6 +131,71 @@ func (tun *Tunnel) ID() string {
 	return tun.id
 }
 
+// Context is done when the tunnel should wind down gracefully.
+func (tun *Tunnel) Context() context.Context {
+	return tun.ctx
+}
+
+func (tun *Tunnel) CreatedAt() time.Time {
+	return tun.state.createdAt
+}
+
+// Info returns a copy of what is known about the tunnel, it is safe to call from any goroutine.
+func (tun *Tunnel) Info() Info {
+	tun.state.mu.Lock()
+	defer tun.state.mu.Unlock()
+
+	return tun.state.info
+}
+
+// UpdateInfo changes the info under lock. update must replace slices instead of modifying them in place.
+func (tun *Tunnel) UpdateInfo(update func(info *Info)) {
+	tun.state.mu.Lock()
+	defer tun.state.mu.Unlock()
+
+	update(&tun.state.info)
+}
+
+// AddHandler appends name to the handler chain.
+func (tun *Tunnel) AddHandler(name string) {
+	tun.UpdateInfo(func(info *Info) {
+		info.Handlers = append(slices.Clip(info.Handlers), name)
+	})
+}
+
+// SetTap makes tap observe the client and origin connections.
+// It must be called before the tunnel is handled, while nothing is buffered yet.
+func (tun *Tunnel) SetTap(tap Tap) {
+	tun.Downstream = NewStream(&tapConn{Conn: tun.Downstream.Conn, side: SideDownstream, tap: tap})
+	tun.Upstream = NewStream(&tapConn{Conn: tun.Upstream.Conn, side: SideUpstream, tap: tap})
+}
+
+// AddKeyLogWriter adds a destination for the TLS secrets of one leg, in NSS key log format.
+// It must be called before TlsHandler starts the handshakes.
+func (tun *Tunnel) AddKeyLogWriter(side Side, w io.Writer) {
+	tun.state.keyLogWriters[side] = append(tun.state.keyLogWriters[side], w)
+}
+
+// KeyLogWriter returns where TlsHandler writes the TLS secrets of a leg, nil when nobody asked for them.
+func (tun *Tunnel) KeyLogWriter(side Side) io.Writer {
+	writers := tun.state.keyLogWriters[side]
+	switch len(writers) {
+	case 0:
+		return nil
+	case 1:
+		return writers[0]
+	}
+
+	return io.MultiWriter(writers...)
+}
+
+func (tun *Tunnel) Stats() Stats {
+	return Stats{
+		BytesIn:  tun.state.counters.read.Load(),
+		BytesOut: tun.state.counters.written.Load(),
+	}
+}
+
 func (tun *Tunnel) SetReadDeadline(deadline time.Time) error {
 	err1 := tun.Downstream.Conn.SetReadDeadline(deadline)
 	err2 := tun.Upstream.Conn.SetReadDeadline(deadline)
@@ -0,0 +1,85 @@
+package tunneltest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+	"toss/cert"
+)
+
+// CA is a root and an intermediate created for one test, laid out like "toss ca init".
+type CA struct {
+	Root *x509.Certificate
+	// Pool holds Root, for the clients trusting the CA.
+	Pool *x509.CertPool
+	// Manager issues the leaves with the intermediate.
+	Manager *cert.Manager
+}
+
+// NewCA creates a CA whose files are removed with the test directory. organization tells the
+// CAs of a test apart, e.g. the one of the proxy and the one of the origins.
+func NewCA(tb testing.TB, organization string) *CA {
+	tb.Helper()
+
+	opts := cert.AuthorityOptions{
+		Organization:         organization,
+		RootValidity:         24 * time.Hour,
+		IntermediateValidity: 24 * time.Hour,
+	}
+
+	root, rootKey, err := cert.NewRoot(opts)
+	if err != nil {
+		tb.Fatalf("create root: %v", err)
+	}
+
+	intermediate, intermediateKey, err := cert.NewIntermediate(root, rootKey, opts)
+	if err != nil {
+		tb.Fatalf("create intermediate: %v", err)
+	}
+
+	dir := tb.TempDir()
+	certPath := filepath.Join(dir, "intermediate.pem")
+	keyPath := filepath.Join(dir, "intermediate.key")
+
+	if err := cert.WriteCertificates(certPath, intermediate, root); err != nil {
+		tb.Fatalf("write intermediate: %v", err)
+	}
+	if err := cert.WritePrivateKey(keyPath, intermediateKey); err != nil {
+		tb.Fatalf("write intermediate key: %v", err)
+	}
+
+	manager, err := cert.NewCertManager(slog.New(slog.DiscardHandler), certPath, keyPath, cert.Options{LeafCacheSize: 100})
+	if err != nil {
+		tb.Fatalf("load ca: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+
+	return &CA{
+		Root:    root,
+		Pool:    pool,
+		Manager: manager,
+	}
+}
+
+// ServerConfig serves the leaves of the CA for the server name of each client,
+// or for the local ip when the client sends none.
+func (ca *CA) ServerConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: ca.Manager.GetCertificate,
+		NextProtos:     nextProtos,
+	}
+}
+
+// ClientConfig trusts only the CA.
+func (ca *CA) ClientConfig(serverName string, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		RootCAs:    ca.Pool,
+		ServerName: serverName,
+		NextProtos: nextProtos,
+	}
+}
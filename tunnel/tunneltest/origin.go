@@ -0,0 +1,265 @@
+package tunneltest
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Origin is a server on loopback that the tunnels of a test connect to, it keeps what it received.
+// It is closed with the test.
+type Origin struct {
+	Addr *net.TCPAddr
+
+	listener net.Listener
+	server   *http.Server
+
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    []*recordingConn
+	requests []*Request
+}
+
+// Request is an http request received by an origin, with its body read in full.
+type Request struct {
+	Proto  string
+	Method string
+	Host   string
+	// RequestURI is the target of the request line, e.g. /path?query.
+	RequestURI string
+	Header     http.Header
+	Body       []byte
+	// TLS is set when the request came over tls.
+	TLS bool
+}
+
+// NewOrigin calls serve with each accepted connection, the connection is closed when serve returns.
+func NewOrigin(tb testing.TB, serve func(conn net.Conn)) *Origin {
+	tb.Helper()
+
+	o := newOrigin(tb)
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		for {
+			conn, err := o.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			o.wg.Add(1)
+			go func() {
+				defer o.wg.Done()
+				defer conn.Close()
+
+				serve(conn)
+			}()
+		}
+	}()
+
+	return o
+}
+
+// NewEchoOrigin writes back whatever it reads, like a client-first protocol the proxy does not know.
+func NewEchoOrigin(tb testing.TB) *Origin {
+	tb.Helper()
+
+	return NewOrigin(tb, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// NewBannerOrigin writes banner as soon as a client connects and then echoes,
+// like the server-first protocols (MySQL, SMTP, SSH).
+func NewBannerOrigin(tb testing.TB, banner []byte) *Origin {
+	tb.Helper()
+
+	return NewOrigin(tb, func(conn net.Conn) {
+		if _, err := conn.Write(banner); err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// NewHTTPOrigin serves h over cleartext HTTP/1.1 and HTTP/2 with prior knowledge.
+func NewHTTPOrigin(tb testing.TB, h http.Handler) *Origin {
+	tb.Helper()
+
+	o := newOrigin(tb)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	o.serve(&http.Server{
+		Handler:   o.record(h),
+		Protocols: &protocols,
+	}, false)
+
+	return o
+}
+
+// NewTLSOrigin serves h over tls with a leaf of ca for any server name, h2 and http/1.1 are offered.
+func NewTLSOrigin(tb testing.TB, ca *CA, h http.Handler) *Origin {
+	tb.Helper()
+
+	o := newOrigin(tb)
+
+	o.serve(&http.Server{
+		Handler:   o.record(h),
+		TLSConfig: ca.ServerConfig("h2", "http/1.1"),
+	}, true)
+
+	return o
+}
+
+func newOrigin(tb testing.TB) *Origin {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("origin listen: %v", err)
+	}
+
+	o := &Origin{
+		Addr: listener.Addr().(*net.TCPAddr),
+	}
+	o.listener = &recordingListener{Listener: listener, origin: o}
+
+	tb.Cleanup(o.Close)
+
+	return o
+}
+
+func (o *Origin) serve(server *http.Server, useTLS bool) {
+	server.ReadHeaderTimeout = 5 * time.Second
+	// the handshakes the proxy aborts on purpose are not worth a line on stderr
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	o.server = server
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		if useTLS {
+			_ = server.ServeTLS(o.listener, "", "")
+		} else {
+			_ = server.Serve(o.listener)
+		}
+	}()
+}
+
+// record keeps the requests before h handles them.
+func (o *Origin) record(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		o.mu.Lock()
+		o.requests = append(o.requests, &Request{
+			Proto:      r.Proto,
+			Method:     r.Method,
+			Host:       r.Host,
+			RequestURI: r.RequestURI,
+			Header:     r.Header.Clone(),
+			Body:       body,
+			TLS:        r.TLS != nil,
+		})
+		o.mu.Unlock()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Requests returns the http requests received so far, in arrival order.
+func (o *Origin) Requests() []*Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]*Request(nil), o.requests...)
+}
+
+// Received returns the bytes read from each accepted connection so far, in accept order.
+// They are the tls records for a tls origin.
+func (o *Origin) Received() [][]byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	received := make([][]byte, len(o.conns))
+	for i, conn := range o.conns {
+		received[i] = conn.bytes()
+	}
+
+	return received
+}
+
+// Close stops the origin and closes the accepted connections.
+func (o *Origin) Close() {
+	if o.server != nil {
+		_ = o.server.Close()
+	}
+	_ = o.listener.Close()
+
+	o.mu.Lock()
+	for _, conn := range o.conns {
+		_ = conn.Close()
+	}
+	o.mu.Unlock()
+
+	o.wg.Wait()
+}
+
+type recordingListener struct {
+	net.Listener
+	origin *Origin
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &recordingConn{Conn: conn}
+
+	l.origin.mu.Lock()
+	l.origin.conns = append(l.origin.conns, rc)
+	l.origin.mu.Unlock()
+
+	return rc, nil
+}
+
+// recordingConn keeps a copy of the bytes read from Conn.
+type recordingConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.mu.Lock()
+	c.read.Write(b[:n])
+	c.mu.Unlock()
+
+	return n, err
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return bytes.Clone(c.read.Bytes())
+}
@@ -0,0 +1,243 @@
+// Package tunneltest runs tunnels through handler.Serve in-process, between a test client and a
+// fake origin on loopback, so the detectors and handlers are tested without a TPROXY socket:
+//
+//	proxy := tunneltest.NewProxy(t)
+//	origin := tunneltest.NewTLSOrigin(t, originCA, handler)
+//	proxy.Trust(originCA)
+//
+//	res, err := proxy.HTTPClient(origin.Addr).Get("https://example.com/")
+//	// res is what the client received, origin.Requests() what the origin received
+//	// and proxy.Tunnels()[0].Info() what the proxy detected
+package tunneltest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+	"toss/config"
+	"toss/policy"
+	"toss/trust"
+	"toss/tunnel"
+	"toss/tunnel/detector"
+	"toss/tunnel/handler"
+)
+
+// closeTimeout bounds the wait for a tunnel to finish once the test is done.
+const closeTimeout = 10 * time.Second
+
+// Proxy hands the connections of a test to handler.Serve, like the TPROXY listener does.
+type Proxy struct {
+	// CA forges the leaves given to the clients of intercepted TLS tunnels.
+	CA *CA
+	// Options are used by the next tunnels. They start from the default config, except that
+	// Policy intercepts everything and UpstreamVerifier trusts no origin until Trust is called.
+	Options *handler.Options
+	// Detectors returns the detectors of a tunnel, nil runs the ones of the default config.
+	Detectors func(logger *slog.Logger) []tunnel.Detector
+
+	tb     testing.TB
+	ctx    context.Context
+	drain  context.CancelFunc
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	tunnels []*tunnel.Tunnel
+}
+
+// NewProxy creates a proxy whose tunnels are closed with the test. The logs of the tunnels are
+// written to the test output.
+func NewProxy(tb testing.TB) *Proxy {
+	tb.Helper()
+
+	conf := config.Default()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	output := &testOutput{w: tb.Output()}
+
+	p := &Proxy{
+		CA: NewCA(tb, "Toss Test Proxy"),
+		Options: &handler.Options{
+			FirstByteTimeout: conf.Timeouts.FirstByte,
+			DetectTimeout:    conf.Detection.Timeout,
+			DetectMaxBytes:   conf.Detection.MaxBytes,
+			BodyPreviewSize:  conf.BodyPreviewSize,
+			Policy:           policy.Static{Action: policy.ActionIntercept},
+			UpstreamVerifier: &trust.Verifier{Roots: x509.NewCertPool()},
+		},
+		tb:     tb,
+		ctx:    ctx,
+		drain:  cancel,
+		logger: slog.New(slog.NewTextHandler(output, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	// registered first, so it runs after the tunnels are closed
+	tb.Cleanup(func() {
+		cancel()
+		output.close()
+	})
+
+	return p
+}
+
+// Trust makes the proxy accept the origins serving a leaf of ca.
+func (p *Proxy) Trust(ca *CA) {
+	p.Options.UpstreamVerifier = &trust.Verifier{Roots: ca.Pool}
+}
+
+// Drain cancels the context of the tunnels, as the server does when shutdown starts: the handlers
+// finish the exchanges in flight and return.
+func (p *Proxy) Drain() {
+	p.drain()
+}
+
+// Tunnels returns the tunnels created so far, in dial order.
+func (p *Proxy) Tunnels() []*tunnel.Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*tunnel.Tunnel(nil), p.tunnels...)
+}
+
+// Conn is the client side of a tunnel.
+type Conn struct {
+	net.Conn
+
+	// Tunnel is the proxy side, its Info tells what was detected.
+	Tunnel *tunnel.Tunnel
+
+	done chan struct{}
+}
+
+// Done is closed once handler.Serve returned and both sides of the tunnel are closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Dial opens a tunnel to dst, as if the client had connected to dst through the VPN.
+// The client and the proxy are connected over loopback, so half-closes and deadlines behave as on a
+// real socket.
+func (p *Proxy) Dial(dst *net.TCPAddr) (*Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	downstream, err := listener.Accept()
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	upstream, err := net.DialTimeout("tcp", dst.String(), closeTimeout)
+	if err != nil {
+		_ = client.Close()
+		_ = downstream.Close()
+		return nil, err
+	}
+
+	tun := tunnel.NewTunnelFromConn(p.ctx, downstream.RemoteAddr(), dst, downstream, upstream)
+
+	p.mu.Lock()
+	p.tunnels = append(p.tunnels, tun)
+	p.mu.Unlock()
+
+	logger := p.logger.With(
+		slog.Group("tunnel",
+			"id", tun.ID(),
+			"src", tun.Src.String(),
+			"dst", tun.Dst.String(),
+		),
+	)
+
+	detectors := p.defaultDetectors
+	if p.Detectors != nil {
+		detectors = p.Detectors
+	}
+
+	conn := &Conn{Conn: client, Tunnel: tun, done: make(chan struct{})}
+
+	go func() {
+		defer close(conn.done)
+		defer tun.Close()
+
+		handler.Serve(tun, logger, detectors(logger), p.Options)
+	}()
+
+	p.tb.Cleanup(func() {
+		_ = client.Close()
+		_ = tun.Close()
+
+		select {
+		case <-conn.done:
+		case <-time.After(closeTimeout):
+			p.tb.Errorf("tunnel %s still running %v after the test", tun.ID(), closeTimeout)
+		}
+	})
+
+	return conn, nil
+}
+
+func (p *Proxy) defaultDetectors(logger *slog.Logger) []tunnel.Detector {
+	return []tunnel.Detector{
+		detector.NewHttp11Detector(logger, p.Options),
+		detector.NewHttp2Detector(logger, p.Options),
+		detector.NewTlsDetector(logger, p.CA.Manager, p.Options),
+	}
+}
+
+// HTTPClient returns a client whose connections are tunnels to dst whatever the url.
+// https urls are verified against the CA of the proxy and offer h2 and http/1.1, http urls use
+// HTTP/1.1 unless Protocols of the *http.Transport is changed, e.g. for HTTP/2 with prior knowledge.
+func (p *Proxy) HTTPClient(dst *net.TCPAddr) *http.Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.Dial(dst)
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: p.CA.Pool},
+		ForceAttemptHTTP2: true,
+	}
+	p.tb.Cleanup(transport.CloseIdleConnections)
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   closeTimeout,
+	}
+}
+
+// testOutput drops the logs written after the test, e.g. by an origin goroutine that outlived it.
+type testOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (o *testOutput) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return len(b), nil
+	}
+
+	return o.w.Write(b)
+}
+
+func (o *testOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+}